@@ -26,6 +26,7 @@ func apiRouter() http.Handler {
 	r.POST("/mails/:mailHost/inboxes", apiControllersMailInboxesCreate)
 	r.GET("/mails/:mailHost/inboxes/:mailInboxAddr", apiControllersMailInboxes)
 	r.GET("/mails/:mailHost/messages/:mailMessageID", apiControllersMailMessages)
+	r.GET("/mails/:mailHost/messages/:mailMessageID/headers", apiControllersMailMessageHeaders)
 
 	// Routes.
 	smtp := r.Group("/")
@@ -33,6 +34,29 @@ func apiRouter() http.Handler {
 	{
 		smtp.POST("/smtp/inbound", apiControllersSmtpInbound)
 		smtp.POST("/smtp/outbound", apiControllersSmtpOutbound)
+		smtp.POST("/smtp/outbound/queue", apiControllersSmtpOutboundQueue)
+		smtp.POST("/smtp/outbound/results", apiControllersSmtpOutboundResults)
+		smtp.POST("/smtp/credentials/verify", apiControllersSmtpCredentialsVerify)
+		smtp.GET("/smtp/mails/:mailHost/dkim", apiControllersSmtpMailDKIM)
+		smtp.POST("/smtp/ratelimits/violations", apiControllersSmtpRatelimitViolations)
+	}
+
+	admin := r.Group("/")
+	admin.Use(apiMiddlewareAuthSmtp())
+	{
+		admin.POST("/mails/:mailHost/dkim", apiControllersMailsDKIM)
+		admin.GET("/mails/:mailHost/ratelimits/violations", apiControllersMailsRatelimitViolations)
+		admin.PUT("/mails/:mailHost/filters", apiControllersMailsFilters)
+		admin.GET("/mails/:mailHost/quarantine", apiControllersMailsQuarantine)
+		admin.POST("/mails/:mailHost/quarantine/:mailMessageID/release", apiControllersMailsQuarantineRelease)
+		admin.POST("/mails/:mailHost/inboxes/:mailInboxAddr/credentials", apiControllersMailInboxCredentialsCreate)
+		admin.PUT("/mails/:mailHost/inboxes/:mailInboxAddr/spam", apiControllersMailInboxSpam)
+	}
+
+	inbox := r.Group("/")
+	inbox.Use(apiMiddlewareAuthMailInbox())
+	{
+		inbox.DELETE("/mails/:mailHost/inboxes/:mailInboxAddr/messages/:mailMessageID", apiControllersMailInboxMessagesDelete)
 	}
 
 	r.NoRoute(func(c *gin.Context) {
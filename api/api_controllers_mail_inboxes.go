@@ -4,20 +4,33 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 
 	gomail "net/mail"
 
 	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
 // apiControllersMailInboxes returns a mail inbox and all mail
 // messages in that mail inbox with the provided host and address.
+// Mail messages over the spam threshold of the inbox are hidden
+// unless all or only the spam is asked with the spam query.
 func apiControllersMailInboxes(c *gin.Context) {
 	mailHost := c.Param("mailHost")
 	mailInboxAddr := c.Param("mailInboxAddr")
 	mailInboxFullAddr := fmt.Sprintf("%s@%s", mailInboxAddr, mailHost)
 
+	spam := c.Query("spam")
+	if spam != mailInboxSpamHide && spam != mailInboxSpamAll && spam != mailInboxSpamOnly {
+		c.AbortWithStatusJSON(http.StatusBadRequest, map[string]interface{}{
+			"success": false,
+			"error":   fmt.Sprintf("Invalid spam query, must be %s or %s", mailInboxSpamAll, mailInboxSpamOnly),
+		})
+		return
+	}
+
 	var mail Mail
 	if err := db.First(&mail, "host = ?", mailHost).Error; err != nil {
 		c.AbortWithStatusJSON(http.StatusNotFound, map[string]interface{}{
@@ -28,13 +41,10 @@ func apiControllersMailInboxes(c *gin.Context) {
 	}
 
 	var mailInbox MailInbox
-	err := db.
-		Preload("MailMessages", func(db *gorm.DB) *gorm.DB {
-			return db.Order("mail_messages.id DESC")
-		}).
-		Preload("MailMessages.MailMessageFiles").
-		Preload("MailMessages.MailMessageRelations").
-		First(&mailInbox, "mail_id = ? and address = ?", mail.ID, mailInboxFullAddr).Error
+	err := db.First(&mailInbox, "mail_id = ? and address = ?", mail.ID, mailInboxFullAddr).Error
+	if err == nil {
+		mailInbox.MailMessages, err = mailInboxMessages(mailInbox, spam)
+	}
 
 	if err != nil {
 		if !errors.Is(err, gorm.ErrRecordNotFound) {
@@ -147,3 +157,283 @@ func apiControllersMailInboxesCreate(c *gin.Context) {
 		"mail_inbox": mailInbox,
 	})
 }
+
+// apiControllersMailInboxSpam sets the spam threshold of the mail
+// inbox, mail messages with a spam score of the threshold or more
+// are hidden from the inbox. Threshold of 0 shows all of them.
+func apiControllersMailInboxSpam(c *gin.Context) {
+	mailHost := c.Param("mailHost")
+	mailInboxAddr := c.Param("mailInboxAddr")
+	mailInboxFullAddr := fmt.Sprintf("%s@%s", mailInboxAddr, mailHost)
+
+	var req typeApiReqMailInboxSpam
+	if err := c.BindJSON(&req); err != nil {
+		logger.Errorf("failed to set mail inbox spam threshold: bind json error: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	if req.SpamThreshold == nil || *req.SpamThreshold < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, map[string]interface{}{
+			"success": false,
+			"error":   "Spam threshold must be 0 or more",
+		})
+		return
+	}
+
+	var mail Mail
+	if err := db.First(&mail, "host = ?", mailHost).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, map[string]interface{}{
+			"success": false,
+			"error":   "Mail not found",
+		})
+		return
+	}
+
+	var mailInbox MailInbox
+	if err := db.First(&mailInbox, "mail_id = ? and address = ?", mail.ID, mailInboxFullAddr).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, map[string]interface{}{
+			"success": false,
+			"error":   "Mail inbox not found",
+		})
+		return
+	}
+
+	if err := db.Model(&mailInbox).Update("spam_threshold", *req.SpamThreshold).Error; err != nil {
+		logger.Errorf("failed to set mail inbox spam threshold: db update error: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success":    true,
+		"mail_inbox": mailInbox,
+	})
+}
+
+// apiControllersMailInboxCredentialsCreate creates an SMTP submission
+// credential for the mail inbox. The password is only returned once,
+// when it's generated.
+func apiControllersMailInboxCredentialsCreate(c *gin.Context) {
+	mailHost := c.Param("mailHost")
+	mailInboxAddr := c.Param("mailInboxAddr")
+	mailInboxFullAddr := fmt.Sprintf("%s@%s", mailInboxAddr, mailHost)
+
+	var req typeApiReqMailInboxCredentialsCreate
+	if err := c.BindJSON(&req); err != nil {
+		logger.Errorf("failed to create mail inbox credential: bind json error: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	var mail Mail
+	if err := db.First(&mail, "host = ?", mailHost).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, map[string]interface{}{
+			"success": false,
+			"error":   "Mail not found",
+		})
+		return
+	}
+
+	var mailInbox MailInbox
+	if err := db.First(&mailInbox, "mail_id = ? and address = ?", mail.ID, mailInboxFullAddr).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, map[string]interface{}{
+			"success": false,
+			"error":   "Mail inbox not found",
+		})
+		return
+	}
+
+	// Username defaults to the inbox address.
+	username := strings.ToLower(strings.TrimSpace(req.Username))
+	if username == "" {
+		username = strings.ToLower(mailInbox.Address)
+	}
+
+	var mailInboxCredentialFound MailInboxCredential
+	if err := db.First(&mailInboxCredentialFound, "username = ?", username).Error; err == nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, map[string]interface{}{
+			"success": false,
+			"error":   "Mail inbox credential with the same username already exists",
+		})
+		return
+	}
+
+	password := req.Password
+	generated := password == ""
+	if generated {
+		password = randomToken(16)
+	}
+
+	if len(password) < mailInboxCredentialPasswordMin {
+		c.AbortWithStatusJSON(http.StatusBadRequest, map[string]interface{}{
+			"success": false,
+			"error":   fmt.Sprintf("Password must be at least %d characters", mailInboxCredentialPasswordMin),
+		})
+		return
+	}
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		logger.Errorf("failed to create mail inbox credential: hash password error: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	mailInboxCredential := MailInboxCredential{
+		MailInboxID:  mailInbox.ID,
+		Username:     username,
+		PasswordHash: string(passwordHash),
+	}
+
+	if err := db.Create(&mailInboxCredential).Error; err != nil {
+		logger.Errorf("failed to create mail inbox credential: db create error: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	res := map[string]interface{}{
+		"success":               true,
+		"mail_inbox_credential": mailInboxCredential,
+	}
+	if generated {
+		res["password"] = password
+	}
+
+	c.JSON(http.StatusCreated, res)
+}
+
+// apiControllersMailInboxMessagesDelete deletes a mail message from
+// the mail inbox. Mail message is deleted once it's deleted from all
+// of the mail inboxes it's delivered to.
+func apiControllersMailInboxMessagesDelete(c *gin.Context) {
+	mailHost := c.Param("mailHost")
+	mailInboxAddr := c.Param("mailInboxAddr")
+	mailInboxFullAddr := fmt.Sprintf("%s@%s", mailInboxAddr, mailHost)
+	mailMessageID := c.Param("mailMessageID")
+
+	var mail Mail
+	if err := db.First(&mail, "host = ?", mailHost).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, map[string]interface{}{
+			"success": false,
+			"error":   "Mail not found",
+		})
+		return
+	}
+
+	var mailInbox MailInbox
+	if err := db.First(&mailInbox, "mail_id = ? and address = ?", mail.ID, mailInboxFullAddr).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, map[string]interface{}{
+			"success": false,
+			"error":   "Mail inbox not found",
+		})
+		return
+	}
+
+	var mailMessageDelivery MailMessageDelivery
+	err := db.First(&mailMessageDelivery, "mail_message_id = ? and mail_inbox_id = ?", mailMessageID, mailInbox.ID).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatusJSON(http.StatusNotFound, map[string]interface{}{
+				"success": false,
+				"error":   "Mail message not found",
+			})
+			return
+		}
+
+		logger.Errorf("failed to delete mail message: find delivery error: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&mailMessageDelivery).Error; err != nil {
+			logger.Errorf("failed to delete mail message: db delete delivery error: %v", err)
+			return err
+		}
+
+		var remaining int64
+		err := tx.Model(&MailMessageDelivery{}).
+			Where("mail_message_id = ?", mailMessageDelivery.MailMessageID).
+			Count(&remaining).Error
+		if err != nil {
+			logger.Errorf("failed to delete mail message: count deliveries error: %v", err)
+			return err
+		}
+
+		if remaining > 0 {
+			return nil
+		}
+
+		if err := tx.Delete(&MailMessage{}, mailMessageDelivery.MailMessageID).Error; err != nil {
+			logger.Errorf("failed to delete mail message: db delete error: %v", err)
+			return err
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// mailInboxMessages returns the mail messages delivered to the
+// mail inbox, latest first. Quarantined mail messages are hidden,
+// spam is filtered with the spam threshold of the inbox.
+func mailInboxMessages(mailInbox MailInbox, spam string) ([]MailMessage, error) {
+	query := db.
+		Joins("JOIN mail_message_deliveries ON mail_message_deliveries.mail_message_id = mail_messages.id").
+		Where("mail_message_deliveries.mail_inbox_id = ? and mail_message_deliveries.deleted_at IS NULL", mailInbox.ID).
+		Where("mail_messages.status <> ?", mailMessageStatusQuarantined)
+
+	// Inboxes without a threshold have no spam.
+	if mailInbox.SpamThreshold > 0 {
+		switch spam {
+		case mailInboxSpamHide:
+			query = query.Where("mail_messages.spam_score < ?", mailInbox.SpamThreshold)
+		case mailInboxSpamOnly:
+			query = query.Where("mail_messages.spam_score >= ?", mailInbox.SpamThreshold)
+		}
+	} else if spam == mailInboxSpamOnly {
+		return nil, nil
+	}
+
+	var mailMessages []MailMessage
+	err := query.
+		Preload("MailMessageFiles").
+		Preload("MailMessageRelations").
+		Preload("MailMessageDKIMs").
+		Preload("MailMessageSpamRules").
+		Preload("MailMessageDeliveries", "mail_inbox_id = ?", mailInbox.ID).
+		Order("mail_messages.id DESC").
+		Find(&mailMessages).Error
+
+	return mailMessages, err
+}
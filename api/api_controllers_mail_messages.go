@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -11,8 +12,10 @@ import (
 	"gorm.io/gorm"
 )
 
-// apiControllersMailInboxes returns a mail inbox and all mail
-// messages in that mail inbox with the provided host and address.
+// apiControllersMailMessages returns a mail message delivered to the
+// mail, quarantined mail messages aren't returned. The deliveries of
+// the message aren't returned either, the envelope recipients of a
+// delivery are only listed in the inbox it's delivered to.
 func apiControllersMailMessages(c *gin.Context) {
 	mailHost := c.Param("mailHost")
 	mailMessageID := c.Param("mailMessageID")
@@ -28,15 +31,22 @@ func apiControllersMailMessages(c *gin.Context) {
 
 	var mailMessage MailMessage
 	err := db.
+		Where("status <> ?", mailMessageStatusQuarantined).
+		Where("id IN (?)", mailMessageIDsQuery(mail)).
 		Preload("MailMessageFiles").
 		Preload("MailMessageRelations").
+		Preload("MailMessageDKIMs").
+		Preload("MailMessageSpamRules").
+		Preload("MailMessageErrors").
+		Preload("MailMessageDomains").
+		Preload("MailMessageAttempts").
 		First(&mailMessage, "id = ?", mailMessageID).Error
 
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			c.AbortWithStatusJSON(http.StatusNotFound, map[string]interface{}{
 				"success": false,
-				"error":   "Mail inbox not found",
+				"error":   "Mail message not found",
 			})
 			return
 		}
@@ -49,9 +59,11 @@ func apiControllersMailMessages(c *gin.Context) {
 		return
 	}
 
+	storageKey := mailMessageStorageKey(mailMessage)
+
 	textreq, _ := awsS3.GetObjectRequest(&s3.GetObjectInput{
 		Bucket: aws.String(config.S3Emails.Bucket),
-		Key:    aws.String(mailMessage.MessageID + "/text"),
+		Key:    aws.String(storageKey + "/text"),
 	})
 
 	mailMessage.TextURL, err = textreq.Presign(15 * time.Minute)
@@ -66,7 +78,7 @@ func apiControllersMailMessages(c *gin.Context) {
 
 	htmlreq, _ := awsS3.GetObjectRequest(&s3.GetObjectInput{
 		Bucket: aws.String(config.S3Emails.Bucket),
-		Key:    aws.String(mailMessage.MessageID + "/html"),
+		Key:    aws.String(storageKey + "/html"),
 	})
 
 	mailMessage.HtmlURL, err = htmlreq.Presign(15 * time.Minute)
@@ -79,13 +91,13 @@ func apiControllersMailMessages(c *gin.Context) {
 		return
 	}
 
-	for _, mailMessageFile := range mailMessage.MailMessageFiles {
+	for i, mailMessageFile := range mailMessage.MailMessageFiles {
 		filereq, _ := awsS3.GetObjectRequest(&s3.GetObjectInput{
 			Bucket: aws.String(config.S3Emails.Bucket),
-			Key:    aws.String(mailMessage.MessageID + "/" + mailMessageFile.Key),
+			Key:    aws.String(storageKey + "/" + mailMessageFile.Key),
 		})
 
-		mailMessageFile.URL, err = filereq.Presign(15 * time.Minute)
+		mailMessage.MailMessageFiles[i].URL, err = filereq.Presign(15 * time.Minute)
 		if err != nil {
 			logger.Errorf("failed to sign file url for mail message: %s: %w", mailMessageID, err)
 			c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
@@ -96,8 +108,227 @@ func apiControllersMailMessages(c *gin.Context) {
 		}
 	}
 
+	mailMessage.Authentication = mailMessageAuthentication(mailMessage)
+
 	c.JSON(http.StatusOK, map[string]interface{}{
 		"success":      true,
 		"mail_message": mailMessage,
 	})
 }
+
+// apiControllersMailMessageHeaders returns the header fields of a
+// mail message in order, filtered by the "name" query if provided.
+func apiControllersMailMessageHeaders(c *gin.Context) {
+	mailHost := c.Param("mailHost")
+	mailMessageID := c.Param("mailMessageID")
+
+	var mail Mail
+	if err := db.First(&mail, "host = ?", mailHost).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, map[string]interface{}{
+			"success": false,
+			"error":   "Mail not found",
+		})
+		return
+	}
+
+	// Quarantined mail messages are only shown in the quarantine.
+	var mailMessage MailMessage
+	err := db.
+		Where("status <> ?", mailMessageStatusQuarantined).
+		Where("id IN (?)", mailMessageIDsQuery(mail)).
+		First(&mailMessage, "id = ?", mailMessageID).Error
+
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatusJSON(http.StatusNotFound, map[string]interface{}{
+				"success": false,
+				"error":   "Mail message not found",
+			})
+			return
+		}
+
+		logger.Errorf("failed to get mail message headers: %s: find message error: %v", mailMessageID, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	query := db.Where("mail_message_id = ?", mailMessage.ID)
+
+	// Header field names are case insensitive.
+	if names := c.QueryArray("name"); len(names) > 0 {
+		for i := range names {
+			names[i] = strings.ToLower(names[i])
+		}
+		query = query.Where("LOWER(name) IN ?", names)
+	}
+
+	mailMessageHeaders := []MailMessageHeader{}
+	if err := query.Order("position").Find(&mailMessageHeaders).Error; err != nil {
+		logger.Errorf("failed to get mail message headers: %s: db find error: %v", mailMessageID, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success":              true,
+		"mail_message_headers": mailMessageHeaders,
+	})
+}
+
+// mailMessageStorageKey returns the S3 prefix of the message data,
+// messages stored before the storage keys are under their message id.
+func mailMessageStorageKey(mailMessage MailMessage) string {
+	if mailMessage.StorageKey != "" {
+		return mailMessage.StorageKey
+	}
+
+	return mailMessage.MessageID
+}
+
+// mailMessageAuthentication creates the authentication summary
+// of a mail message from the stored spf, dkim and dmarc results.
+func mailMessageAuthentication(mailMessage MailMessage) *typeApiMailMessageAuthentication {
+	authentication := typeApiMailMessageAuthentication{
+		SPF: typeApiMailMessageAuthenticationResult{
+			Pass:   mailMessage.SPFResult == "pass",
+			Result: mailMessage.SPFResult,
+			Domain: mailMessage.SPFDomain,
+		},
+		DKIM: []typeApiMailMessageAuthenticationResult{},
+		DMARC: typeApiMailMessageAuthenticationResult{
+			Pass:        mailMessage.DMARCResult == "pass",
+			Result:      mailMessage.DMARCResult,
+			Domain:      mailMessage.DMARCDomain,
+			Policy:      mailMessage.DMARCPolicy,
+			Disposition: mailMessage.DMARCDisposition,
+		},
+	}
+
+	for _, dkim := range mailMessage.MailMessageDKIMs {
+		authentication.DKIM = append(authentication.DKIM, typeApiMailMessageAuthenticationResult{
+			Pass:     dkim.Result == "pass",
+			Result:   dkim.Result,
+			Domain:   dkim.Domain,
+			Selector: dkim.Selector,
+			Reason:   dkim.Reason,
+		})
+	}
+
+	return &authentication
+}
+
+// apiControllersMailsQuarantine returns the mail messages quarantined
+// by the filters of the mail, latest first.
+func apiControllersMailsQuarantine(c *gin.Context) {
+	mailHost := c.Param("mailHost")
+
+	var mail Mail
+	if err := db.First(&mail, "host = ?", mailHost).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, map[string]interface{}{
+			"success": false,
+			"error":   "Mail not found",
+		})
+		return
+	}
+
+	mailMessages := []MailMessage{}
+	err := db.
+		Where("status = ?", mailMessageStatusQuarantined).
+		Where("id IN (?)", mailMessageIDsQuery(mail)).
+		Preload("MailMessageRelations").
+		Preload("MailMessageDeliveries", "mail_inbox_id IN (?)", mailInboxIDsQuery(mail)).
+		Order("id DESC").
+		Find(&mailMessages).Error
+
+	if err != nil {
+		logger.Errorf("failed to get quarantined mail messages: %s: db find error: %v", mailHost, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success":       true,
+		"mail_messages": mailMessages,
+	})
+}
+
+// apiControllersMailsQuarantineRelease releases a quarantined mail
+// message of the mail to the inboxes it's delivered to.
+func apiControllersMailsQuarantineRelease(c *gin.Context) {
+	mailHost := c.Param("mailHost")
+	mailMessageID := c.Param("mailMessageID")
+
+	var mail Mail
+	if err := db.First(&mail, "host = ?", mailHost).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, map[string]interface{}{
+			"success": false,
+			"error":   "Mail not found",
+		})
+		return
+	}
+
+	var mailMessage MailMessage
+	err := db.
+		Where("status = ?", mailMessageStatusQuarantined).
+		Where("id IN (?)", mailMessageIDsQuery(mail)).
+		First(&mailMessage, "id = ?", mailMessageID).Error
+
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatusJSON(http.StatusNotFound, map[string]interface{}{
+				"success": false,
+				"error":   "Mail message not found",
+			})
+			return
+		}
+
+		logger.Errorf("failed to release mail message: %s: db find error: %v", mailMessageID, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	if err := db.Model(&mailMessage).Update("status", mailMessageStatusReceived).Error; err != nil {
+		logger.Errorf("failed to release mail message: %s: db update error: %v", mailMessageID, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// mailMessageIDsQuery returns the query of the mail message ids
+// delivered to the inboxes of the mail, a mail message is only
+// shown to the mails it's delivered to.
+func mailMessageIDsQuery(mail Mail) *gorm.DB {
+	return db.
+		Model(&MailMessageDelivery{}).
+		Select("mail_message_deliveries.mail_message_id").
+		Joins("JOIN mail_inboxes ON mail_inboxes.id = mail_message_deliveries.mail_inbox_id").
+		Where("mail_inboxes.mail_id = ? and mail_inboxes.deleted_at IS NULL", mail.ID)
+}
+
+// mailInboxIDsQuery returns the query of the inbox ids of the mail, the
+// deliveries of a mail message are only shown to the mail they're in.
+func mailInboxIDsQuery(mail Mail) *gorm.DB {
+	return db.
+		Model(&MailInbox{}).
+		Select("id").
+		Where("mail_id = ?", mail.ID)
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"regexp"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -28,6 +30,31 @@ func apiControllersMailsCreate(c *gin.Context) {
 		return
 	}
 
+	if req.SPFPolicy == "" {
+		req.SPFPolicy = mailSPFPolicyIgnore
+	}
+
+	if req.SPFPolicy != mailSPFPolicyReject && req.SPFPolicy != mailSPFPolicyTag && req.SPFPolicy != mailSPFPolicyIgnore {
+		c.AbortWithStatusJSON(http.StatusBadRequest, map[string]interface{}{
+			"success": false,
+			"error":   "SPF policy must be one of reject, tag or ignore",
+		})
+		return
+	}
+
+	if req.DNSBLPolicy == "" {
+		req.DNSBLPolicy = mailDNSBLPolicyIgnore
+	}
+
+	if req.DNSBLPolicy != mailDNSBLPolicyConnect && req.DNSBLPolicy != mailDNSBLPolicyRcpt &&
+		req.DNSBLPolicy != mailDNSBLPolicyTag && req.DNSBLPolicy != mailDNSBLPolicyIgnore {
+		c.AbortWithStatusJSON(http.StatusBadRequest, map[string]interface{}{
+			"success": false,
+			"error":   "DNSBL policy must be one of connect, rcpt, tag or ignore",
+		})
+		return
+	}
+
 	var mailFound Mail
 	if err := db.First(&mailFound, "host = ?", req.Host).Error; err == nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, map[string]interface{}{
@@ -38,9 +65,12 @@ func apiControllersMailsCreate(c *gin.Context) {
 	}
 
 	mail := Mail{
-		Host:    req.Host,
-		Relay:   req.Relay,
-		Version: 1,
+		Host:        req.Host,
+		Relay:       req.Relay,
+		SPFPolicy:   req.SPFPolicy,
+		Greylisting: req.Greylisting,
+		DNSBLPolicy: req.DNSBLPolicy,
+		Version:     1,
 	}
 
 	if err := db.Create(&mail).Error; err != nil {
@@ -76,6 +106,7 @@ func apiControllersMailsRefresh(c *gin.Context) {
 		err := db.
 			Preload("MailInboxes").
 			Preload("MailUpstreams").
+			Preload("MailFilters", mailFiltersOrder).
 			First(&mail, "id = ? and version > ?", mailID, mailVersion).Error
 
 		if err != nil {
@@ -100,6 +131,7 @@ func apiControllersMailsGet(c *gin.Context) {
 	err := db.
 		Preload("MailInboxes").
 		Preload("MailUpstreams").
+		Preload("MailFilters", mailFiltersOrder).
 		First(&mail, "host = ?", mailHost).Error
 
 	if err != nil {
@@ -127,3 +159,288 @@ func apiControllersMailsGet(c *gin.Context) {
 		"mail":    mail,
 	})
 }
+
+// apiControllersMailsDKIM generates a new dkim keypair for the mail
+// and returns the TXT record to publish. Outbound messages are signed
+// with the new key after the SMTP server refreshes the mail.
+func apiControllersMailsDKIM(c *gin.Context) {
+	mailHost := c.Param("mailHost")
+
+	var req typeApiReqMailsDKIM
+	if err := c.BindJSON(&req); err != nil {
+		logger.Errorf("failed to create mail dkim: bind json error: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	if req.Selector == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, map[string]interface{}{
+			"success": false,
+			"error":   "Selector is required",
+		})
+		return
+	}
+
+	if req.Algorithm == "" {
+		req.Algorithm = dkimAlgorithmRSA
+	}
+
+	if req.Algorithm != dkimAlgorithmRSA && req.Algorithm != dkimAlgorithmEd25519 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, map[string]interface{}{
+			"success": false,
+			"error":   "Algorithm must be one of rsa or ed25519",
+		})
+		return
+	}
+
+	var mail Mail
+	if err := db.First(&mail, "host = ?", mailHost).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, map[string]interface{}{
+			"success": false,
+			"error":   "Mail not found",
+		})
+		return
+	}
+
+	privateKey, publicKey, err := dkimKeyGenerate(req.Algorithm)
+	if err != nil {
+		logger.Errorf("failed to create mail dkim: generate key error: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	privateKeyEncrypted, err := dkimEncrypt(privateKey)
+	if err != nil {
+		logger.Errorf("failed to create mail dkim: encrypt key error: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	mail.DKIMSelector = req.Selector
+	mail.DKIMAlgorithm = req.Algorithm
+	mail.DKIMPublicKey = publicKey
+	mail.DKIMPrivateKey = privateKeyEncrypted
+
+	// Version is increased so the SMTP server refreshes the mail.
+	err = db.Model(&mail).Updates(map[string]interface{}{
+		"dkim_selector":    mail.DKIMSelector,
+		"dkim_algorithm":   mail.DKIMAlgorithm,
+		"dkim_public_key":  mail.DKIMPublicKey,
+		"dkim_private_key": mail.DKIMPrivateKey,
+		"version":          mail.Version + 1,
+	}).Error
+
+	if err != nil {
+		logger.Errorf("failed to create mail dkim: db update error: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	name, value := dkimRecord(mail)
+	c.JSON(http.StatusCreated, map[string]interface{}{
+		"success": true,
+		"record": map[string]interface{}{
+			"name":  name,
+			"type":  "TXT",
+			"value": value,
+		},
+	})
+}
+
+// apiControllersMailsRatelimitViolations returns the latest rate
+// limit violations of the sessions delivering to the mail.
+func apiControllersMailsRatelimitViolations(c *gin.Context) {
+	mailHost := c.Param("mailHost")
+
+	var mail Mail
+	if err := db.First(&mail, "host = ?", mailHost).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, map[string]interface{}{
+			"success": false,
+			"error":   "Mail not found",
+		})
+		return
+	}
+
+	violations := []MailRatelimitViolation{}
+	err := db.
+		Where("mail_id = ?", mail.ID).
+		Order("id DESC").
+		Limit(mailRatelimitViolationsLimit).
+		Find(&violations).Error
+
+	if err != nil {
+		logger.Errorf("failed to get rate limit violations: %s: db find error: %v", mailHost, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success":                   true,
+		"mail_ratelimit_violations": violations,
+	})
+}
+
+// apiControllersMailsFilters replaces the message filters of the mail,
+// filters run in the order of the request. Filters run after the
+// filters of the SMTP server config for the mail.
+func apiControllersMailsFilters(c *gin.Context) {
+	mailHost := c.Param("mailHost")
+
+	var req typeApiReqMailsFilters
+	if err := c.BindJSON(&req); err != nil {
+		logger.Errorf("failed to update mail filters: bind json error: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	for i, mailFilter := range req.MailFilters {
+		if mailFilter.Action == "" {
+			req.MailFilters[i].Action = mailFilterActionReject
+			mailFilter.Action = mailFilterActionReject
+		}
+
+		if err := mailFilterValidate(mailFilter); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Filter %d: %s", i+1, err.Error()),
+			})
+			return
+		}
+	}
+
+	var mail Mail
+	if err := db.First(&mail, "host = ?", mailHost).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, map[string]interface{}{
+			"success": false,
+			"error":   "Mail not found",
+		})
+		return
+	}
+
+	mailFilters := []MailFilter{}
+	for i, mailFilter := range req.MailFilters {
+		mailFilters = append(mailFilters, MailFilter{
+			MailID:        mail.ID,
+			Position:      i + 1,
+			Type:          mailFilter.Type,
+			Action:        mailFilter.Action,
+			Code:          mailFilter.Code,
+			Message:       mailFilter.Message,
+			MaxBytes:      mailFilter.MaxBytes,
+			Senders:       mailFilter.Senders,
+			Header:        mailFilter.Header,
+			Pattern:       mailFilter.Pattern,
+			Tag:           mailFilter.Tag,
+			SubjectPrefix: mailFilter.SubjectPrefix,
+		})
+	}
+
+	// Version is increased so the SMTP server refreshes the mail.
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("mail_id = ?", mail.ID).Delete(&MailFilter{}).Error; err != nil {
+			return err
+		}
+
+		if len(mailFilters) > 0 {
+			if err := tx.Create(&mailFilters).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Model(&mail).Update("version", mail.Version+1).Error
+	})
+
+	if err != nil {
+		logger.Errorf("failed to update mail filters: %s: db error: %v", mailHost, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success":      true,
+		"mail_filters": mailFilters,
+	})
+}
+
+// mailFiltersOrder preloads the filters of a mail in order.
+func mailFiltersOrder(db *gorm.DB) *gorm.DB {
+	return db.Order("position")
+}
+
+// mailFilterTagPattern is a single header field, field names are the
+// printable characters except the colon (RFC 5322 section 2.2).
+var mailFilterTagPattern = regexp.MustCompile(`^[!-9;-~]+:[^\r\n]*$`)
+
+// mailFilterValidate returns an error if the mail filter is not valid.
+func mailFilterValidate(mailFilter MailFilter) error {
+	switch mailFilter.Action {
+	case mailFilterActionAccept, mailFilterActionReject, mailFilterActionQuarantine, mailFilterActionTag:
+	case mailFilterActionRewrite:
+		if mailFilter.SubjectPrefix == "" {
+			return fmt.Errorf("subject prefix is required to rewrite")
+		}
+	default:
+		return fmt.Errorf("action must be one of accept, reject, quarantine, tag or rewrite")
+	}
+
+	if mailFilter.Code != 0 && (mailFilter.Code < 400 || mailFilter.Code > 599) {
+		return fmt.Errorf("code must be a 4xx or 5xx reply code")
+	}
+
+	// Tag and subject prefix are written to the messages as they are.
+	if mailFilter.Tag != "" && !mailFilterTagPattern.MatchString(mailFilter.Tag) {
+		return fmt.Errorf(`tag must be a single "name: value" header field`)
+	}
+
+	if strings.ContainsAny(mailFilter.SubjectPrefix, "\r\n") {
+		return fmt.Errorf("subject prefix must be a single line")
+	}
+
+	switch mailFilter.Type {
+	case mailFilterTypeSize:
+		if mailFilter.MaxBytes <= 0 {
+			return fmt.Errorf("max bytes is required")
+		}
+	case mailFilterTypeSender:
+		if len(mailFilter.Senders) == 0 {
+			return fmt.Errorf("senders are required")
+		}
+		for _, sender := range mailFilter.Senders {
+			if strings.TrimSpace(sender) == "" || strings.ContainsAny(sender, "\r\n") {
+				return fmt.Errorf("sender is not valid: %q", sender)
+			}
+		}
+	case mailFilterTypeHeader:
+		if mailFilter.Header == "" {
+			return fmt.Errorf("header is required")
+		}
+		if _, err := regexp.Compile(mailFilter.Pattern); err != nil {
+			return fmt.Errorf("pattern is not valid: %v", err)
+		}
+	default:
+		return fmt.Errorf("type must be one of size, sender or header")
+	}
+
+	return nil
+}
@@ -2,13 +2,19 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
-// apiControllersSmtpInbound receives an inbound mail message from the SMTP server.
+// apiControllersSmtpInbound receives an inbound mail message from the
+// SMTP server. The mail message is saved once and delivered to all of
+// its inboxes.
 func apiControllersSmtpInbound(c *gin.Context) {
 	var req typeApiReqMailMessagesInbound
 	if err := c.BindJSON(&req); err != nil {
@@ -20,6 +26,87 @@ func apiControllersSmtpInbound(c *gin.Context) {
 		return
 	}
 
+	var mailInboxIDs []uint
+	for _, delivery := range req.MailMessage.Deliveries {
+		mailInboxIDs = append(mailInboxIDs, delivery.InboxID)
+	}
+
+	var mailInboxes []MailInbox
+	if len(mailInboxIDs) > 0 {
+		if err := db.Find(&mailInboxes, "id IN ?", mailInboxIDs).Error; err != nil {
+			logger.Errorf("failed to save mail message inbound: find inboxes error: %v", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+				"success": false,
+				"error":   "Something went wrong",
+			})
+			return
+		}
+	}
+
+	// Inboxes deleted after the message is received are
+	// skipped, message is saved to the remaining inboxes.
+	if len(mailInboxes) == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, map[string]interface{}{
+			"success": false,
+			"error":   "Mail inbox not found",
+		})
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		status := mailMessageStatusReceived
+		if req.MailMessage.Quarantine != "" {
+			status = mailMessageStatusQuarantined
+		}
+
+		_, err := mailMessageCreate(tx, 0, mailInboxes, req.MailMessage, status)
+		return err
+	})
+
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// apiControllersSmtpOutboundQueue queues an outbound mail message from
+// an inbox. Text, html and files of the message are expected to be
+// uploaded to S3 under the storage key of the message.
+func apiControllersSmtpOutboundQueue(c *gin.Context) {
+	var req typeApiReqMailMessagesOutboundQueue
+	if err := c.BindJSON(&req); err != nil {
+		logger.Errorf("failed to queue mail message outbound: bind json error: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	if len(req.MailMessage.To)+len(req.MailMessage.Cc)+len(req.MailMessage.Bcc) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, map[string]interface{}{
+			"success": false,
+			"error":   "Mail message has no recipients",
+		})
+		return
+	}
+
+	domains, ok := mailMessageDomains(req.MailMessage)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusBadRequest, map[string]interface{}{
+			"success": false,
+			"error":   "Mail message recipient address is not valid",
+		})
+		return
+	}
+
 	var mailInbox MailInbox
 	err := db.First(&mailInbox, "id = ?", req.MailMessage.InboxID).Error
 	if err != nil {
@@ -31,7 +118,7 @@ func apiControllersSmtpInbound(c *gin.Context) {
 			return
 		}
 
-		logger.Errorf("failed to save mail message inbound: find inbox error: %v", err)
+		logger.Errorf("failed to queue mail message outbound: find inbox error: %v", err)
 		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
 			"success": false,
 			"error":   "Something went wrong",
@@ -39,71 +126,624 @@ func apiControllersSmtpInbound(c *gin.Context) {
 		return
 	}
 
-	db.Transaction(func(tx *gorm.DB) error {
-		mailMessage := MailMessage{
-			MailInboxID: mailInbox.ID,
-
-			MessageID:   req.MailMessage.MessageID,
-			InReplyToID: req.MailMessage.InReplyToID,
+	var mailMessage MailMessage
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		mailMessage, err = mailMessageCreate(tx, mailInbox.ID, []MailInbox{mailInbox}, req.MailMessage, mailMessageStatusQueued)
+		if err != nil {
+			return err
+		}
 
-			Subject: req.MailMessage.Subject,
-			Text:    req.MailMessage.Text,
-			HTML:    req.MailMessage.HTML,
+		// Delivery is tracked and retried per recipient domain.
+		var mailMessageDomains []MailMessageDomain
+		for _, domain := range domains {
+			mailMessageDomains = append(mailMessageDomains, MailMessageDomain{
+				MailMessageID: mailMessage.ID,
+				Domain:        domain,
+				Status:        mailMessageDomainStatusQueued,
+			})
 		}
 
-		if err := tx.Create(&mailMessage).Error; err != nil {
-			logger.Errorf("failed to create mail message: db create error: %v", err)
+		if err := tx.CreateInBatches(mailMessageDomains, len(mailMessageDomains)).Error; err != nil {
+			logger.Errorf("failed to queue mail message outbound: db create domains error: %v", err)
 			return err
 		}
 
-		var mailMessageFiles []MailMessageFile
-		for _, file := range req.MailMessage.Files {
-			mailMessageFile := MailMessageFile{
-				MailMessageID: mailMessage.ID,
-				URL:           file.URL,
-				Disposition:   file.Disposition,
-				Key:           file.Key,
-				FileName:      file.FileName,
-				ContentID:     file.ContentID,
-				ContentType:   file.ContentType,
+		return nil
+	})
+
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, map[string]interface{}{
+		"success":      true,
+		"mail_message": mailMessage,
+	})
+}
+
+// apiControllersSmtpOutbound claims the queued outbound mail messages
+// which are due for the SMTP server. Claimed messages are leased, a
+// message which is not reported before its lease expires is claimed again
+// until it's older than the max age.
+func apiControllersSmtpOutbound(c *gin.Context) {
+	now := time.Now().UTC()
+
+	if err := mailMessagesExpire(now); err != nil {
+		logger.Errorf("failed to expire outbound mail messages: db update error: %v", err)
+	}
+
+	var candidates []MailMessage
+	err := db.
+		Where("status = ? and (next_attempt_at is null or next_attempt_at <= ?)", mailMessageStatusQueued, now).
+		Or("status = ? and lease_until < ?", mailMessageStatusSending, now).
+		Order("id ASC").
+		Limit(config.Outbound.Batch).
+		Find(&candidates).Error
+
+	if err != nil {
+		logger.Errorf("failed to get outbound mail messages: db find error: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	mailMessages := []typeApiResMailMessageOutbound{}
+	for _, candidate := range candidates {
+		mailMessage, claimed, err := mailMessageClaim(candidate, now)
+		if err != nil {
+			logger.Errorf("failed to claim outbound mail message: %d: %v", candidate.ID, err)
+			continue
+		}
+
+		// Message is claimed by another SMTP server.
+		if !claimed {
+			continue
+		}
+
+		mailMessages = append(mailMessages, mailMessage)
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success":       true,
+		"mail_messages": mailMessages,
+	})
+}
+
+// apiControllersSmtpOutboundResults receives the delivery results of
+// the claimed outbound mail messages from the SMTP server. Deferred
+// recipient domains are queued again for the next attempt scheduled by
+// the SMTP server until the message is older than the max age.
+func apiControllersSmtpOutboundResults(c *gin.Context) {
+	var req typeApiReqMailMessagesOutboundResults
+	if err := c.BindJSON(&req); err != nil {
+		logger.Errorf("failed to save outbound results: bind json error: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	for _, result := range req.Results {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			// Results are only accepted from the SMTP server
+			// holding the lease of the message.
+			var mailMessage MailMessage
+			err := tx.
+				Preload("MailMessageDomains").
+				First(&mailMessage, "id = ? and status = ? and lease_token = ?",
+					result.MailMessageID, mailMessageStatusSending, result.LeaseToken,
+				).Error
+
+			if err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					logger.Errorf("failed to save outbound result: %d: lease is not held", result.MailMessageID)
+					return nil
+				}
+				return err
+			}
+
+			now := time.Now().UTC()
+			maxAge := timeDuration(config.Outbound.MaxAge)
+			expired := maxAge > 0 && now.Sub(mailMessage.CreatedAt) >= maxAge
+
+			for _, domainResult := range result.Domains {
+				// Every attempt is kept with its TLS outcome
+				// for auditing the deliveries.
+				attempt := MailMessageAttempt{
+					MailMessageID: mailMessage.ID,
+					Domain:        domainResult.Domain,
+					Status:        domainResult.Status,
+					Response:      domainResult.Response,
+					MX:            domainResult.MX,
+
+					TLSPolicy:      domainResult.TLSPolicy,
+					TLSVersion:     domainResult.TLSVersion,
+					TLSCipherSuite: domainResult.TLSCipherSuite,
+					TLSVerified:    domainResult.TLSVerified,
+					TLSError:       domainResult.TLSError,
+				}
+
+				if err := tx.Create(&attempt).Error; err != nil {
+					return err
+				}
+
+				for i := range mailMessage.MailMessageDomains {
+					domain := &mailMessage.MailMessageDomains[i]
+					if domain.Domain != domainResult.Domain {
+						continue
+					}
+
+					domain.Attempts++
+					domain.LastResponse = domainResult.Response
+					domain.NextAttemptAt = nil
+
+					switch domainResult.Status {
+					case mailMessageDomainStatusDelivered:
+						domain.Status = mailMessageDomainStatusDelivered
+					case mailMessageDomainStatusFailed:
+						domain.Status = mailMessageDomainStatusFailed
+					default:
+						if expired {
+							domain.Status = mailMessageDomainStatusFailed
+							domain.LastResponse = fmt.Sprintf("%s (giving up after %d attempts)", domainResult.Response, domain.Attempts)
+							break
+						}
+
+						domain.Status = mailMessageDomainStatusDeferred
+						domain.NextAttemptAt = domainResult.NextAttemptAt
+					}
+
+					if err := tx.Save(domain).Error; err != nil {
+						return err
+					}
+				}
 			}
 
-			mailMessageFiles = append(mailMessageFiles, mailMessageFile)
+			status, nextAttemptAt := mailMessageStatus(mailMessage, result.Delivered)
+			err = tx.Model(&MailMessage{}).
+				Where("id = ?", mailMessage.ID).
+				Updates(map[string]interface{}{
+					"status":          status,
+					"lease_token":     "",
+					"lease_until":     nil,
+					"next_attempt_at": nextAttemptAt,
+				}).Error
+
+			if err != nil {
+				return err
+			}
+
+			var mailMessageErrors []MailMessageError
+			for _, e := range result.Errors {
+				mailMessageErrors = append(mailMessageErrors, MailMessageError{
+					MailMessageID: result.MailMessageID,
+					Error:         e.Error,
+				})
+			}
+
+			if len(mailMessageErrors) > 0 {
+				if err := tx.CreateInBatches(mailMessageErrors, len(mailMessageErrors)).Error; err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			logger.Errorf("failed to save outbound result: %d: %v", result.MailMessageID, err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+				"success": false,
+				"error":   "Something went wrong",
+			})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// mailMessageCreate creates the mail message with its files, dkim
+// results, headers, relations and the deliveries to the mail inboxes
+// in the provided transaction.
+func mailMessageCreate(tx *gorm.DB, mailInboxID uint, mailInboxes []MailInbox, req typeApiReqMailMessage, status string) (MailMessage, error) {
+	mailMessage := MailMessage{
+		MailInboxID: mailInboxID,
+		Status:      status,
+		Quarantine:  req.Quarantine,
+		SpamScore:   req.SpamScore,
+
+		MessageID:   req.MessageID,
+		InReplyToID: req.InReplyToID,
+		StorageKey:  req.StorageKey,
+
+		Subject: req.Subject,
+		Text:    req.Text,
+		HTML:    req.HTML,
+
+		EnvelopeFrom: req.EnvelopeFrom,
+		RemoteIP:     req.RemoteIP,
+		Helo:         req.Helo,
+		SessionUUID:  req.SessionUUID,
+
+		TLSVersion:     req.TLSVersion,
+		TLSCipherSuite: req.TLSCipherSuite,
+
+		SPFResult: req.SPFResult,
+		SPFDomain: req.SPFDomain,
+
+		DMARCResult:      req.DMARCResult,
+		DMARCDomain:      req.DMARCDomain,
+		DMARCPolicy:      req.DMARCPolicy,
+		DMARCDisposition: req.DMARCDisposition,
+	}
+
+	// Date header is optional, messages without
+	// the header have no date.
+	if !req.Date.IsZero() {
+		date := req.Date.UTC()
+		mailMessage.Date = &date
+	}
+
+	if err := tx.Create(&mailMessage).Error; err != nil {
+		logger.Errorf("failed to create mail message: db create error: %v", err)
+		return mailMessage, err
+	}
+
+	// Envelope recipients are stored per inbox, the Bcc
+	// recipients of an inbox are not shown to the others.
+	envelopeTo := make(map[uint][]string)
+	for _, delivery := range req.Deliveries {
+		envelopeTo[delivery.InboxID] = append(envelopeTo[delivery.InboxID], delivery.EnvelopeTo...)
+	}
+
+	var mailMessageDeliveries []MailMessageDelivery
+	for _, mailInbox := range mailInboxes {
+		mailMessageDeliveries = append(mailMessageDeliveries, MailMessageDelivery{
+			MailMessageID: mailMessage.ID,
+			MailInboxID:   mailInbox.ID,
+			EnvelopeTo:    strings.Join(envelopeTo[mailInbox.ID], ", "),
+		})
+	}
+
+	if len(mailMessageDeliveries) > 0 {
+		if err := tx.CreateInBatches(mailMessageDeliveries, len(mailMessageDeliveries)).Error; err != nil {
+			logger.Errorf("failed to create mail message deliveries: db create deliveries error: %v", err)
+			return mailMessage, err
+		}
+	}
+
+	var mailMessageFiles []MailMessageFile
+	for _, file := range req.Files {
+		mailMessageFile := MailMessageFile{
+			MailMessageID: mailMessage.ID,
+			URL:           file.URL,
+			Disposition:   file.Disposition,
+			Key:           file.Key,
+			FileName:      file.FileName,
+			ContentID:     file.ContentID,
+			ContentType:   file.ContentType,
 		}
 
+		mailMessageFiles = append(mailMessageFiles, mailMessageFile)
+	}
+
+	if len(mailMessageFiles) > 0 {
 		if err := tx.CreateInBatches(mailMessageFiles, len(mailMessageFiles)).Error; err != nil {
 			logger.Errorf("failed to create mail message files: db create files error: %v", err)
-			return err
+			return mailMessage, err
 		}
+	}
+
+	var mailMessageDKIMs []MailMessageDKIM
+	for _, dkim := range req.DKIMs {
+		dkim.MailMessageID = mailMessage.ID
+		mailMessageDKIMs = append(mailMessageDKIMs, dkim)
+	}
 
-		var mailMessageRelations []MailMessageRelation
-		for _, to := range req.MailMessage.To {
-			to.MailMessageID = mailMessage.ID
-			to.Type = mailMessageRelationTypeTo
-			mailMessageRelations = append(mailMessageRelations, to)
+	if len(mailMessageDKIMs) > 0 {
+		if err := tx.CreateInBatches(mailMessageDKIMs, len(mailMessageDKIMs)).Error; err != nil {
+			logger.Errorf("failed to create mail message dkims: db create dkims error: %v", err)
+			return mailMessage, err
 		}
+	}
+
+	var mailMessageSpamRules []MailMessageSpamRule
+	for _, rule := range req.SpamRules {
+		rule.MailMessageID = mailMessage.ID
+		mailMessageSpamRules = append(mailMessageSpamRules, rule)
+	}
 
-		for _, cc := range req.MailMessage.Cc {
-			cc.MailMessageID = mailMessage.ID
-			cc.Type = mailMessageRelationTypeCc
-			mailMessageRelations = append(mailMessageRelations, cc)
+	if len(mailMessageSpamRules) > 0 {
+		if err := tx.CreateInBatches(mailMessageSpamRules, len(mailMessageSpamRules)).Error; err != nil {
+			logger.Errorf("failed to create mail message spam rules: db create spam rules error: %v", err)
+			return mailMessage, err
 		}
+	}
+
+	var mailMessageHeaders []MailMessageHeader
+	for i, header := range req.Headers {
+		header.MailMessageID = mailMessage.ID
+		header.Position = i
+		mailMessageHeaders = append(mailMessageHeaders, header)
+	}
 
-		for _, bcc := range req.MailMessage.Bcc {
-			bcc.MailMessageID = mailMessage.ID
-			bcc.Type = mailMessageRelationTypeBcc
-			mailMessageRelations = append(mailMessageRelations, bcc)
+	if len(mailMessageHeaders) > 0 {
+		if err := tx.CreateInBatches(mailMessageHeaders, 100).Error; err != nil {
+			logger.Errorf("failed to create mail message headers: db create headers error: %v", err)
+			return mailMessage, err
 		}
+	}
+
+	var mailMessageRelations []MailMessageRelation
+	if req.From.Address != "" {
+		from := req.From
+		from.MailMessageID = mailMessage.ID
+		from.Type = mailMessageRelationTypeFrom
+		mailMessageRelations = append(mailMessageRelations, from)
+	}
+
+	if req.ReplyTo.Address != "" {
+		replyTo := req.ReplyTo
+		replyTo.MailMessageID = mailMessage.ID
+		replyTo.Type = mailMessageRelationTypeReplyTo
+		mailMessageRelations = append(mailMessageRelations, replyTo)
+	}
+
+	for _, to := range req.To {
+		to.MailMessageID = mailMessage.ID
+		to.Type = mailMessageRelationTypeTo
+		mailMessageRelations = append(mailMessageRelations, to)
+	}
 
+	for _, cc := range req.Cc {
+		cc.MailMessageID = mailMessage.ID
+		cc.Type = mailMessageRelationTypeCc
+		mailMessageRelations = append(mailMessageRelations, cc)
+	}
+
+	for _, bcc := range req.Bcc {
+		bcc.MailMessageID = mailMessage.ID
+		bcc.Type = mailMessageRelationTypeBcc
+		mailMessageRelations = append(mailMessageRelations, bcc)
+	}
+
+	if len(mailMessageRelations) > 0 {
 		if err := tx.CreateInBatches(mailMessageRelations, len(mailMessageRelations)).Error; err != nil {
 			logger.Errorf("failed to create mail message files: db create relations error: %v", err)
+			return mailMessage, err
+		}
+	}
+
+	return mailMessage, nil
+}
+
+// mailMessagesExpire fails the outbound mail messages which are older
+// than the max age and whose lease expired without a result. Results
+// fail the expired messages otherwise, but a message which is never
+// reported, ie. the SMTP server stops while sending it, would be
+// claimed again forever.
+func mailMessagesExpire(now time.Time) error {
+	maxAge := timeDuration(config.Outbound.MaxAge)
+	if maxAge <= 0 {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var ids []uint
+		err := tx.Model(&MailMessage{}).
+			Where("status = ? and lease_until < ? and created_at <= ?", mailMessageStatusSending, now, now.Add(-maxAge)).
+			Pluck("id", &ids).Error
+
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+
+		err = tx.Model(&MailMessage{}).
+			Where("id in ? and status = ? and lease_until < ?", ids, mailMessageStatusSending, now).
+			Updates(map[string]interface{}{
+				"status":          mailMessageStatusFailed,
+				"lease_token":     "",
+				"lease_until":     nil,
+				"next_attempt_at": nil,
+			}).Error
+
+		if err != nil {
+			return err
+		}
+
+		err = tx.Model(&MailMessageDomain{}).
+			Where("mail_message_id in ? and status in ?", ids, []string{mailMessageDomainStatusQueued, mailMessageDomainStatusDeferred}).
+			Updates(map[string]interface{}{
+				"status":          mailMessageDomainStatusFailed,
+				"next_attempt_at": nil,
+				"last_response":   "expired without a delivery result",
+			}).Error
+
+		if err != nil {
 			return err
 		}
 
+		logger.Printf("expired %d outbound mail messages without a delivery result: %v", len(ids), ids)
 		return nil
 	})
+}
+
+// mailMessageClaim leases the mail message if it's still claimable
+// and returns it in the format used by the SMTP server.
+func mailMessageClaim(candidate MailMessage, now time.Time) (typeApiResMailMessageOutbound, bool, error) {
+	var (
+		leaseToken = randomToken(16)
+		leaseUntil = now.Add(timeDuration(config.Outbound.Lease))
+	)
+
+	update := db.Model(&MailMessage{}).
+		Where("id = ? and ((status = ? and (next_attempt_at is null or next_attempt_at <= ?)) or (status = ? and lease_until < ?))",
+			candidate.ID, mailMessageStatusQueued, now, mailMessageStatusSending, now,
+		).
+		Updates(map[string]interface{}{
+			"status":      mailMessageStatusSending,
+			"lease_token": leaseToken,
+			"lease_until": leaseUntil,
+		})
+
+	if update.Error != nil {
+		return typeApiResMailMessageOutbound{}, false, update.Error
+	}
+
+	if update.RowsAffected == 0 {
+		return typeApiResMailMessageOutbound{}, false, nil
+	}
+
+	var mailMessage MailMessage
+	err := db.
+		Preload("MailMessageFiles").
+		Preload("MailMessageRelations").
+		Preload("MailMessageDomains", "status in ?", []string{mailMessageDomainStatusQueued, mailMessageDomainStatusDeferred}).
+		First(&mailMessage, "id = ?", candidate.ID).Error
 
 	if err != nil {
+		return typeApiResMailMessageOutbound{}, false, err
+	}
+
+	var mailInbox MailInbox
+	if err := db.First(&mailInbox, "id = ?", mailMessage.MailInboxID).Error; err != nil {
+		return typeApiResMailMessageOutbound{}, false, err
+	}
+
+	outbound := typeApiResMailMessageOutbound{
+		ID:         mailMessage.ID,
+		InboxID:    mailMessage.MailInboxID,
+		LeaseToken: leaseToken,
+
+		MessageID:   mailMessage.MessageID,
+		InReplyToID: mailMessage.InReplyToID,
+		StorageKey:  mailMessage.StorageKey,
+
+		From: MailMessageRelation{
+			Address:     mailInbox.Address,
+			DisplayName: mailInbox.DisplayName,
+		},
+
+		Date:    mailMessage.CreatedAt,
+		Subject: mailMessage.Subject,
+		Text:    mailMessage.Text,
+		HTML:    mailMessage.HTML,
+
+		Files:   mailMessage.MailMessageFiles,
+		Domains: mailMessage.MailMessageDomains,
+	}
+
+	for _, relation := range mailMessage.MailMessageRelations {
+		switch relation.Type {
+		case mailMessageRelationTypeReplyTo:
+			outbound.ReplyTo = relation
+		case mailMessageRelationTypeTo:
+			outbound.To = append(outbound.To, relation)
+		case mailMessageRelationTypeCc:
+			outbound.Cc = append(outbound.Cc, relation)
+		case mailMessageRelationTypeBcc:
+			outbound.Bcc = append(outbound.Bcc, relation)
+		}
+	}
+
+	if mailMessage.Date != nil {
+		outbound.Date = *mailMessage.Date
+	}
+
+	if maxAge := timeDuration(config.Outbound.MaxAge); maxAge > 0 {
+		expiresAt := mailMessage.CreatedAt.Add(maxAge)
+		outbound.ExpiresAt = &expiresAt
+	}
+
+	return outbound, true, nil
+}
+
+// mailMessageDomains returns the unique recipient domains of the
+// mail message, false if any of the recipient addresses is not valid.
+func mailMessageDomains(req typeApiReqMailMessage) ([]string, bool) {
+	relations := req.To
+	relations = append(relations, req.Cc...)
+	relations = append(relations, req.Bcc...)
+
+	var domains []string
+	seen := make(map[string]bool)
+	for _, relation := range relations {
+		at := strings.LastIndex(relation.Address, "@")
+		if at <= 0 || at == len(relation.Address)-1 {
+			return nil, false
+		}
+
+		domain := strings.ToLower(relation.Address[at+1:])
+		if seen[domain] {
+			continue
+		}
+		seen[domain] = true
+
+		domains = append(domains, domain)
+	}
+
+	return domains, true
+}
+
+// mailMessageStatus returns the status of the outbound mail message
+// from the states of its recipient domains. Message is queued while any
+// domain is pending and the next attempt is the earliest of them.
+func mailMessageStatus(mailMessage MailMessage, delivered bool) (string, *time.Time) {
+	// Messages queued without recipient domains.
+	if len(mailMessage.MailMessageDomains) == 0 {
+		if delivered {
+			return mailMessageStatusDelivered, nil
+		}
+		return mailMessageStatusFailed, nil
+	}
+
+	var (
+		failed        bool
+		pending       bool
+		nextAttemptAt *time.Time
+	)
+
+	for _, domain := range mailMessage.MailMessageDomains {
+		switch domain.Status {
+		case mailMessageDomainStatusFailed:
+			failed = true
+		case mailMessageDomainStatusQueued, mailMessageDomainStatusDeferred:
+			pending = true
+			if domain.NextAttemptAt != nil && (nextAttemptAt == nil || domain.NextAttemptAt.Before(*nextAttemptAt)) {
+				nextAttemptAt = domain.NextAttemptAt
+			}
+		}
+	}
+
+	if pending {
+		return mailMessageStatusQueued, nextAttemptAt
+	}
+
+	if failed {
+		return mailMessageStatusFailed, nil
+	}
+
+	return mailMessageStatusDelivered, nil
+}
+
+// apiControllersSmtpCredentialsVerify verifies the credential of an
+// SMTP AUTH command and returns the mail inbox which the session is
+// allowed to send as.
+func apiControllersSmtpCredentialsVerify(c *gin.Context) {
+	var req typeApiReqSmtpCredentialsVerify
+	if err := c.BindJSON(&req); err != nil {
+		logger.Errorf("failed to verify smtp credential: bind json error: %v", err)
 		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
 			"success": false,
 			"error":   "Something went wrong",
@@ -111,17 +751,193 @@ func apiControllersSmtpInbound(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusCreated, map[string]interface{}{
+	mailInboxCredential, err := mailInboxCredentialVerify(req.Username, req.Password)
+	if err != nil {
+		logger.Errorf("failed to verify smtp credential: find credential error: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	if mailInboxCredential.ID == 0 {
+		c.JSON(http.StatusOK, map[string]interface{}{
+			"success":  true,
+			"verified": false,
+		})
+		return
+	}
+
+	var mailInbox MailInbox
+	if err := db.First(&mailInbox, "id = ?", mailInboxCredential.MailInboxID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusOK, map[string]interface{}{
+				"success":  true,
+				"verified": false,
+			})
+			return
+		}
+
+		logger.Errorf("failed to verify smtp credential: find inbox error: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	now := time.Now().UTC()
+	if err := db.Model(&mailInboxCredential).Update("last_used_at", now).Error; err != nil {
+		logger.Errorf("failed to verify smtp credential: update last used error: %v", err)
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success":    true,
+		"verified":   true,
+		"mail_inbox": mailInbox,
+	})
+}
+
+// mailInboxCredentialVerify returns the mail inbox credential with the
+// username and password, the credential is empty if they don't match.
+func mailInboxCredentialVerify(username, password string) (MailInboxCredential, error) {
+	username = strings.ToLower(strings.TrimSpace(username))
+
+	var mailInboxCredential MailInboxCredential
+	err := db.First(&mailInboxCredential, "username = ?", username).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return MailInboxCredential{}, err
+	}
+
+	// Unknown usernames are compared with a dummy hash so
+	// they take as long as a wrong password.
+	passwordHash := mailInboxCredential.PasswordHash
+	if passwordHash == "" {
+		passwordHash = mailInboxCredentialDummyHash
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)) != nil {
+		return MailInboxCredential{}, nil
+	}
+
+	return mailInboxCredential, nil
+}
+
+// apiControllersSmtpMailDKIM returns the decrypted dkim signing key of
+// the mail. The key is only sent on this route so the SMTP server can
+// keep it in memory and out of the mail responses it caches.
+func apiControllersSmtpMailDKIM(c *gin.Context) {
+	mailHost := c.Param("mailHost")
+
+	var mail Mail
+	if err := db.First(&mail, "host = ?", mailHost).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusOK, map[string]interface{}{
+				"success": true,
+				"found":   false,
+			})
+			return
+		}
+
+		logger.Errorf("failed to get mail dkim: find mail error: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	if mail.DKIMPrivateKey == "" {
+		c.JSON(http.StatusOK, map[string]interface{}{
+			"success": true,
+			"found":   false,
+		})
+		return
+	}
+
+	privateKey, err := dkimDecrypt(mail.DKIMPrivateKey)
+	if err != nil {
+		logger.Errorf("failed to get mail dkim: decrypt key error: %s: %v", mail.Host, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
 		"success": true,
+		"found":   true,
+		"dkim": typeApiMailDKIM{
+			Selector:   mail.DKIMSelector,
+			PrivateKey: privateKey,
+		},
 	})
 }
 
-// apiControllersSmtpOutbound returns outbound mail messages
-func apiControllersSmtpOutbound(c *gin.Context) {
-	// Not implemented.
+// apiControllersSmtpRatelimitViolations saves the rate limit violations
+// reported by the SMTP server for the owners of the mails to review.
+// Violations of unknown mails are skipped.
+func apiControllersSmtpRatelimitViolations(c *gin.Context) {
+	var req typeApiReqSmtpRatelimitViolations
+	if err := c.BindJSON(&req); err != nil {
+		logger.Errorf("failed to save rate limit violations: bind json error: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   "Something went wrong",
+		})
+		return
+	}
+
+	mails := make(map[string]Mail)
+	var violations []MailRatelimitViolation
+	for _, violation := range req.Violations {
+		mail, ok := mails[violation.Host]
+		if !ok {
+			if err := db.First(&mail, "host = ?", violation.Host).Error; err != nil {
+				if !errors.Is(err, gorm.ErrRecordNotFound) {
+					logger.Errorf("failed to save rate limit violations: %s: find mail error: %v", violation.Host, err)
+					c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+						"success": false,
+						"error":   "Something went wrong",
+					})
+					return
+				}
+			}
+			mails[violation.Host] = mail
+		}
+
+		if mail.ID == 0 {
+			continue
+		}
+
+		violations = append(violations, MailRatelimitViolation{
+			CreatedAt:    violation.CreatedAt,
+			MailID:       mail.ID,
+			Scope:        violation.Scope,
+			Name:         violation.Name,
+			Key:          violation.Key,
+			Limit:        violation.Limit,
+			RemoteIP:     violation.RemoteIP,
+			Helo:         violation.Helo,
+			EnvelopeFrom: violation.From,
+			Recipient:    violation.Recipient,
+		})
+	}
+
+	if len(violations) > 0 {
+		if err := db.CreateInBatches(violations, len(violations)).Error; err != nil {
+			logger.Errorf("failed to save rate limit violations: db create error: %v", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+				"success": false,
+				"error":   "Something went wrong",
+			})
+			return
+		}
+	}
 
 	c.JSON(http.StatusOK, map[string]interface{}{
-		"success":       true,
-		"mail_messages": nil,
+		"success": true,
 	})
 }
@@ -1,17 +1,18 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 func apiMiddlewareAuthSmtp() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		authorization := c.Request.Header.Get("Authorization")
-		authorization = strings.TrimPrefix(authorization, "Bearer:")
-		authorization = strings.TrimSpace(authorization)
+		authorization := apiAuthorization(c)
 
 		if authorization == "" {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, map[string]interface{}{
@@ -33,10 +34,62 @@ func apiMiddlewareAuthSmtp() gin.HandlerFunc {
 	}
 }
 
+// apiMiddlewareAuthMailInbox authorizes the requests to a mail inbox
+// with the basic auth of a credential of the mail inbox.
+func apiMiddlewareAuthMailInbox() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		mailInboxFullAddr := fmt.Sprintf("%s@%s", c.Param("mailInboxAddr"), c.Param("mailHost"))
+
+		username, password, ok := c.Request.BasicAuth()
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, map[string]interface{}{
+				"success": false,
+				"error":   "Authorization header is required",
+			})
+			return
+		}
+
+		mailInboxCredential, err := mailInboxCredentialVerify(username, password)
+		if err != nil {
+			logger.Errorf("failed to authorize mail inbox: %s: find credential error: %v", mailInboxFullAddr, err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+				"success": false,
+				"error":   "Something went wrong",
+			})
+			return
+		}
+
+		var mailInbox MailInbox
+		if mailInboxCredential.ID != 0 {
+			err = db.First(&mailInbox, "id = ?", mailInboxCredential.MailInboxID).Error
+			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				logger.Errorf("failed to authorize mail inbox: %s: find inbox error: %v", mailInboxFullAddr, err)
+				c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+					"success": false,
+					"error":   "Something went wrong",
+				})
+				return
+			}
+		}
+
+		// The credential is only valid for its own mail inbox.
+		if mailInbox.ID == 0 || !strings.EqualFold(mailInbox.Address, mailInboxFullAddr) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, map[string]interface{}{
+				"success": false,
+				"error":   "Not authorized",
+			})
+			return
+		}
+
+		c.Next()
+	}
+}
+
 func apiMiddlewareCors() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
 		c.Header("Access-Control-Allow-Headers", "*")
+		c.Header("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
 
 		if c.Request.Method == http.MethodOptions {
 			c.AbortWithStatus(http.StatusNoContent)
@@ -46,3 +99,10 @@ func apiMiddlewareCors() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// apiAuthorization returns the token of the authorization header.
+func apiAuthorization(c *gin.Context) string {
+	authorization := c.Request.Header.Get("Authorization")
+	authorization = strings.TrimPrefix(authorization, "Bearer:")
+	return strings.TrimSpace(authorization)
+}
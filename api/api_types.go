@@ -3,36 +3,212 @@ package main
 import "time"
 
 type typeApiReqMailsCreate struct {
-	Host  string `json:"host"`
-	Relay bool   `json:"relay"`
+	Host        string `json:"host"`
+	Relay       bool   `json:"relay"`
+	SPFPolicy   string `json:"spf_policy"`
+	Greylisting bool   `json:"greylisting"`
+	DNSBLPolicy string `json:"dnsbl_policy"`
 }
 
 type typeApiReqMailMessagesInbound struct {
-	MailMessage struct {
-		InboxID uint `json:"inbox_id,omitempty"`
+	MailMessage typeApiReqMailMessage `json:"mail_message"`
+}
+
+// typeApiReqMailMessagesOutboundQueue queues an outbound
+// mail message from the inbox.
+type typeApiReqMailMessagesOutboundQueue struct {
+	MailMessage typeApiReqMailMessage `json:"mail_message"`
+}
+
+// typeApiReqMailMessagesOutboundResults reports the delivery
+// results of the claimed outbound mail messages.
+type typeApiReqMailMessagesOutboundResults struct {
+	Results []struct {
+		MailMessageID uint   `json:"mail_message_id"`
+		LeaseToken    string `json:"lease_token"`
+		Delivered     bool   `json:"delivered"`
+		Errors        []struct {
+			Error string `json:"error"`
+		} `json:"mail_message_errors"`
+		Domains []struct {
+			Domain        string     `json:"domain"`
+			Status        string     `json:"status"`
+			Response      string     `json:"response"`
+			NextAttemptAt *time.Time `json:"next_attempt_at"`
+
+			MX             string `json:"mx"`
+			TLSPolicy      string `json:"tls_policy"`
+			TLSVersion     string `json:"tls_version"`
+			TLSCipherSuite string `json:"tls_cipher_suite"`
+			TLSVerified    bool   `json:"tls_verified"`
+			TLSError       string `json:"tls_error"`
+		} `json:"mail_message_domains"`
+	} `json:"results"`
+}
+
+// typeApiReqMailMessageDelivery is an inbox an inbound mail message is
+// delivered to, with the envelope recipients of the inbox.
+type typeApiReqMailMessageDelivery struct {
+	InboxID    uint     `json:"inbox_id"`
+	EnvelopeTo []string `json:"envelope_to"`
+}
+
+// typeApiReqMailMessage is the mail message sent by the SMTP server.
+// Outbound mail messages are sent from the inbox id, inbound mail
+// messages are delivered to the inboxes of the deliveries.
+type typeApiReqMailMessage struct {
+	InboxID    uint                            `json:"inbox_id,omitempty"`
+	Deliveries []typeApiReqMailMessageDelivery `json:"deliveries,omitempty"`
+
+	MessageID   string `json:"message_id"`
+	InReplyToID string `json:"in_reply_to_id"`
+	StorageKey  string `json:"storage_key"`
+
+	From    MailMessageRelation   `json:"from"`
+	ReplyTo MailMessageRelation   `json:"reply_to"`
+	To      []MailMessageRelation `json:"to"`
+	Cc      []MailMessageRelation `json:"cc"`
+	Bcc     []MailMessageRelation `json:"bcc"`
+
+	EnvelopeFrom string `json:"envelope_from"`
+	RemoteIP     string `json:"remote_ip"`
+	Helo         string `json:"helo"`
+	SessionUUID  string `json:"session_uuid"`
+
+	Date    time.Time `json:"date"`
+	Subject string    `json:"subject"`
+	Text    string    `json:"text"`
+	HTML    string    `json:"html"`
+
+	TLSVersion     string `json:"tls_version"`
+	TLSCipherSuite string `json:"tls_cipher_suite"`
+
+	SPFResult string `json:"spf_result"`
+	SPFDomain string `json:"spf_domain"`
+
+	DMARCResult      string `json:"dmarc_result"`
+	DMARCDomain      string `json:"dmarc_domain"`
+	DMARCPolicy      string `json:"dmarc_policy"`
+	DMARCDisposition string `json:"dmarc_disposition"`
+
+	Files   []MailMessageFile   `json:"mail_message_files"`
+	DKIMs   []MailMessageDKIM   `json:"mail_message_dkims"`
+	Headers []MailMessageHeader `json:"mail_message_headers"`
+
+	// Quarantine is the reason the mail message is
+	// quarantined by the filters of the mail.
+	Quarantine string `json:"quarantine"`
+
+	SpamScore float64               `json:"spam_score"`
+	SpamRules []MailMessageSpamRule `json:"mail_message_spam_rules"`
+}
 
-		MessageID   string `json:"message_id"`
-		InReplyToID string `json:"in_reply_to_id"`
+// typeApiResMailMessageOutbound is the outbound mail message
+// claimed by the SMTP server.
+type typeApiResMailMessageOutbound struct {
+	ID         uint   `json:"id"`
+	InboxID    uint   `json:"inbox_id"`
+	LeaseToken string `json:"lease_token"`
 
-		From MailMessageRelation   `json:"from"`
-		To   []MailMessageRelation `json:"to"`
-		Cc   []MailMessageRelation `json:"cc"`
-		Bcc  []MailMessageRelation `json:"bcc"`
+	// Deferred domains are not retried after the message
+	// expires, nil if the messages never expire.
+	ExpiresAt *time.Time `json:"expires_at"`
 
-		Date    time.Time `json:"date"`
-		Subject string    `json:"subject"`
-		Text    string    `json:"text"`
-		HTML    string    `json:"html"`
+	MessageID   string `json:"message_id"`
+	InReplyToID string `json:"in_reply_to_id"`
+	StorageKey  string `json:"storage_key"`
 
-		Files []MailMessageFile `json:"mail_message_files"`
-	} `json:"mail_message"`
+	From    MailMessageRelation   `json:"from"`
+	ReplyTo MailMessageRelation   `json:"reply_to"`
+	To      []MailMessageRelation `json:"to"`
+	Cc      []MailMessageRelation `json:"cc"`
+	Bcc     []MailMessageRelation `json:"bcc"`
+
+	Date    time.Time `json:"date"`
+	Subject string    `json:"subject"`
+	Text    string    `json:"text"`
+	HTML    string    `json:"html"`
+
+	Files   []MailMessageFile   `json:"mail_message_files"`
+	Domains []MailMessageDomain `json:"mail_message_domains"`
+}
+
+type typeApiReqMailsDKIM struct {
+	Selector  string `json:"selector"`
+	Algorithm string `json:"algorithm"`
+}
+
+// typeApiMailDKIM is the dkim signing key of a mail.
+type typeApiMailDKIM struct {
+	Selector   string `json:"selector"`
+	PrivateKey string `json:"private_key"`
 }
 
 type typeApiReqMailsRefresh struct {
 	MailVersions map[int]int `json:"mail_versions"`
 }
 
+// typeApiReqMailsFilters replaces the filters of a mail,
+// filters run in the order of the request.
+type typeApiReqMailsFilters struct {
+	MailFilters []MailFilter `json:"mail_filters"`
+}
+
 type typeApiReqMailInboxesCreate struct {
 	Address     string `json:"address"`
 	DisplayName string `json:"display_name"`
 }
+
+// typeApiReqMailInboxSpam sets the spam threshold of the inbox.
+type typeApiReqMailInboxSpam struct {
+	SpamThreshold *float64 `json:"spam_threshold"`
+}
+
+// typeApiReqMailInboxCredentialsCreate creates a submission credential
+// for the inbox, a random password is generated if none is provided.
+type typeApiReqMailInboxCredentialsCreate struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// typeApiReqSmtpRatelimitViolations reports the rate limit
+// violations of the SMTP sessions delivering to the mails.
+type typeApiReqSmtpRatelimitViolations struct {
+	Violations []struct {
+		Host      string    `json:"host"`
+		Scope     string    `json:"scope"`
+		Name      string    `json:"name"`
+		Key       string    `json:"key"`
+		Limit     int       `json:"limit"`
+		RemoteIP  string    `json:"remote_ip"`
+		Helo      string    `json:"helo"`
+		From      string    `json:"from"`
+		Recipient string    `json:"recipient"`
+		CreatedAt time.Time `json:"created_at"`
+	} `json:"violations"`
+}
+
+// typeApiReqSmtpCredentialsVerify verifies the credential
+// of an SMTP AUTH command.
+type typeApiReqSmtpCredentialsVerify struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// typeApiMailMessageAuthentication is the summary of the spf, dkim
+// and dmarc results of a mail message.
+type typeApiMailMessageAuthentication struct {
+	SPF   typeApiMailMessageAuthenticationResult   `json:"spf"`
+	DKIM  []typeApiMailMessageAuthenticationResult `json:"dkim"`
+	DMARC typeApiMailMessageAuthenticationResult   `json:"dmarc"`
+}
+
+type typeApiMailMessageAuthenticationResult struct {
+	Pass        bool   `json:"pass"`
+	Result      string `json:"result"`
+	Domain      string `json:"domain"`
+	Selector    string `json:"selector,omitempty"`
+	Policy      string `json:"policy,omitempty"`
+	Disposition string `json:"disposition,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
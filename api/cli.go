@@ -12,17 +12,31 @@ func initCLI() {
 		err := db.AutoMigrate(
 			&Mail{},
 			&MailInbox{},
+			&MailInboxCredential{},
 			&MailUpstream{},
+			&MailFilter{},
 			&MailMessage{},
+			&MailMessageDelivery{},
 			&MailMessageRelation{},
+			&MailMessageHeader{},
 			&MailMessageFile{},
 			&MailMessageError{},
+			&MailMessageDKIM{},
+			&MailMessageSpamRule{},
+			&MailMessageDomain{},
+			&MailMessageAttempt{},
+			&MailRatelimitViolation{},
 		)
 		if err != nil {
 			err = fmt.Errorf("failed to migrate database: %w", err)
 			logger.Fatalln("Error:", err)
 		}
 
+		if err := dbMigrateMailMessageDeliveries(); err != nil {
+			err = fmt.Errorf("failed to migrate mail message deliveries: %w", err)
+			logger.Fatalln("Error:", err)
+		}
+
 		logger.Println("Success: database migrated")
 		os.Exit(0)
 	}
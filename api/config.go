@@ -20,6 +20,16 @@ type tomlConfig struct {
 		} `toml:"tls"`
 	} `toml:"api"`
 
+	Outbound struct {
+		Lease  int `toml:"lease"`
+		Batch  int `toml:"batch"`
+		MaxAge int `toml:"max_age"`
+	} `toml:"outbound"`
+
+	DKIM struct {
+		Secret string `toml:"secret"`
+	} `toml:"dkim"`
+
 	Database struct {
 		Driver string `toml:"driver"`
 		DSN    string `toml:"dsn"`
@@ -40,3 +40,14 @@ func initDB() {
 		logger.Fatalln("Error:", err)
 	}
 }
+
+// dbMigrateMailMessageDeliveries links the mail messages which were
+// stored before the deliveries to the inbox of the mail message.
+func dbMigrateMailMessageDeliveries() error {
+	return db.Exec(`
+		INSERT INTO mail_message_deliveries (created_at, updated_at, mail_message_id, mail_inbox_id)
+		SELECT created_at, updated_at, id, mail_inbox_id FROM mail_messages
+		WHERE deleted_at IS NULL AND mail_inbox_id <> 0
+		AND id NOT IN (SELECT mail_message_id FROM mail_message_deliveries)
+	`).Error
+}
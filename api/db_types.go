@@ -1,6 +1,9 @@
 package main
 
 import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
@@ -11,9 +14,69 @@ const (
 	dbDriverPostgres = "postgres"
 	dbDriverSqlite   = "sqlite"
 
-	mailMessageRelationTypeTo  = "to"
-	mailMessageRelationTypeCc  = "cc"
-	mailMessageRelationTypeBcc = "bcc"
+	mailMessageRelationTypeFrom    = "from"
+	mailMessageRelationTypeReplyTo = "reply_to"
+	mailMessageRelationTypeTo      = "to"
+	mailMessageRelationTypeCc      = "cc"
+	mailMessageRelationTypeBcc     = "bcc"
+
+	mailSPFPolicyReject = "reject"
+	mailSPFPolicyTag    = "tag"
+	mailSPFPolicyIgnore = "ignore"
+
+	// Mail dnsbl policies, decides what happens to the
+	// sessions of the clients listed in the blocklists.
+	mailDNSBLPolicyConnect = "connect"
+	mailDNSBLPolicyRcpt    = "rcpt"
+	mailDNSBLPolicyTag     = "tag"
+	mailDNSBLPolicyIgnore  = "ignore"
+
+	// Inbound messages are received, outbound messages move
+	// through queued -> sending -> delivered / failed.
+	mailMessageStatusReceived  = "received"
+	mailMessageStatusQueued    = "queued"
+	mailMessageStatusSending   = "sending"
+	mailMessageStatusDelivered = "delivered"
+	mailMessageStatusFailed    = "failed"
+
+	// Inbound messages quarantined by the filters of the mail
+	// are hidden from the inboxes until they are released.
+	mailMessageStatusQuarantined = "quarantined"
+
+	// Outbound delivery state of a recipient domain. Deferred
+	// domains are retried with backoff until the max age.
+	mailMessageDomainStatusQueued    = "queued"
+	mailMessageDomainStatusDeferred  = "deferred"
+	mailMessageDomainStatusDelivered = "delivered"
+	mailMessageDomainStatusFailed    = "failed"
+
+	// Message filters of a mail and the actions of the
+	// filters when they match a message.
+	mailFilterTypeSize   = "size"
+	mailFilterTypeSender = "sender"
+	mailFilterTypeHeader = "header"
+
+	mailFilterActionAccept     = "accept"
+	mailFilterActionReject     = "reject"
+	mailFilterActionQuarantine = "quarantine"
+	mailFilterActionTag        = "tag"
+	mailFilterActionRewrite    = "rewrite"
+
+	// Latest rate limit violations of a mail
+	// returned for the owner to review.
+	mailRatelimitViolationsLimit = 100
+
+	// Mail messages of an inbox listed with the spam query,
+	// spam over the inbox threshold is hidden by default.
+	mailInboxSpamHide = ""
+	mailInboxSpamAll  = "all"
+	mailInboxSpamOnly = "only"
+
+	mailInboxCredentialPasswordMin = 12
+
+	// mailInboxCredentialDummyHash is compared against the password
+	// of unknown usernames to spend the time of a real comparison.
+	mailInboxCredentialDummyHash = "$2a$10$1SwUHXw2WPshqX4guTmnaeG//t2ZPmAFqCs9jgcZM9hbcKOo9TRHe"
 )
 
 type Mail struct {
@@ -22,12 +85,21 @@ type Mail struct {
 	UpdatedAt time.Time      `gorm:"column:updated_at" json:"updated_at"`
 	DeletedAt gorm.DeletedAt `gorm:"index,column:deleted_at" json:"deleted_at"`
 
-	Host    string `gorm:"column:host" json:"host"`
-	Relay   bool   `gorm:"column:relay" json:"relay"`
-	Version int    `gorm:"column:version" json:"version"`
+	Host        string `gorm:"column:host" json:"host"`
+	Relay       bool   `gorm:"column:relay" json:"relay"`
+	SPFPolicy   string `gorm:"column:spf_policy" json:"spf_policy"`
+	Greylisting bool   `gorm:"column:greylisting" json:"greylisting"`
+	DNSBLPolicy string `gorm:"column:dnsbl_policy" json:"dnsbl_policy"`
+	Version     int    `gorm:"column:version" json:"version"`
+
+	DKIMSelector   string `gorm:"column:dkim_selector" json:"dkim_selector"`
+	DKIMAlgorithm  string `gorm:"column:dkim_algorithm" json:"dkim_algorithm"`
+	DKIMPublicKey  string `gorm:"column:dkim_public_key" json:"dkim_public_key"`
+	DKIMPrivateKey string `gorm:"column:dkim_private_key" json:"-"`
 
 	MailUpstreams []MailUpstream `gorm:"foreignkey:mail_id" json:"mail_upstreams,omitempty"`
 	MailInboxes   []MailInbox    `gorm:"foreignkey:mail_id" json:"mail_inboxes,omitempty"`
+	MailFilters   []MailFilter   `gorm:"foreignkey:mail_id" json:"mail_filters,omitempty"`
 }
 
 type MailUpstream struct {
@@ -41,6 +113,65 @@ type MailUpstream struct {
 	Priority int    `gorm:"column:priority" json:"priority"`
 }
 
+// MailFilter is a message filter of a mail, filters of a mail
+// run in the order of their positions on the inbound messages.
+type MailFilter struct {
+	ID        uint           `gorm:"primaryKey,column:id" json:"id"`
+	CreatedAt time.Time      `gorm:"column:created_at" json:"created_at"`
+	UpdatedAt time.Time      `gorm:"column:updated_at" json:"updated_at"`
+	DeletedAt gorm.DeletedAt `gorm:"index,column:deleted_at" json:"deleted_at"`
+
+	MailID   uint   `gorm:"column:mail_id" json:"mail"`
+	Position int    `gorm:"column:position" json:"position"`
+	Type     string `gorm:"column:type" json:"type"`
+	Action   string `gorm:"column:action" json:"action"`
+	Code     int    `gorm:"column:code" json:"code,omitempty"`
+	Message  string `gorm:"column:message" json:"message,omitempty"`
+
+	MaxBytes int64             `gorm:"column:max_bytes" json:"max_bytes,omitempty"`
+	Senders  MailFilterSenders `gorm:"column:senders" json:"senders,omitempty"`
+	Header   string            `gorm:"column:header" json:"header,omitempty"`
+	Pattern  string            `gorm:"column:pattern" json:"pattern,omitempty"`
+
+	Tag           string `gorm:"column:tag" json:"tag,omitempty"`
+	SubjectPrefix string `gorm:"column:subject_prefix" json:"subject_prefix,omitempty"`
+}
+
+// MailFilterSenders is the senders of a sender filter,
+// stored one sender per line.
+type MailFilterSenders []string
+
+func (MailFilterSenders) GormDataType() string {
+	return "text"
+}
+
+func (s MailFilterSenders) Value() (driver.Value, error) {
+	return strings.Join(s, "\n"), nil
+}
+
+func (s *MailFilterSenders) Scan(value interface{}) error {
+	var senders string
+	switch v := value.(type) {
+	case []byte:
+		senders = string(v)
+	case string:
+		senders = v
+	case nil:
+		senders = ""
+	default:
+		return fmt.Errorf("mail filter senders scan error: %T", value)
+	}
+
+	*s = nil
+	for _, sender := range strings.Split(senders, "\n") {
+		if sender != "" {
+			*s = append(*s, sender)
+		}
+	}
+
+	return nil
+}
+
 type MailInbox struct {
 	ID        uint           `gorm:"primaryKey,column:id" json:"id"`
 	CreatedAt time.Time      `gorm:"column:created_at" json:"created_at"`
@@ -51,7 +182,27 @@ type MailInbox struct {
 	Address     string `gorm:"column:address" json:"address"`
 	DisplayName string `gorm:"column:display_name" json:"display_name"`
 
-	MailMessages []MailMessage `gorm:"foreignkey:mail_inbox_id" json:"mail_messages,omitempty"`
+	// SpamThreshold is the spam score of the mail messages which
+	// are hidden from the inbox, 0 shows all of the mail messages.
+	SpamThreshold float64 `gorm:"column:spam_threshold" json:"spam_threshold"`
+
+	// MailMessages are loaded through the mail message
+	// deliveries of the inbox.
+	MailMessages []MailMessage `gorm:"-" json:"mail_messages,omitempty"`
+}
+
+// MailInboxCredential is the SMTP submission credential of a mail
+// inbox. Passwords are stored as bcrypt hashes.
+type MailInboxCredential struct {
+	ID        uint           `gorm:"primaryKey,column:id" json:"id"`
+	CreatedAt time.Time      `gorm:"column:created_at" json:"created_at"`
+	UpdatedAt time.Time      `gorm:"column:updated_at" json:"updated_at"`
+	DeletedAt gorm.DeletedAt `gorm:"index,column:deleted_at" json:"deleted_at"`
+
+	MailInboxID  uint       `gorm:"column:mail_inbox_id" json:"mail_inbox"`
+	Username     string     `gorm:"column:username" json:"username"`
+	PasswordHash string     `gorm:"column:password_hash" json:"-"`
+	LastUsedAt   *time.Time `gorm:"column:last_used_at" json:"last_used_at,omitempty"`
 }
 
 type MailMessage struct {
@@ -60,21 +211,89 @@ type MailMessage struct {
 	UpdatedAt time.Time      `gorm:"column:updated_at" json:"updated_at"`
 	DeletedAt gorm.DeletedAt `gorm:"index,column:deleted_at" json:"deleted_at"`
 
+	// MailInboxID is the inbox an outbound mail message is sent
+	// from, mail messages are linked to the inboxes they are in
+	// with mail message deliveries.
 	MailInboxID uint `gorm:"column:mail_inbox_id" json:"mail_inbox"`
 
+	Status     string     `gorm:"column:status" json:"status"`
+	LeaseToken string     `gorm:"column:lease_token" json:"-"`
+	LeaseUntil *time.Time `gorm:"column:lease_until" json:"-"`
+
+	NextAttemptAt *time.Time `gorm:"column:next_attempt_at" json:"next_attempt_at,omitempty"`
+
+	// Quarantine is the reason the mail message
+	// is quarantined by the filters of the mail.
+	Quarantine string `gorm:"column:quarantine" json:"quarantine,omitempty"`
+
+	// SpamScore is the spam score of an inbound mail message,
+	// the matched rules are the mail message spam rules.
+	SpamScore float64 `gorm:"column:spam_score" json:"spam_score"`
+
 	MessageID   string `gorm:"column:message_id" json:"message_id"`
 	InReplyToID string `gorm:"column:in_reply_to_id" json:"in_reply_to_id"`
 
-	Subject string `gorm:"column:subject" json:"subject"`
-	Text    string `gorm:"column:text" json:"text"`
-	HTML    string `gorm:"column:html" json:"html"`
+	// StorageKey is the S3 prefix the SMTP server stored the message
+	// data under. Message ids are set by the senders, so they are not
+	// used as the key.
+	StorageKey string `gorm:"column:storage_key" json:"-"`
+
+	Date    *time.Time `gorm:"column:date" json:"date"`
+	Subject string     `gorm:"column:subject" json:"subject"`
+	Text    string     `gorm:"column:text" json:"text"`
+	HTML    string     `gorm:"column:html" json:"html"`
+
+	// Envelope is the SMTP session the mail message is received
+	// with, envelope recipients are kept on the deliveries so an
+	// inbox doesn't see the recipients of the other inboxes.
+	EnvelopeFrom string `gorm:"column:envelope_from" json:"envelope_from"`
+	RemoteIP     string `gorm:"column:remote_ip" json:"remote_ip"`
+	Helo         string `gorm:"column:helo" json:"helo"`
+	SessionUUID  string `gorm:"column:session_uuid" json:"session_uuid"`
+
+	TLSVersion     string `gorm:"column:tls_version" json:"tls_version"`
+	TLSCipherSuite string `gorm:"column:tls_cipher_suite" json:"tls_cipher_suite"`
+
+	SPFResult string `gorm:"column:spf_result" json:"spf_result"`
+	SPFDomain string `gorm:"column:spf_domain" json:"spf_domain"`
+
+	DMARCResult      string `gorm:"column:dmarc_result" json:"dmarc_result"`
+	DMARCDomain      string `gorm:"column:dmarc_domain" json:"dmarc_domain"`
+	DMARCPolicy      string `gorm:"column:dmarc_policy" json:"dmarc_policy"`
+	DMARCDisposition string `gorm:"column:dmarc_disposition" json:"dmarc_disposition"`
 
 	MailMessageRelations []MailMessageRelation `gorm:"foreignkey:mail_message_id" json:"mail_message_relations,omitempty"`
 	MailMessageFiles     []MailMessageFile     `gorm:"foreignkey:mail_message_id" json:"mail_message_files,omitempty"`
 	MailMessageErrors    []MailMessageError    `gorm:"foreignkey:mail_message_id" json:"mail_message_errors,omitempty"`
+	MailMessageDKIMs     []MailMessageDKIM     `gorm:"foreignkey:mail_message_id" json:"mail_message_dkims,omitempty"`
+	MailMessageSpamRules []MailMessageSpamRule `gorm:"foreignkey:mail_message_id" json:"mail_message_spam_rules,omitempty"`
+	MailMessageDomains   []MailMessageDomain   `gorm:"foreignkey:mail_message_id" json:"mail_message_domains,omitempty"`
+	MailMessageAttempts  []MailMessageAttempt  `gorm:"foreignkey:mail_message_id" json:"mail_message_attempts,omitempty"`
+
+	MailMessageDeliveries []MailMessageDelivery `gorm:"foreignkey:mail_message_id" json:"mail_message_deliveries,omitempty"`
+	MailMessageHeaders    []MailMessageHeader   `gorm:"foreignkey:mail_message_id" json:"mail_message_headers,omitempty"`
 
 	TextURL string `json:"text_url,omitempty"`
 	HtmlURL string `json:"html_url,omitempty"`
+
+	Authentication *typeApiMailMessageAuthentication `gorm:"-" json:"authentication,omitempty"`
+}
+
+// MailMessageDelivery links a mail message to an inbox it's in. A
+// mail message is stored once for all of its inboxes, deleting it
+// from an inbox only deletes the delivery of that inbox.
+type MailMessageDelivery struct {
+	ID        uint           `gorm:"primaryKey,column:id" json:"id"`
+	CreatedAt time.Time      `gorm:"column:created_at" json:"created_at"`
+	UpdatedAt time.Time      `gorm:"column:updated_at" json:"updated_at"`
+	DeletedAt gorm.DeletedAt `gorm:"index,column:deleted_at" json:"deleted_at"`
+
+	MailMessageID uint `gorm:"index,column:mail_message_id" json:"mail_message"`
+	MailInboxID   uint `gorm:"index,column:mail_inbox_id" json:"mail_inbox"`
+
+	// EnvelopeTo is the envelope recipients of the SMTP session
+	// the mail message is delivered to the mail inbox with.
+	EnvelopeTo string `gorm:"column:envelope_to" json:"envelope_to,omitempty"`
 }
 
 type MailMessageRelation struct {
@@ -89,6 +308,20 @@ type MailMessageRelation struct {
 	DisplayName   string `gorm:"column:display_name" json:"display_name"`
 }
 
+// MailMessageHeader is a header field of a mail message. Position
+// is the order of the header field in the mail message.
+type MailMessageHeader struct {
+	ID        uint           `gorm:"primaryKey,column:id" json:"id"`
+	CreatedAt time.Time      `gorm:"column:created_at" json:"created_at"`
+	UpdatedAt time.Time      `gorm:"column:updated_at" json:"updated_at"`
+	DeletedAt gorm.DeletedAt `gorm:"index,column:deleted_at" json:"deleted_at"`
+
+	MailMessageID uint   `gorm:"index,column:mail_message_id" json:"mail_message"`
+	Position      int    `gorm:"column:position" json:"position"`
+	Name          string `gorm:"index,column:name" json:"name"`
+	Value         string `gorm:"column:value;type:text" json:"value"`
+}
+
 type MailMessageFile struct {
 	ID        uint           `gorm:"primaryKey,column:id" json:"id"`
 	CreatedAt time.Time      `gorm:"column:created_at" json:"created_at"`
@@ -113,3 +346,89 @@ type MailMessageError struct {
 	MailMessageID uint   `gorm:"column:mail_message_id" json:"mail_message"`
 	Error         string `gorm:"column:error" json:"error"`
 }
+
+type MailMessageDKIM struct {
+	ID        uint           `gorm:"primaryKey,column:id" json:"id"`
+	CreatedAt time.Time      `gorm:"column:created_at" json:"created_at"`
+	UpdatedAt time.Time      `gorm:"column:updated_at" json:"updated_at"`
+	DeletedAt gorm.DeletedAt `gorm:"index,column:deleted_at" json:"deleted_at"`
+
+	MailMessageID uint   `gorm:"column:mail_message_id" json:"mail_message"`
+	Domain        string `gorm:"column:domain" json:"domain"`
+	Selector      string `gorm:"column:selector" json:"selector"`
+	Algorithm     string `gorm:"column:algorithm" json:"algorithm"`
+	Result        string `gorm:"column:result" json:"result"`
+	Reason        string `gorm:"column:reason" json:"reason"`
+}
+
+// MailMessageSpamRule is a spam rule which matched
+// the mail message when it's received.
+type MailMessageSpamRule struct {
+	ID        uint           `gorm:"primaryKey,column:id" json:"id"`
+	CreatedAt time.Time      `gorm:"column:created_at" json:"created_at"`
+	UpdatedAt time.Time      `gorm:"column:updated_at" json:"updated_at"`
+	DeletedAt gorm.DeletedAt `gorm:"index,column:deleted_at" json:"deleted_at"`
+
+	MailMessageID uint    `gorm:"column:mail_message_id" json:"mail_message"`
+	Name          string  `gorm:"column:name" json:"name"`
+	Score         float64 `gorm:"column:score" json:"score"`
+}
+
+// MailMessageDomain is the outbound delivery state of
+// a mail message for one of its recipient domains.
+type MailMessageDomain struct {
+	ID        uint           `gorm:"primaryKey,column:id" json:"id"`
+	CreatedAt time.Time      `gorm:"column:created_at" json:"created_at"`
+	UpdatedAt time.Time      `gorm:"column:updated_at" json:"updated_at"`
+	DeletedAt gorm.DeletedAt `gorm:"index,column:deleted_at" json:"deleted_at"`
+
+	MailMessageID uint       `gorm:"column:mail_message_id" json:"mail_message"`
+	Domain        string     `gorm:"column:domain" json:"domain"`
+	Status        string     `gorm:"column:status" json:"status"`
+	Attempts      int        `gorm:"column:attempts" json:"attempts"`
+	NextAttemptAt *time.Time `gorm:"column:next_attempt_at" json:"next_attempt_at"`
+	LastResponse  string     `gorm:"column:last_response" json:"last_response"`
+}
+
+// MailMessageAttempt is an outbound delivery attempt of a mail
+// message to a recipient domain, with the TLS outcome of the
+// connection to the mx host.
+type MailMessageAttempt struct {
+	ID        uint           `gorm:"primaryKey,column:id" json:"id"`
+	CreatedAt time.Time      `gorm:"column:created_at" json:"created_at"`
+	UpdatedAt time.Time      `gorm:"column:updated_at" json:"updated_at"`
+	DeletedAt gorm.DeletedAt `gorm:"index,column:deleted_at" json:"deleted_at"`
+
+	MailMessageID uint   `gorm:"column:mail_message_id" json:"mail_message"`
+	Domain        string `gorm:"column:domain" json:"domain"`
+	Status        string `gorm:"column:status" json:"status"`
+	Response      string `gorm:"column:response" json:"response"`
+	MX            string `gorm:"column:mx" json:"mx"`
+
+	TLSPolicy      string `gorm:"column:tls_policy" json:"tls_policy"`
+	TLSVersion     string `gorm:"column:tls_version" json:"tls_version"`
+	TLSCipherSuite string `gorm:"column:tls_cipher_suite" json:"tls_cipher_suite"`
+	TLSVerified    bool   `gorm:"column:tls_verified" json:"tls_verified"`
+	TLSError       string `gorm:"column:tls_error" json:"tls_error"`
+}
+
+// MailRatelimitViolation is a rate limit of the SMTP server which is
+// exceeded by a session delivering to the mail. Scope is what the limit
+// is counted for (ip, network, sender or inbox) and key is the value of
+// the scope, ie. the client ip.
+type MailRatelimitViolation struct {
+	ID        uint           `gorm:"primaryKey,column:id" json:"id"`
+	CreatedAt time.Time      `gorm:"column:created_at" json:"created_at"`
+	UpdatedAt time.Time      `gorm:"column:updated_at" json:"updated_at"`
+	DeletedAt gorm.DeletedAt `gorm:"index,column:deleted_at" json:"deleted_at"`
+
+	MailID       uint   `gorm:"index,column:mail_id" json:"mail"`
+	Scope        string `gorm:"column:scope" json:"scope"`
+	Name         string `gorm:"column:name" json:"name"`
+	Key          string `gorm:"column:scope_key" json:"key"`
+	Limit        int    `gorm:"column:scope_limit" json:"limit"`
+	RemoteIP     string `gorm:"column:remote_ip" json:"remote_ip"`
+	Helo         string `gorm:"column:helo" json:"helo"`
+	EnvelopeFrom string `gorm:"column:envelope_from" json:"envelope_from"`
+	Recipient    string `gorm:"column:recipient" json:"recipient"`
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DKIM signing keys of the mails. Private keys are stored encrypted
+// with AES-GCM using a key derived from the configured dkim secret,
+// and only decrypted for the SMTP server.
+
+const (
+	dkimAlgorithmRSA     = "rsa"
+	dkimAlgorithmEd25519 = "ed25519"
+
+	dkimRSABits = 2048
+)
+
+// dkimKeyGenerate generates a keypair and returns the PEM encoded
+// private key and the base64 encoded public key of the dns record.
+func dkimKeyGenerate(algorithm string) (string, string, error) {
+	var (
+		private interface{}
+		public  []byte
+	)
+
+	switch algorithm {
+	case dkimAlgorithmRSA:
+		key, err := rsa.GenerateKey(rand.Reader, dkimRSABits)
+		if err != nil {
+			return "", "", err
+		}
+
+		public, err = x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			return "", "", err
+		}
+		private = key
+
+	case dkimAlgorithmEd25519:
+		pub, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return "", "", err
+		}
+
+		// Ed25519 records have the raw public key (RFC 8463).
+		public = pub
+		private = key
+
+	default:
+		return "", "", fmt.Errorf("algorithm %s is not supported", algorithm)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return "", "", err
+	}
+
+	privatePEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: der,
+	})
+
+	return string(privatePEM), base64.StdEncoding.EncodeToString(public), nil
+}
+
+// dkimRecord returns the name and the value of the
+// TXT record to publish for the mail.
+func dkimRecord(mail Mail) (string, string) {
+	name := fmt.Sprintf("%s._domainkey.%s", mail.DKIMSelector, mail.Host)
+	value := fmt.Sprintf("v=DKIM1; k=%s; p=%s", mail.DKIMAlgorithm, mail.DKIMPublicKey)
+
+	return name, value
+}
+
+// dkimEncrypt encrypts the private key with the dkim secret.
+func dkimEncrypt(plaintext string) (string, error) {
+	gcm, err := dkimCipher()
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// dkimDecrypt decrypts the private key encrypted by dkimEncrypt.
+func dkimDecrypt(ciphertext string) (string, error) {
+	gcm, err := dkimCipher()
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("ciphertext is too short")
+	}
+
+	nonce, sealed := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+func dkimCipher() (cipher.AEAD, error) {
+	if config.DKIM.Secret == "" {
+		return nil, errors.New("dkim secret is not configured")
+	}
+
+	key := sha256.Sum256([]byte(config.DKIM.Secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"os"
 	"time"
 )
@@ -39,3 +41,12 @@ func pathExists(path string) bool {
 	}
 	return true
 }
+
+// randomToken returns a random hex token of n bytes.
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
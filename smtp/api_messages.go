@@ -1,9 +1,10 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
-	"net"
+	"io"
 	"strings"
 	"time"
 
@@ -64,119 +65,408 @@ func messagesOutbound() {
 
 	logger.Debugf("Attempting to send %d messages", len(messages))
 
+	var results []typeMailMessageResult
+	for _, message := range messages {
+		domains, messageErrors := messageSend(message)
+		messageSchedule(message, domains)
+
+		// Message is delivered only if it's delivered to
+		// all of the recipients.
+		results = append(results, typeMailMessageResult{
+			MailMessageID: message.ID,
+			LeaseToken:    message.LeaseToken,
+			Delivered:     len(messageErrors) == 0,
+			Errors:        messageErrors,
+			Domains:       domains,
+		})
+	}
+
+	if len(results) == 0 {
+		return
+	}
+
+	// Messages that are not reported are claimed again
+	// by the API when their lease expires.
+	if err := apiRequestMessagesOutboundResults(results); err != nil {
+		logger.Errorln("Failed to send outbound message results, api request error", err)
+	}
+}
+
+// messageSchedule schedules the next attempt of the deferred domains
+// of the message with an exponential backoff of their attempts.
+func messageSchedule(message typeMailMessage, domains []typeMailMessageDomain) {
+	attempts := make(map[string]int)
+	for _, domain := range message.Domains {
+		attempts[domain.Domain] = domain.Attempts
+	}
+
+	now := time.Now().UTC()
+	for i := range domains {
+		if domains[i].Status != domainStatusDeferred {
+			continue
+		}
+
+		nextAttemptAt := now.Add(timeBackoff(
+			attempts[domains[i].Domain]+1,
+			timeDuration(config.Outbound.BackoffMin),
+			timeDuration(config.Outbound.BackoffMax),
+		))
+		domains[i].NextAttemptAt = &nextAttemptAt
+	}
+}
+
+// messageSend sends the message to the recipient domains which are
+// pending delivery and returns the delivery state of each domain with
+// the delivery errors. Temporary failures are deferred and retried on
+// a later claim, once the message expires they fail and
+// the sender is sent a delivery status notification.
+func messageSend(message typeMailMessage) ([]typeMailMessageDomain, []typeMailMessageError) {
 	var (
-		messageIDs    []uint
+		domains       []typeMailMessageDomain
 		messageErrors []typeMailMessageError
+		messageData   []byte
+		bounces       []dsnRecipient
 	)
 
-	for _, message := range messages {
-		relations := message.To
-		relations = append(relations, message.Cc...)
-		relations = append(relations, message.Bcc...)
+	expired := message.ExpiresAt != nil && !time.Now().Before(*message.ExpiresAt)
 
-		messageEncoded, err := messageBuild(message)
-		if err != nil {
-			logger.Errorln("Failed to convert message to smtp", message.MessageID, err)
+	relations := message.To
+	relations = append(relations, message.Cc...)
+	relations = append(relations, message.Bcc...)
+
+	pending := make(map[string]bool)
+	for _, domain := range message.Domains {
+		pending[domain.Domain] = true
+	}
+
+	// Recipients are grouped by their domains in the order they
+	// appear in the message.
+	var mailHosts []string
+	mailHostsAddresses := make(map[string][]string)
+	for _, relation := range relations {
+		address := relation.Address
+
+		if strings.LastIndex(address, "@") <= 0 {
+			err := fmt.Errorf(`email address "%s" is not valid`, address)
+			logger.Errorln("Failed to get email address host", message.MessageID, err)
 			messageErrors = append(messageErrors, typeMailMessageError{
 				MailMessageID: message.ID,
-				Error:         fmt.Sprintf("email format error: %s", err.Error()),
+				Error:         fmt.Sprintf(`email address format error: %s`, err.Error()),
 			})
 			continue
 		}
 
-		mailHostsSent := make(map[string]bool)
-		for _, relation := range relations {
-			address := relation.Address
+		mailHost := strings.ToLower(address[strings.LastIndex(address, "@")+1:])
+		if len(pending) > 0 && !pending[mailHost] {
+			// Domain is already delivered or failed permanently.
+			continue
+		}
 
-			if strings.LastIndex(address, "@") <= 0 {
-				err := fmt.Errorf(`email address "%s" is not valid`, address)
-				logger.Errorln("Failed to get email address host", message.MessageID, err)
-				messageErrors = append(messageErrors, typeMailMessageError{
-					MailMessageID: message.ID,
-					Error:         fmt.Sprintf(`email address format error: %s`, err.Error()),
-				})
-				continue
-			}
+		if _, ok := mailHostsAddresses[mailHost]; !ok {
+			mailHosts = append(mailHosts, mailHost)
+		}
+		mailHostsAddresses[mailHost] = append(mailHostsAddresses[mailHost], address)
+	}
 
-			mailHost := strings.Split(address, "@")[1]
-			if _, ok := mailHostsSent[mailHost]; ok {
-				// Mail already sent to the mail host. If there are multiple
-				// emails with the same mail host, only send it once.
-				continue
-			}
-			mailHostsSent[mailHost] = true
-
-			mxRecords, err := net.LookupMX(mailHost)
-			if err != nil {
-				err = fmt.Errorf(`email address "%s" host's MX lookup failed due to %s`, address, err.Error())
-				logger.Errorln("Failed to lookup MX records for", message.MessageID, err)
-				messageErrors = append(messageErrors, typeMailMessageError{
-					MailMessageID: message.ID,
-					Error:         fmt.Sprintf("email address host error: %s", err.Error()),
-				})
-				continue
-			}
+	if len(mailHosts) == 0 {
+		return domains, messageErrors
+	}
 
-			var upstreams []typeMailUpstream
-			for _, mx := range mxRecords {
-				upstreams = append(upstreams, typeMailUpstream{
-					Target:   mx.Host,
-					Priority: int(mx.Pref),
-				})
+	messageEncoded, err := messageBuild(message)
+	if err == nil {
+		messageData, err = smtpRender(messageEncoded)
+	}
+
+	if err == nil {
+		messageData, err = messageSign(message, messageData)
+	}
+
+	if err != nil {
+		// Message could not be built, ie. S3 is not available,
+		// all domains are retried later.
+		logger.Errorln("Failed to convert message to smtp", message.MessageID, err)
+		messageErrors = append(messageErrors, typeMailMessageError{
+			MailMessageID: message.ID,
+			Error:         fmt.Sprintf("email format error: %s", err.Error()),
+		})
+
+		for _, mailHost := range mailHosts {
+			domains = append(domains, typeMailMessageDomain{
+				Domain:   mailHost,
+				Status:   domainStatusDeferred,
+				Response: err.Error(),
+			})
+		}
+		return domains, messageErrors
+	}
+
+	// Each destination domain gets its own envelope with only its
+	// own recipients, the rendered message is the same for all.
+	for _, mailHost := range mailHosts {
+		addresses := strings.Join(mailHostsAddresses[mailHost], ", ")
+
+		envelope := smtpEnvelope{
+			From: message.From.Address,
+			To:   mailHostsAddresses[mailHost],
+			Data: messageData,
+		}
+
+		var (
+			outcome  smtpTLSOutcome
+			rejected []smtpRcptError
+		)
+		upstreams, err := smtpUpstreamsMX(mailHost)
+		if err == nil {
+			outcome, rejected, err = smtpSend(envelope, mailHost, upstreams)
+		}
+
+		domain := typeMailMessageDomain{
+			Domain: mailHost,
+
+			MX:             outcome.Host,
+			TLSPolicy:      outcome.Policy,
+			TLSVersion:     outcome.Version,
+			TLSCipherSuite: outcome.CipherSuite,
+			TLSVerified:    outcome.Verified,
+			TLSError:       outcome.Error,
+		}
+
+		if err == nil && len(rejected) == 0 {
+			domain.Status = domainStatusDelivered
+			domains = append(domains, domain)
+			continue
+		}
+
+		if err == nil {
+			var rejectedErrors []typeMailMessageError
+			domain.Status, rejectedErrors = messageRejected(message, messageData, rejected)
+			messageErrors = append(messageErrors, rejectedErrors...)
+
+			var responses []string
+			for _, rejectedError := range rejectedErrors {
+				responses = append(responses, rejectedError.Error)
 			}
+			domain.Response = strings.Join(responses, "; ")
 
-			if err := smtpSend(messageEncoded, upstreams); err != nil {
-				err = fmt.Errorf(`email address "%s" delivery failed due to %s`, address, err.Error())
-				logger.Errorln("Failed to lookup MX records", message.MessageID, err)
-				messageErrors = append(messageErrors, typeMailMessageError{
-					MailMessageID: message.ID,
-					Error:         fmt.Sprintf("email address delivery error: %s", err.Error()),
+			domains = append(domains, domain)
+			continue
+		}
+
+		status := domainStatusDeferred
+		if smtpSendPermanent(err) {
+			status = domainStatusFailed
+		} else if expired {
+			status = domainStatusFailed
+
+			code, diagnostic := dsnStatus(err, true)
+			for _, address := range mailHostsAddresses[mailHost] {
+				bounces = append(bounces, dsnRecipient{
+					Address:    address,
+					Action:     dsnActionFailed,
+					Status:     code,
+					Reason:     fmt.Sprintf("delivery time expired, last error: %s", err.Error()),
+					Diagnostic: diagnostic,
 				})
-				continue
 			}
 		}
 
-		messageIDs = append(messageIDs, message.ID)
+		err = fmt.Errorf(`email address "%s" delivery %s due to %s`, addresses, status, err.Error())
+		logger.Errorln("Failed to send message", message.MessageID, err)
+		messageErrors = append(messageErrors, typeMailMessageError{
+			MailMessageID: message.ID,
+			Error:         fmt.Sprintf("email address delivery error: %s", err.Error()),
+		})
+
+		domain.Status = status
+		domain.Response = err.Error()
+		domains = append(domains, domain)
+	}
+
+	if len(bounces) > 0 {
+		messageBounce(message, messageData, bounces)
+	}
+
+	return domains, messageErrors
+}
+
+// messageRejected handles the recipients of a domain which are rejected
+// while the message is delivered to the others and returns the status
+// of the domain with the errors of the recipients. Retrying the domain
+// would deliver the message again to the others, so the temporarily
+// rejected recipients are retried from the spool instead.
+func messageRejected(message typeMailMessage, messageData []byte, rejected []smtpRcptError) (string, []typeMailMessageError) {
+	var (
+		status        = domainStatusDelivered
+		messageErrors []typeMailMessageError
+		deferred      []string
+	)
+
+	for _, rcptErr := range rejected {
+		if smtpSendPermanent(rcptErr.Err) {
+			status = domainStatusFailed
+		} else {
+			deferred = append(deferred, rcptErr.Address)
+		}
+
+		err := fmt.Errorf(`email address "%s" rejected due to %s`, rcptErr.Address, rcptErr.Err.Error())
+		logger.Errorln("Failed to send message", message.MessageID, err)
+		messageErrors = append(messageErrors, typeMailMessageError{
+			MailMessageID: message.ID,
+			Error:         fmt.Sprintf("email address delivery error: %s", err.Error()),
+		})
+	}
+
+	if len(deferred) == 0 {
+		return status, messageErrors
+	}
+
+	data, err := smtpDataWrite(bytes.NewReader(messageData))
+	if err == nil {
+		defer smtpDataRemove(data)
+
+		var entry spoolEntry
+		entry, err = spoolAddRelay(spoolRelay{
+			From: message.From.Address,
+			To:   deferred,
+		}, smtpMessage{Data: data})
+		if err == nil {
+			logger.Printf("Spooled message %s for %d rejected recipients with entry %s", message.MessageID, len(deferred), entry.ID)
+			return status, messageErrors
+		}
+	}
+
+	// Domain is retried with all of its recipients if
+	// the rejected recipients can't be spooled.
+	logger.Errorln("Failed to spool message for rejected recipients", message.MessageID, err)
+	return domainStatusDeferred, messageErrors
+}
+
+// messageBounce sends a delivery status notification of the recipients
+// which are not delivered to the sender of the outbound message.
+func messageBounce(message typeMailMessage, messageData []byte, recipients []dsnRecipient) {
+	data, err := smtpDataWrite(bytes.NewReader(messageData))
+	if err != nil {
+		logger.Errorln("Failed to write message for delivery status notification", message.MessageID, err)
+		return
 	}
+	defer smtpDataRemove(data)
+
+	logger.Printf("Bouncing message %s to %s", message.MessageID, message.From.Address)
+	dsnNotify(dsnReport{
+		To:         message.From.Address,
+		Arrival:    message.Date,
+		Recipients: recipients,
+		Data:       data,
+	})
 }
 
-// messageParse parses an SMTP message to API Message
-// which can be used by the api handler.
-func messageParse(inboxID uint, message smtpMessage) (typeMailMessage, error) {
-	logger.Debugln("Parsing api message", message.MessageID)
+// messageSign signs the rendered message with the dkim key of the
+// sender's mail. Messages of mails without a key are sent unsigned.
+func messageSign(message typeMailMessage, messageData []byte) ([]byte, error) {
+	address := message.From.Address
+	mailHost := strings.ToLower(address[strings.LastIndex(address, "@")+1:])
 
-	msg := typeMailMessage{
-		InboxID: inboxID,
+	mail, ok := mailsFind(mailHost)
+	if !ok || mail.DKIMSelector == "" {
+		logger.Debugln("Sending message unsigned, no dkim key", message.MessageID, mailHost)
+		return messageData, nil
+	}
 
+	signer, ok, err := dkimSignerFind(mail)
+	if err != nil {
+		return nil, fmt.Errorf("dkim key error: %v", err)
+	}
+
+	if !ok {
+		logger.Debugln("Sending message unsigned, no dkim key", message.MessageID, mailHost)
+		return messageData, nil
+	}
+
+	return dkimSign(messageData, signer)
+}
+
+// messageParse parses an SMTP message to API Message which can be
+// used by the api handler. Message data is uploaded under the storage
+// key, each stored copy of a message has its own key.
+func messageParse(message smtpMessage, storageKey string) (typeMailMessage, error) {
+	logger.Debugln("Parsing api message", message.MessageID, storageKey)
+
+	msg := typeMailMessage{
 		MessageID:   message.MessageID,
 		InReplyToID: message.InReplyTo,
+		StorageKey:  storageKey,
 
 		From: typeMailMessageRelation{
 			DisplayName: message.From.Name,
 			Address:     message.From.Address,
 		},
+		ReplyTo: typeMailMessageRelation{
+			DisplayName: message.ReplyTo.Name,
+			Address:     message.ReplyTo.Address,
+		},
+
+		EnvelopeFrom: message.Session.From,
+		RemoteIP:     message.Session.RemoteIP,
+		Helo:         message.Session.Helo,
+		SessionUUID:  message.Session.UUID,
 
 		Date:    message.Date.UTC(),
 		Subject: message.Subject,
 
+		Quarantine: message.Quarantine,
+		SpamScore:  message.Spam.Score,
+
 		Text: stringsFirstNChars(message.Text, 255),
 		HTML: stringsFirstNChars(message.HTML, 255),
+
+		TLSVersion:     message.Session.TLSVersion,
+		TLSCipherSuite: message.Session.TLSCipherSuite,
+
+		SPFResult: message.Session.SPF.Result,
+		SPFDomain: message.Session.SPF.Domain,
+
+		DMARCResult:      message.DMARC.Result,
+		DMARCDomain:      message.DMARC.Domain,
+		DMARCPolicy:      message.DMARC.Policy,
+		DMARCDisposition: message.DMARC.Disposition,
 	}
 
-	// Upload the MIME format.
+	// Headers are read from the stored message, the prepended
+	// headers come before the headers of the message data.
+	trace := authResultsHeader(message) + message.Trace
+	headers, err := messageHeaders(trace, message.Data)
+	if err != nil {
+		logger.Errorln("Failed to read message headers", err)
+		return msg, err
+	}
+	msg.Headers = headers
+
+	// Upload the MIME format with the authentication results and
+	// the trace headers prepended, streamed from the message data
+	// without the forged authentication results.
+	messageData, err := authResultsOpen(message.Data)
+	if err != nil {
+		logger.Errorln("Failed to open message data", err)
+		return msg, err
+	}
+	defer messageData.Close()
+
 	s3UploadOptsMIME := s3UploadOpts{
 		Bucket: config.S3Emails.Bucket,
-		Key:    fmt.Sprintf("%s/%s", msg.MessageID, uploadFileNameMIME),
+		Key:    fmt.Sprintf("%s/%s", msg.StorageKey, uploadFileNameMIME),
 
 		ACL:         config.S3Emails.ACL,
 		ContentType: contentTypeMIME,
 
 		MetaData: map[string]string{
 			"Message-Id": msg.MessageID,
+			"Sha256":     message.Data.SHA256,
 		},
 	}
 
-	if _, err := s3Upload(s3UploadOptsMIME, bytes.NewReader(message.Raw)); err != nil {
+	messageRaw := io.MultiReader(strings.NewReader(trace), messageData)
+
+	if _, err := s3Upload(s3UploadOptsMIME, messageRaw); err != nil {
 		logger.Errorln("Failed to upload mime file to S3", err)
 		return msg, err
 	}
@@ -184,7 +474,7 @@ func messageParse(inboxID uint, message smtpMessage) (typeMailMessage, error) {
 	// Upload the Text.
 	s3UploadOptsText := s3UploadOpts{
 		Bucket: config.S3Emails.Bucket,
-		Key:    fmt.Sprintf("%s/%s", msg.MessageID, uploadFileNameText),
+		Key:    fmt.Sprintf("%s/%s", msg.StorageKey, uploadFileNameText),
 
 		ACL:         config.S3Emails.ACL,
 		ContentType: contentTypeText,
@@ -202,7 +492,7 @@ func messageParse(inboxID uint, message smtpMessage) (typeMailMessage, error) {
 	// Upload the HTML.
 	s3UploadOptsHTML := s3UploadOpts{
 		Bucket: config.S3Emails.Bucket,
-		Key:    fmt.Sprintf("%s/%s", msg.MessageID, uploadFileNameHTML),
+		Key:    fmt.Sprintf("%s/%s", msg.StorageKey, uploadFileNameHTML),
 
 		ACL:         config.S3Emails.ACL,
 		ContentType: contentTypeHTML,
@@ -221,11 +511,12 @@ func messageParse(inboxID uint, message smtpMessage) (typeMailMessage, error) {
 	messageParts := message.Inlines
 	messageParts = append(messageParts, message.Attachments...)
 
+	// Keys of the files are relative to the storage key.
 	for _, part := range messageParts {
-		key := fmt.Sprintf("%s/%s/%s", msg.MessageID, part.Disposition, part.ContentID)
+		key := fmt.Sprintf("%s/%s", part.Disposition, part.ContentID)
 		s3UploadOpts := s3UploadOpts{
 			Bucket: config.S3Emails.Bucket,
-			Key:    key,
+			Key:    fmt.Sprintf("%s/%s", msg.StorageKey, key),
 
 			ACL:         config.S3Emails.ACL,
 			ContentType: part.ContentType,
@@ -254,6 +545,23 @@ func messageParse(inboxID uint, message smtpMessage) (typeMailMessage, error) {
 		msg.Files = append(msg.Files, messageFile)
 	}
 
+	for _, result := range message.DKIM {
+		msg.DKIMs = append(msg.DKIMs, typeMailMessageDKIM{
+			Domain:    result.Domain,
+			Selector:  result.Selector,
+			Algorithm: result.Algorithm,
+			Result:    result.Result,
+			Reason:    result.Reason,
+		})
+	}
+
+	for _, rule := range message.Spam.Rules {
+		msg.SpamRules = append(msg.SpamRules, typeMailMessageSpamRule{
+			Name:  rule.Name,
+			Score: rule.Score,
+		})
+	}
+
 	for _, to := range message.To {
 		msg.To = append(msg.To, typeMailMessageRelation{
 			DisplayName: to.Name,
@@ -268,7 +576,7 @@ func messageParse(inboxID uint, message smtpMessage) (typeMailMessage, error) {
 		})
 	}
 
-	for _, bcc := range message.Cc {
+	for _, bcc := range message.Bcc {
 		msg.Bcc = append(msg.Bcc, typeMailMessageRelation{
 			DisplayName: bcc.Name,
 			Address:     bcc.Address,
@@ -278,6 +586,38 @@ func messageParse(inboxID uint, message smtpMessage) (typeMailMessage, error) {
 	return msg, nil
 }
 
+// messageHeaders reads the header fields of the message data
+// prepended with the trace header fields, in order. Forged
+// authentication results of the message data are left out.
+func messageHeaders(trace string, data smtpData) ([]typeMailMessageHeader, error) {
+	f, err := authResultsOpen(data)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(io.MultiReader(strings.NewReader(trace), f), smtpDataBufferSize)
+	fields, err := dkimReadHeaders(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var headers []typeMailMessageHeader
+	for _, field := range fields {
+		if len(headers) == messageHeadersMax {
+			break
+		}
+
+		value := strings.NewReplacer("\r\n", "", "\n", "").Replace(dkimHeaderValue(field))
+		headers = append(headers, typeMailMessageHeader{
+			Name:  dkimHeaderName(field),
+			Value: strings.TrimSpace(value),
+		})
+	}
+
+	return headers, nil
+}
+
 // messageBuild converts Violetnorth Message to SMTP message
 // which can be used by the SMTP handler.
 func messageBuild(message typeMailMessage) (enmime.MailBuilder, error) {
@@ -291,6 +631,10 @@ func messageBuild(message typeMailMessage) (enmime.MailBuilder, error) {
 		Date(message.Date).
 		Subject(message.Subject)
 
+	if message.ReplyTo.Address != "" {
+		builder = builder.ReplyTo(message.ReplyTo.DisplayName, message.ReplyTo.Address)
+	}
+
 	for _, to := range message.To {
 		builder = builder.To(to.DisplayName, to.Address)
 	}
@@ -306,7 +650,7 @@ func messageBuild(message typeMailMessage) (enmime.MailBuilder, error) {
 	// Download the text, assign it to the message.
 	text, err := s3Download(s3DownloadOpts{
 		Bucket: config.S3Emails.Bucket,
-		Key:    fmt.Sprintf("%s/%s", message.MessageID, uploadFileNameText),
+		Key:    fmt.Sprintf("%s/%s", message.StorageKey, uploadFileNameText),
 	})
 	if err != nil {
 		logger.Errorln("Failed to download text from S3", err)
@@ -320,7 +664,7 @@ func messageBuild(message typeMailMessage) (enmime.MailBuilder, error) {
 	// Download the HTML, assign it to the message.
 	html, err := s3Download(s3DownloadOpts{
 		Bucket: config.S3Emails.Bucket,
-		Key:    fmt.Sprintf("%s/%s", message.MessageID, uploadFileNameHTML),
+		Key:    fmt.Sprintf("%s/%s", message.StorageKey, uploadFileNameHTML),
 	})
 	if err != nil {
 		logger.Errorln("Failed to download html from S3", err)
@@ -335,7 +679,7 @@ func messageBuild(message typeMailMessage) (enmime.MailBuilder, error) {
 	for _, file := range message.Files {
 		data, err := s3Download(s3DownloadOpts{
 			Bucket: config.S3Emails.Bucket,
-			Key:    fmt.Sprintf("%s/%s/%s", message.MessageID, file.Disposition, file.ContentID),
+			Key:    fmt.Sprintf("%s/%s/%s", message.StorageKey, file.Disposition, file.ContentID),
 		})
 		if err != nil {
 			logger.Errorln("Failed to download message part from S3", err)
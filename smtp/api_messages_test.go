@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessageSchedule(t *testing.T) {
+	backoffMin, backoffMax := config.Outbound.BackoffMin, config.Outbound.BackoffMax
+	t.Cleanup(func() {
+		config.Outbound.BackoffMin, config.Outbound.BackoffMax = backoffMin, backoffMax
+	})
+	config.Outbound.BackoffMin = 300
+	config.Outbound.BackoffMax = 3600
+
+	message := typeMailMessage{
+		Domains: []typeMailMessageDomain{
+			{Domain: "example.com"},
+			{Domain: "example.net", Attempts: 2},
+			{Domain: "example.org", Attempts: 9},
+		},
+	}
+
+	domains := []typeMailMessageDomain{
+		{Domain: "example.com", Status: domainStatusDeferred},
+		{Domain: "example.net", Status: domainStatusDeferred},
+		{Domain: "example.org", Status: domainStatusDeferred},
+		{Domain: "example.edu", Status: domainStatusDelivered},
+	}
+
+	now := time.Now().UTC()
+	messageSchedule(message, domains)
+
+	want := []time.Duration{5 * time.Minute, 20 * time.Minute, time.Hour}
+	for i, backoff := range want {
+		nextAttemptAt := domains[i].NextAttemptAt
+		if nextAttemptAt == nil {
+			t.Fatalf("%s has no next attempt", domains[i].Domain)
+		}
+
+		if got := nextAttemptAt.Sub(now).Round(time.Minute); got != backoff {
+			t.Fatalf("%s next attempt in %s, want %s", domains[i].Domain, got, backoff)
+		}
+	}
+
+	if domains[3].NextAttemptAt != nil {
+		t.Fatalf("delivered %s has a next attempt", domains[3].Domain)
+	}
+}
@@ -135,6 +135,62 @@ func apiRequestMailsGet(host string) (typeMail, bool, error) {
 	return b.Mail, true, nil
 }
 
+// apiRequestMailDKIM requests the dkim signing key of the mail.
+func apiRequestMailDKIM(host string) (typeMailDKIM, bool, error) {
+	logger.Printf("Api request mail dkim, %s", host)
+
+	reqURL := fmt.Sprintf("%s/smtp/mails/%s/dkim",
+		config.API.BaseURL,
+		host,
+	)
+
+	req, err := http.NewRequest("GET", reqURL, nil)
+	if err != nil {
+		logger.Errorln("Failed to request mail dkim, create request error", err)
+		return typeMailDKIM{}, false, err
+	}
+	req.Header.Set(headerAuth, config.API.Secret)
+
+	res, err := apiClient.Do(req)
+	if err != nil {
+		logger.Errorln("Failed to request mail dkim, do request error", err)
+		return typeMailDKIM{}, false, err
+	}
+	defer res.Body.Close()
+
+	type resBodyType struct {
+		Success bool         `json:"success"`
+		Found   bool         `json:"found"`
+		Error   string       `json:"error"`
+		DKIM    typeMailDKIM `json:"dkim"`
+	}
+	var b resBodyType
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		logger.Errorln("Failed to request mail dkim, read response body error", err)
+		return typeMailDKIM{}, false, err
+	}
+
+	if err := json.Unmarshal(body, &b); err != nil {
+		logger.Errorln("Failed to request mail dkim, unmarshal response body error", err)
+		return typeMailDKIM{}, false, err
+	}
+
+	if !b.Success {
+		err := errors.New(b.Error)
+		logger.Errorln("Failed to request mail dkim, api returned error", b.Error)
+		return typeMailDKIM{}, false, err
+	}
+
+	// Mail has no dkim key.
+	if !b.Found {
+		return typeMailDKIM{}, false, nil
+	}
+
+	return b.DKIM, true, nil
+}
+
 // apiRequestMessagesInbound sends all inbound messages
 // that were received from SMTP to the API.
 func apiRequestMessagesInbound(mailMessage typeMailMessage) error {
@@ -249,3 +305,268 @@ func apiRequestMessagesOutbounds() ([]typeMailMessage, error) {
 
 	return b.MailMessages, nil
 }
+
+// apiRequestMessagesOutboundResults sends the delivery results
+// of the outbound mail messages to the API.
+func apiRequestMessagesOutboundResults(results []typeMailMessageResult) error {
+	logger.Printf("Api send outbound mail message results")
+
+	reqURL := fmt.Sprintf("%s/smtp/outbound/results",
+		config.API.BaseURL,
+	)
+
+	type reqBodyType struct {
+		Results []typeMailMessageResult `json:"results"`
+	}
+
+	reqBody := reqBodyType{
+		Results: results,
+	}
+
+	reqBodyMarshalled, err := json.Marshal(reqBody)
+	if err != nil {
+		logger.Errorln("Failed to send outbound mail message results, marshal request body error", err)
+		return err
+	}
+
+	req, err := http.NewRequest("POST", reqURL, bytes.NewBuffer(reqBodyMarshalled))
+	if err != nil {
+		logger.Errorln("Failed to send outbound mail message results, create request error", err)
+		return err
+	}
+	req.Header.Set(headerContentType, applicationJSON)
+	req.Header.Set(headerAuth, config.API.Secret)
+
+	res, err := apiClient.Do(req)
+	if err != nil {
+		logger.Errorln("Failed to send outbound mail message results, do request error", err)
+		return err
+	}
+	defer res.Body.Close()
+
+	type resBodyType struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error"`
+	}
+	var b resBodyType
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		logger.Errorln("Failed to send outbound mail message results, read response body error", err)
+		return err
+	}
+
+	if err := json.Unmarshal(body, &b); err != nil {
+		logger.Errorln("Failed to send outbound mail message results, unmarshal response body error", err)
+		return err
+	}
+
+	if !b.Success {
+		err := errors.New(b.Error)
+		logger.Errorln("Failed to send outbound mail message results, api returned error", b.Error)
+		return err
+	}
+
+	return nil
+}
+
+// apiRequestMessagesOutboundQueue queues a mail message submitted
+// by an authenticated client to be sent outbound.
+func apiRequestMessagesOutboundQueue(mailMessage typeMailMessage) error {
+	logger.Printf("Api queue outbound mail message")
+
+	reqURL := fmt.Sprintf("%s/smtp/outbound/queue",
+		config.API.BaseURL,
+	)
+
+	type reqBodyType struct {
+		MailMessage typeMailMessage `json:"mail_message"`
+	}
+
+	reqBody := reqBodyType{
+		MailMessage: mailMessage,
+	}
+
+	reqBodyMarshalled, err := json.Marshal(reqBody)
+	if err != nil {
+		logger.Errorln("Failed to queue outbound mail message, marshal request body error", err)
+		return err
+	}
+
+	req, err := http.NewRequest("POST", reqURL, bytes.NewBuffer(reqBodyMarshalled))
+	if err != nil {
+		logger.Errorln("Failed to queue outbound mail message, create request error", err)
+		return err
+	}
+	req.Header.Set(headerContentType, applicationJSON)
+	req.Header.Set(headerAuth, config.API.Secret)
+
+	res, err := apiClient.Do(req)
+	if err != nil {
+		logger.Errorln("Failed to queue outbound mail message, do request error", err)
+		return err
+	}
+	defer res.Body.Close()
+
+	type resBodyType struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error"`
+	}
+	var b resBodyType
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		logger.Errorln("Failed to queue outbound mail message, read response body error", err)
+		return err
+	}
+
+	if err := json.Unmarshal(body, &b); err != nil {
+		logger.Errorln("Failed to queue outbound mail message, unmarshal response body error", err)
+		return err
+	}
+
+	if !b.Success {
+		err := errors.New(b.Error)
+		logger.Errorln("Failed to queue outbound mail message, api returned error", b.Error)
+		return err
+	}
+
+	return nil
+}
+
+// apiRequestCredentialsVerify verifies the credential of an SMTP
+// AUTH command and returns the inbox of the credential.
+func apiRequestCredentialsVerify(username, password string) (typeMailInbox, bool, error) {
+	logger.Printf("Api request credentials verify, %s", username)
+
+	reqURL := fmt.Sprintf("%s/smtp/credentials/verify",
+		config.API.BaseURL,
+	)
+
+	type reqBodyType struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+
+	reqBody := reqBodyType{
+		Username: username,
+		Password: password,
+	}
+
+	reqBodyMarshalled, err := json.Marshal(reqBody)
+	if err != nil {
+		logger.Errorln("Failed to request verify credentials, marshal request body error", err)
+		return typeMailInbox{}, false, err
+	}
+
+	req, err := http.NewRequest("POST", reqURL, bytes.NewBuffer(reqBodyMarshalled))
+	if err != nil {
+		logger.Errorln("Failed to request verify credentials, create request error", err)
+		return typeMailInbox{}, false, err
+	}
+	req.Header.Set(headerContentType, applicationJSON)
+	req.Header.Set(headerAuth, config.API.Secret)
+
+	res, err := apiClient.Do(req)
+	if err != nil {
+		logger.Errorln("Failed to request verify credentials, do request error", err)
+		return typeMailInbox{}, false, err
+	}
+	defer res.Body.Close()
+
+	type resBodyType struct {
+		Success   bool          `json:"success"`
+		Verified  bool          `json:"verified"`
+		Error     string        `json:"error"`
+		MailInbox typeMailInbox `json:"mail_inbox"`
+	}
+	var b resBodyType
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		logger.Errorln("Failed to request verify credentials, read response body error", err)
+		return typeMailInbox{}, false, err
+	}
+
+	if err := json.Unmarshal(body, &b); err != nil {
+		logger.Errorln("Failed to request verify credentials, unmarshal response body error", err)
+		return typeMailInbox{}, false, err
+	}
+
+	if !b.Success {
+		err := errors.New(b.Error)
+		logger.Errorln("Failed to request verify credentials, api returned error", b.Error)
+		return typeMailInbox{}, false, err
+	}
+
+	// Credential is not valid.
+	if !b.Verified {
+		return typeMailInbox{}, false, nil
+	}
+
+	return b.MailInbox, true, nil
+}
+
+// apiRequestRatelimitViolations reports the rate limit
+// violations of the sessions to the API.
+func apiRequestRatelimitViolations(violations []typeMailRatelimitViolation) error {
+	logger.Printf("Api send rate limit violations")
+
+	reqURL := fmt.Sprintf("%s/smtp/ratelimits/violations",
+		config.API.BaseURL,
+	)
+
+	type reqBodyType struct {
+		Violations []typeMailRatelimitViolation `json:"violations"`
+	}
+
+	reqBody := reqBodyType{
+		Violations: violations,
+	}
+
+	reqBodyMarshalled, err := json.Marshal(reqBody)
+	if err != nil {
+		logger.Errorln("Failed to send rate limit violations, marshal request body error", err)
+		return err
+	}
+
+	req, err := http.NewRequest("POST", reqURL, bytes.NewBuffer(reqBodyMarshalled))
+	if err != nil {
+		logger.Errorln("Failed to send rate limit violations, create request error", err)
+		return err
+	}
+	req.Header.Set(headerContentType, applicationJSON)
+	req.Header.Set(headerAuth, config.API.Secret)
+
+	res, err := apiClient.Do(req)
+	if err != nil {
+		logger.Errorln("Failed to send rate limit violations, do request error", err)
+		return err
+	}
+	defer res.Body.Close()
+
+	type resBodyType struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error"`
+	}
+	var b resBodyType
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		logger.Errorln("Failed to send rate limit violations, read response body error", err)
+		return err
+	}
+
+	if err := json.Unmarshal(body, &b); err != nil {
+		logger.Errorln("Failed to send rate limit violations, unmarshal response body error", err)
+		return err
+	}
+
+	if !b.Success {
+		err := errors.New(b.Error)
+		logger.Errorln("Failed to send rate limit violations, api returned error", b.Error)
+		return err
+	}
+
+	return nil
+}
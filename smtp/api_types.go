@@ -5,6 +5,10 @@ import "time"
 var (
 	dispositionAttachment = "attachment"
 	dispositionInline     = "inline"
+
+	domainStatusDelivered = "delivered"
+	domainStatusDeferred  = "deferred"
+	domainStatusFailed    = "failed"
 )
 
 // typeMailUpstream is the upstream associated with
@@ -25,14 +29,43 @@ type typeMailInbox struct {
 	Address     string `json:"address"`
 }
 
+// typeMailDKIM is the dkim signing key of the mail, private key is
+// PEM encoded. It's requested separately and never cached in redis.
+type typeMailDKIM struct {
+	Selector   string `json:"selector"`
+	PrivateKey string `json:"private_key"`
+}
+
 // typeMail is the main mail struct.
 type typeMail struct {
-	ID        uint               `json:"id"`
-	Host      string             `json:"host"`
-	Relay     bool               `json:"relay"`
-	Version   int                `json:"version,omitempty"`
-	Inboxes   []typeMailInbox    `json:"mail_inboxes,omitempty"`
-	Upstreams []typeMailUpstream `json:"mail_upstreams,omitempty"`
+	ID           uint               `json:"id"`
+	Host         string             `json:"host"`
+	Relay        bool               `json:"relay"`
+	SPFPolicy    string             `json:"spf_policy,omitempty"`
+	Greylisting  bool               `json:"greylisting,omitempty"`
+	DNSBLPolicy  string             `json:"dnsbl_policy,omitempty"`
+	Filters      []typeMailFilter   `json:"mail_filters,omitempty"`
+	DKIMSelector string             `json:"dkim_selector,omitempty"`
+	Version      int                `json:"version,omitempty"`
+	Inboxes      []typeMailInbox    `json:"mail_inboxes,omitempty"`
+	Upstreams    []typeMailUpstream `json:"mail_upstreams,omitempty"`
+}
+
+// typeMailFilter is a message filter of a mail, the fields of
+// the filter type are set, ie. max bytes of the size filters.
+type typeMailFilter struct {
+	Type    string `json:"type" toml:"type"`
+	Action  string `json:"action" toml:"action"`
+	Code    int    `json:"code,omitempty" toml:"code"`
+	Message string `json:"message,omitempty" toml:"message"`
+
+	MaxBytes int64    `json:"max_bytes,omitempty" toml:"max_bytes"`
+	Senders  []string `json:"senders,omitempty" toml:"senders"`
+	Header   string   `json:"header,omitempty" toml:"header"`
+	Pattern  string   `json:"pattern,omitempty" toml:"pattern"`
+
+	Tag           string `json:"tag,omitempty" toml:"tag"`
+	SubjectPrefix string `json:"subject_prefix,omitempty" toml:"subject_prefix"`
 }
 
 // Message related structs.
@@ -65,19 +98,69 @@ type typeMailMessageFile struct {
 	URL           string `json:"url"`
 }
 
+// typeMailMessageDKIM is the dkim signature verification
+// result of a mail message.
+type typeMailMessageDKIM struct {
+	Domain    string `json:"domain"`
+	Selector  string `json:"selector"`
+	Algorithm string `json:"algorithm"`
+	Result    string `json:"result"`
+	Reason    string `json:"reason"`
+}
+
+// typeMailMessageSpamRule is a spam rule which matched
+// the mail message with its score.
+type typeMailMessageSpamRule struct {
+	Name  string  `json:"name"`
+	Score float64 `json:"score"`
+}
+
+// typeMailMessageHeader is a header field of a mail message,
+// value is unfolded but not decoded.
+type typeMailMessageHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// typeMailMessageDelivery is an inbox the message is delivered to
+// with the envelope recipients of the inbox, so an inbox doesn't see
+// the recipients of the other inboxes.
+type typeMailMessageDelivery struct {
+	InboxID    uint     `json:"inbox_id"`
+	EnvelopeTo []string `json:"envelope_to"`
+}
+
 // MailMessage is the main mail message struct
 // used by API mail message.
 type typeMailMessage struct {
-	ID      uint `json:"id,omitempty"`
-	InboxID uint `json:"inbox_id,omitempty"`
+	ID         uint                      `json:"id,omitempty"`
+	InboxID    uint                      `json:"inbox_id,omitempty"`
+	Deliveries []typeMailMessageDelivery `json:"deliveries,omitempty"`
+	LeaseToken string                    `json:"lease_token,omitempty"`
+
+	// Outbound messages are bounced to the sender when
+	// they are not delivered before they expire.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
 
 	MessageID   string `json:"message_id"`
 	InReplyToID string `json:"in_reply_to_id"`
 
-	From typeMailMessageRelation   `json:"from"`
-	To   []typeMailMessageRelation `json:"to"`
-	Cc   []typeMailMessageRelation `json:"cc"`
-	Bcc  []typeMailMessageRelation `json:"bcc"`
+	// StorageKey is the S3 prefix of the message data, message
+	// ids are set by the senders so they are not used as the key.
+	StorageKey string `json:"storage_key"`
+
+	From    typeMailMessageRelation   `json:"from"`
+	ReplyTo typeMailMessageRelation   `json:"reply_to"`
+	To      []typeMailMessageRelation `json:"to"`
+	Cc      []typeMailMessageRelation `json:"cc"`
+	Bcc     []typeMailMessageRelation `json:"bcc"`
+
+	// Envelope is the SMTP session the message is received
+	// with, envelope recipients are sent with the deliveries.
+	EnvelopeFrom string `json:"envelope_from,omitempty"`
+	RemoteIP     string `json:"remote_ip,omitempty"`
+	Helo         string `json:"helo,omitempty"`
+	SessionUUID  string `json:"session_uuid,omitempty"`
 
 	Date    time.Time `json:"date"`
 	Subject string    `json:"subject"`
@@ -87,5 +170,71 @@ type typeMailMessage struct {
 	IsDraft     bool `json:"is_draft"`
 	IsDelivered bool `json:"is_delivered"`
 
-	Files []typeMailMessageFile `json:"mail_message_files"`
+	// Quarantine is the reason an inbound message is
+	// quarantined by the filters of the mail.
+	Quarantine string `json:"quarantine,omitempty"`
+
+	SpamScore float64                   `json:"spam_score"`
+	SpamRules []typeMailMessageSpamRule `json:"mail_message_spam_rules,omitempty"`
+
+	TLSVersion     string `json:"tls_version,omitempty"`
+	TLSCipherSuite string `json:"tls_cipher_suite,omitempty"`
+
+	SPFResult string `json:"spf_result,omitempty"`
+	SPFDomain string `json:"spf_domain,omitempty"`
+
+	DMARCResult      string `json:"dmarc_result,omitempty"`
+	DMARCDomain      string `json:"dmarc_domain,omitempty"`
+	DMARCPolicy      string `json:"dmarc_policy,omitempty"`
+	DMARCDisposition string `json:"dmarc_disposition,omitempty"`
+
+	Files   []typeMailMessageFile   `json:"mail_message_files"`
+	DKIMs   []typeMailMessageDKIM   `json:"mail_message_dkims"`
+	Headers []typeMailMessageHeader `json:"mail_message_headers,omitempty"`
+	Domains []typeMailMessageDomain `json:"mail_message_domains,omitempty"`
+}
+
+// typeMailMessageDomain is the outbound delivery state of a
+// recipient domain. Outbound messages from the API only have the
+// domains which are pending delivery. Results have the mx host and
+// the TLS outcome of the delivery attempt.
+type typeMailMessageDomain struct {
+	Domain   string `json:"domain"`
+	Status   string `json:"status"`
+	Response string `json:"response,omitempty"`
+
+	Attempts      int        `json:"attempts,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+
+	MX             string `json:"mx,omitempty"`
+	TLSPolicy      string `json:"tls_policy,omitempty"`
+	TLSVersion     string `json:"tls_version,omitempty"`
+	TLSCipherSuite string `json:"tls_cipher_suite,omitempty"`
+	TLSVerified    bool   `json:"tls_verified,omitempty"`
+	TLSError       string `json:"tls_error,omitempty"`
+}
+
+// typeMailMessageResult is the delivery result of an outbound
+// mail message claimed with the lease token.
+type typeMailMessageResult struct {
+	MailMessageID uint                    `json:"mail_message_id"`
+	LeaseToken    string                  `json:"lease_token"`
+	Delivered     bool                    `json:"delivered"`
+	Errors        []typeMailMessageError  `json:"mail_message_errors"`
+	Domains       []typeMailMessageDomain `json:"mail_message_domains"`
+}
+
+// typeMailRatelimitViolation is a rate limit violation of
+// a session delivering to the mail of the host.
+type typeMailRatelimitViolation struct {
+	Host      string    `json:"host"`
+	Scope     string    `json:"scope"`
+	Name      string    `json:"name"`
+	Key       string    `json:"key"`
+	Limit     int       `json:"limit"`
+	RemoteIP  string    `json:"remote_ip"`
+	Helo      string    `json:"helo"`
+	From      string    `json:"from"`
+	Recipient string    `json:"recipient,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
 }
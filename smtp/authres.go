@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// authResultsHeader returns the Authentication-Results header
+// (RFC 8601) with the spf, dkim and dmarc results of the message.
+func authResultsHeader(message smtpMessage) string {
+	var results []string
+
+	if spf := message.Session.SPF; spf.Result != "" {
+		results = append(results, fmt.Sprintf("spf=%s (%s) smtp.mailfrom=%s",
+			spf.Result, authResultsComment(spf.Reason), authResultsValue(message.Session.From),
+		))
+	}
+
+	for _, dkim := range message.DKIM {
+		results = append(results, fmt.Sprintf("dkim=%s (%s) header.d=%s header.s=%s header.a=%s",
+			dkim.Result, authResultsComment(dkim.Reason),
+			authResultsValue(dkim.Domain), authResultsValue(dkim.Selector), authResultsValue(dkim.Algorithm),
+		))
+	}
+
+	if dmarc := message.DMARC; dmarc.Result != "" {
+		results = append(results, fmt.Sprintf("dmarc=%s (p=%s dis=%s) header.from=%s",
+			dmarc.Result, authResultsComment(dmarc.Policy), authResultsComment(dmarc.Disposition), authResultsValue(dmarc.Domain),
+		))
+	}
+
+	if len(results) == 0 {
+		return fmt.Sprintf("Authentication-Results: %s; none\r\n", config.Server.Domain)
+	}
+
+	return fmt.Sprintf("Authentication-Results: %s;\r\n\t%s\r\n",
+		config.Server.Domain,
+		strings.Join(results, ";\r\n\t"),
+	)
+}
+
+// authResultsComment removes the characters which can not
+// be used in a header comment.
+func authResultsComment(s string) string {
+	if s == "" {
+		return "none"
+	}
+
+	return strings.NewReplacer("(", "", ")", "", "\r", "", "\n", "").Replace(s)
+}
+
+// authResultsValue quotes a property value when it's not a token.
+func authResultsValue(s string) string {
+	if s == "" {
+		return `""`
+	}
+
+	if strings.ContainsAny(s, " \t\r\n\"();:,<>[]\\") {
+		return fmt.Sprintf("%q", s)
+	}
+
+	return s
+}
+
+// authResultsOpen opens the message data without the inbound
+// Authentication-Results fields which claim the authserv-id of the
+// server, so senders can't forge the results of the server (RFC 8601
+// section 5). Only the header section is read into memory.
+func authResultsOpen(data smtpData) (io.ReadCloser, error) {
+	f, err := smtpDataOpen(data)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReaderSize(f, smtpDataBufferSize)
+	fields, err := dkimReadHeaders(r)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	var header strings.Builder
+	for _, field := range fields {
+		if authResultsForged(field) {
+			continue
+		}
+		header.WriteString(field)
+	}
+	header.WriteString("\r\n")
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(strings.NewReader(header.String()), r), f}, nil
+}
+
+// authResultsForged returns true if the raw header field is an
+// Authentication-Results field with the authserv-id of the server.
+func authResultsForged(field string) bool {
+	if !strings.EqualFold(dkimHeaderName(field), "Authentication-Results") {
+		return false
+	}
+
+	value := authResultsUncomment(dkimHeaderValue(field))
+	id := strings.TrimSpace(value)
+	if i := strings.IndexAny(id, "; \t\r\n"); i >= 0 {
+		id = id[:i]
+	}
+
+	return strings.EqualFold(id, config.Server.Domain)
+}
+
+// authResultsUncomment removes the comments of a header value.
+func authResultsUncomment(value string) string {
+	var (
+		b     strings.Builder
+		depth int
+	)
+
+	for _, c := range value {
+		switch {
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case depth == 0:
+			b.WriteRune(c)
+		}
+	}
+
+	return b.String()
+}
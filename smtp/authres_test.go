@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestAuthResultsForged(t *testing.T) {
+	domain := config.Server.Domain
+	t.Cleanup(func() {
+		config.Server.Domain = domain
+	})
+	config.Server.Domain = "mx.example.com"
+
+	tests := []struct {
+		field  string
+		forged bool
+	}{
+		{"Authentication-Results: mx.example.com; spf=pass\r\n", true},
+		{"authentication-results:MX.Example.com;\r\n\tdkim=pass header.d=example.org\r\n", true},
+		{"Authentication-Results: (forged) mx.example.com (v1); none\r\n", true},
+		{"Authentication-Results: mx.example.com 1; none\r\n", true},
+		{"Authentication-Results: mx.example.org; spf=pass\r\n", false},
+		{"Authentication-Results: mx.example.com.evil; spf=pass\r\n", false},
+		{"X-Authentication-Results: mx.example.com; spf=pass\r\n", false},
+		{"Subject: mx.example.com; spf=pass\r\n", false},
+	}
+
+	for _, test := range tests {
+		if forged := authResultsForged(test.field); forged != test.forged {
+			t.Errorf("forged %t, want %t for %q", forged, test.forged, test.field)
+		}
+	}
+}
+
+// TestAuthResultsOpen strips the results which claim the authserv-id
+// of the server and keeps the results of the other servers.
+func TestAuthResultsOpen(t *testing.T) {
+	domain := config.Server.Domain
+	t.Cleanup(func() {
+		config.Server.Domain = domain
+	})
+	config.Server.Domain = "mx.example.com"
+
+	raw := "Authentication-Results: mx.example.com;\r\n" +
+		"\tdmarc=pass header.from=example.org\r\n" +
+		"Authentication-Results: relay.example.org; spf=pass\r\n" +
+		"From: sender@example.org\r\n" +
+		"Subject: forged\r\n" +
+		"\r\n" +
+		"Authentication-Results: mx.example.com; body is kept\r\n"
+
+	data, err := smtpDataWrite(bytes.NewReader([]byte(raw)))
+	if err != nil {
+		t.Fatalf("write data: %v", err)
+	}
+	defer smtpDataRemove(data)
+
+	f, err := authResultsOpen(data)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.Close()
+
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	want := "Authentication-Results: relay.example.org; spf=pass\r\n" +
+		"From: sender@example.org\r\n" +
+		"Subject: forged\r\n" +
+		"\r\n" +
+		"Authentication-Results: mx.example.com; body is kept\r\n"
+
+	if string(got) != want {
+		t.Fatalf("data %q, want %q", got, want)
+	}
+
+	headers, err := messageHeaders("Authentication-Results: mx.example.com; none\r\n", data)
+	if err != nil {
+		t.Fatalf("headers: %v", err)
+	}
+
+	if len(headers) != 4 || headers[0].Value != "mx.example.com; none" || headers[1].Value != "relay.example.org; spf=pass" {
+		t.Fatalf("headers %+v", headers)
+	}
+}
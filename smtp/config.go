@@ -11,22 +11,117 @@ import (
 
 type tomlConfig struct {
 	Server struct {
-		Host              string `toml:"host"`
-		Port              int    `toml:"port"`
-		Domain            string `toml:"domain"`
-		TimeoutRead       int    `toml:"timeout_read"`
-		TimeoutWrite      int    `toml:"timeout_write"`
-		MaxMessageBytes   int    `toml:"max_message_bytes"`
-		MaxRecipients     int    `toml:"max_recipients"`
-		AllowInsecureAuth bool   `toml:"allow_insecure_auth"`
-		FirewallOnly      bool   `toml:"firewall_only"`
+		Host             string `toml:"host"`
+		Port             int    `toml:"port"`
+		Domain           string `toml:"domain"`
+		TimeoutRead      int    `toml:"timeout_read"`
+		TimeoutWrite     int    `toml:"timeout_write"`
+		MaxMessageBytes  int    `toml:"max_message_bytes"`
+		MaxRecipients    int    `toml:"max_recipients"`
+		ParseConcurrency int    `toml:"parse_concurrency"`
+		FirewallOnly     bool   `toml:"firewall_only"`
+
+		TLS struct {
+			Status       bool     `toml:"status"`
+			Crt          string   `toml:"crt"`
+			Key          string   `toml:"key"`
+			MinVersion   string   `toml:"min_version"`
+			Ciphers      []string `toml:"ciphers"`
+			ImplicitPort int      `toml:"implicit_port"`
+		} `toml:"tls"`
+
+		Submission struct {
+			Status bool `toml:"status"`
+			Port   int  `toml:"port"`
+		} `toml:"submission"`
+
+		LMTP struct {
+			Status bool   `toml:"status"`
+			Path   string `toml:"path"`
+		} `toml:"lmtp"`
 	} `toml:"server"`
 
+	DNS struct {
+		Timeout int    `toml:"timeout"`
+		Zone    string `toml:"zone"`
+	} `toml:"dns"`
+
+	SPF struct {
+		Status bool   `toml:"status"`
+		Policy string `toml:"policy"`
+	} `toml:"spf"`
+
+	DKIM struct {
+		Status bool `toml:"status"`
+	} `toml:"dkim"`
+
+	DMARC struct {
+		Status bool `toml:"status"`
+	} `toml:"dmarc"`
+
+	Greylist struct {
+		Status       bool     `toml:"status"`
+		Delay        int      `toml:"delay"`
+		RetryWindow  int      `toml:"retry_window"`
+		WhitelistTTL int      `toml:"whitelist_ttl"`
+		Allowlist    []string `toml:"allowlist"`
+	} `toml:"greylist"`
+
+	DNSBL struct {
+		Status       bool                  `toml:"status"`
+		Zone         string                `toml:"zone"`
+		Score        float64               `toml:"score"`
+		ConnectScore float64               `toml:"connect_score"`
+		CacheTTL     int                   `toml:"cache_ttl"`
+		Lists        []tomlConfigDNSBLList `toml:"lists"`
+	} `toml:"dnsbl"`
+
+	Ratelimit struct {
+		Status      bool                 `toml:"status"`
+		Window      int                  `toml:"window"`
+		ReportEvery int                  `toml:"report_every"`
+		IP          tomlConfigRatelimits `toml:"ip"`
+		Network     tomlConfigRatelimits `toml:"network"`
+		Sender      tomlConfigRatelimits `toml:"sender"`
+		Inbox       tomlConfigRatelimits `toml:"inbox"`
+	} `toml:"ratelimit"`
+
+	Filters []tomlConfigFilter `toml:"filters"`
+
+	Spam struct {
+		Status     bool               `toml:"status"`
+		Rules      map[string]float64 `toml:"rules"`
+		Shorteners []string           `toml:"shorteners"`
+		Bayes      struct {
+			Status      bool  `toml:"status"`
+			MinMessages int64 `toml:"min_messages"`
+		} `toml:"bayes"`
+	} `toml:"spam"`
+
 	Mails struct {
 		RefreshEvery int `toml:"refresh_every"`
 		TTL          int `toml:"ttl"`
 	} `toml:"mails"`
 
+	Spool struct {
+		Path       string `toml:"path"`
+		RetryEvery int    `toml:"retry_every"`
+		BackoffMin int    `toml:"backoff_min"`
+		BackoffMax int    `toml:"backoff_max"`
+		RelayDays  int    `toml:"relay_days"`
+		InboxDays  int    `toml:"inbox_days"`
+	} `toml:"spool"`
+
+	Outbound struct {
+		Port    int  `toml:"port"`
+		Timeout int  `toml:"timeout"`
+		MTASTS  bool `toml:"mta_sts"`
+		DANE    bool `toml:"dane"`
+
+		BackoffMin int `toml:"backoff_min"`
+		BackoffMax int `toml:"backoff_max"`
+	} `toml:"outbound"`
+
 	Messages struct {
 		OutboundEvery int `toml:"outbound_every"`
 	} `toml:"messages"`
@@ -65,6 +160,30 @@ type tomlConfig struct {
 	} `toml:"logger"`
 }
 
+// tomlConfigRatelimits are the limits of a rate limit
+// scope in a window, limits which are 0 are not enforced.
+type tomlConfigRatelimits struct {
+	Connections int `toml:"connections"`
+	Mails       int `toml:"mails"`
+	Recipients  int `toml:"recipients"`
+	Bytes       int `toml:"bytes"`
+}
+
+// tomlConfigDNSBLList is a dns blocklist, the weight of the list is
+// used for any return code unless the weights of the codes are set.
+type tomlConfigDNSBLList struct {
+	Name   string             `toml:"name"`
+	Weight float64            `toml:"weight"`
+	Codes  map[string]float64 `toml:"codes"`
+}
+
+// tomlConfigFilter is a message filter of the mail of the host,
+// filters of the "*" host apply to all of the mails.
+type tomlConfigFilter struct {
+	Host string `toml:"host"`
+	typeMailFilter
+}
+
 var (
 	config     tomlConfig
 	configPath string
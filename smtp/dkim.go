@@ -0,0 +1,692 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DKIM (RFC 6376) signature verification of inbound messages.
+// Supported algorithms are rsa-sha256 and ed25519-sha256 (RFC 8463).
+
+const (
+	dkimResultPass      = "pass"
+	dkimResultFail      = "fail"
+	dkimResultNeutral   = "neutral"
+	dkimResultTempError = "temperror"
+	dkimResultPermError = "permerror"
+
+	dkimHeaderSignature = "DKIM-Signature"
+
+	dkimAlgorithmRSASHA256     = "rsa-sha256"
+	dkimAlgorithmEd25519SHA256 = "ed25519-sha256"
+
+	dkimCanonicalizationSimple  = "simple"
+	dkimCanonicalizationRelaxed = "relaxed"
+)
+
+var (
+	dkimSignatureValueRegexp = regexp.MustCompile(`([;:]\s*b\s*=)[^;]*`)
+	dkimWSPRegexp            = regexp.MustCompile(`[ \t]+`)
+)
+
+// dkimResult is the verification result of a single signature.
+type dkimResult struct {
+	Domain    string
+	Selector  string
+	Algorithm string
+	Result    string
+	Reason    string
+}
+
+// dkimSignature is a parsed DKIM-Signature header.
+type dkimSignature struct {
+	header string
+	tags   map[string]string
+
+	algorithm string
+	domain    string
+	selector  string
+	headers   []string
+	length    int64
+
+	canonHeader string
+	canonBody   string
+
+	bodyHash  []byte
+	signature []byte
+}
+
+// dkimVerify verifies every DKIM-Signature header of the message.
+// The body is streamed once and hashed for all of the signatures.
+func dkimVerify(r io.Reader) ([]dkimResult, error) {
+	br := bufio.NewReader(r)
+
+	headers, err := dkimReadHeaders(br)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		results []dkimResult
+		sigs    []*dkimSignature
+		hashes  []*dkimBodyHash
+		writers []io.Writer
+	)
+
+	for _, header := range headers {
+		if !strings.EqualFold(dkimHeaderName(header), dkimHeaderSignature) {
+			continue
+		}
+
+		sig, result, ok := dkimVerifyPrepare(header)
+		results = append(results, result)
+		if !ok {
+			sigs = append(sigs, nil)
+			hashes = append(hashes, nil)
+			continue
+		}
+
+		hash := dkimBodyHashNew(sig.canonBody, sig.length)
+		sigs = append(sigs, &sig)
+		hashes = append(hashes, hash)
+		writers = append(writers, hash.canon)
+	}
+
+	if len(writers) > 0 {
+		if _, err := io.Copy(io.MultiWriter(writers...), br); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, sig := range sigs {
+		if sig == nil {
+			continue
+		}
+
+		results[i] = dkimVerifySignature(*sig, results[i], headers, hashes[i])
+	}
+
+	return results, nil
+}
+
+// dkimVerifyPrepare parses the signature, false is returned with
+// the result if the signature can't be verified.
+func dkimVerifyPrepare(header string) (dkimSignature, dkimResult, bool) {
+	sig, err := dkimSignatureParse(header)
+	if err != nil {
+		return sig, dkimResult{
+			Domain:    sig.domain,
+			Selector:  sig.selector,
+			Algorithm: sig.algorithm,
+			Result:    dkimResultPermError,
+			Reason:    err.Error(),
+		}, false
+	}
+
+	result := dkimResult{
+		Domain:    sig.domain,
+		Selector:  sig.selector,
+		Algorithm: sig.algorithm,
+	}
+
+	if x, ok := sig.tags["x"]; ok {
+		expires, err := strconv.ParseInt(x, 10, 64)
+		if err == nil && time.Now().Unix() > expires {
+			result.Result = dkimResultFail
+			result.Reason = "signature expired"
+			return sig, result, false
+		}
+	}
+
+	return sig, result, true
+}
+
+func dkimVerifySignature(sig dkimSignature, result dkimResult, headers []string, hash *dkimBodyHash) dkimResult {
+	key, res, err := dkimKeyLookup(sig)
+	if err != nil {
+		result.Result = res
+		result.Reason = err.Error()
+		return result
+	}
+
+	// Compare the body hash first, if the body hash
+	// doesn't match the signature is not checked.
+	hash.canon.Close()
+	if sig.length >= 0 && sig.length > hash.canon.n {
+		result.Result = dkimResultPermError
+		result.Reason = "body length tag is longer than the body"
+		return result
+	}
+
+	if !bytes.Equal(hash.hash.Sum(nil), sig.bodyHash) {
+		result.Result = dkimResultFail
+		result.Reason = "body hash did not verify"
+		return result
+	}
+
+	headerHash := sha256.Sum256(dkimSignedHeaders(sig, headers))
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, headerHash[:], sig.signature)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, headerHash[:], sig.signature) {
+			err = fmt.Errorf("ed25519 verification error")
+		}
+	}
+
+	if err != nil {
+		result.Result = dkimResultFail
+		result.Reason = "signature did not verify"
+		return result
+	}
+
+	result.Result = dkimResultPass
+	result.Reason = "signature verified"
+	return result
+}
+
+// dkimSignatureParse parses and validates the tags of a DKIM-Signature.
+func dkimSignatureParse(header string) (dkimSignature, error) {
+	sig := dkimSignature{
+		header: header,
+		tags:   dkimTags(dkimHeaderValue(header)),
+		length: -1,
+	}
+
+	sig.algorithm = strings.ToLower(sig.tags["a"])
+	sig.domain = strings.ToLower(sig.tags["d"])
+	sig.selector = sig.tags["s"]
+
+	for _, tag := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := sig.tags[tag]; !ok {
+			return sig, fmt.Errorf("signature is missing required tag %s", tag)
+		}
+	}
+
+	if sig.tags["v"] != "1" {
+		return sig, fmt.Errorf("signature version %s is not supported", sig.tags["v"])
+	}
+
+	if sig.algorithm != dkimAlgorithmRSASHA256 && sig.algorithm != dkimAlgorithmEd25519SHA256 {
+		return sig, fmt.Errorf("signature algorithm %s is not supported", sig.algorithm)
+	}
+
+	fromSigned := false
+	for _, h := range strings.Split(sig.tags["h"], ":") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		if strings.EqualFold(h, "From") {
+			fromSigned = true
+		}
+		sig.headers = append(sig.headers, h)
+	}
+
+	if !fromSigned {
+		return sig, fmt.Errorf("from header is not signed")
+	}
+
+	if i, ok := sig.tags["i"]; ok {
+		iDomain := strings.ToLower(i[strings.LastIndex(i, "@")+1:])
+		if iDomain != sig.domain && !strings.HasSuffix(iDomain, "."+sig.domain) {
+			return sig, fmt.Errorf("identity %s is not in the signing domain", i)
+		}
+	}
+
+	sig.canonHeader, sig.canonBody = dkimCanonicalizationSimple, dkimCanonicalizationSimple
+	if c, ok := sig.tags["c"]; ok {
+		parts := strings.SplitN(strings.ToLower(c), "/", 2)
+		sig.canonHeader = parts[0]
+		if len(parts) == 2 {
+			sig.canonBody = parts[1]
+		}
+	}
+
+	for _, canon := range []string{sig.canonHeader, sig.canonBody} {
+		if canon != dkimCanonicalizationSimple && canon != dkimCanonicalizationRelaxed {
+			return sig, fmt.Errorf("canonicalization %s is not supported", canon)
+		}
+	}
+
+	if l, ok := sig.tags["l"]; ok {
+		length, err := strconv.ParseInt(l, 10, 64)
+		if err != nil || length < 0 {
+			return sig, fmt.Errorf("body length tag format error")
+		}
+		sig.length = length
+	}
+
+	var err error
+	if sig.bodyHash, err = base64.StdEncoding.DecodeString(dkimStripWSP(sig.tags["bh"])); err != nil {
+		return sig, fmt.Errorf("body hash format error")
+	}
+
+	if sig.signature, err = base64.StdEncoding.DecodeString(dkimStripWSP(sig.tags["b"])); err != nil {
+		return sig, fmt.Errorf("signature format error")
+	}
+
+	return sig, nil
+}
+
+// dkimKeyLookup finds the public key of the signature in dns. The
+// result is returned with the error when the key can not be used.
+func dkimKeyLookup(sig dkimSignature) (crypto.PublicKey, string, error) {
+	ctx, cancel := dnsContext()
+	defer cancel()
+
+	name := fmt.Sprintf("%s._domainkey.%s", sig.selector, sig.domain)
+	txts, err := resolver.LookupTXT(ctx, name)
+	if err != nil {
+		if err == dnsErrNotFound {
+			return nil, dkimResultPermError, fmt.Errorf("no key for signature at %s", name)
+		}
+		return nil, dkimResultTempError, fmt.Errorf("key lookup for %s failed: %v", name, err)
+	}
+
+	if len(txts) == 0 {
+		return nil, dkimResultPermError, fmt.Errorf("no key for signature at %s", name)
+	}
+
+	tags := dkimTags(strings.Join(txts, ""))
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, dkimResultPermError, fmt.Errorf("key version %s is not supported", v)
+	}
+
+	p := dkimStripWSP(tags["p"])
+	if p == "" {
+		return nil, dkimResultPermError, fmt.Errorf("key is revoked")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, dkimResultPermError, fmt.Errorf("key format error")
+	}
+
+	keyType := strings.ToLower(tags["k"])
+	if keyType == "" {
+		keyType = "rsa"
+	}
+
+	if !strings.HasPrefix(sig.algorithm, keyType+"-") {
+		return nil, dkimResultPermError, fmt.Errorf("key type %s does not match algorithm %s", keyType, sig.algorithm)
+	}
+
+	switch keyType {
+	case "rsa":
+		pub, err := x509.ParsePKIXPublicKey(data)
+		if err != nil {
+			// Some keys are published as PKCS1 instead of PKIX.
+			if pub, err = x509.ParsePKCS1PublicKey(data); err != nil {
+				return nil, dkimResultPermError, fmt.Errorf("rsa key format error")
+			}
+		}
+
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, dkimResultPermError, fmt.Errorf("key is not an rsa key")
+		}
+
+		if rsaPub.N.BitLen() < 1024 {
+			return nil, dkimResultPermError, fmt.Errorf("rsa key is shorter than 1024 bits")
+		}
+
+		return rsaPub, "", nil
+
+	case "ed25519":
+		if len(data) != ed25519.PublicKeySize {
+			return nil, dkimResultPermError, fmt.Errorf("ed25519 key format error")
+		}
+
+		return ed25519.PublicKey(data), "", nil
+	}
+
+	return nil, dkimResultPermError, fmt.Errorf("key type %s is not supported", keyType)
+}
+
+// dkimSignedHeaders returns the canonicalized header data of the
+// signature. Header instances are used from the bottom up and the
+// signature itself is added with an empty b tag.
+func dkimSignedHeaders(sig dkimSignature, headers []string) []byte {
+	var (
+		b    bytes.Buffer
+		used = make(map[string]int)
+	)
+
+	for _, name := range sig.headers {
+		key := strings.ToLower(name)
+
+		seen := 0
+		for i := len(headers) - 1; i >= 0; i-- {
+			if strings.ToLower(dkimHeaderName(headers[i])) != key {
+				continue
+			}
+
+			if seen == used[key] {
+				b.WriteString(dkimCanonHeader(headers[i], sig.canonHeader))
+				break
+			}
+			seen++
+		}
+		used[key]++
+	}
+
+	signature := dkimSignatureValueRegexp.ReplaceAllString(sig.header, "${1}")
+	signature = dkimCanonHeader(signature, sig.canonHeader)
+	b.WriteString(strings.TrimSuffix(signature, "\r\n"))
+
+	return b.Bytes()
+}
+
+// dkimSplit splits the raw message into header fields and the body.
+// Header fields keep the folding and the trailing CRLF.
+func dkimSplit(raw []byte) ([]string, []byte) {
+	raw = dkimCRLF(raw)
+
+	var (
+		headers []string
+		body    []byte
+	)
+
+	for len(raw) > 0 {
+		end := bytes.Index(raw, []byte("\r\n"))
+		if end < 0 {
+			headers = append(headers, string(raw)+"\r\n")
+			raw = nil
+			break
+		}
+
+		line := string(raw[:end+2])
+		raw = raw[end+2:]
+
+		if line == "\r\n" {
+			body = raw
+			break
+		}
+
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1] += line
+			continue
+		}
+
+		headers = append(headers, line)
+	}
+
+	return headers, body
+}
+
+// dkimCRLF converts bare line feeds to CRLF.
+func dkimCRLF(raw []byte) []byte {
+	if !bytes.Contains(raw, []byte("\n")) || bytes.Count(raw, []byte("\n")) == bytes.Count(raw, []byte("\r\n")) {
+		return raw
+	}
+
+	raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(raw, []byte("\n"), []byte("\r\n"))
+}
+
+// dkimCanonHeader canonicalizes a header field.
+func dkimCanonHeader(header, canon string) string {
+	if canon == dkimCanonicalizationSimple {
+		return header
+	}
+
+	name := strings.ToLower(strings.TrimSpace(dkimHeaderName(header)))
+	value := dkimHeaderValue(header)
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = dkimWSPRegexp.ReplaceAllString(value, " ")
+	value = strings.TrimSpace(value)
+
+	return name + ":" + value + "\r\n"
+}
+
+// dkimCanonBody canonicalizes the message body.
+func dkimCanonBody(body []byte, canon string) []byte {
+	var b bytes.Buffer
+
+	c := &dkimBodyCanon{canon: canon, w: &b}
+	c.Write(body)
+	c.Close()
+
+	return b.Bytes()
+}
+
+// dkimBodyCanon is a streaming body canonicalizer, the canonical body
+// is written to w. Empty lines are held back until a non empty line
+// is written since the trailing empty lines are removed.
+type dkimBodyCanon struct {
+	canon string
+	w     io.Writer
+	n     int64
+
+	buf    []byte
+	empty  int
+	inLine bool
+	wsp    bool
+	cr     bool
+	closed bool
+}
+
+// Write canonicalizes p, bare line feeds are line endings.
+func (c *dkimBodyCanon) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if c.cr {
+			c.cr = false
+			if b == '\n' {
+				c.eol()
+				continue
+			}
+			c.content('\r')
+		}
+
+		switch b {
+		case '\r':
+			c.cr = true
+		case '\n':
+			c.eol()
+		case ' ', '\t':
+			if c.canon == dkimCanonicalizationRelaxed {
+				c.wsp = true
+			} else {
+				c.content(b)
+			}
+		default:
+			c.content(b)
+		}
+	}
+
+	return len(p), c.flush()
+}
+
+// Close ends the last line of the body. An empty body is a
+// single CRLF with simple canonicalization.
+func (c *dkimBodyCanon) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	if c.cr {
+		c.cr = false
+		c.content('\r')
+	}
+
+	if c.inLine {
+		c.eol()
+	}
+
+	if c.n == 0 && len(c.buf) == 0 && c.canon == dkimCanonicalizationSimple {
+		c.buf = append(c.buf, '\r', '\n')
+	}
+
+	return c.flush()
+}
+
+func (c *dkimBodyCanon) content(b byte) {
+	for ; c.empty > 0; c.empty-- {
+		c.buf = append(c.buf, '\r', '\n')
+	}
+
+	if c.wsp {
+		c.wsp = false
+		c.buf = append(c.buf, ' ')
+	}
+
+	c.buf = append(c.buf, b)
+	c.inLine = true
+}
+
+func (c *dkimBodyCanon) eol() {
+	// Trailing whitespace of a line is removed with
+	// relaxed canonicalization.
+	c.wsp = false
+
+	if !c.inLine {
+		c.empty++
+		return
+	}
+
+	c.buf = append(c.buf, '\r', '\n')
+	c.inLine = false
+}
+
+func (c *dkimBodyCanon) flush() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+
+	n, err := c.w.Write(c.buf)
+	c.n += int64(n)
+	c.buf = c.buf[:0]
+
+	return err
+}
+
+// dkimBodyHash is the body hash of a signature, only the first
+// length bytes of the canonical body are hashed if length is set.
+type dkimBodyHash struct {
+	canon *dkimBodyCanon
+	hash  hash.Hash
+}
+
+func dkimBodyHashNew(canon string, length int64) *dkimBodyHash {
+	h := sha256.New()
+
+	w := io.Writer(h)
+	if length >= 0 {
+		w = &dkimLimitWriter{w: h, n: length}
+	}
+
+	return &dkimBodyHash{
+		canon: &dkimBodyCanon{canon: canon, w: w},
+		hash:  h,
+	}
+}
+
+// dkimLimitWriter writes the first n bytes and discards the rest.
+type dkimLimitWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *dkimLimitWriter) Write(p []byte) (int, error) {
+	size := len(p)
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	l.n -= int64(len(p))
+
+	if _, err := l.w.Write(p); err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// dkimReadHeaders reads the header fields of the message up to the
+// empty line. Header fields keep the folding and end with CRLF.
+func dkimReadHeaders(r *bufio.Reader) ([]string, error) {
+	var headers []string
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		if line == "" && err == io.EOF {
+			return headers, nil
+		}
+
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if line == "" {
+			return headers, nil
+		}
+
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1] += line + "\r\n"
+		} else {
+			headers = append(headers, line+"\r\n")
+		}
+
+		if err == io.EOF {
+			return headers, nil
+		}
+	}
+}
+
+// dkimHeaderName returns the name of a raw header field.
+func dkimHeaderName(header string) string {
+	if i := strings.Index(header, ":"); i >= 0 {
+		return strings.TrimRight(header[:i], " \t")
+	}
+
+	return header
+}
+
+// dkimHeaderValue returns the value of a raw header field.
+func dkimHeaderValue(header string) string {
+	if i := strings.Index(header, ":"); i >= 0 {
+		return header[i+1:]
+	}
+
+	return ""
+}
+
+// dkimTags parses a tag list, ie. "v=1; a=rsa-sha256; d=example.com".
+func dkimTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(s, ";") {
+		eq := strings.Index(tag, "=")
+		if eq < 0 {
+			continue
+		}
+
+		name := strings.TrimSpace(tag[:eq])
+		value := strings.TrimSpace(strings.ReplaceAll(tag[eq+1:], "\r\n", ""))
+		if name != "" {
+			tags[name] = value
+		}
+	}
+
+	return tags
+}
+
+// dkimStripWSP removes all whitespace from a tag value.
+func dkimStripWSP(s string) string {
+	return strings.Join(strings.Fields(s), "")
+}
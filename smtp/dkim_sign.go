@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DKIM signing of outbound messages with the key of the sender's
+// mail. Messages are signed with relaxed/relaxed canonicalization.
+
+// dkimSignHeaders are the header fields signed when they
+// are present in the message.
+var dkimSignHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc",
+	"Message-Id", "In-Reply-To", "References",
+	"Mime-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// dkimSigners are the parsed signing keys of the mails. Private keys
+// are only kept in memory, the mails cached in redis have the selector.
+var (
+	dkimSigners      = map[string]dkimSignerCached{}
+	dkimSignersMutex = &sync.Mutex{}
+)
+
+// dkimSignerCached is a signing key with the mail version it was
+// requested for, keys are requested again when the mail changes.
+type dkimSignerCached struct {
+	version int
+	signer  *dkimSigner
+}
+
+// dkimSigner is the signing key of a domain.
+type dkimSigner struct {
+	domain    string
+	selector  string
+	algorithm string
+	key       crypto.Signer
+}
+
+// dkimSignerParse parses the PEM encoded private key of the domain,
+// PKCS #8 (rsa or ed25519) and PKCS #1 (rsa) keys are supported.
+func dkimSignerParse(domain, selector, keyPEM string) (*dkimSigner, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, errors.New("private key is not pem encoded")
+	}
+
+	var (
+		key interface{}
+		err error
+	)
+
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("private key format error: %v", err)
+	}
+
+	signer := &dkimSigner{
+		domain:   strings.ToLower(domain),
+		selector: selector,
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		signer.algorithm = dkimAlgorithmRSASHA256
+		signer.key = k
+	case ed25519.PrivateKey:
+		signer.algorithm = dkimAlgorithmEd25519SHA256
+		signer.key = k
+	default:
+		return nil, errors.New("private key type is not supported")
+	}
+
+	return signer, nil
+}
+
+// dkimSignerFind returns the signing key of the mail, the key is
+// requested from the API the first time and after the mail changes.
+func dkimSignerFind(mail typeMail) (*dkimSigner, bool, error) {
+	dkimSignersMutex.Lock()
+	cached, ok := dkimSigners[mail.Host]
+	dkimSignersMutex.Unlock()
+
+	if ok && cached.version == mail.Version && cached.signer.selector == mail.DKIMSelector {
+		return cached.signer, true, nil
+	}
+
+	key, found, err := apiRequestMailDKIM(mail.Host)
+	if err != nil || !found {
+		return nil, false, err
+	}
+
+	signer, err := dkimSignerParse(mail.Host, key.Selector, key.PrivateKey)
+	if err != nil {
+		return nil, false, err
+	}
+
+	dkimSignersMutex.Lock()
+	dkimSigners[mail.Host] = dkimSignerCached{
+		version: mail.Version,
+		signer:  signer,
+	}
+	dkimSignersMutex.Unlock()
+
+	return signer, true, nil
+}
+
+// dkimSign signs the raw message and returns it with the
+// DKIM-Signature header prepended.
+func dkimSign(raw []byte, signer *dkimSigner) ([]byte, error) {
+	raw = dkimCRLF(raw)
+	headers, body := dkimSplit(raw)
+
+	present := make(map[string]bool)
+	for _, header := range headers {
+		present[strings.ToLower(dkimHeaderName(header))] = true
+	}
+
+	if !present["from"] {
+		return nil, errors.New("message has no from header")
+	}
+
+	var signed []string
+	for _, name := range dkimSignHeaders {
+		if present[strings.ToLower(name)] {
+			signed = append(signed, name)
+		}
+	}
+
+	bodyHash := sha256.Sum256(dkimCanonBody(body, dkimCanonicalizationRelaxed))
+
+	value := fmt.Sprintf(" v=1; a=%s; c=%s/%s; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		signer.algorithm,
+		dkimCanonicalizationRelaxed, dkimCanonicalizationRelaxed,
+		signer.domain,
+		signer.selector,
+		time.Now().Unix(),
+		strings.Join(signed, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]),
+	)
+
+	sig := dkimSignature{
+		header:      dkimHeaderSignature + ":" + value + "\r\n",
+		headers:     signed,
+		canonHeader: dkimCanonicalizationRelaxed,
+	}
+
+	headerHash := sha256.Sum256(dkimSignedHeaders(sig, headers))
+
+	// Ed25519 signs the sha256 hash of the headers (RFC 8463).
+	opts := crypto.SignerOpts(crypto.SHA256)
+	if signer.algorithm == dkimAlgorithmEd25519SHA256 {
+		opts = crypto.Hash(0)
+	}
+
+	signature, err := signer.key.Sign(rand.Reader, headerHash[:], opts)
+	if err != nil {
+		return nil, fmt.Errorf("sign error: %v", err)
+	}
+
+	header := dkimHeaderSignature + ":" + value + dkimFold(base64.StdEncoding.EncodeToString(signature)) + "\r\n"
+	return append([]byte(header), raw...), nil
+}
+
+// dkimFold folds the base64 value into lines of 72 characters.
+func dkimFold(s string) string {
+	var lines []string
+	for len(s) > 72 {
+		lines = append(lines, s[:72])
+		s = s[72:]
+	}
+	lines = append(lines, s)
+
+	return strings.Join(lines, "\r\n\t")
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// DMARC (RFC 7489) evaluation of the From header domain using
+// the spf and dkim results of the message.
+
+const (
+	dmarcResultNone      = "none"
+	dmarcResultPass      = "pass"
+	dmarcResultFail      = "fail"
+	dmarcResultTempError = "temperror"
+	dmarcResultPermError = "permerror"
+
+	dmarcPolicyNone       = "none"
+	dmarcPolicyQuarantine = "quarantine"
+	dmarcPolicyReject     = "reject"
+
+	dmarcAlignmentRelaxed = "r"
+	dmarcAlignmentStrict  = "s"
+)
+
+// dmarcResult is the result of a dmarc evaluation. Policy is the
+// published policy and disposition is the policy after the
+// pct sampling is applied.
+type dmarcResult struct {
+	Result      string
+	Domain      string
+	Policy      string
+	Disposition string
+	Reason      string
+}
+
+// dmarcRecord is a parsed dmarc record.
+type dmarcRecord struct {
+	policy          string
+	subdomainPolicy string
+	alignSPF        string
+	alignDKIM       string
+	pct             int
+}
+
+// dmarcCheck evaluates the dmarc policy of the from domain.
+func dmarcCheck(from string, spf spfResult, dkims []dkimResult) dmarcResult {
+	domain := strings.ToLower(from[strings.LastIndex(from, "@")+1:])
+	result := dmarcResult{
+		Domain: domain,
+	}
+
+	if domain == "" {
+		result.Result = dmarcResultNone
+		result.Reason = "from header has no domain"
+		return result
+	}
+
+	orgDomain := dmarcOrgDomain(domain)
+
+	record, found, err := dmarcRecordLookup(domain)
+	if err == nil && !found && orgDomain != domain {
+		record, found, err = dmarcRecordLookup(orgDomain)
+
+		// Subdomain policy applies when the record
+		// is found on the organizational domain.
+		if found && record.subdomainPolicy != "" {
+			record.policy = record.subdomainPolicy
+		}
+	}
+
+	if err != nil {
+		result.Result = dmarcResultTempError
+		result.Reason = err.Error()
+		return result
+	}
+
+	if !found {
+		result.Result = dmarcResultNone
+		result.Reason = "no dmarc record"
+		return result
+	}
+
+	result.Policy = record.policy
+
+	aligned := false
+	if spf.Result == spfResultPass && dmarcAligned(domain, spf.Domain, record.alignSPF) {
+		aligned = true
+		result.Reason = fmt.Sprintf("spf aligned with %s", spf.Domain)
+	}
+
+	for _, dkim := range dkims {
+		if aligned {
+			break
+		}
+		if dkim.Result == dkimResultPass && dmarcAligned(domain, dkim.Domain, record.alignDKIM) {
+			aligned = true
+			result.Reason = fmt.Sprintf("dkim aligned with %s", dkim.Domain)
+		}
+	}
+
+	if aligned {
+		result.Result = dmarcResultPass
+		result.Disposition = dmarcPolicyNone
+		return result
+	}
+
+	result.Result = dmarcResultFail
+	result.Reason = "no aligned spf or dkim identifiers"
+	result.Disposition = record.policy
+
+	// Messages which are not sampled by pct get the next
+	// less strict policy (RFC 7489 section 6.6.4).
+	if record.pct < 100 && rand.Intn(100) >= record.pct {
+		if result.Disposition == dmarcPolicyReject {
+			result.Disposition = dmarcPolicyQuarantine
+		} else {
+			result.Disposition = dmarcPolicyNone
+		}
+	}
+
+	return result
+}
+
+// dmarcRecordLookup finds the dmarc record of the domain.
+func dmarcRecordLookup(domain string) (dmarcRecord, bool, error) {
+	ctx, cancel := dnsContext()
+	defer cancel()
+
+	txts, err := resolver.LookupTXT(ctx, "_dmarc."+domain)
+	if err != nil {
+		if err == dnsErrNotFound {
+			return dmarcRecord{}, false, nil
+		}
+		return dmarcRecord{}, false, fmt.Errorf("dmarc lookup for %s failed: %v", domain, err)
+	}
+
+	var records []string
+	for _, txt := range txts {
+		if strings.HasPrefix(strings.TrimSpace(txt), "v=DMARC1") {
+			records = append(records, txt)
+		}
+	}
+
+	// Domains with multiple records are treated as
+	// domains without a record.
+	if len(records) != 1 {
+		return dmarcRecord{}, false, nil
+	}
+
+	tags := dkimTags(records[0])
+	record := dmarcRecord{
+		policy:          strings.ToLower(tags["p"]),
+		subdomainPolicy: strings.ToLower(tags["sp"]),
+		alignSPF:        strings.ToLower(tags["aspf"]),
+		alignDKIM:       strings.ToLower(tags["adkim"]),
+		pct:             100,
+	}
+
+	switch record.policy {
+	case dmarcPolicyNone, dmarcPolicyQuarantine, dmarcPolicyReject:
+	default:
+		return dmarcRecord{}, false, nil
+	}
+
+	switch record.subdomainPolicy {
+	case "", dmarcPolicyNone, dmarcPolicyQuarantine, dmarcPolicyReject:
+	default:
+		record.subdomainPolicy = ""
+	}
+
+	if pct, ok := tags["pct"]; ok {
+		if n, err := strconv.Atoi(pct); err == nil && n >= 0 && n <= 100 {
+			record.pct = n
+		}
+	}
+
+	return record, true, nil
+}
+
+// dmarcAligned returns true if the authenticated domain is aligned
+// with the from domain in the provided alignment mode.
+func dmarcAligned(from, authenticated, mode string) bool {
+	authenticated = strings.ToLower(authenticated)
+	if from == authenticated {
+		return true
+	}
+
+	if mode == dmarcAlignmentStrict {
+		return false
+	}
+
+	return dmarcOrgDomain(from) == dmarcOrgDomain(authenticated)
+}
+
+// dmarcOrgDomain returns the organizational domain of the domain,
+// ie. "example.co.uk" for "mail.example.co.uk".
+func dmarcOrgDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+
+	return org
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	// dnsErrNotFound is returned by resolvers when the name
+	// does not exist or has no records of the requested type.
+	dnsErrNotFound = errors.New("dns record not found")
+
+	// resolver is the dns resolver used by the smtp checks.
+	// It can be replaced by a zone resolver which resolves
+	// from a local zone file, ie. for offline tests.
+	resolver dnsResolver
+)
+
+// dnsResolver is the resolver used for all dns lookups
+// done by the smtp server.
+type dnsResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+
+	// LookupTLSA returns the TLSA records of the name and true if
+	// the answer is DNSSEC validated by the resolver.
+	LookupTLSA(ctx context.Context, name string) ([]dnsTLSA, bool, error)
+
+	// LookupSecure returns true if the answer of the name for the
+	// record type is DNSSEC validated by the resolver, including
+	// the answers which deny the existence of the records.
+	LookupSecure(ctx context.Context, name, typ string) (bool, error)
+}
+
+// dnsTLSA is a TLSA record (RFC 6698).
+type dnsTLSA struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+// dnsNetResolver resolves using the system resolver, lookups which
+// are not supported by the net package query the nameservers of the
+// resolver configuration loaded at start.
+type dnsNetResolver struct {
+	r    *net.Resolver
+	conf *dns.ClientConfig
+}
+
+func initDNS() {
+	if config.DNS.Zone != "" {
+		logger.Println("Creating dns zone resolver from", config.DNS.Zone)
+
+		zone, err := dnsZoneLoad(config.DNS.Zone)
+		if err != nil {
+			logger.Fatalln("Failed to load dns zone", err)
+		}
+
+		resolver = zone
+		return
+	}
+
+	conf, err := dns.ClientConfigFromFile(dnsResolvConf)
+	if err != nil {
+		logger.Errorln("Failed to load resolver configuration, dnssec lookups are disabled", dnsResolvConf, err)
+	}
+
+	resolver = &dnsNetResolver{
+		r:    net.DefaultResolver,
+		conf: conf,
+	}
+}
+
+// dnsContext returns a context with the dns timeout.
+func dnsContext() (context.Context, context.CancelFunc) {
+	timeout := timeDuration(config.DNS.Timeout)
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// dnsValidatedNames returns the names of the ip which resolve back
+// to the ip (forward-confirmed reverse dns), only the first limit
+// names of the ip are checked.
+func dnsValidatedNames(ctx context.Context, ip net.IP, limit int) []string {
+	names, err := resolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		return nil
+	}
+
+	if len(names) > limit {
+		names = names[:limit]
+	}
+
+	var validated []string
+	for _, name := range names {
+		name = dnsZoneName(name)
+
+		addrs, err := resolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				validated = append(validated, name)
+				break
+			}
+		}
+	}
+
+	return validated
+}
+
+// dnsSecure returns true if the answer of the name for the record type
+// is DNSSEC validated, lookup errors are logged and treated as insecure.
+func dnsSecure(name, typ string) bool {
+	ctx, cancel := dnsContext()
+	defer cancel()
+
+	secure, err := resolver.LookupSecure(ctx, name, typ)
+	if err != nil {
+		logger.Errorln("Failed to lookup dnssec status", name, typ, err)
+		return false
+	}
+
+	return secure
+}
+
+// dnsError converts not found errors of the net
+// package to dnsErrNotFound.
+func dnsError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return dnsErrNotFound
+	}
+
+	return err
+}
+
+func (r *dnsNetResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	txts, err := r.r.LookupTXT(ctx, name)
+	return txts, dnsError(err)
+}
+
+func (r *dnsNetResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, err := r.r.LookupIPAddr(ctx, host)
+	return addrs, dnsError(err)
+}
+
+func (r *dnsNetResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	mxs, err := r.r.LookupMX(ctx, name)
+	return mxs, dnsError(err)
+}
+
+func (r *dnsNetResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	names, err := r.r.LookupAddr(ctx, addr)
+	return names, dnsError(err)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsResolvConf is the resolver configuration used for the
+// lookups which are not supported by the net package.
+const dnsResolvConf = "/etc/resolv.conf"
+
+// LookupTLSA queries the system nameservers with the DNSSEC OK bit
+// set. The answer is only trusted as validated when the nameserver
+// sets the authenticated data bit, so the nameservers are expected
+// to be local validating resolvers.
+func (r *dnsNetResolver) LookupTLSA(ctx context.Context, name string) ([]dnsTLSA, bool, error) {
+	res, err := r.exchange(ctx, name, dns.TypeTLSA)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if res.Rcode == dns.RcodeNameError {
+		return nil, false, dnsErrNotFound
+	}
+
+	var tlsas []dnsTLSA
+	for _, answer := range res.Answer {
+		record, ok := answer.(*dns.TLSA)
+		if !ok {
+			continue
+		}
+
+		data, err := hex.DecodeString(record.Certificate)
+		if err != nil {
+			continue
+		}
+
+		tlsas = append(tlsas, dnsTLSA{
+			Usage:        record.Usage,
+			Selector:     record.Selector,
+			MatchingType: record.MatchingType,
+			Data:         data,
+		})
+	}
+
+	if len(tlsas) == 0 {
+		return nil, res.AuthenticatedData, dnsErrNotFound
+	}
+
+	return tlsas, res.AuthenticatedData, nil
+}
+
+// LookupSecure queries the system nameservers like LookupTLSA and
+// returns the authenticated data bit of the answer.
+func (r *dnsNetResolver) LookupSecure(ctx context.Context, name, typ string) (bool, error) {
+	qtype, ok := dns.StringToType[typ]
+	if !ok {
+		return false, fmt.Errorf("unknown record type %s", typ)
+	}
+
+	res, err := r.exchange(ctx, name, qtype)
+	if err != nil {
+		return false, err
+	}
+
+	return res.AuthenticatedData, nil
+}
+
+// exchange sends the query with the DNSSEC OK bit set to the
+// nameservers until one of them answers, truncated answers are
+// queried again over tcp. Only answers with success or name error
+// codes are returned.
+func (r *dnsNetResolver) exchange(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	if r.conf == nil {
+		return nil, errors.New("resolver configuration is not loaded")
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	msg.SetEdns0(4096, true)
+	msg.AuthenticatedData = true
+
+	timeout := 5 * time.Second
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+
+	client := &dns.Client{Net: "udp", Timeout: timeout}
+	tcpClient := &dns.Client{Net: "tcp", Timeout: timeout}
+
+	var lastErr error
+	for _, server := range r.conf.Servers {
+		addr := net.JoinHostPort(server, r.conf.Port)
+
+		res, _, err := client.ExchangeContext(ctx, msg, addr)
+		if err == nil && res.Truncated {
+			res, _, err = tcpClient.ExchangeContext(ctx, msg, addr)
+		}
+
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		switch res.Rcode {
+		case dns.RcodeSuccess, dns.RcodeNameError:
+			return res, nil
+		}
+
+		lastErr = fmt.Errorf("%s lookup for %s failed: %s", dns.TypeToString[qtype], name, dns.RcodeToString[res.Rcode])
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("no nameservers")
+	}
+
+	return nil, lastErr
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// dnsZone is a resolver which answers from a local zone file.
+// It is used to run the dns based checks (SPF, DKIM, DMARC, RBL)
+// offline against known fixtures.
+//
+// Zone file format, one record per line, ttl and class are optional:
+//
+//	example.com.                 3600 IN TXT "v=spf1 ip4:192.0.2.0/24 -all"
+//	example.com.                 IN A    192.0.2.1
+//	example.com.                 MX      10 mail.example.com.
+//	1.2.0.192.in-addr.arpa.      PTR     mail.example.com.
+//	_25._tcp.mail.example.com.   TLSA    3 1 1 0123...cdef
+//
+// TLSA records of the zone and all other answers of the zone are
+// treated as DNSSEC validated.
+// Lines starting with ";" or "#" are comments.
+type dnsZone struct {
+	records map[string]map[string][]string
+}
+
+// dnsZoneLoad loads the zone file from the provided path.
+func dnsZoneLoad(path string) (*dnsZone, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zone := &dnsZone{
+		records: make(map[string]map[string][]string),
+	}
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if err := zone.parseLine(line); err != nil {
+			return nil, fmt.Errorf("zone line %d: %w", n, err)
+		}
+	}
+
+	return zone, scanner.Err()
+}
+
+func (z *dnsZone) parseLine(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return fmt.Errorf("record is missing fields: %s", line)
+	}
+
+	name := dnsZoneName(fields[0])
+	fields = fields[1:]
+
+	// Skip the optional ttl and class.
+	if _, err := strconv.Atoi(fields[0]); err == nil {
+		fields = fields[1:]
+	}
+	if len(fields) > 0 && strings.EqualFold(fields[0], "IN") {
+		fields = fields[1:]
+	}
+	if len(fields) < 2 {
+		return fmt.Errorf("record is missing data: %s", line)
+	}
+
+	typ := strings.ToUpper(fields[0])
+	data := strings.Join(fields[1:], " ")
+
+	// TXT data is taken from the raw line to keep the
+	// whitespace inside the quoted strings.
+	if typ == "TXT" {
+		if quote := strings.Index(line, `"`); quote >= 0 {
+			data = line[quote:]
+		}
+
+		var err error
+		if data, err = dnsZoneTXT(data); err != nil {
+			return err
+		}
+	}
+
+	if z.records[name] == nil {
+		z.records[name] = make(map[string][]string)
+	}
+	z.records[name][typ] = append(z.records[name][typ], data)
+
+	return nil
+}
+
+// dnsZoneTXT joins the quoted character strings of a TXT record.
+func dnsZoneTXT(data string) (string, error) {
+	data = strings.TrimSpace(data)
+	if !strings.HasPrefix(data, `"`) {
+		return data, nil
+	}
+
+	var b strings.Builder
+	for data != "" {
+		if !strings.HasPrefix(data, `"`) {
+			return "", fmt.Errorf("txt record is not quoted: %s", data)
+		}
+
+		end := strings.Index(data[1:], `"`)
+		if end < 0 {
+			return "", fmt.Errorf("txt record quote is not closed: %s", data)
+		}
+
+		b.WriteString(data[1 : end+1])
+		data = strings.TrimSpace(data[end+2:])
+	}
+
+	return b.String(), nil
+}
+
+// dnsZoneName normalizes a domain name for zone lookups.
+func dnsZoneName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
+
+// dnsZoneReverse returns the reverse lookup name of an ip.
+func dnsZoneReverse(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+
+	var b strings.Builder
+	ip16 := ip.To16()
+	for i := len(ip16) - 1; i >= 0; i-- {
+		fmt.Fprintf(&b, "%x.%x.", ip16[i]&0x0f, ip16[i]>>4)
+	}
+	b.WriteString("ip6.arpa")
+
+	return b.String()
+}
+
+func (z *dnsZone) lookup(name, typ string) ([]string, error) {
+	records, ok := z.records[dnsZoneName(name)][typ]
+	if !ok {
+		return nil, dnsErrNotFound
+	}
+
+	return records, nil
+}
+
+func (z *dnsZone) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return z.lookup(name, "TXT")
+}
+
+func (z *dnsZone) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	var addrs []net.IPAddr
+	for _, typ := range []string{"A", "AAAA"} {
+		records, _ := z.lookup(host, typ)
+		for _, record := range records {
+			if ip := net.ParseIP(record); ip != nil {
+				addrs = append(addrs, net.IPAddr{IP: ip})
+			}
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, dnsErrNotFound
+	}
+
+	return addrs, nil
+}
+
+func (z *dnsZone) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	records, err := z.lookup(name, "MX")
+	if err != nil {
+		return nil, err
+	}
+
+	var mxs []*net.MX
+	for _, record := range records {
+		fields := strings.Fields(record)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("mx record format error: %s", record)
+		}
+
+		pref, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("mx record preference error: %s", record)
+		}
+
+		mxs = append(mxs, &net.MX{
+			Host: fields[1],
+			Pref: uint16(pref),
+		})
+	}
+
+	return mxs, nil
+}
+
+func (z *dnsZone) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("ip address format error: %s", addr)
+	}
+
+	return z.lookup(dnsZoneReverse(ip), "PTR")
+}
+
+func (z *dnsZone) LookupTLSA(ctx context.Context, name string) ([]dnsTLSA, bool, error) {
+	records, err := z.lookup(name, "TLSA")
+	if err != nil {
+		return nil, false, err
+	}
+
+	var tlsas []dnsTLSA
+	for _, record := range records {
+		fields := strings.Fields(record)
+		if len(fields) < 4 {
+			return nil, false, fmt.Errorf("tlsa record format error: %s", record)
+		}
+
+		var params [3]uint8
+		for i := range params {
+			n, err := strconv.ParseUint(fields[i], 10, 8)
+			if err != nil {
+				return nil, false, fmt.Errorf("tlsa record parameter error: %s", record)
+			}
+			params[i] = uint8(n)
+		}
+
+		data, err := hex.DecodeString(strings.Join(fields[3:], ""))
+		if err != nil {
+			return nil, false, fmt.Errorf("tlsa record data error: %s", record)
+		}
+
+		tlsas = append(tlsas, dnsTLSA{
+			Usage:        params[0],
+			Selector:     params[1],
+			MatchingType: params[2],
+			Data:         data,
+		})
+	}
+
+	return tlsas, true, nil
+}
+
+func (z *dnsZone) LookupSecure(ctx context.Context, name, typ string) (bool, error) {
+	return true, nil
+}
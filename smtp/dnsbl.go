@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	redis "github.com/go-redis/redis/v7"
+	"github.com/violetnorth/smtplib"
+)
+
+// DNS blocklists (RFC 5782) are checked when a client connects, before
+// its connection is served. The client ip is looked up in the zones of the lists in
+// parallel, the answers of a list are interpreted with the weights of
+// its return codes and the weights of the listings add up to the score
+// of the client. Clients with a score of "score" or more are listed,
+// clients with a score of "connect_score" or more are rejected for all
+// of the mails with a 554 greeting and their connection is closed.
+//
+// Mails decide what happens to the messages of the listed clients:
+// "connect" rejects the session on the first recipient of the mail
+// since the mail is not known before, "rcpt" rejects the recipients
+// of the mail and "tag" adds the score header to the message.
+//
+// Answers are cached in redis for "cache_ttl", lists can be resolved
+// from a local zone file so the checks can run offline.
+
+const (
+	dnsblPolicyConnect = "connect"
+	dnsblPolicyRcpt    = "rcpt"
+	dnsblPolicyTag     = "tag"
+	dnsblPolicyIgnore  = "ignore"
+
+	dnsblScoreDefault    = 1
+	dnsblCacheTTLDefault = 900
+)
+
+var (
+	// dnsblResolver is the resolver of the lists, it's the
+	// resolver of the smtp checks unless the lists are
+	// resolved from their own zone file.
+	dnsblResolver dnsResolver
+
+	// dnsblCodeNetwork is the network of the return codes,
+	// answers outside of it are not listings (RFC 5782).
+	dnsblCodeNetwork = &net.IPNet{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}
+
+	// dnsblErrorNetwork is used by the lists to return errors,
+	// ie. queries of open resolvers are refused with 127.255.255.254.
+	dnsblErrorNetwork = &net.IPNet{IP: net.IPv4(127, 255, 255, 0), Mask: net.CIDRMask(24, 32)}
+)
+
+// dnsblResult is the result of the dnsbl check of a client.
+type dnsblResult struct {
+	Score    float64
+	Listings []dnsblListing
+}
+
+// dnsblListing is a listing of the client in a list.
+type dnsblListing struct {
+	List   string
+	Codes  []string
+	Weight float64
+}
+
+func initDNSBL() {
+	if !config.DNSBL.Status {
+		return
+	}
+
+	dnsblResolver = resolver
+	if config.DNSBL.Zone != "" {
+		logger.Println("Creating dnsbl zone resolver from", config.DNSBL.Zone)
+
+		zone, err := dnsZoneLoad(config.DNSBL.Zone)
+		if err != nil {
+			logger.Fatalln("Failed to load dnsbl zone", err)
+		}
+
+		dnsblResolver = zone
+	}
+}
+
+// dnsblCheck checks the client ip in all of the lists in parallel,
+// lists which can't be checked are skipped.
+func dnsblCheck(ip net.IP) dnsblResult {
+	var result dnsblResult
+	if !config.DNSBL.Status || ip == nil || len(config.DNSBL.Lists) == 0 {
+		return result
+	}
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+
+	for _, list := range config.DNSBL.Lists {
+		wg.Add(1)
+		go func(list tomlConfigDNSBLList) {
+			defer wg.Done()
+
+			codes, err := dnsblLookup(ip, list.Name)
+			if err != nil {
+				logger.Errorln("Failed to check dnsbl", list.Name, ip, err)
+				return
+			}
+
+			listing, ok := dnsblInterpret(list, codes)
+			if !ok {
+				return
+			}
+
+			mu.Lock()
+			result.Listings = append(result.Listings, listing)
+			result.Score += listing.Weight
+			mu.Unlock()
+		}(list)
+	}
+
+	wg.Wait()
+
+	// Listings are sorted so the header of
+	// the same listings is always the same.
+	sort.Slice(result.Listings, func(n1, n2 int) bool {
+		return result.Listings[n1].List < result.Listings[n2].List
+	})
+
+	return result
+}
+
+// dnsblLookup returns the return codes of the ip in the list, the
+// answers of the list are cached including the ips which are not
+// listed. Answers are not cached if redis is not available.
+func dnsblLookup(ip net.IP, list string) ([]string, error) {
+	key := redisKeyDNSBL(list, ip.String())
+
+	cached, err := redisdb.Get(key).Result()
+	if err == nil {
+		if cached == "" {
+			return nil, nil
+		}
+		return strings.Split(cached, ","), nil
+	}
+	if err != redis.Nil {
+		logger.Errorln("Failed to get cached dnsbl answer", list, ip, err)
+	}
+
+	ctx, cancel := dnsContext()
+	defer cancel()
+
+	var codes []string
+	addrs, err := dnsblResolver.LookupIPAddr(ctx, dnsblQuery(ip, list))
+	if err != nil && err != dnsErrNotFound {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		codes = append(codes, addr.IP.String())
+	}
+
+	ttl := timeDuration(config.DNSBL.CacheTTL)
+	if ttl <= 0 {
+		ttl = timeDuration(dnsblCacheTTLDefault)
+	}
+
+	if err := redisdb.Set(key, strings.Join(codes, ","), ttl).Err(); err != nil {
+		logger.Errorln("Failed to cache dnsbl answer", list, ip, err)
+	}
+
+	return codes, nil
+}
+
+// dnsblQuery returns the name of the ip in the list, the
+// reverse name of the ip under the zone of the list.
+func dnsblQuery(ip net.IP, list string) string {
+	name := dnsZoneReverse(ip)
+	name = strings.TrimSuffix(name, ".in-addr.arpa")
+	name = strings.TrimSuffix(name, ".ip6.arpa")
+
+	return name + "." + dnsZoneName(list)
+}
+
+// dnsblInterpret returns the listing of the return codes of the list.
+// Lists without codes list the client with their weight for any code,
+// lists with codes list the client with the weights of the known codes.
+func dnsblInterpret(list tomlConfigDNSBLList, codes []string) (dnsblListing, bool) {
+	listing := dnsblListing{
+		List: list.Name,
+	}
+
+	for _, code := range codes {
+		ip := net.ParseIP(code)
+		if ip == nil || !dnsblCodeNetwork.Contains(ip) {
+			continue
+		}
+
+		if dnsblErrorNetwork.Contains(ip) {
+			logger.Errorln("Failed to check dnsbl, list returned error code", list.Name, code)
+			continue
+		}
+
+		weight := list.Weight
+		if len(list.Codes) > 0 {
+			var ok bool
+			if weight, ok = list.Codes[code]; !ok {
+				continue
+			}
+		}
+
+		listing.Codes = append(listing.Codes, code)
+		listing.Weight += weight
+	}
+
+	return listing, len(listing.Codes) > 0
+}
+
+// dnsblListed returns true if the score of the result is over
+// the score of the listed clients.
+func dnsblListed(result dnsblResult) bool {
+	score := config.DNSBL.Score
+	if score <= 0 {
+		score = dnsblScoreDefault
+	}
+
+	return len(result.Listings) > 0 && result.Score >= score
+}
+
+// dnsblConnect returns true if the client is rejected for all of the
+// mails, the connection is closed with a 554 before it's served.
+func dnsblConnect(result dnsblResult, ip net.IP) bool {
+	if config.DNSBL.ConnectScore <= 0 || result.Score < config.DNSBL.ConnectScore {
+		return false
+	}
+
+	logger.Errorf("Rejecting connection of %s, dnsbl score %.2f", ip, result.Score)
+	return true
+}
+
+// dnsblRcpt returns an error if the recipient of the mail is rejected,
+// the session is refused if the mail rejects the listed clients at
+// connect so the following commands of the session are rejected too.
+func dnsblRcpt(s *smtpSession, mail typeMail, recipient string) error {
+	if s.DNSBLRefused {
+		return dnsblError(s, smtplib.StatusTransactionFailed)
+	}
+
+	if !dnsblListed(s.DNSBL) {
+		return nil
+	}
+
+	switch mail.DNSBLPolicy {
+	case dnsblPolicyConnect:
+		logger.Errorf("Rejecting session %s, dnsbl score %.2f for %s", s.UUID, s.DNSBL.Score, mail.Host)
+		s.DNSBLRefused = true
+		return dnsblError(s, smtplib.StatusTransactionFailed)
+
+	case dnsblPolicyRcpt:
+		logger.Errorf("Rejecting rcpt for %s, dnsbl score %.2f for %s", s.UUID, s.DNSBL.Score, recipient)
+		return dnsblError(s, smtplib.StatusActionNotTakenMailboxInaccessible)
+	}
+
+	return nil
+}
+
+// dnsblError returns the rejection of the listed client.
+func dnsblError(s *smtpSession, code int) error {
+	return smtpError(code, fmt.Sprintf("Email Receiver: %s", dnsblReason(s.DNSBL, smtpRemoteIP(s.Conn.RemoteAddr))))
+}
+
+// dnsblReason returns the reason of the rejection with the lists
+// the client is listed in.
+func dnsblReason(result dnsblResult, ip net.IP) string {
+	var lists []string
+	for _, listing := range result.Listings {
+		lists = append(lists, listing.List)
+	}
+
+	return fmt.Sprintf("client %s is blocked, listed in %s", ip, strings.Join(lists, ", "))
+}
+
+// dnsblHeader returns the score header of the dnsbl
+// result with the listings of the client.
+func dnsblHeader(result dnsblResult, ip net.IP) string {
+	var listings []string
+	for _, listing := range result.Listings {
+		listings = append(listings, fmt.Sprintf("%s=%s (%.2f)", listing.List, strings.Join(listing.Codes, ","), listing.Weight))
+	}
+
+	if len(listings) == 0 {
+		listings = append(listings, "none")
+	}
+
+	return fmt.Sprintf("X-DNSBL-Score: %.2f client-ip=%s; %s\r\n",
+		result.Score,
+		ip,
+		strings.Join(listings, "; "),
+	)
+}
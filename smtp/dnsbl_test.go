@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+
+	redis "github.com/go-redis/redis/v7"
+)
+
+// testDNSBL resolves the lists from the zone file for the test, answers
+// are not cached since redis is not available.
+func testDNSBL(t *testing.T, path string, connectScore float64) {
+	t.Helper()
+
+	zone, err := dnsZoneLoad(path)
+	if err != nil {
+		t.Fatalf("load zone %s: %v", path, err)
+	}
+
+	previousResolver, previousRedis, previousConfig := dnsblResolver, redisdb, config.DNSBL
+	t.Cleanup(func() {
+		dnsblResolver, redisdb, config.DNSBL = previousResolver, previousRedis, previousConfig
+	})
+
+	dnsblResolver = zone
+	redisdb = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1"})
+
+	config.DNSBL.Status = true
+	config.DNSBL.Score = 1
+	config.DNSBL.ConnectScore = connectScore
+	config.DNSBL.Lists = []tomlConfigDNSBLList{
+		{Name: "zen.example", Codes: map[string]float64{"127.0.0.2": 1, "127.0.0.4": 1, "127.0.0.10": 0.5}},
+		{Name: "weight.example", Weight: 0.5},
+	}
+}
+
+func TestDNSBLQuery(t *testing.T) {
+	tests := []struct {
+		ip   string
+		list string
+		want string
+	}{
+		{"192.0.2.99", "zen.example", "99.2.0.192.zen.example"},
+		{"127.0.0.2", "zen.example.", "2.0.0.127.zen.example"},
+		{"2001:db8:1:2:3:4:567:89ab", "Zen.Example", "b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.8.b.d.0.1.0.0.2.zen.example"},
+	}
+
+	for _, test := range tests {
+		if got := dnsblQuery(net.ParseIP(test.ip), test.list); got != test.want {
+			t.Errorf("query %s in %s = %s, want %s", test.ip, test.list, got, test.want)
+		}
+	}
+}
+
+func TestDNSBLInterpret(t *testing.T) {
+	codes := tomlConfigDNSBLList{Name: "zen.example", Codes: map[string]float64{"127.0.0.2": 1, "127.0.0.4": 1, "127.0.0.10": 0.5}}
+	weight := tomlConfigDNSBLList{Name: "weight.example", Weight: 0.5}
+
+	tests := []struct {
+		name   string
+		list   tomlConfigDNSBLList
+		codes  []string
+		listed bool
+		weight float64
+	}{
+		{"no answer", codes, nil, false, 0},
+		{"code", codes, []string{"127.0.0.2"}, true, 1},
+		{"codes add up", codes, []string{"127.0.0.2", "127.0.0.4"}, true, 2},
+		{"code weight", codes, []string{"127.0.0.10"}, true, 0.5},
+		{"unknown code", codes, []string{"127.0.0.99"}, false, 0},
+		{"unknown code skipped", codes, []string{"127.0.0.10", "127.0.0.99"}, true, 0.5},
+		{"list weight", weight, []string{"127.0.0.2"}, true, 0.5},
+		{"outside of the code network", weight, []string{"10.0.0.2"}, false, 0},
+		{"invalid code", weight, []string{"listed"}, false, 0},
+		{"error code", weight, []string{"127.255.255.254"}, false, 0},
+		{"error code of a list with codes", codes, []string{"127.255.255.252"}, false, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listing, listed := dnsblInterpret(test.list, test.codes)
+			if listed != test.listed {
+				t.Fatalf("listed %t, want %t", listed, test.listed)
+			}
+
+			if listing.Weight != test.weight {
+				t.Fatalf("weight %.2f, want %.2f", listing.Weight, test.weight)
+			}
+
+			if listing.List != test.list.Name {
+				t.Fatalf("list %s, want %s", listing.List, test.list.Name)
+			}
+		})
+	}
+}
+
+func TestDNSBLCheck(t *testing.T) {
+	testDNSBL(t, "testdata/dnsbl.zone", 0)
+
+	tests := []struct {
+		ip    string
+		score float64
+		lists []string
+	}{
+		{"127.0.0.2", 1.5, []string{"weight.example", "zen.example"}},
+		{"198.51.100.1", 0.5, []string{"zen.example"}},
+		{"198.51.100.2", 0, nil},
+		{"198.51.100.3", 0, nil},
+		{"192.0.2.1", 0, nil},
+		{"2001:db8::2", 0.5, []string{"weight.example"}},
+	}
+
+	for _, test := range tests {
+		result := dnsblCheck(net.ParseIP(test.ip))
+		if result.Score != test.score {
+			t.Errorf("score of %s %.2f, want %.2f", test.ip, result.Score, test.score)
+		}
+
+		var lists []string
+		for _, listing := range result.Listings {
+			lists = append(lists, listing.List)
+		}
+
+		if strings.Join(lists, ",") != strings.Join(test.lists, ",") {
+			t.Errorf("lists of %s %v, want %v", test.ip, lists, test.lists)
+		}
+	}
+}
+
+// TestSMTPListenerDNSBL checks the dns blocklists when the connection
+// is accepted, clients over the connect score are closed with a 554
+// before they are served.
+func TestSMTPListenerDNSBL(t *testing.T) {
+	timeout := config.Server.TimeoutWrite
+	t.Cleanup(func() {
+		config.Server.TimeoutWrite = timeout
+	})
+	config.Server.TimeoutWrite = 10
+
+	tests := []struct {
+		name         string
+		connectScore float64
+		dnsbl        bool
+		rejected     bool
+	}{
+		{"listed", 2, true, true},
+		{"under the connect score", 3, true, false},
+		{"without a connect score", 0, true, false},
+		{"submission", 2, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testDNSBL(t, "testdata/dnsbl.zone", test.connectScore)
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("listen: %v", err)
+			}
+			sl := smtpListenerNew(l, nil, test.dnsbl)
+			defer sl.Close()
+
+			client, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer client.Close()
+
+			if test.rejected {
+				reply, err := bufio.NewReader(client).ReadString('\n')
+				if err != nil {
+					t.Fatalf("read reply: %v", err)
+				}
+
+				if !strings.HasPrefix(reply, "554 5.7.1 ") || !strings.Contains(reply, "zen.example") {
+					t.Fatalf("reply %q, want a 554 with the list", reply)
+				}
+				return
+			}
+
+			conn, err := sl.Accept()
+			if err != nil {
+				t.Fatalf("accept: %v", err)
+			}
+
+			c, ok := smtpListenerFind(client.LocalAddr())
+			if !ok {
+				t.Fatalf("connection of %s is not found", client.LocalAddr())
+			}
+
+			if want := 2.0; test.dnsbl && c.DNSBL.Score != want {
+				t.Fatalf("score %.2f, want %.2f", c.DNSBL.Score, want)
+			}
+
+			conn.Close()
+			if _, ok := smtpListenerFind(client.LocalAddr()); ok {
+				t.Fatalf("connection of %s is found after it's closed", client.LocalAddr())
+			}
+		})
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Delivery status notifications (RFC 3464) are sent to the envelope
+// sender of a message. A notification is a multipart/report message
+// with a human readable part, the delivery status of the recipients and
+// the headers of the message. Notifications are sent with the null sender
+// so they are never bounced back. The DSN parameters (RFC 3461) of the
+// receiver clients are kept with the message:
+// 	- NOTIFY: recipients are notified of the failures by default, NEVER
+// 	  notifies nothing, SUCCESS and DELAY notify the delivered and the
+// 	  spooled messages
+// 	- RET: failures return the full message for FULL, otherwise only
+// 	  the headers of the message are returned
+// 	- ENVID and ORCPT: sent back in the notifications
+// Relayed messages are sent with the DSN parameters to the upstreams
+// which support the extension, the upstream is then responsible for the
+// notifications. Otherwise the message is notified as relayed.
+
+const (
+	dsnActionFailed    = "failed"
+	dsnActionDelayed   = "delayed"
+	dsnActionDelivered = "delivered"
+	dsnActionRelayed   = "relayed"
+
+	dsnRetFull = "FULL"
+
+	// Status of the messages which are not delivered
+	// before they expire (RFC 3463).
+	dsnStatusExpired = "4.4.7"
+)
+
+var (
+	dsnEnhancedStatus = regexp.MustCompile(`^([245])\.\d{1,3}\.\d{1,3}\b`)
+)
+
+// dsnRecipient is the delivery status of a recipient, diagnostic is
+// the SMTP reply of the remote mail server if there is one.
+type dsnRecipient struct {
+	Address    string
+	Action     string
+	Status     string
+	Reason     string
+	Diagnostic string
+}
+
+// dsnReport is the delivery status notification of a message to
+// its envelope sender. Trace is the header fields prepended to
+// the message data.
+type dsnReport struct {
+	To         string
+	Arrival    time.Time
+	Options    *dsnOptions
+	Recipients []dsnRecipient
+
+	Trace string
+	Data  smtpData
+}
+
+// dsnOptions is the DSN parameters of a message, the recipient
+// parameters are keyed by the lowercase recipient address.
+type dsnOptions struct {
+	Ret        string                         `json:"ret,omitempty"`
+	EnvelopeID string                         `json:"envid,omitempty"`
+	Recipients map[string]dsnRecipientOptions `json:"recipients,omitempty"`
+}
+
+// dsnRecipientOptions is the NOTIFY and ORCPT parameters of a recipient.
+type dsnRecipientOptions struct {
+	Notify       []string `json:"notify,omitempty"`
+	OriginalType string   `json:"orcpt_type,omitempty"`
+	Original     string   `json:"orcpt,omitempty"`
+}
+
+// dsnSessionOptions returns the DSN parameters of the session
+// envelope, nil if the client didn't send any.
+func dsnSessionOptions(s *smtpSession) *dsnOptions {
+	options := dsnOptions{
+		Ret:        string(s.Opts.Return),
+		EnvelopeID: s.Opts.EnvelopeID,
+	}
+
+	for _, recipient := range s.Recipients {
+		opts := recipient.Opts
+		if len(opts.Notify) == 0 && opts.OriginalRecipient == "" {
+			continue
+		}
+
+		rcpt := dsnRecipientOptions{
+			OriginalType: string(opts.OriginalRecipientType),
+			Original:     opts.OriginalRecipient,
+		}
+		for _, notify := range opts.Notify {
+			rcpt.Notify = append(rcpt.Notify, string(notify))
+		}
+
+		if options.Recipients == nil {
+			options.Recipients = make(map[string]dsnRecipientOptions)
+		}
+		options.Recipients[strings.ToLower(recipient.Address)] = rcpt
+	}
+
+	if options.Ret == "" && options.EnvelopeID == "" && len(options.Recipients) == 0 {
+		return nil
+	}
+
+	return &options
+}
+
+// dsnRecipientFind returns the DSN parameters of a recipient.
+func dsnRecipientFind(options *dsnOptions, address string) (dsnRecipientOptions, bool) {
+	if options == nil {
+		return dsnRecipientOptions{}, false
+	}
+
+	rcpt, ok := options.Recipients[strings.ToLower(address)]
+	return rcpt, ok
+}
+
+// dsnRequested returns true if the recipient asked to be notified of
+// the action, recipients without NOTIFY are notified of failures only.
+func dsnRequested(options *dsnOptions, address, action string) bool {
+	notify := map[string]string{
+		dsnActionFailed:    "FAILURE",
+		dsnActionDelayed:   "DELAY",
+		dsnActionDelivered: "SUCCESS",
+		dsnActionRelayed:   "SUCCESS",
+	}[action]
+
+	rcpt, _ := dsnRecipientFind(options, address)
+	if len(rcpt.Notify) == 0 {
+		return action == dsnActionFailed
+	}
+
+	for _, n := range rcpt.Notify {
+		if strings.EqualFold(n, notify) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dsnNotify spools the notification of the report to be sent to the
+// envelope sender, recipients which didn't ask to be notified of their
+// action are left out of the report. Nothing is sent to the null sender.
+func dsnNotify(report dsnReport) {
+	var recipients []dsnRecipient
+	for _, recipient := range report.Recipients {
+		if dsnRequested(report.Options, recipient.Address, recipient.Action) {
+			recipients = append(recipients, recipient)
+		}
+	}
+
+	if report.To == "" || len(recipients) == 0 {
+		return
+	}
+	report.Recipients = recipients
+
+	data, err := dsnWrite(report)
+	if err != nil {
+		logger.Errorln("Failed to write delivery status notification", report.To, err)
+		return
+	}
+	defer smtpDataRemove(data)
+
+	entry, err := spoolAddRelay(spoolRelay{
+		To: []string{report.To},
+	}, smtpMessage{Data: data})
+	if err != nil {
+		logger.Errorln("Failed to spool delivery status notification", report.To, err)
+		return
+	}
+
+	logger.Printf("Sending %s notification %s to %s for %d recipients", recipients[0].Action, entry.ID, report.To, len(recipients))
+}
+
+// dsnStatus returns the status and the diagnostic code of a delivery
+// error. Enhanced status codes of the SMTP replies are kept, messages
+// which expire after temporary failures have the expired status.
+func dsnStatus(err error, expired bool) (string, string) {
+	status := "5.0.0"
+	if expired {
+		status = dsnStatusExpired
+	}
+
+	var replyErr *textproto.Error
+	if !errors.As(err, &replyErr) {
+		return status, ""
+	}
+
+	msg := strings.Join(strings.Fields(replyErr.Msg), " ")
+	diagnostic := fmt.Sprintf("smtp; %d %s", replyErr.Code, msg)
+
+	if expired {
+		return status, diagnostic
+	}
+
+	if m := dsnEnhancedStatus.FindStringSubmatch(msg); m != nil && m[1] == fmt.Sprint(replyErr.Code/100) {
+		return m[0], diagnostic
+	}
+
+	return fmt.Sprintf("%d.0.0", replyErr.Code/100), diagnostic
+}
+
+// dsnWrite writes the notification of the report as message data
+// which can be spooled to be sent to the envelope sender. Failures
+// return the full message if the sender asked for it with RET=FULL,
+// otherwise only the headers of the message are returned.
+func dsnWrite(report dsnReport) (smtpData, error) {
+	f, err := smtpDataOpen(report.Data)
+	if err != nil {
+		return smtpData{}, err
+	}
+	defer f.Close()
+
+	action := report.Recipients[0].Action
+	message := io.MultiReader(strings.NewReader(report.Trace), f)
+
+	returned := message
+	returnedType := "message/rfc822"
+	if report.Options == nil || !strings.EqualFold(report.Options.Ret, dsnRetFull) || action != dsnActionFailed {
+		headers, err := dkimReadHeaders(bufio.NewReaderSize(message, smtpDataBufferSize))
+		if err != nil {
+			return smtpData{}, err
+		}
+
+		returned = strings.NewReader(strings.Join(headers, ""))
+		returnedType = "text/rfc822-headers"
+	}
+
+	subject, summary := dsnSummary(action)
+	boundary := strings.Replace(uuid.New().String(), "-", "", -1)
+	now := time.Now()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", config.Server.Domain)
+	fmt.Fprintf(&b, "To: <%s>\r\n", report.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-Id: <%s@%s>\r\n", uuid.New().String(), config.Server.Domain)
+	fmt.Fprintf(&b, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=delivery-status;\r\n\tboundary=\"%s\"\r\n", boundary)
+	fmt.Fprintf(&b, "\r\n")
+	fmt.Fprintf(&b, "This is a MIME-encapsulated message.\r\n")
+
+	// Human readable part.
+	fmt.Fprintf(&b, "\r\n--%s\r\n", boundary)
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&b, "This is the mail system at host %s.\r\n\r\n", config.Server.Domain)
+	fmt.Fprintf(&b, "%s\r\n\r\n", summary)
+	for _, recipient := range report.Recipients {
+		fmt.Fprintf(&b, "<%s>: %s\r\n", recipient.Address, recipient.Reason)
+	}
+
+	// Delivery status part, the per message fields
+	// followed by the per recipient fields.
+	fmt.Fprintf(&b, "\r\n--%s\r\n", boundary)
+	fmt.Fprintf(&b, "Content-Type: message/delivery-status\r\n\r\n")
+	if report.Options != nil && report.Options.EnvelopeID != "" {
+		fmt.Fprintf(&b, "Original-Envelope-Id: %s\r\n", dsnXtext(report.Options.EnvelopeID))
+	}
+	fmt.Fprintf(&b, "Reporting-MTA: dns; %s\r\n", config.Server.Domain)
+	if !report.Arrival.IsZero() {
+		fmt.Fprintf(&b, "Arrival-Date: %s\r\n", report.Arrival.Format(time.RFC1123Z))
+	}
+
+	for _, recipient := range report.Recipients {
+		fmt.Fprintf(&b, "\r\n")
+		if rcpt, ok := dsnRecipientFind(report.Options, recipient.Address); ok && rcpt.Original != "" {
+			fmt.Fprintf(&b, "Original-Recipient: %s; %s\r\n", strings.ToLower(rcpt.OriginalType), dsnXtext(rcpt.Original))
+		}
+		fmt.Fprintf(&b, "Final-Recipient: rfc822; %s\r\n", recipient.Address)
+		fmt.Fprintf(&b, "Action: %s\r\n", recipient.Action)
+		fmt.Fprintf(&b, "Status: %s\r\n", recipient.Status)
+		if recipient.Diagnostic != "" {
+			fmt.Fprintf(&b, "Diagnostic-Code: %s\r\n", recipient.Diagnostic)
+		}
+		fmt.Fprintf(&b, "Last-Attempt-Date: %s\r\n", now.Format(time.RFC1123Z))
+	}
+
+	// The message or the headers of the message.
+	fmt.Fprintf(&b, "\r\n--%s\r\n", boundary)
+	fmt.Fprintf(&b, "Content-Type: %s\r\n\r\n", returnedType)
+
+	return smtpDataWrite(io.MultiReader(
+		strings.NewReader(b.String()),
+		returned,
+		strings.NewReader(fmt.Sprintf("\r\n--%s--\r\n", boundary)),
+	))
+}
+
+// dsnSummary returns the subject and the human readable
+// summary of the notification of an action.
+func dsnSummary(action string) (string, string) {
+	switch action {
+	case dsnActionDelayed:
+		return "Delayed Mail (still being retried)",
+			"Your message could not be delivered yet to one or more recipients, delivery is still being retried."
+	case dsnActionDelivered:
+		return "Successful Mail Delivery Report",
+			"Your message was successfully delivered to the recipients."
+	case dsnActionRelayed:
+		return "Successful Mail Delivery Report",
+			"Your message was relayed to the recipients, no further notifications will be sent."
+	}
+
+	return "Undelivered Mail Returned to Sender",
+		"Your message could not be delivered to one or more recipients."
+}
+
+// dsnXtext encodes the value as xtext (RFC 3461 section 4), the
+// envelope id and the original recipients are sent as xtext.
+func dsnXtext(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+
+	return b.String()
+}
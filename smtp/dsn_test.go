@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestDSNSessionOptions(t *testing.T) {
+	s := testSession([]string{"a@example.net", "B@example.net"})
+	if options := dsnSessionOptions(s); options != nil {
+		t.Fatalf("options %+v without parameters, want nil", options)
+	}
+
+	s.Opts.Return = smtp.DSNReturnFull
+	s.Opts.EnvelopeID = "envelope"
+	s.Recipients[1].Opts = smtp.RcptOptions{
+		Notify:                []smtp.DSNNotify{smtp.DSNNotifySuccess},
+		OriginalRecipientType: smtp.DSNAddressTypeRFC822,
+		OriginalRecipient:     "b@example.com",
+	}
+
+	options := dsnSessionOptions(s)
+	if options == nil || options.Ret != "FULL" || options.EnvelopeID != "envelope" {
+		t.Fatalf("options %+v, want ret and envid", options)
+	}
+
+	if _, ok := dsnRecipientFind(options, "a@example.net"); ok {
+		t.Errorf("options of a@example.net without parameters")
+	}
+
+	rcpt, ok := dsnRecipientFind(options, "b@example.net")
+	if !ok || strings.Join(rcpt.Notify, ",") != "SUCCESS" || rcpt.Original != "b@example.com" {
+		t.Errorf("options of b@example.net %+v, want notify and orcpt", rcpt)
+	}
+}
+
+func TestDSNRequested(t *testing.T) {
+	options := &dsnOptions{
+		Recipients: map[string]dsnRecipientOptions{
+			"never@example.net":   {Notify: []string{"NEVER"}},
+			"success@example.net": {Notify: []string{"SUCCESS"}},
+			"delay@example.net":   {Notify: []string{"DELAY", "FAILURE"}},
+			"orcpt@example.net":   {Original: "orcpt@example.com"},
+		},
+	}
+
+	tests := []struct {
+		address   string
+		action    string
+		requested bool
+	}{
+		{"default@example.net", dsnActionFailed, true},
+		{"default@example.net", dsnActionDelayed, false},
+		{"default@example.net", dsnActionDelivered, false},
+		{"orcpt@example.net", dsnActionFailed, true},
+		{"never@example.net", dsnActionFailed, false},
+		{"never@example.net", dsnActionDelivered, false},
+		{"success@example.net", dsnActionFailed, false},
+		{"success@example.net", dsnActionDelivered, true},
+		{"Success@example.net", dsnActionRelayed, true},
+		{"delay@example.net", dsnActionDelayed, true},
+		{"delay@example.net", dsnActionFailed, true},
+		{"delay@example.net", dsnActionDelivered, false},
+	}
+
+	for _, test := range tests {
+		if requested := dsnRequested(options, test.address, test.action); requested != test.requested {
+			t.Errorf("%s %s requested %t, want %t", test.address, test.action, requested, test.requested)
+		}
+	}
+
+	if !dsnRequested(nil, "default@example.net", dsnActionFailed) || dsnRequested(nil, "default@example.net", dsnActionDelivered) {
+		t.Errorf("failures only are requested without options")
+	}
+}
+
+func TestDSNWrite(t *testing.T) {
+	raw := []byte("Subject: report\r\n\r\nthe body of the message\r\n")
+
+	data, err := smtpDataWrite(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("write data: %v", err)
+	}
+	defer smtpDataRemove(data)
+
+	tests := []struct {
+		name     string
+		ret      string
+		action   string
+		body     bool
+		contains []string
+	}{
+		{
+			name:     "failure with headers",
+			action:   dsnActionFailed,
+			contains: []string{"Subject: Undelivered Mail", "Content-Type: text/rfc822-headers"},
+		},
+		{
+			name:     "failure with the full message",
+			ret:      "FULL",
+			action:   dsnActionFailed,
+			body:     true,
+			contains: []string{"Subject: Undelivered Mail", "Content-Type: message/rfc822"},
+		},
+		{
+			name:     "success returns headers only",
+			ret:      "FULL",
+			action:   dsnActionDelivered,
+			contains: []string{"Subject: Successful Mail Delivery Report", "Action: delivered", "Content-Type: text/rfc822-headers"},
+		},
+		{
+			name:     "delay",
+			ret:      "HDRS",
+			action:   dsnActionDelayed,
+			contains: []string{"Subject: Delayed Mail", "Action: delayed"},
+		},
+	}
+
+	for _, test := range tests {
+		report := dsnReport{
+			To: "sender@example.org",
+			Options: &dsnOptions{
+				Ret:        test.ret,
+				EnvelopeID: "envelope 1",
+				Recipients: map[string]dsnRecipientOptions{
+					"a@example.net": {OriginalType: "RFC822", Original: "a@example.com"},
+				},
+			},
+			Recipients: []dsnRecipient{
+				{Address: "a@example.net", Action: test.action, Status: "5.1.1", Reason: "rejected"},
+				{Address: "b@example.net", Action: test.action, Status: "5.1.1", Reason: "rejected"},
+			},
+			Trace: "Received: from client\r\n",
+			Data:  data,
+		}
+
+		notification, err := dsnWrite(report)
+		if err != nil {
+			t.Fatalf("%s: write: %v", test.name, err)
+		}
+		b, err := ioutil.ReadFile(notification.Path)
+		smtpDataRemove(notification)
+		if err != nil {
+			t.Fatalf("%s: read: %v", test.name, err)
+		}
+		written := string(b)
+
+		contains := append(test.contains,
+			"Original-Envelope-Id: envelope+201\r\n",
+			"Original-Recipient: rfc822; a@example.com\r\nFinal-Recipient: rfc822; a@example.net\r\n",
+			"\r\nFinal-Recipient: rfc822; b@example.net\r\n",
+			"Received: from client\r\nSubject: report\r\n",
+		)
+		for _, c := range contains {
+			if !strings.Contains(written, c) {
+				t.Errorf("%s: notification doesn't contain %q", test.name, c)
+			}
+		}
+
+		if body := strings.Contains(written, "the body of the message"); body != test.body {
+			t.Errorf("%s: body returned %t, want %t", test.name, body, test.body)
+		}
+	}
+}
+
+// TestDSNNotify spools the notification of the requested recipients
+// only, nothing is spooled for the null sender.
+func TestDSNNotify(t *testing.T) {
+	data, err := smtpDataWrite(strings.NewReader("Subject: report\r\n\r\nreport\r\n"))
+	if err != nil {
+		t.Fatalf("write data: %v", err)
+	}
+	defer smtpDataRemove(data)
+
+	entry := spoolEntry{
+		Session: smtpMessageSession{
+			From:       "sender@example.org",
+			Recipients: []string{"a@example.net", "b@example.net"},
+			DSN: &dsnOptions{
+				Recipients: map[string]dsnRecipientOptions{
+					"a@example.net": {Notify: []string{"SUCCESS"}},
+				},
+			},
+		},
+		Data: data,
+	}
+
+	tests := []struct {
+		name   string
+		notify func()
+		to     []string
+	}{
+		{
+			name:   "delivered",
+			notify: func() { spoolDelivered(entry) },
+			to:     []string{"sender@example.org"},
+		},
+		{
+			name: "delivered to the null sender",
+			notify: func() {
+				entry := entry
+				entry.Session.From = ""
+				spoolDelivered(entry)
+			},
+		},
+		{
+			name: "delayed without delay requested",
+			notify: func() {
+				entry := entry
+				entry.Relay = &spoolRelay{From: "sender@example.org", To: entry.Session.Recipients}
+				spoolRelayDelay(entry, &textproto.Error{Code: 451, Msg: "4.3.0 try again"})
+			},
+		},
+		{
+			name: "relayed to an upstream without dsn",
+			notify: func() {
+				spoolRelaySent(spoolReport(entry, "sender@example.org"), smtpTLSOutcome{Host: "upstream"}, entry.Session.Recipients, nil)
+			},
+			to: []string{"sender@example.org"},
+		},
+		{
+			name: "relayed to an upstream with dsn",
+			notify: func() {
+				spoolRelaySent(spoolReport(entry, "sender@example.org"), smtpTLSOutcome{Host: "upstream", DSN: true}, entry.Session.Recipients, nil)
+			},
+		},
+		{
+			name: "bounced with notify success",
+			notify: func() {
+				entry := entry
+				entry.Relay = &spoolRelay{From: "sender@example.org", To: entry.Session.Recipients}
+				spoolRelayBounceRecipients(entry, []smtpRcptError{
+					{Address: "a@example.net", Err: &smtpSendError{Permanent: true, Err: errors.New("rejected")}},
+				})
+			},
+		},
+	}
+
+	for _, test := range tests {
+		before := testSpoolIDs(t)
+		test.notify()
+
+		var to []string
+		entries, err := spoolList()
+		if err != nil {
+			t.Fatalf("list spool: %v", err)
+		}
+		for _, listed := range entries {
+			if before[listed.ID] {
+				continue
+			}
+
+			to = append(to, listed.Relay.To...)
+			spoolRemove(listed.ID)
+		}
+
+		if strings.Join(to, ",") != strings.Join(test.to, ",") {
+			t.Errorf("%s: notified %v, want %v", test.name, to, test.to)
+		}
+	}
+}
+
+// testSpoolIDs returns the ids of the spooled entries.
+func testSpoolIDs(t *testing.T) map[string]bool {
+	t.Helper()
+
+	entries, err := spoolList()
+	if err != nil {
+		t.Fatalf("list spool: %v", err)
+	}
+
+	ids := make(map[string]bool)
+	for _, entry := range entries {
+		ids[entry.ID] = true
+	}
+
+	return ids
+}
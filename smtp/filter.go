@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/violetnorth/smtplib"
+)
+
+// Filters run in order on the parsed message for each mail of the
+// recipients before the message is delivered. A filter returns the
+// action for the message: "accept" delivers the message without the
+// following filters, "reject" rejects the recipients of the mail,
+// "quarantine" stores the message hidden from the inboxes until it's
+// released, "tag" adds a header field and "rewrite" changes the
+// message, the following filters see the tagged or rewritten message.
+//
+// Filters of a mail are the filters of the config for the mail, in
+// the order of the config, followed by the filters of the mail set
+// with the API. Filters which fail are skipped.
+
+const (
+	filterActionAccept     = "accept"
+	filterActionReject     = "reject"
+	filterActionQuarantine = "quarantine"
+	filterActionTag        = "tag"
+	filterActionRewrite    = "rewrite"
+
+	filterTypeSize   = "size"
+	filterTypeSender = "sender"
+	filterTypeHeader = "header"
+
+	// filterHostAll is the host of the config
+	// filters which apply to all of the mails.
+	filterHostAll = "*"
+)
+
+// filter is a message filter of a mail. Filters may change the
+// message, ie. rewrite filters return the rewrite action after
+// they change it.
+type filter interface {
+	Filter(s *smtpSession, mail typeMail, message *smtpMessage) (filterResult, error)
+}
+
+// filterResult is the action of a filter for the message, filters
+// which don't match the message return no action. Code and Message
+// are the reply of a rejection, Reason is the quarantine reason.
+type filterResult struct {
+	Action  string
+	Code    int
+	Message string
+	Reason  string
+	Header  string
+}
+
+// filterOutcome is the outcome of the filters of a mail, Err is the
+// rejection of the recipients of the mail. Changed is true if the
+// message is tagged, rewritten or quarantined by the filters.
+type filterOutcome struct {
+	Err     error
+	Message smtpMessage
+	Changed bool
+}
+
+// filterTagPattern is a single header field, field names are the
+// printable characters except the colon (RFC 5322 section 2.2).
+var filterTagPattern = regexp.MustCompile(`^[!-9;-~]+:[^\r\n]*$`)
+
+// filterBuilders create the filters of the filter types,
+// new filter types are added with their builders.
+var filterBuilders = map[string]func(spec typeMailFilter) (filter, error){
+	filterTypeSize:   filterSizeBuild,
+	filterTypeSender: filterSenderBuild,
+	filterTypeHeader: filterHeaderBuild,
+}
+
+// filterRun runs the filters of the mail on the message. Messages
+// rewritten by the filters are written to new message data, the
+// message data of the outcome is removed by the caller after the
+// delivery if it's not the data of the message.
+func filterRun(s *smtpSession, mail typeMail, message smtpMessage) filterOutcome {
+	outcome := filterOutcome{
+		Message: message,
+	}
+
+	for _, spec := range filterSpecs(mail) {
+		build, ok := filterBuilders[spec.Type]
+		if !ok {
+			logger.Errorf("Failed to filter message for %s, unknown filter type %s of %s", s.UUID, spec.Type, mail.Host)
+			continue
+		}
+
+		if err := filterSpecValidate(spec); err != nil {
+			logger.Errorf("Failed to filter message for %s, %s filter of %s error %v", s.UUID, spec.Type, mail.Host, err)
+			continue
+		}
+
+		f, err := build(spec)
+		if err != nil {
+			logger.Errorf("Failed to filter message for %s, %s filter of %s error %v", s.UUID, spec.Type, mail.Host, err)
+			continue
+		}
+
+		data := outcome.Message.Data
+		result, err := f.Filter(s, mail, &outcome.Message)
+		if err != nil {
+			logger.Errorf("Failed to filter message for %s, %s filter of %s error %v", s.UUID, spec.Type, mail.Host, err)
+			continue
+		}
+
+		// Data of the previous rewrite is replaced.
+		if data.Path != message.Data.Path && data.Path != outcome.Message.Data.Path {
+			smtpDataRemove(data)
+		}
+
+		if result.Action != "" {
+			logger.Debugf("Session %s, filter %s of %s: %s (%s)", s.UUID, spec.Type, mail.Host, result.Action, result.Reason)
+		}
+
+		switch result.Action {
+		case filterActionAccept:
+			return outcome
+
+		case filterActionReject:
+			code := result.Code
+			if code == 0 {
+				code = smtplib.StatusTransactionFailed
+			}
+
+			reply := result.Message
+			if reply == "" {
+				reply = "email rejected"
+			}
+
+			logger.Errorf("Rejecting message for %s, %s filter of %s (%s)", s.UUID, spec.Type, mail.Host, result.Reason)
+			outcome.Err = smtpError(code, fmt.Sprintf("Email Receiver: %s", reply))
+			return outcome
+
+		case filterActionQuarantine:
+			outcome.Message.Quarantine = result.Reason
+			outcome.Changed = true
+			return outcome
+
+		case filterActionTag:
+			outcome.Message.Trace = result.Header + outcome.Message.Trace
+			outcome.Changed = true
+
+		case filterActionRewrite:
+			outcome.Changed = true
+		}
+	}
+
+	return outcome
+}
+
+// filterSpecs returns the filters of the mail in order.
+func filterSpecs(mail typeMail) []typeMailFilter {
+	var specs []typeMailFilter
+	for _, spec := range config.Filters {
+		if spec.Host == filterHostAll || strings.EqualFold(spec.Host, mail.Host) {
+			specs = append(specs, spec.typeMailFilter)
+		}
+	}
+
+	return append(specs, mail.Filters...)
+}
+
+// filterSpecValidate checks the tag and the subject prefix of the
+// filter, both are written to the message as they are.
+func filterSpecValidate(spec typeMailFilter) error {
+	if spec.Tag != "" && !filterTagPattern.MatchString(spec.Tag) {
+		return fmt.Errorf("tag is not a single header field %q", spec.Tag)
+	}
+
+	if strings.ContainsAny(spec.SubjectPrefix, "\r\n") {
+		return fmt.Errorf("subject prefix is not a single line %q", spec.SubjectPrefix)
+	}
+
+	return nil
+}
+
+// filterMatched returns the result of the action of the filter
+// for a message the filter matches, messages are rewritten here.
+func filterMatched(spec typeMailFilter, message *smtpMessage, reason string) (filterResult, error) {
+	result := filterResult{
+		Action:  spec.Action,
+		Code:    spec.Code,
+		Message: spec.Message,
+		Reason:  reason,
+	}
+
+	if result.Action == "" {
+		result.Action = filterActionReject
+	}
+
+	switch result.Action {
+	case filterActionTag:
+		result.Header = spec.Tag
+		if result.Header == "" {
+			result.Header = fmt.Sprintf("X-Filter: %s", strings.NewReplacer("\r", " ", "\n", " ").Replace(reason))
+		}
+		result.Header = strings.TrimRight(result.Header, "\r\n") + "\r\n"
+
+	case filterActionRewrite:
+		if err := filterRewriteSubject(message, spec.SubjectPrefix); err != nil {
+			return filterResult{}, err
+		}
+	}
+
+	return result, nil
+}
+
+// filterRewriteSubject prefixes the subject of the message, the
+// message data with the new subject is written to new message data.
+// Subjects which already have the prefix are not changed.
+func filterRewriteSubject(message *smtpMessage, prefix string) error {
+	if prefix == "" || strings.HasPrefix(message.Subject, prefix) {
+		return nil
+	}
+
+	f, err := smtpDataOpen(message.Data)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, smtpDataBufferSize)
+	fields, err := dkimReadHeaders(r)
+	if err != nil {
+		return err
+	}
+
+	var (
+		header    strings.Builder
+		rewritten bool
+	)
+
+	for _, field := range fields {
+		if !rewritten && strings.EqualFold(dkimHeaderName(field), "Subject") {
+			field = fmt.Sprintf("Subject: %s%s", prefix, strings.TrimLeft(dkimHeaderValue(field), " \t"))
+			rewritten = true
+		}
+		header.WriteString(field)
+	}
+
+	if !rewritten {
+		fmt.Fprintf(&header, "Subject: %s\r\n", prefix)
+	}
+	header.WriteString("\r\n")
+
+	data, err := smtpDataWrite(io.MultiReader(strings.NewReader(header.String()), r))
+	if err != nil {
+		return err
+	}
+
+	message.Data = data
+	message.Subject = prefix + message.Subject
+	return nil
+}
+
+// filterSize matches the messages over the max bytes.
+type filterSize struct {
+	spec typeMailFilter
+}
+
+func filterSizeBuild(spec typeMailFilter) (filter, error) {
+	if spec.MaxBytes <= 0 {
+		return nil, fmt.Errorf("max bytes is required")
+	}
+
+	if spec.Code == 0 {
+		spec.Code = smtplib.StatusActionAbortedExceedStorageAllocation
+	}
+
+	return &filterSize{spec: spec}, nil
+}
+
+func (f *filterSize) Filter(s *smtpSession, mail typeMail, message *smtpMessage) (filterResult, error) {
+	if message.Data.Size <= f.spec.MaxBytes {
+		return filterResult{}, nil
+	}
+
+	return filterMatched(f.spec, message, fmt.Sprintf("size %d over %d bytes", message.Data.Size, f.spec.MaxBytes))
+}
+
+// filterSender matches the messages of the senders, the envelope
+// sender and the From header address are matched. Senders are
+// addresses or domains which match their subdomains as well. Sender
+// filters with the accept action are allow lists, others are deny
+// lists.
+type filterSender struct {
+	spec typeMailFilter
+}
+
+func filterSenderBuild(spec typeMailFilter) (filter, error) {
+	if len(spec.Senders) == 0 {
+		return nil, fmt.Errorf("senders are required")
+	}
+
+	return &filterSender{spec: spec}, nil
+}
+
+func (f *filterSender) Filter(s *smtpSession, mail typeMail, message *smtpMessage) (filterResult, error) {
+	for _, address := range []string{s.From, message.From.Address} {
+		address = strings.ToLower(strings.TrimSpace(address))
+		at := strings.LastIndex(address, "@")
+		if at <= 0 {
+			continue
+		}
+
+		for _, sender := range f.spec.Senders {
+			sender = strings.ToLower(strings.TrimSpace(sender))
+			if sender == "" {
+				continue
+			}
+
+			if strings.Contains(sender, "@") {
+				if address == sender {
+					return filterMatched(f.spec, message, fmt.Sprintf("sender %s", sender))
+				}
+				continue
+			}
+
+			sender = dnsZoneName(sender)
+			if domain := address[at+1:]; domain == sender || strings.HasSuffix(domain, "."+sender) {
+				return filterMatched(f.spec, message, fmt.Sprintf("sender %s", sender))
+			}
+		}
+	}
+
+	return filterResult{}, nil
+}
+
+// filterHeader matches the messages with a header field of the name
+// which matches the pattern. Trace header fields added to the message
+// are matched as well, ie. the header fields of tag filters.
+type filterHeader struct {
+	spec    typeMailFilter
+	pattern *regexp.Regexp
+}
+
+func filterHeaderBuild(spec typeMailFilter) (filter, error) {
+	if spec.Header == "" {
+		return nil, fmt.Errorf("header is required")
+	}
+
+	pattern, err := regexp.Compile(spec.Pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	return &filterHeader{spec: spec, pattern: pattern}, nil
+}
+
+func (f *filterHeader) Filter(s *smtpSession, mail typeMail, message *smtpMessage) (filterResult, error) {
+	headers, err := messageHeaders(message.Trace, message.Data)
+	if err != nil {
+		return filterResult{}, err
+	}
+
+	for _, header := range headers {
+		if strings.EqualFold(header.Name, f.spec.Header) && f.pattern.MatchString(header.Value) {
+			return filterMatched(f.spec, message, fmt.Sprintf("header %s matches %s", header.Name, f.spec.Pattern))
+		}
+	}
+
+	return filterResult{}, nil
+}
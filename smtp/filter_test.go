@@ -0,0 +1,228 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/violetnorth/smtplib"
+)
+
+// testFilterMessage returns a message written to message data.
+func testFilterMessage(t *testing.T, raw string) smtpMessage {
+	t.Helper()
+
+	data, err := smtpDataWrite(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("write data: %v", err)
+	}
+	t.Cleanup(func() {
+		smtpDataRemove(data)
+	})
+
+	return smtpMessage{
+		Data:    data,
+		From:    mail.Address{Address: "sender@example.org"},
+		Subject: "Quarterly report",
+	}
+}
+
+// TestFilterRun runs the filters in order, accept, reject and quarantine
+// end the filters while the following filters see the tagged or the
+// rewritten message.
+func TestFilterRun(t *testing.T) {
+	previous := config.Filters
+	t.Cleanup(func() {
+		config.Filters = previous
+	})
+
+	const raw = "From: Sender <sender@example.org>\r\nSubject: Quarterly report\r\n\r\nreport\r\n"
+
+	var (
+		sizeReject      = typeMailFilter{Type: filterTypeSize, Action: filterActionReject, MaxBytes: 1}
+		senderAccept    = typeMailFilter{Type: filterTypeSender, Action: filterActionAccept, Senders: []string{"example.org"}}
+		senderTag       = typeMailFilter{Type: filterTypeSender, Action: filterActionTag, Senders: []string{"sender@example.org"}, Tag: "X-Sender: listed"}
+		senderRewrite   = typeMailFilter{Type: filterTypeSender, Action: filterActionRewrite, Senders: []string{"example.org"}, SubjectPrefix: "[external] "}
+		tagQuarantine   = typeMailFilter{Type: filterTypeHeader, Action: filterActionQuarantine, Header: "X-Sender", Pattern: "^listed$"}
+		subjectTag      = typeMailFilter{Type: filterTypeHeader, Action: filterActionTag, Header: "Subject", Pattern: `^\[external\]`, Tag: "X-Rewritten: yes"}
+		headerReject    = typeMailFilter{Type: filterTypeHeader, Action: filterActionReject, Header: "Subject", Pattern: "report", Code: smtplib.StatusActionNotTakenMailboxInaccessible, Message: "reports are not accepted"}
+		invalidTag      = typeMailFilter{Type: filterTypeSender, Action: filterActionTag, Senders: []string{"example.org"}, Tag: "X-Bad: tag\r\nBcc: injected"}
+		unknownType     = typeMailFilter{Type: "unknown", Action: filterActionReject}
+		defaultReject   = typeMailFilter{Type: filterTypeSender, Senders: []string{"example.org"}}
+		unmatchedReject = typeMailFilter{Type: filterTypeSender, Action: filterActionReject, Senders: []string{"example.net"}}
+	)
+
+	tests := []struct {
+		name       string
+		config     []tomlConfigFilter
+		filters    []typeMailFilter
+		code       int
+		quarantine string
+		trace      string
+		subject    string
+		changed    bool
+	}{
+		{
+			name:    "no filters",
+			subject: "Quarterly report",
+		},
+		{
+			name:    "unmatched filters",
+			filters: []typeMailFilter{unmatchedReject},
+			subject: "Quarterly report",
+		},
+		{
+			name:    "accept skips the following filters",
+			filters: []typeMailFilter{senderAccept, sizeReject},
+			subject: "Quarterly report",
+		},
+		{
+			name:    "reject",
+			filters: []typeMailFilter{sizeReject, senderAccept},
+			code:    smtplib.StatusActionAbortedExceedStorageAllocation,
+		},
+		{
+			name:    "reject with the reply of the filter",
+			filters: []typeMailFilter{headerReject},
+			code:    smtplib.StatusActionNotTakenMailboxInaccessible,
+		},
+		{
+			name:    "filters without an action reject",
+			filters: []typeMailFilter{defaultReject},
+			code:    smtplib.StatusTransactionFailed,
+		},
+		{
+			name:       "tag is seen by the following filters",
+			filters:    []typeMailFilter{senderTag, tagQuarantine, sizeReject},
+			quarantine: "header X-Sender matches ^listed$",
+			trace:      "X-Sender: listed\r\n",
+			subject:    "Quarterly report",
+			changed:    true,
+		},
+		{
+			name:    "rewrite is seen by the following filters",
+			filters: []typeMailFilter{senderRewrite, subjectTag},
+			trace:   "X-Rewritten: yes\r\n",
+			subject: "[external] Quarterly report",
+			changed: true,
+		},
+		{
+			name:    "invalid and unknown filters are skipped",
+			filters: []typeMailFilter{invalidTag, unknownType, senderTag},
+			trace:   "X-Sender: listed\r\n",
+			subject: "Quarterly report",
+			changed: true,
+		},
+		{
+			name:    "config filters run before the mail filters",
+			config:  []tomlConfigFilter{{Host: filterHostAll, typeMailFilter: sizeReject}},
+			filters: []typeMailFilter{senderAccept},
+			code:    smtplib.StatusActionAbortedExceedStorageAllocation,
+		},
+		{
+			name:    "config filters of other mails",
+			config:  []tomlConfigFilter{{Host: "example.net", typeMailFilter: sizeReject}},
+			subject: "Quarterly report",
+		},
+	}
+
+	for _, test := range tests {
+		config.Filters = test.config
+
+		message := testFilterMessage(t, raw)
+		outcome := filterRun(testSession(nil), typeMail{Host: "example.com", Filters: test.filters}, message)
+
+		code := 0
+		if smtpErr, ok := outcome.Err.(*smtp.SMTPError); ok {
+			code = smtpErr.Code
+		} else if outcome.Err != nil {
+			t.Errorf("%s: error %v, want an smtp error", test.name, outcome.Err)
+			continue
+		}
+
+		if code != test.code {
+			t.Errorf("%s: rejected with %d, want %d", test.name, code, test.code)
+		}
+		if code != 0 {
+			continue
+		}
+
+		if outcome.Message.Quarantine != test.quarantine {
+			t.Errorf("%s: quarantine %q, want %q", test.name, outcome.Message.Quarantine, test.quarantine)
+		}
+		if outcome.Message.Trace != test.trace {
+			t.Errorf("%s: trace %q, want %q", test.name, outcome.Message.Trace, test.trace)
+		}
+		if outcome.Message.Subject != test.subject {
+			t.Errorf("%s: subject %q, want %q", test.name, outcome.Message.Subject, test.subject)
+		}
+		if outcome.Changed != test.changed {
+			t.Errorf("%s: changed %t, want %t", test.name, outcome.Changed, test.changed)
+		}
+
+		if outcome.Message.Data.Path != message.Data.Path {
+			smtpDataRemove(outcome.Message.Data)
+		}
+	}
+}
+
+func TestFilterRewriteSubject(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		subject string
+		data    string
+	}{
+		{
+			name:    "prefixed",
+			raw:     "From: sender@example.org\r\nSubject: Quarterly report\r\n\r\nreport\r\n",
+			subject: "Quarterly report",
+			data:    "From: sender@example.org\r\nSubject: [external] Quarterly report\r\n\r\nreport\r\n",
+		},
+		{
+			name:    "already prefixed",
+			raw:     "Subject: [external] Quarterly report\r\n\r\nreport\r\n",
+			subject: "[external] Quarterly report",
+			data:    "Subject: [external] Quarterly report\r\n\r\nreport\r\n",
+		},
+		{
+			name: "without a subject",
+			raw:  "From: sender@example.org\r\n\r\nreport\r\n",
+			data: "From: sender@example.org\r\nSubject: [external] \r\n\r\nreport\r\n",
+		},
+		{
+			name:    "first subject only",
+			raw:     "Subject: first\r\nSubject: second\r\n\r\nreport\r\n",
+			subject: "first",
+			data:    "Subject: [external] first\r\nSubject: second\r\n\r\nreport\r\n",
+		},
+	}
+
+	for _, test := range tests {
+		message := testFilterMessage(t, test.raw)
+		message.Subject = test.subject
+		original := message.Data
+
+		if err := filterRewriteSubject(&message, "[external] "); err != nil {
+			t.Fatalf("%s: rewrite: %v", test.name, err)
+		}
+
+		b, err := ioutil.ReadFile(message.Data.Path)
+		if err != nil {
+			t.Fatalf("%s: read: %v", test.name, err)
+		}
+		if message.Data.Path != original.Path {
+			smtpDataRemove(message.Data)
+		}
+
+		if string(b) != test.data {
+			t.Errorf("%s: data %q, want %q", test.name, b, test.data)
+		}
+
+		if !strings.HasPrefix(message.Subject, "[external] ") {
+			t.Errorf("%s: subject %q without the prefix", test.name, message.Subject)
+		}
+	}
+}
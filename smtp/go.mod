@@ -6,10 +6,13 @@ require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/PaesslerAG/gval v1.1.0
 	github.com/aws/aws-sdk-go v1.36.23
-	github.com/emersion/go-smtp v0.14.0
+	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21
+	github.com/emersion/go-smtp v0.19.0
 	github.com/go-redis/redis/v7 v7.4.0
 	github.com/google/uuid v1.1.2
 	github.com/jhillyerd/enmime v0.8.3
+	github.com/miekg/dns v1.1.50
 	github.com/spf13/pflag v1.0.5
 	github.com/violetnorth/smtplib v1.0.1
+	golang.org/x/net v0.0.0-20210726213435-c6fcb2dbf985
 )
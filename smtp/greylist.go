@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	redis "github.com/go-redis/redis/v7"
+	"github.com/violetnorth/smtplib"
+)
+
+// Greylisting defers the first delivery attempt of an unseen triplet of
+// the client network, envelope sender and recipient with a temporary
+// failure. Mail servers retry the delivery, a retry after "delay" and
+// within "retry_window" of the first attempt is accepted and the triplet
+// is whitelisted for "whitelist_ttl", which is extended on every message.
+// Clients in the allowlist are never deferred, allowlist entries are ip
+// addresses, networks in CIDR notation or domains which are matched with
+// the validated reverse dns names of the client.
+//
+// Greylisting is enabled per mail, stats of each mail count the triplets
+// deferred and the triplets accepted after they are retried.
+
+const (
+	greylistDelayDefault        = 300
+	greylistRetryWindowDefault  = 86400
+	greylistWhitelistTTLDefault = 3024000
+
+	// Only the first names of the client
+	// are matched with the allowlist.
+	greylistNamesLimit = 10
+
+	greylistStatDeferred = "deferred"
+	greylistStatAccepted = "accepted"
+)
+
+// greylistCheck returns a temporary error if the delivery to the
+// recipient is deferred. Deliveries are not deferred if the greylist
+// can't be checked, ie. redis is not available.
+func greylistCheck(s *smtpSession, mail typeMail, recipient string) error {
+	if !config.Greylist.Status || !mail.Greylisting {
+		return nil
+	}
+
+	// Sessions of the local unix socket.
+	ip := smtpRemoteIP(s.Conn.RemoteAddr)
+	if ip == nil {
+		return nil
+	}
+
+	triplet := greylistTriplet(ip, s.From, recipient)
+
+	whitelisted, err := greylistWhitelisted(triplet)
+	if err != nil {
+		logger.Errorf("Failed to check greylist for %s, %v", s.UUID, err)
+		return nil
+	}
+
+	if whitelisted || greylistAllowed(ip) {
+		return nil
+	}
+
+	accepted, err := greylistRetry(mail.Host, triplet)
+	if err != nil {
+		logger.Errorf("Failed to check greylist for %s, %v", s.UUID, err)
+		return nil
+	}
+
+	if accepted {
+		logger.Debugf("Session %s, greylist accepted: %s", s.UUID, triplet)
+		return nil
+	}
+
+	logger.Debugf("Session %s, greylist deferred: %s", s.UUID, triplet)
+	return smtpError(
+		smtplib.StatusActionAbortedLocalError,
+		fmt.Sprintf(`Email Receiver: greylisted "%s", please try again later`, recipient),
+	)
+}
+
+// greylistTriplet returns the triplet of the delivery attempt, clients
+// are grouped by their networks since mail servers may retry from other
+// addresses of the same network.
+func greylistTriplet(ip net.IP, from, recipient string) string {
+	return fmt.Sprintf("%s,%s,%s", smtpRemoteNetwork(ip), strings.ToLower(from), strings.ToLower(recipient))
+}
+
+// greylistWhitelisted returns true if the triplet is whitelisted
+// and extends the whitelist of the triplet.
+func greylistWhitelisted(triplet string) (bool, error) {
+	ttl := greylistDuration(config.Greylist.WhitelistTTL, greylistWhitelistTTLDefault)
+	return redisdb.Expire(redisKeyGreylistWhitelist(triplet), ttl).Result()
+}
+
+// greylistRetry records the first attempt of the triplet and returns
+// true if the attempt is a retry after the delay. Triplets which are
+// not retried within the retry window are removed by their expiry.
+func greylistRetry(host, triplet string) (bool, error) {
+	var (
+		now         = time.Now()
+		delay       = greylistDuration(config.Greylist.Delay, greylistDelayDefault)
+		retryWindow = greylistDuration(config.Greylist.RetryWindow, greylistRetryWindowDefault)
+		key         = redisKeyGreylist(triplet)
+	)
+
+	created, err := redisdb.SetNX(key, now.Unix(), retryWindow).Result()
+	if err != nil {
+		return false, err
+	}
+
+	if created {
+		greylistCount(host, greylistStatDeferred)
+		return false, nil
+	}
+
+	firstAttempt, err := redisdb.Get(key).Int64()
+	if err == redis.Nil {
+		// Triplet expired after it's checked, the
+		// next attempt is a first attempt again.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if now.Sub(time.Unix(firstAttempt, 0)) < delay {
+		return false, nil
+	}
+
+	whitelistTTL := greylistDuration(config.Greylist.WhitelistTTL, greylistWhitelistTTLDefault)
+
+	if err := redisdb.Set(redisKeyGreylistWhitelist(triplet), now.Unix(), whitelistTTL).Err(); err != nil {
+		return false, err
+	}
+
+	if err := redisdb.Del(key).Err(); err != nil {
+		return false, err
+	}
+
+	greylistCount(host, greylistStatAccepted)
+	return true, nil
+}
+
+// greylistCount increments the greylist stat of the mail.
+func greylistCount(host, name string) {
+	if err := redisdb.HIncrBy(redisKeyGreylistStats(host), name, 1).Err(); err != nil {
+		logger.Errorln("Failed to count greylist stat", host, name, err)
+	}
+}
+
+// greylistAllowed returns true if the client is in the allowlist.
+func greylistAllowed(ip net.IP) bool {
+	var domains []string
+	for _, entry := range config.Greylist.Allowlist {
+		entry = strings.TrimSpace(entry)
+
+		if strings.Contains(entry, "/") {
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				logger.Errorln("Failed to parse greylist allowlist network", entry, err)
+				continue
+			}
+
+			if network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		if allowedIP := net.ParseIP(entry); allowedIP != nil {
+			if allowedIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		domains = append(domains, dnsZoneName(entry))
+	}
+
+	if len(domains) == 0 {
+		return false
+	}
+
+	ctx, cancel := dnsContext()
+	defer cancel()
+
+	for _, name := range dnsValidatedNames(ctx, ip, greylistNamesLimit) {
+		for _, domain := range domains {
+			if name == domain || strings.HasSuffix(name, "."+domain) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// greylistDuration returns the duration of the config
+// value in seconds or of the default if it's not set.
+func greylistDuration(seconds, defaultSeconds int) time.Duration {
+	if seconds <= 0 {
+		seconds = defaultSeconds
+	}
+
+	return timeDuration(seconds)
+}
+
+// greylistStatus prints the greylist stats of the mails.
+func greylistStatus() {
+	keys, err := redisdb.Keys(redisKeyGreylistStats("*")).Result()
+	if err != nil {
+		fmt.Println("Failed to list greylist stats", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%d mails with greylist stats\n\n", len(keys))
+	if len(keys) == 0 {
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tDEFERRED\tACCEPTED")
+
+	for _, key := range keys {
+		stats, err := redisdb.HGetAll(key).Result()
+		if err != nil {
+			fmt.Println("Failed to get greylist stats", key, err)
+			os.Exit(1)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\n",
+			strings.TrimPrefix(key, redisKeyGreylistStats("")),
+			greylistStat(stats, greylistStatDeferred),
+			greylistStat(stats, greylistStatAccepted),
+		)
+	}
+
+	w.Flush()
+}
+
+// greylistStat returns the stat or 0 if it's not counted yet.
+func greylistStat(stats map[string]string, name string) string {
+	if stat, ok := stats[name]; ok {
+		return stat
+	}
+	return "0"
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/google/uuid"
+	"github.com/violetnorth/smtplib"
+)
+
+func TestGreylistTriplet(t *testing.T) {
+	tests := []struct {
+		ip      string
+		triplet string
+	}{
+		{"192.0.2.1", "192.0.2.0/24,sender@example.org,koray@example.com"},
+		{"192.0.2.200", "192.0.2.0/24,sender@example.org,koray@example.com"},
+		{"2001:db8::1", "2001:db8::/64,sender@example.org,koray@example.com"},
+	}
+
+	for _, test := range tests {
+		if triplet := greylistTriplet(net.ParseIP(test.ip), "Sender@Example.org", "Koray@example.com"); triplet != test.triplet {
+			t.Errorf("triplet %s of %s, want %s", triplet, test.ip, test.triplet)
+		}
+	}
+}
+
+func TestGreylistAllowed(t *testing.T) {
+	allowlist := config.Greylist.Allowlist
+	t.Cleanup(func() {
+		config.Greylist.Allowlist = allowlist
+	})
+	config.Greylist.Allowlist = []string{"192.0.2.1", " 198.51.100.0/24 ", "not-a-network/33"}
+
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"198.51.100.77", true},
+		{"203.0.113.1", false},
+	}
+
+	for _, test := range tests {
+		if allowed := greylistAllowed(net.ParseIP(test.ip)); allowed != test.allowed {
+			t.Errorf("%s allowed %t, want %t", test.ip, allowed, test.allowed)
+		}
+	}
+}
+
+// TestGreylistCheck defers the first attempt and the retries before
+// the delay, a retry after the delay is accepted and whitelists the
+// triplet for the other clients of the network.
+func TestGreylistCheck(t *testing.T) {
+	testRedis(t)
+
+	previous := config.Greylist
+	t.Cleanup(func() {
+		config.Greylist = previous
+	})
+	config.Greylist.Status = true
+	config.Greylist.Delay = 60
+	config.Greylist.Allowlist = nil
+
+	mail := typeMail{Host: uuid.New().String() + ".example.com", Greylisting: true}
+	recipient := "koray@" + mail.Host
+
+	s := testSession(nil)
+	s.From = "sender@" + uuid.New().String() + ".example.org"
+	triplet := greylistTriplet(smtpRemoteIP(s.Conn.RemoteAddr), s.From, recipient)
+
+	t.Cleanup(func() {
+		redisdb.Del(redisKeyGreylist(triplet), redisKeyGreylistWhitelist(triplet), redisKeyGreylistStats(mail.Host))
+	})
+
+	deferred := func(err error) bool {
+		smtpErr, ok := err.(*smtp.SMTPError)
+		return ok && smtpErr.Code == smtplib.StatusActionAbortedLocalError
+	}
+
+	if err := greylistCheck(s, mail, recipient); !deferred(err) {
+		t.Fatalf("first attempt %v, want deferred", err)
+	}
+
+	if err := greylistCheck(s, mail, recipient); !deferred(err) {
+		t.Fatalf("retry before the delay %v, want deferred", err)
+	}
+
+	// First attempt is moved back past the delay.
+	firstAttempt := time.Now().Add(-2 * time.Minute).Unix()
+	if err := redisdb.Set(redisKeyGreylist(triplet), firstAttempt, time.Hour).Err(); err != nil {
+		t.Fatalf("set first attempt: %v", err)
+	}
+
+	if err := greylistCheck(s, mail, recipient); err != nil {
+		t.Fatalf("retry after the delay %v, want accepted", err)
+	}
+
+	other := testSession(nil)
+	other.From = s.From
+	other.Conn.RemoteAddr = &net.TCPAddr{IP: net.ParseIP("192.0.2.99"), Port: 25}
+	if err := greylistCheck(other, mail, recipient); err != nil {
+		t.Fatalf("whitelisted triplet from the network %v, want accepted", err)
+	}
+
+	stats, err := redisdb.HGetAll(redisKeyGreylistStats(mail.Host)).Result()
+	if err != nil {
+		t.Fatalf("get stats: %v", err)
+	}
+	if stats[greylistStatDeferred] != "1" || stats[greylistStatAccepted] != "1" {
+		t.Fatalf("stats %v, want 1 deferred and 1 accepted", stats)
+	}
+
+	mail.Greylisting = false
+	s.From = "other@" + uuid.New().String() + ".example.org"
+	if err := greylistCheck(s, mail, recipient); err != nil {
+		t.Fatalf("mail without greylisting %v, want accepted", err)
+	}
+}
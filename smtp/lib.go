@@ -22,6 +22,21 @@ func timeDuration(duration int) time.Duration {
 	return time.Duration(duration) * time.Second
 }
 
+// timeBackoff returns the exponential backoff duration of the
+// provided attempt, starting from min and capped at max.
+func timeBackoff(attempt int, min, max time.Duration) time.Duration {
+	backoff := min
+	for i := 1; i < attempt && backoff < max; i++ {
+		backoff *= 2
+	}
+
+	if backoff > max {
+		return max
+	}
+
+	return backoff
+}
+
 // pathEnsure creates the directory path if it
 // doesn't exists.
 func pathEnsure(path string) {
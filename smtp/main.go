@@ -13,8 +13,13 @@ const (
 	version = "1.3.1"
 )
 
-func init() {
+// initApp parses the flags and initializes the application, it's
+// called by main so the package can be loaded by the tests.
+func initApp() {
 	versionAsked := pflag.BoolP("version", "v", false, "Print the version")
+	spoolStatusAsked := pflag.Bool("spool-status", false, "Print the spooled messages")
+	greylistStatusAsked := pflag.Bool("greylist-status", false, "Print the greylist stats of the mails")
+	spamTrainAsked := pflag.String("spam-train", "", "Train the spam classifier with the message files as spam or ham")
 	pflag.StringVarP(&configPath, "config", "c", "config.toml", "Path to config file")
 	pflag.Parse()
 
@@ -27,18 +32,60 @@ func init() {
 
 	initConfig()
 
+	// If the spool status argument passed,
+	// print the spooled messages and exit.
+	if *spoolStatusAsked {
+		config.Logger.Mode = loggerModeConsole
+		initLogger()
+
+		spoolStatus()
+		os.Exit(0)
+	}
+
+	// If the greylist status argument passed,
+	// print the greylist stats and exit.
+	if *greylistStatusAsked {
+		config.Logger.Mode = loggerModeConsole
+		initLogger()
+		initRedis()
+
+		greylistStatus()
+		os.Exit(0)
+	}
+
+	// If the spam train argument passed, train the spam
+	// classifier with the message file arguments and exit.
+	if *spamTrainAsked != "" {
+		config.Logger.Mode = loggerModeConsole
+		initLogger()
+		initRedis()
+
+		spamTrain(*spamTrainAsked, pflag.Args())
+		os.Exit(0)
+	}
+
 	initLogger()
 
 	initRedis()
 
+	initDNS()
+
+	initDNSBL()
+
 	initAWS()
 
+	initSpool()
+
 	initMails()
 
 	initMessages()
+
+	initRatelimit()
 }
 
 func main() {
+	initApp()
+
 	smtpRelay()
 
 	sig := make(chan os.Signal)
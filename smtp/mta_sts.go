@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// MTA-STS (RFC 8461) policies of the recipient domains. Policies
+// are fetched over HTTPS when the id of the dns record changes and
+// cached in redis until their max age.
+
+const (
+	mtaSTSModeEnforce = "enforce"
+	mtaSTSModeTesting = "testing"
+	mtaSTSModeNone    = "none"
+
+	// mtaSTSMaxAge is the maximum max_age of a policy (RFC 8461 section 3.2).
+	mtaSTSMaxAge = 31557600
+
+	// mtaSTSMaxSize is the maximum size of a policy file.
+	mtaSTSMaxSize = 64 * 1024
+)
+
+var mtaSTSClient = &http.Client{
+	Timeout: 60 * time.Second,
+
+	// Redirects are not followed (RFC 8461 section 3.3).
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// mtaSTSPolicy is the MTA-STS policy of a domain.
+type mtaSTSPolicy struct {
+	ID        string    `json:"id"`
+	Mode      string    `json:"mode"`
+	MX        []string  `json:"mx"`
+	MaxAge    int       `json:"max_age"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// mtaSTSLookup returns the policy of the domain, false if the domain
+// has no policy. A cached policy is used until it expires even if
+// the dns record is removed or the policy can not be fetched.
+func mtaSTSLookup(domain string) (mtaSTSPolicy, bool, error) {
+	domain = strings.ToLower(domain)
+	cached, cachedOK := mtaSTSCacheGet(domain)
+
+	id, err := mtaSTSRecordID(domain)
+	if err != nil {
+		if cachedOK {
+			return cached, true, nil
+		}
+		if err == dnsErrNotFound {
+			return mtaSTSPolicy{}, false, nil
+		}
+		return mtaSTSPolicy{}, false, err
+	}
+
+	if cachedOK && cached.ID == id {
+		return cached, true, nil
+	}
+
+	policy, err := mtaSTSFetch(domain)
+	if err != nil {
+		if cachedOK {
+			logger.Errorln("Failed to refresh mta-sts policy, using cached policy", domain, err)
+			return cached, true, nil
+		}
+		return mtaSTSPolicy{}, false, err
+	}
+	policy.ID = id
+
+	mtaSTSCacheSet(domain, policy)
+	return policy, true, nil
+}
+
+// mtaSTSRecordID returns the id of the _mta-sts TXT record.
+func mtaSTSRecordID(domain string) (string, error) {
+	ctx, cancel := dnsContext()
+	defer cancel()
+
+	txts, err := resolver.LookupTXT(ctx, "_mta-sts."+domain)
+	if err != nil {
+		return "", err
+	}
+
+	var records []string
+	for _, txt := range txts {
+		if strings.HasPrefix(strings.TrimSpace(txt), "v=STSv1") {
+			records = append(records, txt)
+		}
+	}
+
+	if len(records) != 1 {
+		return "", dnsErrNotFound
+	}
+
+	id := dkimTags(records[0])["id"]
+	if id == "" {
+		return "", dnsErrNotFound
+	}
+
+	return id, nil
+}
+
+// mtaSTSFetch fetches and parses the policy file of the domain.
+func mtaSTSFetch(domain string) (mtaSTSPolicy, error) {
+	url := fmt.Sprintf("https://mta-sts.%s/.well-known/mta-sts.txt", domain)
+
+	res, err := mtaSTSClient.Get(url)
+	if err != nil {
+		return mtaSTSPolicy{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return mtaSTSPolicy{}, fmt.Errorf("mta-sts policy fetch returned %d", res.StatusCode)
+	}
+
+	if !strings.HasPrefix(res.Header.Get(headerContentType), "text/plain") {
+		return mtaSTSPolicy{}, errors.New("mta-sts policy content type is not text/plain")
+	}
+
+	return mtaSTSParse(io.LimitReader(res.Body, mtaSTSMaxSize))
+}
+
+// mtaSTSParse parses a policy file.
+func mtaSTSParse(r io.Reader) (mtaSTSPolicy, error) {
+	var (
+		policy  mtaSTSPolicy
+		version string
+	)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		switch key {
+		case "version":
+			version = value
+		case "mode":
+			policy.Mode = value
+		case "mx":
+			policy.MX = append(policy.MX, strings.ToLower(value))
+		case "max_age":
+			maxAge, err := strconv.Atoi(value)
+			if err != nil || maxAge < 0 {
+				return policy, errors.New("mta-sts policy max_age format error")
+			}
+			policy.MaxAge = maxAge
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return policy, err
+	}
+
+	if version != "STSv1" {
+		return policy, errors.New("mta-sts policy version is not STSv1")
+	}
+
+	switch policy.Mode {
+	case mtaSTSModeEnforce, mtaSTSModeTesting:
+		if len(policy.MX) == 0 {
+			return policy, errors.New("mta-sts policy has no mx")
+		}
+	case mtaSTSModeNone:
+	default:
+		return policy, fmt.Errorf("mta-sts policy mode %s is not supported", policy.Mode)
+	}
+
+	if policy.MaxAge > mtaSTSMaxAge {
+		policy.MaxAge = mtaSTSMaxAge
+	}
+	policy.ExpiresAt = time.Now().UTC().Add(time.Duration(policy.MaxAge) * time.Second)
+
+	return policy, nil
+}
+
+// mtaSTSMatch returns true if the mx host matches one of the mx
+// patterns of the policy. Wildcards match a single leftmost label.
+func mtaSTSMatch(policy mtaSTSPolicy, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	for _, pattern := range policy.MX {
+		if strings.HasPrefix(pattern, "*.") {
+			i := strings.Index(host, ".")
+			if i > 0 && host[i+1:] == pattern[2:] {
+				return true
+			}
+			continue
+		}
+
+		if host == pattern {
+			return true
+		}
+	}
+
+	return false
+}
+
+func mtaSTSCacheGet(domain string) (mtaSTSPolicy, bool) {
+	raw, err := redisdb.Get(redisKeyMTASTS(domain)).Result()
+	if err != nil {
+		if err != redis.Nil {
+			logger.Errorln("Failed to get mta-sts policy from redis", domain, err)
+		}
+		return mtaSTSPolicy{}, false
+	}
+
+	var policy mtaSTSPolicy
+	if err := json.Unmarshal([]byte(raw), &policy); err != nil {
+		logger.Errorln("Failed to unmarshal mta-sts policy", domain, err)
+		return mtaSTSPolicy{}, false
+	}
+
+	if time.Now().UTC().After(policy.ExpiresAt) {
+		return mtaSTSPolicy{}, false
+	}
+
+	return policy, true
+}
+
+func mtaSTSCacheSet(domain string, policy mtaSTSPolicy) {
+	raw, err := json.Marshal(policy)
+	if err != nil {
+		logger.Errorln("Failed to marshal mta-sts policy", domain, err)
+		return
+	}
+
+	ttl := time.Until(policy.ExpiresAt)
+	if ttl <= 0 {
+		return
+	}
+
+	if err := redisdb.Set(redisKeyMTASTS(domain), raw, ttl).Err(); err != nil {
+		logger.Errorln("Failed to save mta-sts policy to redis", domain, err)
+	}
+}
@@ -1,35 +1,142 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net"
+	"os"
 
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 )
 
 var (
-	serverSMTP *smtp.Server
+	serverSMTP           *smtp.Server
+	serverSMTPTLS        *smtp.Server
+	serverSMTPSubmission *smtp.Server
+	serverLMTP           *smtp.Server
 )
 
 func smtpRelay() {
-	be := &smtpBackend{}
-	serverSMTP = smtp.NewServer(be)
+	var tlsConfig *tls.Config
+	if config.Server.TLS.Status {
+		var err error
+		if tlsConfig, err = smtpTLSConfig(); err != nil {
+			logger.Fatalln("Failed to create smtp tls config", err)
+		}
+	}
+
+	// STARTTLS is advertised on the plaintext listener
+	// when the tls config is set.
+	serverSMTP = smtpServer(config.Server.Port, tlsConfig, false)
+	go smtpListen(serverSMTP, false)
 
-	serverSMTP.Addr = fmt.Sprintf("%s:%d", config.Server.Host, config.Server.Port)
-	serverSMTP.Domain = config.Server.Domain
+	// Implicit TLS listener (ie. port 465) is created only
+	// when tls is enabled and the port is configured.
+	if tlsConfig != nil && config.Server.TLS.ImplicitPort > 0 {
+		serverSMTPTLS = smtpServer(config.Server.TLS.ImplicitPort, tlsConfig, false)
+		go smtpListenTLS(serverSMTPTLS, false)
+	}
 
-	serverSMTP.ReadTimeout = timeDuration(config.Server.TimeoutRead)
-	serverSMTP.WriteTimeout = timeDuration(config.Server.TimeoutWrite)
+	// Submission listener (ie. port 587) only accepts emails
+	// from authenticated clients, to be sent outbound.
+	if config.Server.Submission.Status {
+		if tlsConfig == nil {
+			logger.Errorln("Submission listener has no tls config, clients won't be able to authenticate")
+		}
 
-	serverSMTP.MaxMessageBytes = config.Server.MaxMessageBytes
-	serverSMTP.MaxRecipients = config.Server.MaxRecipients
-	serverSMTP.AllowInsecureAuth = config.Server.AllowInsecureAuth
+		serverSMTPSubmission = smtpServer(config.Server.Submission.Port, tlsConfig, true)
+		go smtpListen(serverSMTPSubmission, true)
+	}
 
-	go smtpListen(serverSMTP)
+	// LMTP listener on a unix socket, ie. as the delivery
+	// agent of Postfix, returns a status per recipient.
+	if config.Server.LMTP.Status {
+		serverLMTP = smtpServer(0, nil, false)
+		serverLMTP.Addr = config.Server.LMTP.Path
+		serverLMTP.LMTP = true
+		go smtpListenLMTP(serverLMTP)
+	}
 }
 
-func smtpListen(s *smtp.Server) {
+// smtpServer creates an smtp server listening on the provided
+// port with the server configs.
+func smtpServer(port int, tlsConfig *tls.Config, submission bool) *smtp.Server {
+	be := &smtpBackend{submission: submission}
+	s := smtp.NewServer(be)
+
+	// AUTH is only advertised on the submission listener and only
+	// over tls. AUTH PLAIN is enabled by default, LOGIN is still
+	// used by some submission clients.
+	if submission {
+		s.EnableAuth(sasl.Login, func(conn *smtp.Conn) sasl.Server {
+			return sasl.NewLoginServer(func(username, password string) error {
+				return conn.Session().AuthPlain(username, password)
+			})
+		})
+		s.AllowInsecureAuth = false
+	} else {
+		s.AuthDisabled = true
+	}
+
+	// DSN parameters (RFC 3461) are only accepted from the receiver
+	// clients, submitted messages are sent with the default
+	// notifications.
+	s.EnableDSN = !submission
+
+	s.Addr = fmt.Sprintf("%s:%d", config.Server.Host, port)
+	s.Domain = config.Server.Domain
+	s.TLSConfig = tlsConfig
+
+	s.ReadTimeout = timeDuration(config.Server.TimeoutRead)
+	s.WriteTimeout = timeDuration(config.Server.TimeoutWrite)
+
+	s.MaxMessageBytes = int64(config.Server.MaxMessageBytes)
+	s.MaxRecipients = config.Server.MaxRecipients
+
+	return s
+}
+
+// smtpListen serves the smtp server, the connections are rate limited
+// and the receiver clients are checked in the dns blocklists before
+// they are served.
+func smtpListen(s *smtp.Server, submission bool) {
 	logger.Println("(SMTP) Listening on", s.Addr)
-	if err := s.ListenAndServe(); err != nil {
+
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		logger.Fatalln("Failed to listen smtp", err)
+	}
+
+	if err := s.Serve(smtpListenerNew(l, nil, !submission)); err != nil {
 		logger.Fatalln("Failed to serve smtp", err)
 	}
 }
+
+// smtpListenTLS serves the smtp server with implicit tls, the connections
+// are checked before the tls handshake.
+func smtpListenTLS(s *smtp.Server, submission bool) {
+	logger.Println("(SMTP) Listening with implicit tls on", s.Addr)
+
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		logger.Fatalln("Failed to listen smtp with tls", err)
+	}
+
+	if err := s.Serve(smtpListenerNew(l, s.TLSConfig, !submission)); err != nil {
+		logger.Fatalln("Failed to serve smtp with tls", err)
+	}
+}
+
+func smtpListenLMTP(s *smtp.Server) {
+	// Socket of a previous run is removed, listen
+	// fails if the socket file exists.
+	if err := os.Remove(s.Addr); err != nil && !os.IsNotExist(err) {
+		logger.Fatalln("Failed to remove lmtp socket", err)
+	}
+
+	logger.Println("(LMTP) Listening on", s.Addr)
+	if err := s.ListenAndServe(); err != nil {
+		logger.Fatalln("Failed to serve lmtp", err)
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	redis "github.com/go-redis/redis/v7"
+	"github.com/violetnorth/smtplib"
+)
+
+// Rate limits count the connections, MAIL commands, recipients and
+// message bytes of the inbound sessions in a sliding "window". Limits
+// apply per client ip, per client network, per envelope sender domain
+// and per recipient inbox. The sliding window is approximated with the
+// counters of the current and the previous fixed windows, the previous
+// counter is weighted by the part of it which is still in the window.
+//
+// Connections over the limit are closed with a 421 reply. Sessions over
+// the MAIL command limits get a 421 reply at the first recipient of a
+// mail and the connection is closed after it, recipients and messages
+// get a 452 reply. Violations of the sessions delivering to a mail are
+// reported to the API every "report_every" so the mail owners can
+// review them, only the first violation of a limit in a window is
+// reported. Connection violations are only logged since the mails of
+// the connection are unknown.
+
+const (
+	ratelimitScopeIP      = "ip"
+	ratelimitScopeNetwork = "network"
+	ratelimitScopeSender  = "sender"
+	ratelimitScopeInbox   = "inbox"
+
+	ratelimitConnections = "connections"
+	ratelimitMails       = "mails"
+	ratelimitRecipients  = "recipients"
+	ratelimitBytes       = "bytes"
+
+	ratelimitWindowDefault      = 3600
+	ratelimitReportEveryDefault = 60
+
+	// Transactions of the counters are retried this many
+	// times if other sessions change the counters.
+	ratelimitTakeRetries = 10
+
+	// Violations are dropped if the API is not
+	// available for long enough to queue more.
+	ratelimitViolationsMax = 1000
+)
+
+var (
+	ratelimitViolationsMu sync.Mutex
+	ratelimitViolations   []typeMailRatelimitViolation
+)
+
+// ratelimitKey is a counter of a scope which is limited.
+type ratelimitKey struct {
+	Scope string
+	Name  string
+	Key   string
+	Limit int
+}
+
+func initRatelimit() {
+	if !config.Ratelimit.Status {
+		return
+	}
+
+	go func() {
+		logger.Println("Creating rate limit violations report timer")
+
+		reportEvery := timeDuration(config.Ratelimit.ReportEvery)
+		if reportEvery <= 0 {
+			reportEvery = timeDuration(ratelimitReportEveryDefault)
+		}
+
+		reportTicker := time.NewTicker(reportEvery)
+		defer reportTicker.Stop()
+
+		for {
+			select {
+			case <-reportTicker.C:
+				ratelimitReport()
+			}
+		}
+	}()
+}
+
+// ratelimitConnection returns true if the client is over its connection
+// limits, the connection is closed with a 421 before it's served. The
+// violation is only logged, no mail of the connection is known yet.
+func ratelimitConnection(ip net.IP) bool {
+	if !config.Ratelimit.Status || ip == nil {
+		return false
+	}
+
+	key, err := ratelimitTake(ratelimitKeys(ratelimitConnections, ip, "", nil), 1)
+	if err != nil {
+		logger.Errorln("Failed to check connection rate limit", ip, err)
+		return false
+	}
+
+	if key == nil {
+		return false
+	}
+
+	logger.Errorf("Rejecting connection of %s, %s %s limit of %d exceeded for %s", ip, key.Scope, key.Name, key.Limit, key.Key)
+	return true
+}
+
+// ratelimitMail checks the MAIL command limits of the session. The
+// exceeded limit is kept on the session and the MAIL command is
+// rejected at the first recipient of a mail, so the violation is
+// reported to the mail.
+func ratelimitMail(s *smtpSession) {
+	s.RatelimitMail = nil
+
+	ip := smtpRemoteIP(s.Conn.RemoteAddr)
+	if !config.Ratelimit.Status || ip == nil {
+		return
+	}
+
+	key, err := ratelimitTake(ratelimitKeys(ratelimitMails, ip, s.From, nil), 1)
+	if err != nil {
+		logger.Errorf("Failed to check mail rate limit for %s, %v", s.UUID, err)
+		return
+	}
+
+	s.RatelimitMail = key
+}
+
+// ratelimitMailRcpt returns an error if the session exceeded the MAIL
+// command limits, the violation is reported to the mail of the
+// recipient and the connection is closed.
+func ratelimitMailRcpt(s *smtpSession, mail typeMail, recipient string) error {
+	if s.RatelimitMail == nil {
+		return nil
+	}
+
+	// 421 closes the transmission channel (RFC 5321 section 3.8).
+	ratelimitViolate(s, *s.RatelimitMail, []string{mail.Host}, recipient)
+	smtpListenerClose(s.Conn.RemoteAddr)
+	return smtpError(
+		smtplib.StatusServiceNotAvailable,
+		fmt.Sprintf("Email Receiver: too many emails, please try again later"),
+	)
+}
+
+// ratelimitRcpt checks the recipient limits of the session
+// for the recipient of the mail.
+func ratelimitRcpt(s *smtpSession, mail typeMail, recipient string) error {
+	ip := smtpRemoteIP(s.Conn.RemoteAddr)
+	if !config.Ratelimit.Status || ip == nil {
+		return nil
+	}
+
+	key, err := ratelimitTake(ratelimitKeys(ratelimitRecipients, ip, s.From, []string{recipient}), 1)
+	if err != nil {
+		logger.Errorf("Failed to check recipient rate limit for %s, %v", s.UUID, err)
+		return nil
+	}
+
+	if key == nil {
+		return nil
+	}
+
+	ratelimitViolate(s, *key, []string{mail.Host}, recipient)
+	return smtpError(
+		smtplib.StatusActionNotTakenInsufficentStorage,
+		fmt.Sprintf(`Email Receiver: too many emails for "%s", please try again later`, recipient),
+	)
+}
+
+// ratelimitData checks the message bytes limits of the session
+// for all of the recipients of the message.
+func ratelimitData(s *smtpSession, size int64) error {
+	ip := smtpRemoteIP(s.Conn.RemoteAddr)
+	if !config.Ratelimit.Status || ip == nil {
+		return nil
+	}
+
+	var (
+		inboxes []string
+		hosts   []string
+	)
+
+	seen := make(map[string]bool)
+	for _, recipient := range s.Recipients {
+		inboxes = append(inboxes, recipient.Address)
+
+		host := strings.ToLower(recipient.Address[strings.LastIndex(recipient.Address, "@")+1:])
+		if !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+
+	key, err := ratelimitTake(ratelimitKeys(ratelimitBytes, ip, s.From, inboxes), size)
+	if err != nil {
+		logger.Errorf("Failed to check bytes rate limit for %s, %v", s.UUID, err)
+		return nil
+	}
+
+	if key == nil {
+		return nil
+	}
+
+	ratelimitViolate(s, *key, hosts, "")
+	return smtpError(
+		smtplib.StatusActionNotTakenInsufficentStorage,
+		fmt.Sprintf("Email Receiver: too many email bytes, please try again later"),
+	)
+}
+
+// ratelimitKeys returns the keys of the scopes which are
+// limited for the counter of the client, sender and inboxes.
+func ratelimitKeys(name string, ip net.IP, from string, inboxes []string) []ratelimitKey {
+	var keys []ratelimitKey
+
+	add := func(scope, key string, limits tomlConfigRatelimits) {
+		limit := ratelimitLimit(name, limits)
+		if limit <= 0 || key == "" {
+			return
+		}
+
+		keys = append(keys, ratelimitKey{
+			Scope: scope,
+			Name:  name,
+			Key:   key,
+			Limit: limit,
+		})
+	}
+
+	add(ratelimitScopeIP, ip.String(), config.Ratelimit.IP)
+	add(ratelimitScopeNetwork, smtpRemoteNetwork(ip), config.Ratelimit.Network)
+
+	// Null sender has no domain.
+	if at := strings.LastIndex(from, "@"); at > 0 {
+		add(ratelimitScopeSender, strings.ToLower(from[at+1:]), config.Ratelimit.Sender)
+	}
+
+	for _, inbox := range inboxes {
+		add(ratelimitScopeInbox, strings.ToLower(inbox), config.Ratelimit.Inbox)
+	}
+
+	return keys
+}
+
+// ratelimitLimit returns the limit of the counter in the limits.
+func ratelimitLimit(name string, limits tomlConfigRatelimits) int {
+	switch name {
+	case ratelimitConnections:
+		return limits.Connections
+	case ratelimitMails:
+		return limits.Mails
+	case ratelimitRecipients:
+		return limits.Recipients
+	case ratelimitBytes:
+		return limits.Bytes
+	}
+
+	return 0
+}
+
+// ratelimitTake adds n to the counters of the keys if none of them
+// exceeds its limit, otherwise returns the first key which exceeds.
+// Counters are checked and added in a transaction which watches the
+// buckets of the keys, so concurrent sessions can't all pass the check
+// with the last of a limit. The transaction is retried if any of the
+// buckets changes before it's executed.
+func ratelimitTake(keys []ratelimitKey, n int64) (*ratelimitKey, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	window := ratelimitWindow()
+	for attempt := 0; attempt < ratelimitTakeRetries; attempt++ {
+		now := time.Now()
+		bucket := now.Unix() / int64(window.Seconds())
+
+		var buckets []string
+		for _, key := range keys {
+			buckets = append(buckets,
+				redisKeyRatelimit(key.Scope, key.Name, key.Key, bucket),
+				redisKeyRatelimit(key.Scope, key.Name, key.Key, bucket-1),
+			)
+		}
+
+		var exceeded *ratelimitKey
+		err := redisdb.Watch(func(tx *redis.Tx) error {
+			for i, key := range keys {
+				count, err := ratelimitCount(tx, key, now)
+				if err != nil {
+					return err
+				}
+
+				if count+float64(n) > float64(key.Limit) {
+					exceeded = &keys[i]
+					return nil
+				}
+			}
+
+			_, err := tx.TxPipelined(func(pipe redis.Pipeliner) error {
+				for _, key := range keys {
+					current := redisKeyRatelimit(key.Scope, key.Name, key.Key, bucket)
+					pipe.IncrBy(current, n)
+					pipe.Expire(current, 2*window)
+				}
+				return nil
+			})
+			return err
+		}, buckets...)
+
+		if err == redis.TxFailedErr {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return exceeded, nil
+	}
+
+	return nil, fmt.Errorf("rate limit counters changed in %d attempts", ratelimitTakeRetries)
+}
+
+// ratelimitCount returns the count of the key in the sliding window.
+func ratelimitCount(c redis.Cmdable, key ratelimitKey, now time.Time) (float64, error) {
+	window := ratelimitWindow()
+	seconds := int64(window.Seconds())
+	bucket := now.Unix() / seconds
+
+	current, err := c.Get(redisKeyRatelimit(key.Scope, key.Name, key.Key, bucket)).Int64()
+	if err != nil && err != redis.Nil {
+		return 0, err
+	}
+
+	previous, err := c.Get(redisKeyRatelimit(key.Scope, key.Name, key.Key, bucket-1)).Int64()
+	if err != nil && err != redis.Nil {
+		return 0, err
+	}
+
+	elapsed := now.Sub(time.Unix(bucket*seconds, 0))
+	weight := 1 - float64(elapsed)/float64(window)
+
+	return float64(current) + float64(previous)*weight, nil
+}
+
+// ratelimitWindow returns the duration of the window.
+func ratelimitWindow() time.Duration {
+	if config.Ratelimit.Window <= 0 {
+		return timeDuration(ratelimitWindowDefault)
+	}
+
+	return timeDuration(config.Ratelimit.Window)
+}
+
+// ratelimitViolate logs the violation of the session and queues
+// the first violation of the key in the window of each mail to
+// be reported.
+func ratelimitViolate(s *smtpSession, key ratelimitKey, hosts []string, recipient string) {
+	logger.Errorf("Rejecting %s for %s, %s %s limit of %d exceeded for %s", key.Name, s.UUID, key.Scope, key.Name, key.Limit, key.Key)
+
+	for _, host := range hosts {
+		first, err := redisdb.SetNX(redisKeyRatelimitViolation(host, key.Scope, key.Name, key.Key), "true", ratelimitWindow()).Result()
+		if err != nil {
+			logger.Errorf("Failed to record rate limit violation for %s, %v", s.UUID, err)
+			continue
+		}
+
+		if !first {
+			continue
+		}
+
+		violation := typeMailRatelimitViolation{
+			Host:      host,
+			Scope:     key.Scope,
+			Name:      key.Name,
+			Key:       key.Key,
+			Limit:     key.Limit,
+			RemoteIP:  smtpRemoteIP(s.Conn.RemoteAddr).String(),
+			Helo:      s.Conn.Helo,
+			From:      s.From,
+			Recipient: recipient,
+			CreatedAt: time.Now().UTC(),
+		}
+
+		ratelimitViolationsMu.Lock()
+		if len(ratelimitViolations) < ratelimitViolationsMax {
+			ratelimitViolations = append(ratelimitViolations, violation)
+		}
+		ratelimitViolationsMu.Unlock()
+	}
+}
+
+// ratelimitReport sends the queued violations to the API, the
+// violations are queued again if the API is not available.
+func ratelimitReport() {
+	ratelimitViolationsMu.Lock()
+	violations := ratelimitViolations
+	ratelimitViolations = nil
+	ratelimitViolationsMu.Unlock()
+
+	if len(violations) == 0 {
+		return
+	}
+
+	if err := apiRequestRatelimitViolations(violations); err != nil {
+		logger.Errorln("Failed to report rate limit violations, api request error", err)
+
+		ratelimitViolationsMu.Lock()
+		violations = append(violations, ratelimitViolations...)
+		if len(violations) > ratelimitViolationsMax {
+			violations = violations[:ratelimitViolationsMax]
+		}
+		ratelimitViolations = violations
+		ratelimitViolationsMu.Unlock()
+	}
+}
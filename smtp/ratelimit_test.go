@@ -0,0 +1,179 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	redis "github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+	"github.com/violetnorth/smtplib"
+)
+
+// testRedis connects to the redis of SMTP_TEST_REDIS, tests which
+// need redis are skipped without it.
+func testRedis(t *testing.T) {
+	t.Helper()
+
+	addr := os.Getenv("SMTP_TEST_REDIS")
+	if addr == "" {
+		t.Skip("SMTP_TEST_REDIS is not set")
+	}
+
+	previous := redisdb
+	t.Cleanup(func() {
+		redisdb.Close()
+		redisdb = previous
+	})
+
+	redisdb = redis.NewClient(&redis.Options{Addr: addr})
+	if err := redisdb.Ping().Err(); err != nil {
+		t.Skipf("redis %s is not available: %v", addr, err)
+	}
+}
+
+// TestRatelimitTakeConcurrent takes the counter from concurrent
+// sessions, only the limit of them can pass the check.
+func TestRatelimitTakeConcurrent(t *testing.T) {
+	testRedis(t)
+
+	const (
+		limit    = 20
+		sessions = 100
+	)
+
+	keys := []ratelimitKey{{
+		Scope: ratelimitScopeIP,
+		Name:  ratelimitMails,
+		Key:   uuid.New().String(),
+		Limit: limit,
+	}}
+
+	var (
+		wg       sync.WaitGroup
+		taken    int32
+		failures int32
+	)
+	for i := 0; i < sessions; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				key, err := ratelimitTake(keys, 1)
+				if err != nil {
+					atomic.AddInt32(&failures, 1)
+					continue
+				}
+
+				if key == nil {
+					atomic.AddInt32(&taken, 1)
+				}
+				return
+			}
+		}()
+	}
+	wg.Wait()
+
+	if taken != limit {
+		t.Fatalf("taken %d times, want %d (%d transactions failed)", taken, limit, failures)
+	}
+}
+
+// TestRatelimitMailRcpt rejects the first recipient of a mail after
+// the MAIL command limit is exceeded, the violation is reported to
+// the mail of the recipient.
+func TestRatelimitMailRcpt(t *testing.T) {
+	testRedis(t)
+
+	previousRatelimit, previousViolations := config.Ratelimit, ratelimitViolations
+	t.Cleanup(func() {
+		config.Ratelimit, ratelimitViolations = previousRatelimit, previousViolations
+	})
+
+	config.Ratelimit.Status = true
+	config.Ratelimit.IP = tomlConfigRatelimits{}
+	config.Ratelimit.Network = tomlConfigRatelimits{}
+	config.Ratelimit.Inbox = tomlConfigRatelimits{}
+	config.Ratelimit.Sender = tomlConfigRatelimits{Mails: 1}
+	ratelimitViolations = nil
+
+	mail := typeMail{Host: uuid.New().String() + ".example.com"}
+	s := testSession(nil)
+	s.From = "sender@" + uuid.New().String() + ".example.org"
+
+	ratelimitMail(s)
+	if err := ratelimitMailRcpt(s, mail, "koray@"+mail.Host); err != nil {
+		t.Fatalf("first mail rejected: %v", err)
+	}
+
+	ratelimitMail(s)
+	err := ratelimitMailRcpt(s, mail, "koray@"+mail.Host)
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != smtplib.StatusServiceNotAvailable {
+		t.Fatalf("second mail error %v, want 421", err)
+	}
+
+	if len(ratelimitViolations) != 1 {
+		t.Fatalf("%d violations queued, want 1", len(ratelimitViolations))
+	}
+
+	violation := ratelimitViolations[0]
+	if violation.Host != mail.Host || violation.Name != ratelimitMails || violation.Recipient != "koray@"+mail.Host {
+		t.Fatalf("violation %+v", violation)
+	}
+
+	s.Reset()
+	if s.RatelimitMail != nil {
+		t.Fatal("exceeded limit is kept after reset")
+	}
+}
+
+// TestSMTPListenerClose ends the reads of a closing connection while
+// the replies can still be written.
+func TestSMTPListenerClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	sl := smtpListenerNew(l, nil, false)
+	defer sl.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+
+	conn, err := sl.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := client.Write([]byte("MAIL FROM:<sender@example.org>\r\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	buf := make([]byte, 64)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatalf("read before closing: %v", err)
+	}
+
+	smtpListenerClose(client.LocalAddr())
+
+	if _, err := conn.Write([]byte("421 4.7.0 too many emails\r\n")); err != nil {
+		t.Fatalf("write reply: %v", err)
+	}
+
+	if _, err := client.Write([]byte("RCPT TO:<koray@example.com>\r\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if n, err := conn.Read(buf); err != io.EOF {
+		t.Fatalf("read after closing %d bytes, %v, want EOF", n, err)
+	}
+}
@@ -10,6 +10,20 @@ import (
 // 		- "true" / "false" (is mail known)
 // `mail:<host>` <string>
 // 		- mail details (marshalled json string)
+// `mtasts:<domain>` <string>
+// 		- mta-sts policy of a recipient domain (marshalled json string)
+// `greylist:<network>/<bits>,<from>,<rcpt>` <string>
+// 		- unix time of the first attempt of a greylisted triplet
+// `greylist:white:<network>/<bits>,<from>,<rcpt>` <string>
+// 		- unix time a greylisted triplet is whitelisted
+// `greylist:stats:<host>` <hash>
+// 		- greylist counters of a mail ("deferred", "accepted")
+// `dnsbl:<list>:<ip>` <string>
+// 		- return codes of an ip in a dns blocklist ("" if not listed)
+// `ratelimit:<scope>:<name>:<key>:<window>` <string>
+// 		- rate limit counter of a key in a fixed window
+// `ratelimit:violation:<host>:<scope>:<name>:<key>` <string>
+// 		- "true" if the violation of a key is reported in the window
 
 // redisKeyMailKnown is used to check if a mail is known.
 func redisKeyMailKnown(host string) string {
@@ -29,3 +43,56 @@ func redisKeyMail(host string) string {
 	host = strings.TrimSpace(host)
 	return fmt.Sprintf("mail:%s", host)
 }
+
+// redisKeyMTASTS is used to cache the mta-sts policy of a domain.
+func redisKeyMTASTS(domain string) string {
+	domain = strings.ToLower(domain)
+	domain = strings.TrimSpace(domain)
+	return fmt.Sprintf("mtasts:%s", domain)
+}
+
+// redisKeyGreylist is used to track the first attempt of a triplet.
+func redisKeyGreylist(triplet string) string {
+	return fmt.Sprintf("greylist:%s", triplet)
+}
+
+// redisKeyGreylistWhitelist is used to check if a triplet is whitelisted.
+func redisKeyGreylistWhitelist(triplet string) string {
+	return fmt.Sprintf("greylist:white:%s", triplet)
+}
+
+// redisKeyGreylistStats is used to count the greylisted triplets of a mail.
+func redisKeyGreylistStats(host string) string {
+	host = strings.ToLower(host)
+	host = strings.TrimSpace(host)
+	return fmt.Sprintf("greylist:stats:%s", host)
+}
+
+// redisKeyDNSBL is used to cache the answer of a dns blocklist for an ip.
+func redisKeyDNSBL(list, ip string) string {
+	list = strings.ToLower(list)
+	list = strings.TrimSpace(list)
+	return fmt.Sprintf("dnsbl:%s:%s", list, ip)
+}
+
+// redisKeyRatelimit is used to count a rate limit key in a window.
+func redisKeyRatelimit(scope, name, key string, window int64) string {
+	return fmt.Sprintf("ratelimit:%s:%s:%s:%d", scope, name, key, window)
+}
+
+// redisKeyRatelimitViolation is used to report a violation once in a window.
+func redisKeyRatelimitViolation(host, scope, name, key string) string {
+	host = strings.ToLower(host)
+	host = strings.TrimSpace(host)
+	return fmt.Sprintf("ratelimit:violation:%s:%s:%s:%s", host, scope, name, key)
+}
+
+// redisKeySpamBayesTokens is used to count the tokens of the trained messages of a class.
+func redisKeySpamBayesTokens(class string) string {
+	return fmt.Sprintf("spam:bayes:tokens:%s", class)
+}
+
+// redisKeySpamBayesMessages is used to count the trained messages of each class.
+func redisKeySpamBayesMessages() string {
+	return "spam:bayes:messages"
+}
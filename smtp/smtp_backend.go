@@ -1,49 +1,81 @@
 package main
 
 import (
+	"fmt"
+
 	"github.com/emersion/go-smtp"
 	"github.com/google/uuid"
+	"github.com/violetnorth/smtplib"
 )
 
-// The smtpBackend implements SMTP server methods.
-type smtpBackend struct{}
+// The smtpBackend implements SMTP server methods. Submission
+// backends require clients to authenticate before sending emails.
+type smtpBackend struct {
+	submission bool
+}
 
-// Login handles a login command with username and password.
-func (bkd *smtpBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+// NewSession creates the session of a connection when the client
+// greets the server, the dns blocklist results of the receiver
+// clients are read from their connection. Sessions of submission
+// backends send emails once they authenticate.
+func (bkd *smtpBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
 	session := smtpSession{
 		UUID: uuid.New().String(),
 
 		Conn: smtpConn{
-			LocalAddr:  state.LocalAddr,
-			RemoteAddr: state.RemoteAddr,
-			TLS:        state.TLS,
+			LocalAddr:  c.Conn().LocalAddr(),
+			RemoteAddr: c.Conn().RemoteAddr(),
 		},
 
 		Auth: smtpAuth{
-			Anonymous: false,
-			Username:  username,
-			Password:  password,
+			Anonymous: !bkd.submission,
 		},
+
+		conn: c,
+	}
+	session.Conn.TLS, _ = c.TLSConnectionState()
+
+	if !bkd.submission {
+		if conn, ok := smtpListenerFind(session.Conn.RemoteAddr); ok {
+			session.DNSBL = conn.DNSBL
+		}
 	}
 
 	return &session, nil
 }
 
-// AnonymousLogin requires clients to authenticate using SMTP AUTH before sending emails
-func (bkd *smtpBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
-	session := smtpSession{
-		UUID: uuid.New().String(),
+// AuthPlain handles a login command with username and password. The
+// credential is verified by the API, the session sends as the
+// address of the inbox of the credential.
+func (s *smtpSession) AuthPlain(username, password string) error {
+	if s.Auth.Anonymous {
+		return smtp.ErrAuthUnsupported
+	}
 
-		Conn: smtpConn{
-			LocalAddr:  state.LocalAddr,
-			RemoteAddr: state.RemoteAddr,
-			TLS:        state.TLS,
-		},
+	inbox, ok, err := apiRequestCredentialsVerify(username, password)
+	if err != nil {
+		logger.Errorln("Failed to verify credential", username, err)
+		return smtpError(
+			smtplib.StatusAuthenticationTemporaryFailured,
+			fmt.Sprintf("Email Submission: authentication temporarily failed"),
+		)
+	}
 
-		Auth: smtpAuth{
-			Anonymous: true,
-		},
+	if !ok {
+		logger.Errorln("Failed to login, credential is not valid", username, smtpRemoteIP(s.Conn.RemoteAddr))
+		return smtpError(
+			smtplib.StatusAuthenticationInvalid,
+			fmt.Sprintf("Email Submission: authentication credentials invalid"),
+		)
 	}
 
-	return &session, nil
+	s.Auth = smtpAuth{
+		Anonymous: false,
+		Username:  username,
+		InboxID:   inbox.ID,
+		Address:   inbox.Address,
+	}
+
+	logger.Debugf("Session %s, login: %s as %s", s.UUID, username, inbox.Address)
+	return nil
 }
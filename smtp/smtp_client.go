@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Outbound SMTP client. STARTTLS is always attempted when offered,
+// the TLS policy of an upstream decides if the delivery fails when
+// TLS can not be negotiated or the certificate can not be verified:
+// 	- dane: TLSA records of the upstream are DNSSEC validated (RFC 7672)
+// 	- mta-sts: recipient domain has an enforced MTA-STS policy (RFC 8461)
+// 	- mta-sts-testing: MTA-STS policy in testing mode, failures are recorded
+// 	- none: opportunistic TLS (RFC 7435), falls back to plaintext
+
+const (
+	smtpTLSPolicyNone          = "none"
+	smtpTLSPolicyMTASTS        = "mta-sts"
+	smtpTLSPolicyMTASTSTesting = "mta-sts-testing"
+	smtpTLSPolicyDANE          = "dane"
+
+	// TLSA parameters used by DANE for SMTP (RFC 7672 section 3.1).
+	dnsTLSAUsageDANETA    = 2
+	dnsTLSAUsageDANEEE    = 3
+	dnsTLSASelectorCert   = 0
+	dnsTLSASelectorSPKI   = 1
+	dnsTLSAMatchingFull   = 0
+	dnsTLSAMatchingSHA256 = 1
+	dnsTLSAMatchingSHA512 = 2
+
+	smtpOutboundPortDefault = 25
+)
+
+// smtpTLSOutcome is the TLS outcome of a delivery to an upstream.
+type smtpTLSOutcome struct {
+	Host        string
+	Policy      string
+	Version     string
+	CipherSuite string
+	Verified    bool
+	Error       string
+
+	// DSN is true if the upstream supports
+	// the DSN extension (RFC 3461).
+	DSN bool
+}
+
+// smtpTLSRequirement is the TLS policy of an upstream.
+type smtpTLSRequirement struct {
+	policy   string
+	required bool
+	tlsas    []dnsTLSA
+}
+
+// smtpUpstreamAddr returns the host and the port of an upstream, the
+// outbound port is used if the upstream target has no port.
+func smtpUpstreamAddr(target string) (string, string) {
+	if host, port, err := net.SplitHostPort(target); err == nil {
+		return host, port
+	}
+
+	port := config.Outbound.Port
+	if port == 0 {
+		port = smtpOutboundPortDefault
+	}
+
+	return target, strconv.Itoa(port)
+}
+
+// smtpTLSRequirementFor returns the TLS policy of the upstream host
+// of the domain. DANE takes precedence over MTA-STS, TLSA records are
+// only looked up if the MX lookup of the domain and the address
+// lookups of the host are DNSSEC validated (RFC 7672 section 2.2).
+func smtpTLSRequirementFor(domain, host, port string, mxSecure bool, sts *mtaSTSPolicy) (smtpTLSRequirement, error) {
+	if domain == "" {
+		return smtpTLSRequirement{policy: smtpTLSPolicyNone}, nil
+	}
+
+	if config.Outbound.DANE && mxSecure && dnsSecure(host, "A") && dnsSecure(host, "AAAA") {
+		ctx, cancel := dnsContext()
+		tlsas, secure, err := resolver.LookupTLSA(ctx, fmt.Sprintf("_%s._tcp.%s", port, host))
+		cancel()
+
+		if err != nil && err != dnsErrNotFound {
+			logger.Errorln("Failed to lookup tlsa records", host, err)
+		}
+
+		// Only validated records are used, records with
+		// unsupported parameters are ignored.
+		if err == nil && secure {
+			var usable []dnsTLSA
+			for _, tlsa := range tlsas {
+				if dnsTLSAUsable(tlsa) {
+					usable = append(usable, tlsa)
+				}
+			}
+
+			if len(usable) > 0 {
+				return smtpTLSRequirement{
+					policy:   smtpTLSPolicyDANE,
+					required: true,
+					tlsas:    usable,
+				}, nil
+			}
+		}
+	}
+
+	if sts != nil {
+		switch sts.Mode {
+		case mtaSTSModeEnforce:
+			if !mtaSTSMatch(*sts, host) {
+				return smtpTLSRequirement{}, &smtpSendError{
+					Err: fmt.Errorf("mx %s does not match the mta-sts policy of %s", host, domain),
+				}
+			}
+			return smtpTLSRequirement{policy: smtpTLSPolicyMTASTS, required: true}, nil
+
+		case mtaSTSModeTesting:
+			return smtpTLSRequirement{policy: smtpTLSPolicyMTASTSTesting}, nil
+		}
+	}
+
+	return smtpTLSRequirement{policy: smtpTLSPolicyNone}, nil
+}
+
+// smtpRcptError is a recipient of the envelope rejected by an upstream.
+type smtpRcptError struct {
+	Address string
+	Err     error
+}
+
+// smtpDeliver delivers the envelope to the upstream with the TLS
+// requirement and returns the TLS outcome of the delivery. Recipients
+// rejected by the upstream are returned while the message is sent to
+// the accepted recipients, the message is not sent if all of the
+// recipients are rejected.
+func smtpDeliver(host, port string, envelope smtpEnvelope, req smtpTLSRequirement) (smtpTLSOutcome, []smtpRcptError, error) {
+	outcome := smtpTLSOutcome{
+		Host:   host,
+		Policy: req.policy,
+	}
+
+	c, err := smtpDial(host, port)
+	if err != nil {
+		return outcome, nil, err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		tlsConfig := &tls.Config{
+			ServerName: host,
+			MinVersion: tls.VersionTLS12,
+
+			// Certificates are verified by the policy below, so
+			// opportunistic TLS accepts any certificate.
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				err := smtpVerifyPeer(rawCerts, host, req)
+				outcome.Verified = err == nil
+				if err != nil {
+					outcome.Error = err.Error()
+					if req.required {
+						return err
+					}
+				}
+				return nil
+			},
+		}
+
+		if err := c.StartTLS(tlsConfig); err != nil {
+			outcome.Error = err.Error()
+			if req.required {
+				return outcome, nil, fmt.Errorf("starttls with %s policy failed: %v", req.policy, err)
+			}
+
+			// Opportunistic TLS failed, delivery is retried
+			// in plaintext on a new connection.
+			c.Close()
+			if c, err = smtpDial(host, port); err != nil {
+				return outcome, nil, err
+			}
+			defer c.Close()
+		} else if state, ok := c.TLSConnectionState(); ok {
+			outcome.Version, outcome.CipherSuite = smtpTLSState(state)
+		}
+	} else if req.required {
+		outcome.Error = "starttls is not offered"
+		return outcome, nil, fmt.Errorf("starttls is required by %s policy but not offered", req.policy)
+	}
+
+	outcome.DSN, _ = c.Extension("DSN")
+	if err := smtpClientMail(c, envelope, outcome.DSN); err != nil {
+		return outcome, nil, err
+	}
+
+	var rejected []smtpRcptError
+	for _, to := range envelope.To {
+		if err := smtpClientRcpt(c, envelope, to, outcome.DSN); err != nil {
+			var replyErr *textproto.Error
+			if !errors.As(err, &replyErr) {
+				return outcome, nil, err
+			}
+
+			rejected = append(rejected, smtpRcptError{Address: to, Err: err})
+		}
+	}
+
+	if len(rejected) == len(envelope.To) {
+		c.Quit()
+		return outcome, rejected, nil
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return outcome, nil, err
+	}
+
+	if err := smtpEnvelopeWrite(w, envelope); err != nil {
+		return outcome, nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return outcome, nil, err
+	}
+
+	c.Quit()
+	return outcome, rejected, nil
+}
+
+// smtpClientMail sends the MAIL command of the envelope, the DSN
+// parameters are passed on if the upstream supports the extension.
+// Parameters of the net/smtp client are kept for the upstreams.
+func smtpClientMail(c *smtp.Client, envelope smtpEnvelope, dsn bool) error {
+	if !dsn || envelope.DSN == nil {
+		return c.Mail(envelope.From)
+	}
+
+	cmd := fmt.Sprintf("MAIL FROM:<%s>", envelope.From)
+	if ok, _ := c.Extension("8BITMIME"); ok {
+		cmd += " BODY=8BITMIME"
+	}
+	if ok, _ := c.Extension("SMTPUTF8"); ok {
+		cmd += " SMTPUTF8"
+	}
+	if envelope.DSN.Ret != "" {
+		cmd += " RET=" + envelope.DSN.Ret
+	}
+	if envelope.DSN.EnvelopeID != "" {
+		cmd += " ENVID=" + dsnXtext(envelope.DSN.EnvelopeID)
+	}
+
+	return smtpClientCmd(c, 250, cmd)
+}
+
+// smtpClientRcpt sends the RCPT command of the recipient with its
+// DSN parameters if the upstream supports the extension.
+func smtpClientRcpt(c *smtp.Client, envelope smtpEnvelope, to string, dsn bool) error {
+	rcpt, ok := dsnRecipientFind(envelope.DSN, to)
+	if !dsn || !ok {
+		return c.Rcpt(to)
+	}
+
+	cmd := fmt.Sprintf("RCPT TO:<%s>", to)
+	if len(rcpt.Notify) > 0 {
+		cmd += " NOTIFY=" + strings.Join(rcpt.Notify, ",")
+	}
+	if rcpt.Original != "" {
+		cmd += fmt.Sprintf(" ORCPT=%s;%s", rcpt.OriginalType, dsnXtext(rcpt.Original))
+	}
+
+	return smtpClientCmd(c, 25, cmd)
+}
+
+// smtpClientCmd sends the command and reads the reply like the
+// commands of the net/smtp client.
+func smtpClientCmd(c *smtp.Client, expectCode int, cmd string) error {
+	if strings.ContainsAny(cmd, "\r\n") {
+		return errors.New("smtp: A line must not contain CR or LF")
+	}
+
+	id, err := c.Text.Cmd("%s", cmd)
+	if err != nil {
+		return err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+
+	_, _, err = c.Text.ReadResponse(expectCode)
+	return err
+}
+
+// smtpDial connects to the upstream and greets it with the
+// server domain, the whole delivery is bound by the timeout.
+func smtpDial(host, port string) (*smtp.Client, error) {
+	timeout := timeDuration(config.Outbound.Timeout)
+	if timeout <= 0 {
+		timeout = 5 * time.Minute
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := c.Hello(config.Server.Domain); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// smtpVerifyPeer verifies the certificate chain of the upstream with
+// the TLSA records for DANE and with the system roots otherwise.
+func smtpVerifyPeer(rawCerts [][]byte, host string, req smtpTLSRequirement) error {
+	var certs []*x509.Certificate
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("certificate format error: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return errors.New("no certificates")
+	}
+
+	if req.policy == smtpTLSPolicyDANE {
+		return smtpVerifyDANE(certs, host, req.tlsas)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Intermediates: intermediates,
+	})
+
+	return err
+}
+
+// smtpVerifyDANE matches the certificate chain with the TLSA records.
+// DANE-EE records match the leaf certificate without any other checks,
+// DANE-TA records match a certificate of the chain which is then used
+// as the trust anchor to verify the leaf for the host.
+func smtpVerifyDANE(certs []*x509.Certificate, host string, tlsas []dnsTLSA) error {
+	for _, tlsa := range tlsas {
+		switch tlsa.Usage {
+		case dnsTLSAUsageDANEEE:
+			if dnsTLSAMatch(tlsa, certs[0]) {
+				return nil
+			}
+
+		case dnsTLSAUsageDANETA:
+			for i, cert := range certs {
+				if !dnsTLSAMatch(tlsa, cert) {
+					continue
+				}
+
+				roots := x509.NewCertPool()
+				roots.AddCert(cert)
+
+				intermediates := x509.NewCertPool()
+				for j := 1; j < i; j++ {
+					intermediates.AddCert(certs[j])
+				}
+
+				_, err := certs[0].Verify(x509.VerifyOptions{
+					DNSName:       host,
+					Roots:         roots,
+					Intermediates: intermediates,
+				})
+				if err == nil {
+					return nil
+				}
+			}
+		}
+	}
+
+	return errors.New("certificate does not match the tlsa records")
+}
+
+// dnsTLSAUsable returns true if the TLSA record can be used for SMTP.
+func dnsTLSAUsable(tlsa dnsTLSA) bool {
+	if tlsa.Usage != dnsTLSAUsageDANETA && tlsa.Usage != dnsTLSAUsageDANEEE {
+		return false
+	}
+
+	if tlsa.Selector != dnsTLSASelectorCert && tlsa.Selector != dnsTLSASelectorSPKI {
+		return false
+	}
+
+	switch tlsa.MatchingType {
+	case dnsTLSAMatchingFull, dnsTLSAMatchingSHA256, dnsTLSAMatchingSHA512:
+		return true
+	}
+
+	return false
+}
+
+// dnsTLSAMatch returns true if the certificate matches the TLSA record.
+func dnsTLSAMatch(tlsa dnsTLSA, cert *x509.Certificate) bool {
+	data := cert.Raw
+	if tlsa.Selector == dnsTLSASelectorSPKI {
+		data = cert.RawSubjectPublicKeyInfo
+	}
+
+	switch tlsa.MatchingType {
+	case dnsTLSAMatchingSHA256:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case dnsTLSAMatchingSHA512:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	}
+
+	return bytes.Equal(data, tlsa.Data)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Message data of a session is streamed to a temp file under the spool
+// path while being hashed, so the raw message is never held in memory.
+// Spooled messages are hard links of the data file. Messages are parsed
+// once, and only "parse_concurrency" parsed messages are held at a time
+// since parsing decodes the message parts in memory. The slot is held
+// until the parsed message is delivered, the decoded parts are kept
+// until they're uploaded.
+
+const (
+	smtpDataPrefix = "data-"
+
+	smtpDataBufferSize = 32 * 1024
+
+	smtpParseConcurrencyDefault = 4
+)
+
+var (
+	smtpParseSlots     chan struct{}
+	smtpParseSlotsOnce sync.Once
+)
+
+// smtpData is the raw message on disk.
+type smtpData struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// smtpDataWrite streams the message data to a temp file, the
+// file is synced before it's returned so it can be spooled.
+func smtpDataWrite(r io.Reader) (smtpData, error) {
+	data := smtpData{
+		Path: spoolPath(smtpDataPrefix+uuid.New().String(), spoolExtTemp),
+	}
+
+	f, err := os.OpenFile(data.Path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return data, err
+	}
+
+	hash := sha256.New()
+	w := bufio.NewWriterSize(io.MultiWriter(f, hash), smtpDataBufferSize)
+
+	data.Size, err = io.Copy(w, r)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(data.Path)
+		return data, err
+	}
+
+	data.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return data, nil
+}
+
+// smtpDataOpen opens the message data for reading.
+func smtpDataOpen(data smtpData) (*os.File, error) {
+	if data.Path == "" {
+		return nil, fmt.Errorf("message data has no path")
+	}
+
+	return os.Open(data.Path)
+}
+
+// smtpDataRemove removes the temp file of the message data.
+func smtpDataRemove(data smtpData) {
+	if err := os.Remove(data.Path); err != nil && !os.IsNotExist(err) {
+		logger.Errorln("Failed to remove message data", data.Path, err)
+	}
+}
+
+// smtpParseAcquire waits for a parse slot, the returned function
+// releases the slot once the parsed message is delivered.
+func smtpParseAcquire() func() {
+	smtpParseSlotsOnce.Do(func() {
+		concurrency := config.Server.ParseConcurrency
+		if concurrency <= 0 {
+			concurrency = smtpParseConcurrencyDefault
+		}
+		smtpParseSlots = make(chan struct{}, concurrency)
+	})
+
+	smtpParseSlots <- struct{}{}
+	return func() {
+		<-smtpParseSlots
+	}
+}
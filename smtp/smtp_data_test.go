@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+func TestMain(m *testing.M) {
+	spoolPath, err := ioutil.TempDir("", "smtp-spool-")
+	if err != nil {
+		fmt.Println("Failed to create spool path", err)
+		os.Exit(1)
+	}
+
+	config.Logger.Mode = loggerModeConsole
+	config.Logger.Level = loggerLevelMinimal
+	config.Spool.Path = spoolPath
+	loggerCreate()
+
+	code := m.Run()
+
+	os.RemoveAll(spoolPath)
+	os.Exit(code)
+}
+
+// testMessage returns a multipart message with a text body
+// and a base64 encoded attachment of the provided size.
+func testMessage(recipients []string, attachmentSize int) []byte {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "From: Sender <sender@example.org>\r\n")
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(recipients, ", "))
+	fmt.Fprintf(&b, "Subject: Quarterly report\r\n")
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-Id: <report@example.org>\r\n")
+	fmt.Fprintf(&b, "Mime-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=\"boundary\"\r\n\r\n")
+
+	fmt.Fprintf(&b, "--boundary\r\n")
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&b, "%s\r\n", strings.Repeat("The report is attached.\r\n", 1000))
+
+	fmt.Fprintf(&b, "--boundary\r\n")
+	fmt.Fprintf(&b, "Content-Type: application/octet-stream\r\n")
+	fmt.Fprintf(&b, "Content-Disposition: attachment; filename=\"report.bin\"\r\n")
+	fmt.Fprintf(&b, "Content-Transfer-Encoding: base64\r\n\r\n")
+
+	encoded := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x5a, 0x17, 0xc3}, attachmentSize/3))
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded + "\r\n")
+	fmt.Fprintf(&b, "--boundary--\r\n")
+
+	return b.Bytes()
+}
+
+// testSession returns an anonymous session with the recipients.
+func testSession(recipients []string) *smtpSession {
+	s := &smtpSession{
+		UUID: "session",
+		From: "sender@example.org",
+		Conn: smtpConn{
+			Helo:       "mail.example.org",
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25},
+		},
+		Auth: smtpAuth{
+			Anonymous: true,
+		},
+	}
+
+	for i, recipient := range recipients {
+		s.Recipients = append(s.Recipients, smtpRecipient{
+			Address: recipient,
+			InboxID: uint(i + 1),
+		})
+	}
+
+	return s
+}
+
+// testStorage serves the S3 uploads and the inbound messages of the
+// API. A parsed message is in delivery from its first upload until
+// it's sent to the API, the peak of the messages in delivery is kept.
+type testStorage struct {
+	mu       sync.Mutex
+	delivery map[string]bool
+	peak     int
+}
+
+func (st *testStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	// Requests are slowed down so the deliveries overlap.
+	time.Sleep(5 * time.Millisecond)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if r.URL.Path == "/smtp/inbound" {
+		var req struct {
+			MailMessage typeMailMessage `json:"mail_message"`
+		}
+		json.Unmarshal(body, &req)
+
+		delete(st.delivery, req.MailMessage.StorageKey)
+		w.Write([]byte(`{"success": true}`))
+		return
+	}
+
+	// Uploads are under "/bucket/storage key/file".
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+	if len(parts) == 3 {
+		st.delivery[parts[1]] = true
+		if len(st.delivery) > st.peak {
+			st.peak = len(st.delivery)
+		}
+	}
+}
+
+// testAPI points the API and the S3 uploads at the server for the
+// test, uploads are path style requests under the bucket.
+func testAPI(t *testing.T, server *httptest.Server) {
+	t.Helper()
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String(server.URL),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+	})
+	if err != nil {
+		t.Fatalf("aws session: %v", err)
+	}
+
+	previousUploader := s3Uploader
+	previousURL, previousBucket := config.API.BaseURL, config.S3Emails.Bucket
+	t.Cleanup(func() {
+		s3Uploader = previousUploader
+		config.API.BaseURL, config.S3Emails.Bucket = previousURL, previousBucket
+	})
+
+	s3Uploader = s3manager.NewUploader(sess)
+	config.API.BaseURL = server.URL
+	config.S3Emails.Bucket = "emails"
+}
+
+// TestSpoolRetryParseSlots delivers large spooled messages concurrently,
+// only "parse_concurrency" parsed messages can be in delivery at a time
+// since their decoded parts are kept until they're uploaded.
+func TestSpoolRetryParseSlots(t *testing.T) {
+	const (
+		concurrency = 2
+		messages    = 8
+		attachment  = 1024 * 1024
+	)
+
+	storage := &testStorage{delivery: make(map[string]bool)}
+	server := httptest.NewServer(storage)
+	defer server.Close()
+	testAPI(t, server)
+
+	// Slots are created once, the slots of the test replace
+	// them and the created slots are restored after the test.
+	smtpParseAcquire()()
+
+	previousSlots := smtpParseSlots
+	t.Cleanup(func() {
+		smtpParseSlots = previousSlots
+	})
+	smtpParseSlots = make(chan struct{}, concurrency)
+
+	raw := testMessage([]string{"koray@example.com"}, attachment)
+
+	var entries []spoolEntry
+	for i := 0; i < messages; i++ {
+		data, err := smtpDataWrite(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("write data: %v", err)
+		}
+		defer smtpDataRemove(data)
+
+		entry, err := spoolAdd([]typeMailMessageDelivery{{InboxID: 1}}, smtpMessage{Data: data})
+		if err != nil {
+			t.Fatalf("spool: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, messages)
+	for _, entry := range entries {
+		wg.Add(1)
+		go func(entry spoolEntry) {
+			defer wg.Done()
+			errs <- spoolRetryEntry(entry)
+		}(entry)
+	}
+	wg.Wait()
+
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("deliver: %v", err)
+		}
+	}
+
+	if storage.peak > concurrency {
+		t.Fatalf("%d parsed messages in delivery at once, want at most %d", storage.peak, concurrency)
+	}
+
+	if storage.peak == 0 || len(storage.delivery) != 0 {
+		t.Fatalf("%d messages in delivery after the deliveries, peak %d", len(storage.delivery), storage.peak)
+	}
+}
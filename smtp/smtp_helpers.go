@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+	"net"
 	"net/url"
 	"strings"
 
@@ -34,3 +36,35 @@ func smtpIDHeaderEncode(v string) string {
 	v = url.QueryEscape(v)
 	return "<" + strings.Replace(v, "%40", "@", -1) + ">"
 }
+
+// smtpRemoteIP returns the ip of the remote address,
+// nil if the address is not a tcp address.
+func smtpRemoteIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+
+	return nil
+}
+
+// smtpRemoteNetwork returns the /24 (IPv4) or /64 (IPv6) network
+// of the remote ip, mail servers of a network are treated as one.
+func smtpRemoteNetwork(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%s/24", ip4.Mask(net.CIDRMask(24, 32)))
+	}
+
+	return fmt.Sprintf("%s/64", ip.Mask(net.CIDRMask(64, 128)))
+}
+
+// smtpAddressIn returns true if the address is in the addresses,
+// addresses are compared case insensitively.
+func smtpAddressIn(address string, addresses []string) bool {
+	for _, a := range addresses {
+		if strings.EqualFold(a, address) {
+			return true
+		}
+	}
+
+	return false
+}
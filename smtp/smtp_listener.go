@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/violetnorth/smtplib"
+)
+
+// Connections are checked when they are accepted, before the smtp
+// server greets the client. Clients over their connection limits are
+// closed with a 421, receiver clients are looked up in the dns
+// blocklists and closed with a 554 if their score is over the connect
+// score. Checks run for each connection in parallel so a slow dns
+// answer doesn't hold the other connections.
+
+// smtpListener checks the connections of the listener before
+// they are served.
+type smtpListener struct {
+	net.Listener
+	tlsConfig *tls.Config
+	dnsbl     bool
+
+	conns chan net.Conn
+	errs  chan error
+}
+
+// smtpListenerConn is an accepted connection with the results
+// of its checks.
+type smtpListenerConn struct {
+	net.Conn
+	DNSBL dnsblResult
+
+	closing   int32
+	closeOnce sync.Once
+}
+
+var (
+	// smtpListenerConns are the served connections by their remote
+	// address, sessions read the results of their connection.
+	smtpListenerConns = map[string]*smtpListenerConn{}
+	smtpListenerMutex sync.Mutex
+)
+
+// smtpListenerNew returns the listener checking the connections of l,
+// connections are wrapped with tls if a tls config is provided.
+func smtpListenerNew(l net.Listener, tlsConfig *tls.Config, dnsbl bool) *smtpListener {
+	sl := &smtpListener{
+		Listener:  l,
+		tlsConfig: tlsConfig,
+		dnsbl:     dnsbl,
+		conns:     make(chan net.Conn),
+		errs:      make(chan error, 1),
+	}
+
+	go sl.accept()
+	return sl
+}
+
+func (l *smtpListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	}
+}
+
+// accept accepts the connections and checks them in parallel.
+func (l *smtpListener) accept() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.errs <- err
+			return
+		}
+
+		go l.check(conn)
+	}
+}
+
+// check serves the connection if it passes the checks, it's
+// closed with the reply of the failed check otherwise.
+func (l *smtpListener) check(conn net.Conn) {
+	c := &smtpListenerConn{Conn: conn}
+
+	ip := smtpRemoteIP(conn.RemoteAddr())
+	if ratelimitConnection(ip) {
+		l.reject(conn, fmt.Sprintf("%d 4.7.0 %s Too many connections, try again later",
+			smtplib.StatusServiceNotAvailable,
+			config.Server.Domain,
+		))
+		return
+	}
+
+	if l.dnsbl && config.DNSBL.Status {
+		c.DNSBL = dnsblCheck(ip)
+		logger.Debugf("Connection %s, dnsbl: %.2f (%d listings)", conn.RemoteAddr(), c.DNSBL.Score, len(c.DNSBL.Listings))
+
+		if dnsblConnect(c.DNSBL, ip) {
+			l.reject(conn, fmt.Sprintf("%d 5.7.1 %s %s",
+				smtplib.StatusTransactionFailed,
+				config.Server.Domain,
+				dnsblReason(c.DNSBL, ip),
+			))
+			return
+		}
+	}
+
+	smtpListenerMutex.Lock()
+	smtpListenerConns[conn.RemoteAddr().String()] = c
+	smtpListenerMutex.Unlock()
+
+	if l.tlsConfig != nil {
+		l.conns <- tls.Server(c, l.tlsConfig)
+		return
+	}
+
+	l.conns <- c
+}
+
+// reject replies to the connection and closes it.
+func (l *smtpListener) reject(conn net.Conn, reply string) {
+	if l.tlsConfig != nil {
+		conn = tls.Server(conn, l.tlsConfig)
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(timeDuration(config.Server.TimeoutWrite)))
+	fmt.Fprintf(conn, "%s\r\n", reply)
+}
+
+// Read returns io.EOF once the connection is closing, so the session
+// ends after the reply which closes the connection is written.
+func (c *smtpListenerConn) Read(b []byte) (int, error) {
+	if atomic.LoadInt32(&c.closing) == 1 {
+		return 0, io.EOF
+	}
+
+	return c.Conn.Read(b)
+}
+
+// Close closes the connection and removes it from the served connections.
+func (c *smtpListenerConn) Close() error {
+	c.closeOnce.Do(func() {
+		smtpListenerMutex.Lock()
+		defer smtpListenerMutex.Unlock()
+
+		key := c.RemoteAddr().String()
+		if smtpListenerConns[key] == c {
+			delete(smtpListenerConns, key)
+		}
+	})
+
+	return c.Conn.Close()
+}
+
+// smtpListenerFind returns the served connection of the remote address.
+func smtpListenerFind(addr net.Addr) (*smtpListenerConn, bool) {
+	if addr == nil {
+		return nil, false
+	}
+
+	smtpListenerMutex.Lock()
+	defer smtpListenerMutex.Unlock()
+
+	c, ok := smtpListenerConns[addr.String()]
+	return c, ok
+}
+
+// smtpListenerClose marks the served connection of the remote address
+// as closing, the session ends on its next read.
+func smtpListenerClose(addr net.Addr) {
+	if c, ok := smtpListenerFind(addr); ok {
+		atomic.StoreInt32(&c.closing, 1)
+	}
+}
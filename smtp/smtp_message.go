@@ -1,20 +1,35 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"net/mail"
 	"time"
 
 	"github.com/jhillyerd/enmime"
 )
 
+// smtpMessageSession is the session details of a message, Recipients
+// are the envelope recipients the message is delivered to.
 type smtpMessageSession struct {
-	UUID string
-	From string
+	UUID       string
+	From       string
+	Recipients []string
+
+	RemoteIP string
+	Helo     string
+
+	TLSVersion     string
+	TLSCipherSuite string
+
+	SPF spfResult
+	DSN *dsnOptions
 }
 
+// smtpMessage is the parsed message, the raw message stays on disk.
+// Trace is the header fields prepended to the raw message.
 type smtpMessage struct {
-	Raw     []byte
+	Data    smtpData
+	Trace   string
 	Session smtpMessageSession
 
 	MessageID string
@@ -31,19 +46,62 @@ type smtpMessage struct {
 
 	Inlines     []*enmime.Part
 	Attachments []*enmime.Part
+
+	DKIM  []dkimResult
+	DMARC dmarcResult
+
+	// Quarantine is the reason the message is quarantined by
+	// the filters, quarantined messages are hidden from the
+	// inboxes until they are released.
+	Quarantine string
+
+	// HTMLOnly is true if the message has no plain text
+	// part, Text of these messages is converted from HTML.
+	HTMLOnly bool
+
+	// Spam is the spam score of the message.
+	Spam spamResult
+}
+
+// smtpMessageParse decodes the message data into an smtp message.
+func smtpMessageParse(sess *smtpSession, data smtpData) (smtpMessage, error) {
+	session := smtpMessageSession{
+		UUID: sess.UUID,
+		From: sess.From,
+		SPF:  sess.SPF,
+		Helo: sess.Conn.Helo,
+		DSN:  dsnSessionOptions(sess),
+	}
+
+	// Remote ip is unknown for the LMTP sessions over unix sockets.
+	if ip := smtpRemoteIP(sess.Conn.RemoteAddr); ip != nil {
+		session.RemoteIP = ip.String()
+	}
+
+	for _, recipient := range sess.Recipients {
+		session.Recipients = append(session.Recipients, recipient.Address)
+	}
+
+	session.TLSVersion, session.TLSCipherSuite = smtpTLSState(sess.Conn.TLS)
+
+	return smtpMessageRead(session, data)
 }
 
-// smtpMessageParse decodes a raw message buffer into an smtp message.
-func smtpMessageParse(sess *smtpSession, messageRaw []byte) (smtpMessage, error) {
+// smtpMessageRead decodes the message data into an smtp message
+// with the provided message session, ie. a message read from spool.
+func smtpMessageRead(session smtpMessageSession, data smtpData) (smtpMessage, error) {
 	message := smtpMessage{
-		Session: smtpMessageSession{
-			UUID: sess.UUID,
-			From: sess.From,
-		},
-		Raw: messageRaw,
+		Session: session,
+		Data:    data,
+	}
+
+	f, err := smtpDataOpen(data)
+	if err != nil {
+		return message, err
 	}
+	defer f.Close()
 
-	messageEnvelope, err := enmime.ReadEnvelope(bytes.NewReader(messageRaw))
+	messageEnvelope, err := enmime.ReadEnvelope(bufio.NewReaderSize(f, smtpDataBufferSize))
 	if err != nil {
 		return message, err
 	}
@@ -90,35 +148,12 @@ func smtpMessageParse(sess *smtpSession, messageRaw []byte) (smtpMessage, error)
 	message.Subject = messageEnvelope.GetHeader("Subject")
 	message.Text = messageEnvelope.Text
 	message.HTML = messageEnvelope.HTML
+	message.HTMLOnly = message.HTML != "" && messageEnvelope.Root.BreadthMatchFirst(func(p *enmime.Part) bool {
+		return p.ContentType == "text/plain" && p.Disposition != "attachment"
+	}) == nil
 
 	message.Inlines = messageEnvelope.Inlines
 	message.Attachments = messageEnvelope.Attachments
 
 	return message, nil
 }
-
-// smtpMessageBuild encodes an smtp message into an enmime mailbuilder.
-// The encoded mail builder can be used to mail to upstream.
-func smtpMessageBuild(message smtpMessage) enmime.MailBuilder {
-	builder := enmime.MailBuilder{}
-
-	builder = builder.From(message.From.Name, message.From.Address).
-		ReplyTo(message.ReplyTo.Name, message.ReplyTo.Address).
-		ToAddrs(message.To).
-		CCAddrs(message.Cc).
-		BCCAddrs(message.Bcc).
-		Date(message.Date).
-		Subject(message.Subject).
-		Text([]byte(message.Text)).
-		HTML([]byte(message.HTML))
-
-	for _, i := range message.Inlines {
-		builder = builder.AddInline(i.Content, i.ContentType, i.FileName, i.ContentID)
-	}
-
-	for _, a := range message.Attachments {
-		builder = builder.AddAttachment(a.Content, a.ContentType, a.FileName)
-	}
-
-	return builder
-}
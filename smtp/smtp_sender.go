@@ -1,36 +1,243 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"net/textproto"
 	"sort"
+	"strings"
 
 	"github.com/jhillyerd/enmime"
 )
 
-// smtpSend tries to send an smtp message to the provided upstreams.
-func smtpSend(messageEncoded enmime.MailBuilder, upstreams []typeMailUpstream) error {
-	// Sort the upstreams by priority.
+// smtpEnvelope is the envelope sender and recipients with the
+// rendered message data sent to the upstreams of a destination.
+// Relayed messages are streamed from the message data file with
+// the trace headers prepended instead.
+type smtpEnvelope struct {
+	From string
+	To   []string
+	Data []byte
+
+	// DSN is the DSN parameters passed on to
+	// the upstreams with the DSN extension.
+	DSN *dsnOptions
+
+	Trace string
+	File  *smtpData
+}
+
+// smtpEnvelopeWrite writes the message data of the envelope.
+func smtpEnvelopeWrite(w io.Writer, envelope smtpEnvelope) error {
+	if envelope.File == nil {
+		_, err := w.Write(envelope.Data)
+		return err
+	}
+
+	f, err := smtpDataOpen(*envelope.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, io.MultiReader(strings.NewReader(envelope.Trace), f))
+	return err
+}
+
+// smtpSendError is a delivery error with the last response of the
+// upstreams. Permanent errors (5xx replies, domains without mail
+// hosts) are not retried, all others are retried with backoff.
+type smtpSendError struct {
+	Permanent bool
+	Err       error
+}
+
+func (e *smtpSendError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *smtpSendError) Unwrap() error {
+	return e.Err
+}
+
+// smtpSendPermanent returns true if the delivery error is permanent.
+func smtpSendPermanent(err error) bool {
+	var sendErr *smtpSendError
+	return errors.As(err, &sendErr) && sendErr.Permanent
+}
+
+// smtpRender renders the MIME message once so the same data can be
+// sent with an envelope per destination. Bcc recipients are only
+// part of the envelopes and never rendered in the headers.
+func smtpRender(messageEncoded enmime.MailBuilder) ([]byte, error) {
+	root, err := messageEncoded.Build()
+	if err != nil {
+		return nil, err
+	}
+	root.Header.Del("Bcc")
+
+	var buf bytes.Buffer
+	if err := root.Encode(&buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// smtpSend tries to send the envelope to the upstreams of the
+// recipient domain and returns the TLS outcome of the last upstream
+// tried. Relayed messages have no recipient domain and are sent with
+// opportunistic TLS. A permanent reply of an upstream ends the
+// delivery, temporary failures move on to the next upstream.
+//
+// Recipients are rejected one by one: permanent rejections are final
+// and temporary rejections are tried with the next upstream. Recipients
+// which are not delivered are returned with their own errors, unless
+// none of the recipients are delivered and all of them failed the
+// same way, then the delivery fails with the error.
+func smtpSend(envelope smtpEnvelope, domain string, upstreams []typeMailUpstream) (smtpTLSOutcome, []smtpRcptError, error) {
+	// Sort a copy of the upstreams by priority, the upstreams of
+	// a mail are shared by the concurrent sends of the mail.
+	upstreams = append([]typeMailUpstream(nil), upstreams...)
 	sort.Slice(upstreams, func(n1, n2 int) bool {
 		return upstreams[n1].Priority < upstreams[n2].Priority
 	})
 
-	// Add the port number to the upstream if there is no port number.
-	var sortedUpstreams []typeMailUpstream
-	for _, upstream := range upstreams {
-		upstream.Target = fmt.Sprintf("%s:%d", upstream.Target, config.Server.Port)
-		sortedUpstreams = append(sortedUpstreams, upstream)
+	var sts *mtaSTSPolicy
+	if domain != "" && config.Outbound.MTASTS {
+		policy, ok, err := mtaSTSLookup(domain)
+		if err != nil {
+			logger.Errorln("Failed to get mta-sts policy, delivering without policy", domain, err)
+		} else if ok {
+			sts = &policy
+		}
 	}
 
-	var err error
-	for _, upstream := range sortedUpstreams {
-		if err = messageEncoded.Send(upstream.Target, nil); err != nil {
-			logger.Errorf("Failed to send message %v", err)
+	// DANE is only used for the mail hosts of a validated MX lookup,
+	// a validated denial of the MX records validates the domain as
+	// its own mail host.
+	mxSecure := domain != "" && config.Outbound.DANE && dnsSecure(domain, "MX")
+
+	var (
+		outcome   smtpTLSOutcome
+		err       error = &smtpSendError{Err: errors.New("no upstreams")}
+		pending         = envelope.To
+		rejected  []smtpRcptError
+		delivered bool
+	)
+
+	for _, upstream := range upstreams {
+		host, port := smtpUpstreamAddr(upstream.Target)
+
+		req, reqErr := smtpTLSRequirementFor(domain, host, port, mxSecure, sts)
+		if reqErr != nil {
+			logger.Errorf("Failed to send message %v", reqErr)
+			outcome = smtpTLSOutcome{Host: host, Policy: smtpTLSPolicyMTASTS, Error: reqErr.Error()}
+			err = &smtpSendError{Err: reqErr}
+			continue
+		}
+
+		envelope.To = pending
+
+		var rcptErrs []smtpRcptError
+		var deliverErr error
+		if outcome, rcptErrs, deliverErr = smtpDeliver(host, port, envelope, req); deliverErr != nil {
+			logger.Errorf("Failed to send message %v", deliverErr)
+
+			err = &smtpSendError{Permanent: smtpReplyPermanent(deliverErr), Err: deliverErr}
+			if smtpSendPermanent(err) {
+				break
+			}
 			continue
 		}
 
-		// If there is no error, relay succeded.
-		return nil
+		delivered = delivered || len(rcptErrs) < len(pending)
+
+		pending = nil
+		for _, rcptErr := range rcptErrs {
+			logger.Errorf("Failed to send message to %s %v", rcptErr.Address, rcptErr.Err)
+
+			rcptErr.Err = &smtpSendError{Permanent: smtpReplyPermanent(rcptErr.Err), Err: rcptErr.Err}
+			if smtpSendPermanent(rcptErr.Err) {
+				rejected = append(rejected, rcptErr)
+				continue
+			}
+
+			pending = append(pending, rcptErr.Address)
+			err = rcptErr.Err
+		}
+
+		// If there are no pending recipients, relay succeded.
+		if len(pending) == 0 {
+			err = nil
+			break
+		}
 	}
 
-	return err
+	for _, address := range pending {
+		rejected = append(rejected, smtpRcptError{Address: address, Err: err})
+	}
+
+	if !delivered && len(rejected) > 0 {
+		permanent := smtpSendPermanent(rejected[0].Err)
+
+		same := true
+		for _, rcptErr := range rejected {
+			same = same && smtpSendPermanent(rcptErr.Err) == permanent
+		}
+
+		if same {
+			return outcome, nil, rejected[len(rejected)-1].Err
+		}
+	}
+
+	return outcome, rejected, nil
+}
+
+// smtpReplyPermanent returns true if the error is a permanent (5xx)
+// reply of an upstream.
+func smtpReplyPermanent(err error) bool {
+	var replyErr *textproto.Error
+	return errors.As(err, &replyErr) && replyErr.Code >= 500
+}
+
+// smtpUpstreamsMX returns the mail hosts of the domain. Domains
+// without MX records are delivered to their address records
+// (RFC 5321 section 5.1), domains with a null MX (RFC 7505) or
+// without any records do not accept mail.
+func smtpUpstreamsMX(domain string) ([]typeMailUpstream, error) {
+	ctx, cancel := dnsContext()
+	defer cancel()
+
+	mxRecords, err := resolver.LookupMX(ctx, domain)
+	if err != nil && err != dnsErrNotFound {
+		return nil, &smtpSendError{Err: fmt.Errorf("MX lookup failed due to %s", err.Error())}
+	}
+
+	if len(mxRecords) == 0 {
+		if _, err := resolver.LookupIPAddr(ctx, domain); err != nil {
+			if err == dnsErrNotFound {
+				return nil, &smtpSendError{Permanent: true, Err: errors.New("domain has no mail hosts")}
+			}
+			return nil, &smtpSendError{Err: fmt.Errorf("address lookup failed due to %s", err.Error())}
+		}
+
+		return []typeMailUpstream{{Target: domain}}, nil
+	}
+
+	if len(mxRecords) == 1 && strings.TrimSuffix(mxRecords[0].Host, ".") == "" {
+		return nil, &smtpSendError{Permanent: true, Err: errors.New("domain does not accept mail (null MX)")}
+	}
+
+	var upstreams []typeMailUpstream
+	for _, mx := range mxRecords {
+		upstreams = append(upstreams, typeMailUpstream{
+			Target:   strings.TrimSuffix(mx.Host, "."),
+			Priority: int(mx.Pref),
+		})
+	}
+
+	return upstreams, nil
 }
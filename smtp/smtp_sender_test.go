@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testUpstream is an upstream which replies to the recipients with the
+// reply codes of their addresses and records the delivered recipients,
+// and the envelope commands if it offers the DSN extension.
+type testUpstream struct {
+	listener  net.Listener
+	replies   map[string]int
+	dsn       bool
+	mutex     sync.Mutex
+	delivered []string
+	commands  []string
+}
+
+func testUpstreamListen(t *testing.T, replies map[string]int) *testUpstream {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	u := &testUpstream{listener: l, replies: replies}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go u.serve(conn)
+		}
+	}()
+
+	return u
+}
+
+func (u *testUpstream) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := textproto.NewReader(bufio.NewReader(conn))
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+
+	reply("220 upstream ready")
+
+	var accepted []string
+	for {
+		line, err := r.ReadLine()
+		if err != nil {
+			return
+		}
+
+		command := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(command, "EHLO") && u.dsn:
+			reply("250-upstream")
+			reply("250 DSN")
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 upstream")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			u.record(line)
+			accepted = nil
+			reply("250 2.1.0 ok")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			u.record(line)
+			address := strings.Trim(strings.Fields(line[len("RCPT TO:"):])[0], "<>")
+			code, ok := u.replies[address]
+			if !ok {
+				code = 250
+			}
+			if code == 250 {
+				accepted = append(accepted, address)
+			}
+			reply("%d %d.1.1 %s", code, code/100, address)
+		case command == "DATA":
+			reply("354 go ahead")
+			if _, err := r.ReadDotBytes(); err != nil {
+				return
+			}
+
+			u.mutex.Lock()
+			u.delivered = append(u.delivered, accepted...)
+			u.mutex.Unlock()
+			reply("250 2.0.0 queued")
+		case command == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("500 5.5.1 unknown command")
+		}
+	}
+}
+
+func (u *testUpstream) record(command string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.commands = append(u.commands, command)
+}
+
+func (u *testUpstream) Commands() []string {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return append([]string(nil), u.commands...)
+}
+
+func (u *testUpstream) Delivered() []string {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return append([]string(nil), u.delivered...)
+}
+
+func TestSMTPSendRecipients(t *testing.T) {
+	tests := []struct {
+		name      string
+		replies   []map[string]int
+		delivered []string
+		rejected  map[string]bool
+		err       bool
+		permanent bool
+		next      []string
+	}{
+		{
+			name:      "accepted",
+			replies:   []map[string]int{{}},
+			delivered: []string{"a@example.net", "b@example.net", "c@example.net"},
+		},
+		{
+			name:      "rejected recipients",
+			replies:   []map[string]int{{"b@example.net": 550, "c@example.net": 451}},
+			delivered: []string{"a@example.net"},
+			rejected:  map[string]bool{"b@example.net": true, "c@example.net": false},
+		},
+		{
+			name:      "temporary rejection tried with the next upstream",
+			replies:   []map[string]int{{"b@example.net": 550, "c@example.net": 451}, {}},
+			delivered: []string{"a@example.net"},
+			rejected:  map[string]bool{"b@example.net": true},
+			next:      []string{"c@example.net"},
+		},
+		{
+			name:      "all rejected permanently",
+			replies:   []map[string]int{{"a@example.net": 550, "b@example.net": 550, "c@example.net": 553}},
+			err:       true,
+			permanent: true,
+		},
+		{
+			name:    "all rejected temporarily",
+			replies: []map[string]int{{"a@example.net": 450, "b@example.net": 451, "c@example.net": 452}},
+			err:     true,
+		},
+		{
+			name:     "all rejected with mixed replies",
+			replies:  []map[string]int{{"a@example.net": 550, "b@example.net": 451, "c@example.net": 550}},
+			rejected: map[string]bool{"a@example.net": true, "b@example.net": false, "c@example.net": true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				upstreams     []*testUpstream
+				mailUpstreams []typeMailUpstream
+			)
+			for i, replies := range test.replies {
+				u := testUpstreamListen(t, replies)
+				upstreams = append(upstreams, u)
+				mailUpstreams = append(mailUpstreams, typeMailUpstream{
+					Target:   u.listener.Addr().String(),
+					Priority: i,
+				})
+			}
+
+			envelope := smtpEnvelope{
+				From: "sender@example.org",
+				To:   []string{"a@example.net", "b@example.net", "c@example.net"},
+				Data: []byte("Subject: test\r\n\r\ntest\r\n"),
+			}
+
+			_, rejected, err := smtpSend(envelope, "", mailUpstreams)
+			if (err != nil) != test.err {
+				t.Fatalf("error %v, want error %t", err, test.err)
+			}
+			if err != nil && smtpSendPermanent(err) != test.permanent {
+				t.Fatalf("permanent %t, want %t", smtpSendPermanent(err), test.permanent)
+			}
+
+			if len(rejected) != len(test.rejected) {
+				t.Fatalf("rejected %v, want %v", rejected, test.rejected)
+			}
+			for _, rcptErr := range rejected {
+				permanent, ok := test.rejected[rcptErr.Address]
+				if !ok {
+					t.Fatalf("rejected %s, want %v", rcptErr.Address, test.rejected)
+				}
+				if smtpSendPermanent(rcptErr.Err) != permanent {
+					t.Fatalf("rejection of %s permanent %t, want %t", rcptErr.Address, smtpSendPermanent(rcptErr.Err), permanent)
+				}
+			}
+
+			if got := upstreams[0].Delivered(); strings.Join(got, ",") != strings.Join(test.delivered, ",") {
+				t.Fatalf("delivered %v, want %v", got, test.delivered)
+			}
+			if len(upstreams) > 1 {
+				if got := upstreams[1].Delivered(); strings.Join(got, ",") != strings.Join(test.next, ",") {
+					t.Fatalf("delivered to the next upstream %v, want %v", got, test.next)
+				}
+			}
+		})
+	}
+}
+
+// testInsecureZone is a zone resolver whose answers of the
+// insecure names and types are not DNSSEC validated.
+type testInsecureZone struct {
+	*dnsZone
+	insecure map[string]bool
+}
+
+func (z *testInsecureZone) LookupSecure(ctx context.Context, name, typ string) (bool, error) {
+	if z.insecure[dnsZoneName(name)+" "+typ] {
+		return false, nil
+	}
+	if z.insecure[dnsZoneName(name)+" ERROR"] {
+		return false, errors.New("lookup failed")
+	}
+
+	return true, nil
+}
+
+func TestSMTPTLSRequirementDANE(t *testing.T) {
+	zone, err := dnsZoneLoad("testdata/dane.zone")
+	if err != nil {
+		t.Fatalf("load zone: %v", err)
+	}
+
+	previousResolver, previousDANE := resolver, config.Outbound.DANE
+	t.Cleanup(func() {
+		resolver, config.Outbound.DANE = previousResolver, previousDANE
+	})
+	config.Outbound.DANE = true
+
+	tests := []struct {
+		name     string
+		insecure []string
+		policy   string
+	}{
+		{"secure chain", nil, smtpTLSPolicyDANE},
+		{"insecure mx", []string{"example.net MX"}, smtpTLSPolicyNone},
+		{"insecure address", []string{"mx.example.net A"}, smtpTLSPolicyNone},
+		{"insecure ipv6 address", []string{"mx.example.net AAAA"}, smtpTLSPolicyNone},
+		{"lookup error", []string{"mx.example.net ERROR"}, smtpTLSPolicyNone},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			insecure := make(map[string]bool)
+			for _, name := range test.insecure {
+				insecure[name] = true
+			}
+			resolver = &testInsecureZone{dnsZone: zone, insecure: insecure}
+
+			mxSecure := dnsSecure("example.net", "MX")
+			req, err := smtpTLSRequirementFor("example.net", "mx.example.net", "25", mxSecure, nil)
+			if err != nil {
+				t.Fatalf("requirement: %v", err)
+			}
+
+			if req.policy != test.policy {
+				t.Fatalf("policy %s, want %s", req.policy, test.policy)
+			}
+
+			if req.required != (test.policy == smtpTLSPolicyDANE) {
+				t.Fatalf("required %t with %s policy", req.required, req.policy)
+			}
+		})
+	}
+}
+
+// TestSMTPSendUpstreamsOrder sends with the upstreams of a mail, the
+// upstreams shared by the concurrent sends are not reordered.
+func TestSMTPSendUpstreamsOrder(t *testing.T) {
+	u := testUpstreamListen(t, nil)
+
+	upstreams := []typeMailUpstream{
+		{Target: "127.0.0.1:1", Priority: 20},
+		{Target: u.listener.Addr().String(), Priority: 10},
+	}
+
+	envelope := smtpEnvelope{
+		From: "sender@example.org",
+		To:   []string{"a@example.net"},
+		Data: []byte("Subject: test\r\n\r\ntest\r\n"),
+	}
+
+	if _, _, err := smtpSend(envelope, "", upstreams); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	if upstreams[0].Priority != 20 || upstreams[1].Priority != 10 {
+		t.Fatalf("upstreams reordered %v", upstreams)
+	}
+}
+
+// TestSMTPSendDSN passes the DSN parameters to an upstream with the
+// extension and sends the plain envelope to upstreams without it.
+func TestSMTPSendDSN(t *testing.T) {
+	envelope := smtpEnvelope{
+		From: "sender@example.org",
+		To:   []string{"a@example.net", "b@example.net"},
+		Data: []byte("Subject: test\r\n\r\ntest\r\n"),
+		DSN: &dsnOptions{
+			Ret:        "HDRS",
+			EnvelopeID: "id=1",
+			Recipients: map[string]dsnRecipientOptions{
+				"a@example.net": {Notify: []string{"SUCCESS", "FAILURE"}, OriginalType: "RFC822", Original: "a+x@example.net"},
+			},
+		},
+	}
+
+	tests := []struct {
+		dsn      bool
+		commands []string
+	}{
+		{
+			dsn: true,
+			commands: []string{
+				"MAIL FROM:<sender@example.org> RET=HDRS ENVID=id+3D1",
+				"RCPT TO:<a@example.net> NOTIFY=SUCCESS,FAILURE ORCPT=RFC822;a+2Bx@example.net",
+				"RCPT TO:<b@example.net>",
+			},
+		},
+		{
+			dsn: false,
+			commands: []string{
+				"MAIL FROM:<sender@example.org>",
+				"RCPT TO:<a@example.net>",
+				"RCPT TO:<b@example.net>",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		u := testUpstreamListen(t, nil)
+		u.dsn = test.dsn
+
+		outcome, _, err := smtpSend(envelope, "", []typeMailUpstream{{Target: u.listener.Addr().String()}})
+		if err != nil {
+			t.Fatalf("send: %v", err)
+		}
+
+		if outcome.DSN != test.dsn {
+			t.Errorf("dsn %t, want %t", outcome.DSN, test.dsn)
+		}
+
+		if commands := u.Commands(); strings.Join(commands, "\n") != strings.Join(test.commands, "\n") {
+			t.Errorf("commands %q, want %q", commands, test.commands)
+		}
+	}
+}
@@ -3,8 +3,8 @@ package main
 import (
 	"fmt"
 	"io"
-	"io/ioutil"
 	"strings"
+	"time"
 
 	"github.com/emersion/go-smtp"
 	"github.com/violetnorth/smtplib"
@@ -12,10 +12,16 @@ import (
 
 // Mail is mail from session. Mail command starts the
 // mail exchange between the two SMTP servers.
-func (s *smtpSession) Mail(from string, opts smtp.MailOptions) error {
+func (s *smtpSession) Mail(from string, opts *smtp.MailOptions) error {
 	logger.Debugf("Session %s, from: %s", s.UUID, from)
 
-	if strings.LastIndex(from, "@") <= 0 {
+	if s.conn != nil {
+		s.Conn.Helo = s.conn.Hostname()
+	}
+
+	// Null sender is accepted, delivery status
+	// notifications are sent without a sender.
+	if from != "" && strings.LastIndex(from, "@") <= 0 {
 		logger.Errorf("Failed to parse from for %s, recipient with bad format %s", s.UUID, from)
 		return smtpError(
 			smtplib.StatusActionNotTakenMailboxNameNotAllowed,
@@ -23,15 +29,49 @@ func (s *smtpSession) Mail(from string, opts smtp.MailOptions) error {
 		)
 	}
 
-	s.Opts = opts
+	if opts != nil {
+		s.Opts = *opts
+	}
 	s.From = from
+
+	if !s.Auth.Anonymous {
+		return smtpSubmissionMail(s, from)
+	}
+
+	if s.DNSBLRefused {
+		return dnsblError(s, smtplib.StatusTransactionFailed)
+	}
+
+	ratelimitMail(s)
+
+	// SPF is checked for every sender, fail results are rejected
+	// at MAIL FROM with the reject policy of the server. Otherwise
+	// the spf policy of the mail is enforced on its recipients since
+	// the mail is unknown until the recipients are received.
+	if config.SPF.Status {
+		s.SPF = spfCheck(smtpRemoteIP(s.Conn.RemoteAddr), from, s.Conn.Helo)
+		logger.Debugf("Session %s, spf: %s (%s)", s.UUID, s.SPF.Result, s.SPF.Reason)
+
+		if config.SPF.Policy == spfPolicyReject && s.SPF.Result == spfResultFail {
+			logger.Errorf("Rejecting mail for %s, spf failed for %s", s.UUID, from)
+			return smtpError(
+				smtplib.StatusActionNotTakenMailboxInaccessible,
+				fmt.Sprintf(`Email Receiver: SPF check failed for "%s"`, from),
+			)
+		}
+	}
+
 	return nil
 }
 
 // Rcpt is recipient from session.
-func (s *smtpSession) Rcpt(recipient string) error {
+func (s *smtpSession) Rcpt(recipient string, opts *smtp.RcptOptions) error {
 	logger.Debugf("Session %s, rcpt: %s", s.UUID, recipient)
 
+	if opts == nil {
+		opts = &smtp.RcptOptions{}
+	}
+
 	if strings.LastIndex(recipient, "@") <= 0 {
 		return smtpError(
 			smtplib.StatusActionNotTakenMailboxNameNotAllowed,
@@ -39,121 +79,533 @@ func (s *smtpSession) Rcpt(recipient string) error {
 		)
 	}
 
+	if !s.Auth.Anonymous {
+		return smtpSubmissionRcpt(s, recipient)
+	}
+
 	mailHost := strings.Split(recipient, "@")[1]
 	if mail, ok := mailsFind(mailHost); ok {
-		// If the mail is in relay only mode, add the recipient to
-		// the recipients list otherwise if the mail is hosted by
-		// API, check if the inbox exists and save the inbox id.
-		if mail.Relay {
-			s.Recipients = append(s.Recipients, smtpRecipient{
-				Address: recipient,
-			})
-		} else {
+		if err := ratelimitMailRcpt(s, mail, recipient); err != nil {
+			return err
+		}
+
+		if err := dnsblRcpt(s, mail, recipient); err != nil {
+			return err
+		}
+
+		if mail.SPFPolicy == spfPolicyReject && s.SPF.Result == spfResultFail {
+			logger.Errorf("Rejecting rcpt for %s, spf failed for %s", s.UUID, s.From)
+			return smtpError(
+				smtplib.StatusActionNotTakenMailboxInaccessible,
+				fmt.Sprintf(`Email Receiver: SPF check failed for "%s"`, s.From),
+			)
+		}
+
+		// If the mail is in relay only mode, any recipient is
+		// accepted otherwise if the mail is hosted by API, check
+		// if the inbox exists and save the inbox id.
+		var inboxID uint
+		if !mail.Relay {
 			for _, inbox := range mail.Inboxes {
 				if inbox.Address == recipient {
-					s.Recipients = append(s.Recipients, smtpRecipient{
-						InboxID: inbox.ID,
-						Address: recipient,
-					})
-					return nil
+					inboxID = inbox.ID
+					break
 				}
 			}
 
-			return smtpError(
-				smtplib.StatusActionNotTakenMailboxInaccessible,
-				fmt.Sprintf(`Email Receiver: mailbox name unknown "%s"`, recipient),
-			)
+			if inboxID == 0 {
+				return smtpError(
+					smtplib.StatusActionNotTakenMailboxInaccessible,
+					fmt.Sprintf(`Email Receiver: mailbox name unknown "%s"`, recipient),
+				)
+			}
+		}
+
+		if err := ratelimitRcpt(s, mail, recipient); err != nil {
+			return err
+		}
+
+		if err := greylistCheck(s, mail, recipient); err != nil {
+			return err
 		}
+
+		s.Recipients = append(s.Recipients, smtpRecipient{
+			InboxID: inboxID,
+			Address: recipient,
+			Opts:    *opts,
+		})
 	}
 
 	return nil
 }
 
-// Data is data from session.
+// Data is data from session. The message is delivered to all of
+// the recipients and the first failure fails the transaction for
+// all of the recipients.
 func (s *smtpSession) Data(r io.Reader) error {
-	messageRaw, err := ioutil.ReadAll(r)
+	data, err := smtpSessionDataRead(s, r)
+	if err != nil {
+		return err
+	}
+	defer smtpDataRemove(data.file)
+	data.protocol = smtpTraceProtocol(s, false)
+
+	if !s.Auth.Anonymous {
+		return smtpSubmissionData(s, data)
+	}
+
+	if err := ratelimitData(s, data.file.Size); err != nil {
+		return err
+	}
+
+	release := smtpParseAcquire()
+	defer release()
+
+	if err := smtpSessionDataParse(s, data); err != nil {
+		return err
+	}
+
+	for _, err := range smtpSessionDeliver(s, data) {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LMTPData is data from an LMTP session. Each recipient is delivered
+// independently and gets its own status, a failed recipient doesn't
+// fail the others.
+func (s *smtpSession) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	data, err := smtpSessionDataRead(s, r)
+	if err != nil {
+		return err
+	}
+	defer smtpDataRemove(data.file)
+	data.protocol = smtpTraceProtocol(s, true)
+
+	if !s.Auth.Anonymous {
+		return smtpSubmissionData(s, data)
+	}
+
+	if err := ratelimitData(s, data.file.Size); err != nil {
+		return err
+	}
+
+	release := smtpParseAcquire()
+	defer release()
+
+	if err := smtpSessionDataParse(s, data); err != nil {
+		return err
+	}
+
+	// LMTP replies once for each accepted RCPT command (RFC 2033
+	// section 4.2), a recipient received multiple times gets its
+	// status set for each time it's received.
+	errs := smtpSessionDeliver(s, data)
+	for i, recipient := range s.Recipients {
+		if errs[i] != nil {
+			logger.Errorf("Failed to deliver to %s for %s, %v", recipient.Address, s.UUID, errs[i])
+		}
+		status.SetStatus(recipient.Address, errs[i])
+	}
+
+	return nil
+}
+
+// smtpSessionDataRead streams the message data of the session to
+// disk. Signatures are verified once on the raw message before any
+// headers are added to the message.
+func smtpSessionDataRead(s *smtpSession, r io.Reader) (*smtpSessionData, error) {
+	file, err := smtpDataWrite(r)
 	if err != nil {
 		logger.Errorf("Failed to read data for %s, read error %v", s.UUID, err)
-		return smtpError(
+		return nil, smtpError(
 			smtplib.StatusActionAbortedLocalError,
 			fmt.Sprintf("Email Receiver: email reading failed"),
 		)
 	}
 
-	logger.Debugf("Session %s, data:\n%s", s.UUID, string(messageRaw))
+	logger.Debugf("Session %s, data: %d bytes, sha256 %s", s.UUID, file.Size, file.SHA256)
 
-	// Iterate all recipients and apply plugins and rules
-	// for those mails. Send the email to upstream.
-	for _, recipient := range s.Recipients {
-		// Get the recipient host to find the mail.
-		recipientSplit := strings.Split(recipient.Address, "@")
-		if len(recipientSplit) != 2 {
-			err := fmt.Errorf("address format error: %s", recipient.Address)
-			logger.Errorf("Failed get recipient host %s, split host error %v", s.UUID, err)
-			return smtpError(
-				smtplib.StatusActionAbortedLocalError,
-				fmt.Sprintf(`Email Receiver: format error for "%s"`, recipient.Address),
-			)
+	data := &smtpSessionData{
+		file:     file,
+		received: time.Now(),
+	}
+
+	if config.DKIM.Status && s.Auth.Anonymous {
+		data.dkim = smtpSessionDataDKIM(s, file)
+	}
+
+	return data, nil
+}
+
+// smtpSessionDataDKIM verifies the signatures of the message data.
+func smtpSessionDataDKIM(s *smtpSession, file smtpData) []dkimResult {
+	f, err := smtpDataOpen(file)
+	if err != nil {
+		logger.Errorf("Failed to open data for %s, %v", s.UUID, err)
+		return nil
+	}
+	defer f.Close()
+
+	results, err := dkimVerify(f)
+	if err != nil {
+		logger.Errorf("Failed to verify dkim for %s, %v", s.UUID, err)
+		return nil
+	}
+
+	for _, result := range results {
+		logger.Debugf("Session %s, dkim: %s %s (%s)", s.UUID, result.Domain, result.Result, result.Reason)
+	}
+
+	return results
+}
+
+// smtpSessionDataParse parses the message data once for all of the
+// recipients. DMARC is evaluated with the parsed message since it
+// only depends on the From header, the message is scored once for
+// all of the recipients too. The caller holds a parse slot until the
+// parsed message is delivered.
+func smtpSessionDataParse(s *smtpSession, data *smtpSessionData) error {
+	message, err := smtpMessageParse(s, data.file)
+
+	if err != nil {
+		logger.Errorf("Failed to read envelople for %s, read error %v", s.UUID, err)
+		return smtpError(
+			smtplib.StatusActionAbortedLocalError,
+			fmt.Sprintf("Email Receiver: email parsing failed"),
+		)
+	}
+	message.DKIM = data.dkim
+
+	if config.DMARC.Status {
+		message.DMARC = dmarcCheck(message.From.Address, s.SPF, data.dkim)
+		logger.Debugf("Session %s, dmarc: %s %s (%s)", s.UUID, message.DMARC.Domain, message.DMARC.Result, message.DMARC.Reason)
+	}
+
+	if config.Spam.Status {
+		message.Spam = spamCheck(s, message)
+		logger.Debugf("Session %s, spam: %.2f %v", s.UUID, message.Spam.Score, message.Spam.Rules)
+	}
+
+	data.message = message
+	return nil
+}
+
+// smtpSessionDeliver delivers the message data to the recipients of
+// the session and returns the delivery error of each recipient. The
+// filters of each mail run once on the message. The message is relayed
+// once for the recipients of each relay mail and spooled once for all
+// of the inbox recipients so it's stored once by the API, unless the
+// filters of the inbox mail change the message.
+func smtpSessionDeliver(s *smtpSession, data *smtpSessionData) []error {
+	errs := make([]error, len(s.Recipients))
+
+	var (
+		inboxKeys   []string
+		inboxGroups = make(map[string]*smtpSessionInbox)
+
+		relayHosts      []string
+		relayMails      = make(map[string]typeMail)
+		relayRecipients = make(map[string][]int)
+		relayAddresses  = make(map[string][]string)
+
+		filtered = make(map[string]filterOutcome)
+	)
+
+	// Message data rewritten by the filters is
+	// removed once the message is delivered.
+	defer func() {
+		for _, outcome := range filtered {
+			if outcome.Message.Data.Path != data.message.Data.Path {
+				smtpDataRemove(outcome.Message.Data)
+			}
 		}
+	}()
 
-		mailHost := recipientSplit[1]
-		mail, ok := mailsFind(mailHost)
+	relaySeen := make(map[string]bool)
+	for i, recipient := range s.Recipients {
+		mail, err := smtpSessionMail(s, recipient)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		outcome, ok := filtered[mail.Host]
 		if !ok {
-			return smtpError(
-				smtplib.StatusActionNotTakenMailboxInaccessible,
-				fmt.Sprintf(`Email Receiver: mail unknown "%s"`, mailHost),
-			)
+			outcome = filterRun(s, mail, data.message)
+			filtered[mail.Host] = outcome
 		}
 
-		// Recreate the message from the raw message data in
-		// order to start from scratch for each mail rules.
-		message, err := smtpMessageParse(s, messageRaw)
-		if err != nil {
-			logger.Errorf("Failed to read envelople for %s, read error %v", s.UUID, err)
-			return smtpError(
-				smtplib.StatusActionAbortedLocalError,
-				fmt.Sprintf("Email Receiver: email parsing failed"),
-			)
+		if outcome.Err != nil {
+			errs[i] = outcome.Err
+			continue
 		}
 
-		// Relay the email message to upstreams, only if the mail is in
-		// the firewall only configuration.
+		// Relay the email message to upstreams, only if the mail
+		// is in the firewall only configuration.
 		if mail.Relay {
-			messageEncoded := smtpMessageBuild(message)
-			if err := smtpSend(messageEncoded, mail.Upstreams); err != nil {
-				logger.Errorf("Failed to relay message for %s, all upstreams failed", s.UUID)
-				return smtpError(
-					smtplib.StatusActionNotTakenMailboxInaccessible,
-					fmt.Sprintf(`Email Receiver: email relaying failed %s`, err.Error()),
-				)
+			if _, ok := relayMails[mail.Host]; !ok {
+				relayHosts = append(relayHosts, mail.Host)
+				relayMails[mail.Host] = mail
 			}
-		} else {
-			msg, err := messageParse(recipient.InboxID, message)
-			if err != nil {
-				logger.Errorf("Failed to save message for %s, %v", s.UUID, err)
-				return smtpError(
-					smtplib.StatusActionAbortedLocalError,
-					fmt.Sprintf(`Email: email receive failed due to internal error`),
-				)
+
+			relayRecipients[mail.Host] = append(relayRecipients[mail.Host], i)
+			if address := strings.ToLower(recipient.Address); !relaySeen[address] {
+				relaySeen[address] = true
+				relayAddresses[mail.Host] = append(relayAddresses[mail.Host], recipient.Address)
 			}
+			continue
+		}
 
-			if err := messagesSave(msg); err != nil {
-				logger.Errorf("Failed to send message for %s, %v", s.UUID, err)
-				return smtpError(
-					smtplib.StatusActionAbortedLocalError,
-					fmt.Sprintf(`Email: email receive failed due to internal error`),
-				)
+		// Inboxes of the mails with the message changed by
+		// their filters get their own copy of the message.
+		var key string
+		if outcome.Changed {
+			key = mail.Host
+		}
+
+		group, ok := inboxGroups[key]
+		if !ok {
+			group = &smtpSessionInbox{
+				message: outcome.Message,
+				seen:    make(map[uint]int),
+			}
+			inboxKeys = append(inboxKeys, key)
+			inboxGroups[key] = group
+		}
+
+		group.recipients = append(group.recipients, i)
+		n, ok := group.seen[recipient.InboxID]
+		if !ok {
+			n = len(group.deliveries)
+			group.seen[recipient.InboxID] = n
+			group.deliveries = append(group.deliveries, typeMailMessageDelivery{InboxID: recipient.InboxID})
+		}
+
+		// Each inbox only gets the recipients it's delivered for.
+		if !smtpAddressIn(recipient.Address, group.deliveries[n].EnvelopeTo) {
+			group.deliveries[n].EnvelopeTo = append(group.deliveries[n].EnvelopeTo, recipient.Address)
+		}
+
+		if mail.SPFPolicy == spfPolicyTag {
+			group.tag = true
+		}
+
+		if mail.DNSBLPolicy == dnsblPolicyTag {
+			group.dnsblTag = true
+		}
+	}
+
+	for _, host := range relayHosts {
+		err := smtpSessionRelay(s, data, filtered[host].Message, relayMails[host], relayAddresses[host])
+		for _, i := range relayRecipients[host] {
+			errs[i] = err
+		}
+	}
+
+	for _, key := range inboxKeys {
+		group := inboxGroups[key]
+		err := smtpSessionStore(s, data, group.message, group.deliveries, group.tag, group.dnsblTag)
+		for _, i := range group.recipients {
+			errs[i] = err
+		}
+	}
+
+	return errs
+}
+
+// smtpSessionMail finds the mail of a recipient of the session.
+func smtpSessionMail(s *smtpSession, recipient smtpRecipient) (typeMail, error) {
+	// Get the recipient host to find the mail.
+	recipientSplit := strings.Split(recipient.Address, "@")
+	if len(recipientSplit) != 2 {
+		err := fmt.Errorf("address format error: %s", recipient.Address)
+		logger.Errorf("Failed get recipient host %s, split host error %v", s.UUID, err)
+		return typeMail{}, smtpError(
+			smtplib.StatusActionAbortedLocalError,
+			fmt.Sprintf(`Email Receiver: format error for "%s"`, recipient.Address),
+		)
+	}
+
+	mailHost := recipientSplit[1]
+	mail, ok := mailsFind(mailHost)
+	if !ok {
+		return mail, smtpError(
+			smtplib.StatusActionNotTakenMailboxInaccessible,
+			fmt.Sprintf(`Email Receiver: mail unknown "%s"`, mailHost),
+		)
+	}
+
+	return mail, nil
+}
+
+// smtpSessionRelay relays the original message data to the upstreams
+// of the mail with the session envelope, only the trace headers are
+// prepended so the message and its signatures are kept intact, unless
+// the filters of the mail rewrite it. The message is spooled if none
+// of the upstreams accept it.
+func smtpSessionRelay(s *smtpSession, data *smtpSessionData, message smtpMessage, mail typeMail, addresses []string) error {
+	message.Session.Recipients = addresses
+	if mail.SPFPolicy == spfPolicyTag {
+		smtpSessionTag(s, &message)
+	}
+	if mail.DNSBLPolicy == dnsblPolicyTag {
+		smtpSessionDNSBLTag(s, &message)
+	}
+
+	envelope := smtpEnvelope{
+		From:  s.From,
+		To:    addresses,
+		DSN:   message.Session.DSN,
+		Trace: smtpTraceReceived(message.Session, data.protocol, data.received) + message.Trace,
+		File:  &message.Data,
+	}
+
+	outcome, rejected, err := smtpSend(envelope, "", mail.Upstreams)
+	if err == nil {
+		spoolRelaySent(dsnReport{
+			To:      s.From,
+			Arrival: data.received,
+			Options: message.Session.DSN,
+
+			Trace: envelope.Trace,
+			Data:  message.Data,
+		}, outcome, addresses, rejected)
+	}
+	if err == nil && len(rejected) == 0 {
+		return nil
+	}
+
+	// Recipients rejected while the others are delivered are
+	// bounced or retried from the spool on their own since the
+	// transaction can't fail for some of the recipients.
+	if err == nil {
+		message.Trace = envelope.Trace
+		if err := spoolAddRejected(spoolRelay{
+			Host: mail.Host,
+			From: s.From,
+			To:   addresses,
+		}, message, rejected); err != nil {
+			logger.Errorf("Failed to spool rejected recipients of relay message for %s, %v", s.UUID, err)
+			return smtpError(
+				smtplib.StatusActionAbortedLocalError,
+				fmt.Sprintf(`Email Receiver: email relaying failed %s`, err.Error()),
+			)
+		}
+
+		logger.Errorf("Failed to relay message for %s to %d recipients", s.UUID, len(rejected))
+		return nil
+	}
+
+	// Permanent failures are returned to the client, otherwise
+	// the message is accepted and retried from the spool.
+	if smtpSendPermanent(err) {
+		logger.Errorf("Failed to relay message for %s, upstream rejected %v", s.UUID, err)
+		return smtpError(
+			smtplib.StatusActionNotTakenMailboxInaccessible,
+			fmt.Sprintf(`Email Receiver: email relaying failed %s`, err.Error()),
+		)
+	}
+
+	message.Trace = envelope.Trace
+	entry, spoolErr := spoolAddRelay(spoolRelay{
+		Host: mail.Host,
+		From: s.From,
+		To:   addresses,
+	}, message)
+	if spoolErr != nil {
+		logger.Errorf("Failed to spool relay message for %s, %v", s.UUID, spoolErr)
+		return smtpError(
+			smtplib.StatusActionAbortedLocalError,
+			fmt.Sprintf(`Email Receiver: email relaying failed %s`, err.Error()),
+		)
+	}
+
+	logger.Errorf("Failed to relay message for %s, all upstreams failed, spooled for retry %s, %v", s.UUID, entry.ID, err)
+	spoolRelayDelay(entry, err)
+	return nil
+}
+
+// smtpSessionStore spools a copy of the parsed message once for all
+// of the inboxes. The message is tagged if any of the inbox mails
+// has the spf or dnsbl tag policy since the inboxes share the stored
+// message. Envelope recipients are stored with the delivery of each
+// inbox, the trace headers only name a recipient if there's one.
+func smtpSessionStore(s *smtpSession, data *smtpSessionData, message smtpMessage, deliveries []typeMailMessageDelivery, tag, dnsblTag bool) error {
+	message.Session.Recipients = nil
+	for _, delivery := range deliveries {
+		for _, address := range delivery.EnvelopeTo {
+			if !smtpAddressIn(address, message.Session.Recipients) {
+				message.Session.Recipients = append(message.Session.Recipients, address)
 			}
 		}
+	}
+	if tag {
+		smtpSessionTag(s, &message)
+	}
+	if dnsblTag {
+		smtpSessionDNSBLTag(s, &message)
+	}
+
+	// Message is delivered to the inboxes, trace headers
+	// are added on top of the existing trace headers.
+	message.Trace = smtpTraceReturnPath(s.From) +
+		smtpTraceReceived(message.Session, data.protocol, data.received) +
+		message.Trace
+
+	// Message is accepted once it's written to the spool,
+	// if the delivery fails, spool retries it later.
+	entry, err := spoolAdd(deliveries, message)
+	if err != nil {
+		logger.Errorf("Failed to spool message for %s, %v", s.UUID, err)
+		return smtpError(
+			smtplib.StatusActionAbortedLocalError,
+			fmt.Sprintf(`Email: email receive failed due to internal error`),
+		)
+	}
 
+	message.Data = entry.Data
+	if err := spoolDeliver(entry, message); err != nil {
+		logger.Errorf("Failed to deliver message for %s, spooled for retry %s, %v", s.UUID, entry.ID, err)
 	}
 
 	return nil
 }
 
+// smtpSessionTag tags the message with the spf result header.
+func smtpSessionTag(s *smtpSession, message *smtpMessage) {
+	if s.SPF.Result == "" {
+		return
+	}
+
+	header := spfReceivedHeader(s.SPF, smtpRemoteIP(s.Conn.RemoteAddr), s.From, s.Conn.Helo)
+	message.Trace = header + message.Trace
+}
+
+// smtpSessionDNSBLTag tags the message with the dnsbl score header.
+func smtpSessionDNSBLTag(s *smtpSession, message *smtpMessage) {
+	ip := smtpRemoteIP(s.Conn.RemoteAddr)
+	if !config.DNSBL.Status || ip == nil {
+		return
+	}
+
+	header := dnsblHeader(s.DNSBL, ip)
+	message.Trace = header + message.Trace
+}
+
 // Reset is reset from session.
 func (s *smtpSession) Reset() {
 	logger.Debugf("Session %s, reset", s.UUID)
+
+	// Envelope is cleared so the recipients of a message
+	// are not kept for the next message of the session.
+	s.Opts = smtp.MailOptions{}
+	s.From = ""
+	s.Recipients = nil
+	s.RatelimitMail = nil
 }
 
 // Logout is log out from session.
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/google/uuid"
+	"github.com/violetnorth/smtplib"
+)
+
+// testStatus collects the LMTP statuses of the recipients.
+type testStatus struct {
+	recipients []string
+	errs       []error
+}
+
+func (st *testStatus) SetStatus(rcptTo string, err error) {
+	st.recipients = append(st.recipients, rcptTo)
+	st.errs = append(st.errs, err)
+}
+
+// testMails adds the mails to redis for the test, mails without
+// a host are added as unknown hosts.
+func testMails(t *testing.T, mails map[string]typeMail) {
+	t.Helper()
+
+	for host, mail := range mails {
+		if err := mailsAdd(host, mail, mail.Host != ""); err != nil {
+			t.Fatalf("add mail %s: %v", host, err)
+		}
+	}
+
+	t.Cleanup(func() {
+		for host := range mails {
+			redisdb.Del(redisKeyMailKnown(host), redisKeyMail(host))
+		}
+	})
+}
+
+// TestSessionLMTPData replies with the status of each recipient, the
+// recipients of a mail get the status of the delivery to the mail and
+// a recipient received twice gets a status for each time.
+func TestSessionLMTPData(t *testing.T) {
+	testRedis(t)
+
+	previousTTL := config.Mails.TTL
+	t.Cleanup(func() {
+		config.Mails.TTL = previousTTL
+	})
+	config.Mails.TTL = 60
+
+	var (
+		relayHost    = uuid.New().String() + ".example.com"
+		rejectedHost = uuid.New().String() + ".example.com"
+		filteredHost = uuid.New().String() + ".example.com"
+		unknownHost  = uuid.New().String() + ".example.com"
+	)
+
+	accepting := testUpstreamListen(t, nil)
+	rejecting := testUpstreamListen(t, map[string]int{"b@" + rejectedHost: 550})
+
+	testMails(t, map[string]typeMail{
+		relayHost: {
+			Host:      relayHost,
+			Relay:     true,
+			Upstreams: []typeMailUpstream{{Target: accepting.listener.Addr().String()}},
+		},
+		rejectedHost: {
+			Host:      rejectedHost,
+			Relay:     true,
+			Upstreams: []typeMailUpstream{{Target: rejecting.listener.Addr().String()}},
+		},
+		filteredHost: {
+			Host:    filteredHost,
+			Relay:   true,
+			Filters: []typeMailFilter{{Type: filterTypeSize, Action: filterActionReject, MaxBytes: 1}},
+		},
+		unknownHost: {},
+	})
+
+	recipients := []string{
+		"a@" + relayHost,
+		"b@" + rejectedHost,
+		"c@" + filteredHost,
+		"d@" + unknownHost,
+		"a@" + relayHost,
+	}
+	codes := []int{
+		0,
+		smtplib.StatusActionNotTakenMailboxInaccessible,
+		smtplib.StatusActionAbortedExceedStorageAllocation,
+		smtplib.StatusActionNotTakenMailboxInaccessible,
+		0,
+	}
+
+	s := testSession(recipients)
+	status := &testStatus{}
+	if err := s.LMTPData(bytes.NewReader(testMessage(recipients, 3)), status); err != nil {
+		t.Fatalf("lmtp data: %v", err)
+	}
+
+	if len(status.recipients) != len(recipients) {
+		t.Fatalf("%d statuses, want %d", len(status.recipients), len(recipients))
+	}
+
+	for i, recipient := range recipients {
+		if status.recipients[i] != recipient {
+			t.Errorf("status %d of %s, want %s", i, status.recipients[i], recipient)
+		}
+
+		code := 0
+		if smtpErr, ok := status.errs[i].(*smtp.SMTPError); ok {
+			code = smtpErr.Code
+		} else if status.errs[i] != nil {
+			t.Errorf("status of %s %v, want an smtp error", recipient, status.errs[i])
+			continue
+		}
+
+		if code != codes[i] {
+			t.Errorf("status of %s %v, want %d", recipient, status.errs[i], codes[i])
+		}
+	}
+
+	if delivered := accepting.Delivered(); len(delivered) != 1 || delivered[0] != "a@"+relayHost {
+		t.Errorf("delivered %v, want the relay recipient once", delivered)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/violetnorth/smtplib"
+)
+
+// Submission (RFC 6409) of authenticated sessions. Authenticated
+// clients send as the address of their inbox to any recipient,
+// messages are queued by the API to be sent outbound.
+
+// smtpSubmissionMail checks that the sender is the address
+// of the authenticated inbox.
+func smtpSubmissionMail(s *smtpSession, from string) error {
+	if s.Auth.InboxID == 0 {
+		return smtpError(
+			smtplib.StatusAuthenticationRequired,
+			fmt.Sprintf("Email Submission: authentication required"),
+		)
+	}
+
+	if !strings.EqualFold(from, s.Auth.Address) {
+		logger.Errorf("Rejecting mail for %s, %s is not allowed to send as %s", s.UUID, s.Auth.Username, from)
+		return smtpError(
+			smtplib.StatusActionNotTakenMailboxNameNotAllowed,
+			fmt.Sprintf(`Email Submission: not allowed to send as "%s"`, from),
+		)
+	}
+
+	return nil
+}
+
+// smtpSubmissionRcpt adds the recipient, any recipient is
+// allowed for authenticated sessions.
+func smtpSubmissionRcpt(s *smtpSession, recipient string) error {
+	s.Recipients = append(s.Recipients, smtpRecipient{
+		Address: recipient,
+	})
+
+	return nil
+}
+
+// smtpSubmissionData queues the submitted message to be sent
+// outbound to the envelope recipients.
+func smtpSubmissionData(s *smtpSession, data *smtpSessionData) error {
+	release := smtpParseAcquire()
+	defer release()
+
+	message, err := smtpMessageParse(s, data.file)
+
+	if err != nil {
+		logger.Errorf("Failed to read envelope for %s, read error %v", s.UUID, err)
+		return smtpError(
+			smtplib.StatusActionAbortedLocalError,
+			fmt.Sprintf("Email Submission: email parsing failed"),
+		)
+	}
+
+	if !strings.EqualFold(message.From.Address, s.Auth.Address) {
+		logger.Errorf("Rejecting data for %s, from header %s is not %s", s.UUID, message.From.Address, s.Auth.Address)
+		return smtpError(
+			smtplib.StatusActionNotTakenMailboxNameNotAllowed,
+			fmt.Sprintf(`Email Submission: not allowed to send as "%s"`, message.From.Address),
+		)
+	}
+
+	// Missing Message-Id and Date are added by the
+	// submission server (RFC 6409 section 8).
+	if message.MessageID == "" {
+		message.MessageID = fmt.Sprintf("%s@%s", uuid.New().String(), config.Server.Domain)
+		message.Trace += fmt.Sprintf("Message-Id: %s\r\n", smtpIDHeaderEncode(message.MessageID))
+	}
+
+	if message.Date.IsZero() {
+		message.Date = time.Now()
+		message.Trace += fmt.Sprintf("Date: %s\r\n", message.Date.Format(time.RFC1123Z))
+	}
+
+	message.Trace = smtpTraceReceived(message.Session, data.protocol, data.received) + message.Trace
+
+	mailMessage, err := messageParse(message, uuid.New().String())
+	if err != nil {
+		logger.Errorf("Failed to parse message for %s, %v", s.UUID, err)
+		return smtpError(
+			smtplib.StatusActionAbortedLocalError,
+			fmt.Sprintf("Email Submission: email submission failed due to internal error"),
+		)
+	}
+	mailMessage.InboxID = s.Auth.InboxID
+
+	// Messages are only sent to the envelope recipients, the To
+	// and Cc headers decide which of them are the blind carbon
+	// copy recipients. Header addresses which are not envelope
+	// recipients are not sent to.
+	headerTo := make(map[string]typeMailMessageRelation)
+	for _, relation := range mailMessage.To {
+		headerTo[strings.ToLower(relation.Address)] = relation
+	}
+
+	headerCc := make(map[string]typeMailMessageRelation)
+	for _, relation := range mailMessage.Cc {
+		headerCc[strings.ToLower(relation.Address)] = relation
+	}
+
+	mailMessage.To = nil
+	mailMessage.Cc = nil
+	mailMessage.Bcc = nil
+
+	envelopeRecipients := make(map[string]bool)
+	for _, recipient := range s.Recipients {
+		address := strings.ToLower(recipient.Address)
+		if envelopeRecipients[address] {
+			continue
+		}
+		envelopeRecipients[address] = true
+
+		if relation, ok := headerTo[address]; ok {
+			mailMessage.To = append(mailMessage.To, relation)
+			continue
+		}
+
+		if relation, ok := headerCc[address]; ok {
+			mailMessage.Cc = append(mailMessage.Cc, relation)
+			continue
+		}
+
+		mailMessage.Bcc = append(mailMessage.Bcc, typeMailMessageRelation{
+			Address: recipient.Address,
+		})
+	}
+
+	if err := apiRequestMessagesOutboundQueue(mailMessage); err != nil {
+		logger.Errorf("Failed to queue message for %s, %v", s.UUID, err)
+		return smtpError(
+			smtplib.StatusActionAbortedLocalError,
+			fmt.Sprintf("Email Submission: email submission failed due to internal error"),
+		)
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/violetnorth/smtplib"
+)
+
+// testSubmissionAPI verifies the credential of koray@example.com and
+// records the messages queued to be sent outbound, uploads are
+// accepted without being kept.
+type testSubmissionAPI struct {
+	mu     sync.Mutex
+	queued []typeMailMessage
+}
+
+func (api *testSubmissionAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	switch r.URL.Path {
+	case "/smtp/credentials/verify":
+		var req struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		json.Unmarshal(body, &req)
+
+		if req.Username != "koray" || req.Password != "secret" {
+			w.Write([]byte(`{"success": true, "verified": false}`))
+			return
+		}
+		w.Write([]byte(`{"success": true, "verified": true, "mail_inbox": {"id": 1, "address": "koray@example.com"}}`))
+
+	case "/smtp/outbound/queue":
+		var req struct {
+			MailMessage typeMailMessage `json:"mail_message"`
+		}
+		json.Unmarshal(body, &req)
+
+		api.mu.Lock()
+		api.queued = append(api.queued, req.MailMessage)
+		api.mu.Unlock()
+		w.Write([]byte(`{"success": true}`))
+	}
+}
+
+// testSubmissionSession returns a submission session of a
+// client which is not authenticated yet.
+func testSubmissionSession(t *testing.T) (*smtpSession, *testSubmissionAPI) {
+	t.Helper()
+
+	api := &testSubmissionAPI{}
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	testAPI(t, server)
+
+	s := testSession(nil)
+	s.Auth.Anonymous = false
+
+	return s, api
+}
+
+// testSMTPCode returns the reply code of the smtp error.
+func testSMTPCode(err error) int {
+	if smtpErr, ok := err.(*smtp.SMTPError); ok {
+		return smtpErr.Code
+	}
+	return 0
+}
+
+func TestSubmissionAuth(t *testing.T) {
+	s, _ := testSubmissionSession(t)
+
+	receiver := testSession(nil)
+	if err := receiver.AuthPlain("koray", "secret"); err != smtp.ErrAuthUnsupported {
+		t.Fatalf("receiver session auth %v, want unsupported", err)
+	}
+
+	if err := s.AuthPlain("koray", "wrong"); testSMTPCode(err) != smtplib.StatusAuthenticationInvalid {
+		t.Fatalf("invalid credential %v, want %d", err, smtplib.StatusAuthenticationInvalid)
+	}
+	if s.Auth.InboxID != 0 {
+		t.Fatalf("session authenticated as inbox %d with an invalid credential", s.Auth.InboxID)
+	}
+
+	if err := s.AuthPlain("koray", "secret"); err != nil {
+		t.Fatalf("valid credential %v", err)
+	}
+	if s.Auth.InboxID != 1 || s.Auth.Address != "koray@example.com" {
+		t.Fatalf("session authenticated as %+v, want the inbox of the credential", s.Auth)
+	}
+}
+
+// TestSubmissionMail accepts the address of the authenticated inbox
+// as the envelope sender only.
+func TestSubmissionMail(t *testing.T) {
+	s, _ := testSubmissionSession(t)
+
+	if err := s.Mail("koray@example.com", &smtp.MailOptions{}); testSMTPCode(err) != smtplib.StatusAuthenticationRequired {
+		t.Fatalf("mail before auth %v, want %d", err, smtplib.StatusAuthenticationRequired)
+	}
+
+	if err := s.AuthPlain("koray", "secret"); err != nil {
+		t.Fatalf("auth: %v", err)
+	}
+
+	tests := []struct {
+		from string
+		code int
+	}{
+		{"koray@example.com", 0},
+		{"Koray@Example.com", 0},
+		{"other@example.com", smtplib.StatusActionNotTakenMailboxNameNotAllowed},
+		{"", smtplib.StatusActionNotTakenMailboxNameNotAllowed},
+	}
+
+	for _, test := range tests {
+		if err := s.Mail(test.from, &smtp.MailOptions{}); testSMTPCode(err) != test.code {
+			t.Errorf("mail from %q %v, want %d", test.from, err, test.code)
+		}
+		s.Reset()
+	}
+}
+
+// TestSubmissionData queues the messages with the From header of the
+// authenticated inbox, the envelope recipients missing from the To
+// and Cc headers are sent as blind carbon copies.
+func TestSubmissionData(t *testing.T) {
+	s, api := testSubmissionSession(t)
+	if err := s.AuthPlain("koray", "secret"); err != nil {
+		t.Fatalf("auth: %v", err)
+	}
+
+	message := func(from string) []byte {
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "From: Koray <%s>\r\n", from)
+		fmt.Fprintf(&b, "To: a@example.net, not-a-recipient@example.net\r\n")
+		fmt.Fprintf(&b, "Cc: b@example.net\r\n")
+		fmt.Fprintf(&b, "Subject: Quarterly report\r\n\r\n")
+		fmt.Fprintf(&b, "The report is attached.\r\n")
+		return b.Bytes()
+	}
+
+	for _, recipient := range []string{"a@example.net", "B@example.net", "c@example.net"} {
+		if err := s.Rcpt(recipient, &smtp.RcptOptions{}); err != nil {
+			t.Fatalf("rcpt %s: %v", recipient, err)
+		}
+	}
+
+	err := s.Data(bytes.NewReader(message("other@example.com")))
+	if testSMTPCode(err) != smtplib.StatusActionNotTakenMailboxNameNotAllowed {
+		t.Fatalf("data from another address %v, want %d", err, smtplib.StatusActionNotTakenMailboxNameNotAllowed)
+	}
+	if len(api.queued) != 0 {
+		t.Fatalf("%d messages queued from another address", len(api.queued))
+	}
+
+	if err := s.Data(bytes.NewReader(message("Koray@example.com"))); err != nil {
+		t.Fatalf("data: %v", err)
+	}
+	if len(api.queued) != 1 {
+		t.Fatalf("%d messages queued, want 1", len(api.queued))
+	}
+
+	queued := api.queued[0]
+	if queued.InboxID != 1 {
+		t.Errorf("queued for inbox %d, want 1", queued.InboxID)
+	}
+
+	addresses := func(relations []typeMailMessageRelation) string {
+		var list []string
+		for _, relation := range relations {
+			list = append(list, strings.ToLower(relation.Address))
+		}
+		return strings.Join(list, ",")
+	}
+
+	if to, cc, bcc := addresses(queued.To), addresses(queued.Cc), addresses(queued.Bcc); to != "a@example.net" || cc != "b@example.net" || bcc != "c@example.net" {
+		t.Errorf("queued to %q cc %q bcc %q, want the envelope recipients", to, cc, bcc)
+	}
+}
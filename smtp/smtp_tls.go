@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+var (
+	smtpTLSVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+)
+
+// smtpTLSConfig creates the tls config used by the smtp listeners
+// from the server tls config. Certificate and key are loaded from
+// the configured paths.
+func smtpTLSConfig() (*tls.Config, error) {
+	crt, err := tls.LoadX509KeyPair(config.Server.TLS.Crt, config.Server.TLS.Key)
+	if err != nil {
+		return nil, fmt.Errorf("load key pair error: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{crt},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if config.Server.TLS.MinVersion != "" {
+		minVersion, ok := smtpTLSVersions[config.Server.TLS.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls min version: %s", config.Server.TLS.MinVersion)
+		}
+		tlsConfig.MinVersion = minVersion
+	}
+
+	// Cipher suites only apply to TLS 1.0 - 1.2, TLS 1.3
+	// suites are not configurable.
+	for _, cipher := range config.Server.TLS.Ciphers {
+		id, ok := smtpTLSCipherSuite(cipher)
+		if !ok {
+			return nil, fmt.Errorf("unknown tls cipher suite: %s", cipher)
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+
+	return tlsConfig, nil
+}
+
+// smtpTLSCipherSuite returns the cipher suite id with the provided
+// IANA name, ie. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256".
+func smtpTLSCipherSuite(name string) (uint16, bool) {
+	name = strings.TrimSpace(name)
+
+	suites := tls.CipherSuites()
+	suites = append(suites, tls.InsecureCipherSuites()...)
+	for _, suite := range suites {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+
+	return 0, false
+}
+
+// smtpTLSVersionName returns the human readable name of
+// the negotiated tls version, ie. "TLS 1.3".
+func smtpTLSVersionName(version uint16) string {
+	for name, v := range smtpTLSVersions {
+		if v == version {
+			return "TLS " + name
+		}
+	}
+
+	return fmt.Sprintf("0x%04X", version)
+}
+
+// smtpTLSState returns the negotiated version and cipher suite
+// names of a connection. Empty strings are returned if the
+// connection is plaintext.
+func smtpTLSState(state tls.ConnectionState) (string, string) {
+	if !state.HandshakeComplete {
+		return "", ""
+	}
+
+	return smtpTLSVersionName(state.Version), tls.CipherSuiteName(state.CipherSuite)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Trace header fields (RFC 5321 section 4.4) are prepended to the
+// messages before they are stored. Received is added for every
+// message the server handles, Return-Path only on the final
+// delivery to the inboxes.
+
+// smtpTraceProtocol returns the protocol of the session for the
+// received header (RFC 3848), ie. ESMTPS for a STARTTLS session.
+func smtpTraceProtocol(s *smtpSession, lmtp bool) string {
+	protocol := "ESMTP"
+	if lmtp {
+		protocol = "LMTP"
+	}
+
+	if s.Conn.TLS.HandshakeComplete {
+		protocol += "S"
+	}
+
+	if !s.Auth.Anonymous {
+		protocol += "A"
+	}
+
+	return protocol
+}
+
+// smtpTraceReceived returns the received header of the message
+// session. Recipient is added only if the message has a single
+// recipient, so the other recipients are not disclosed.
+func smtpTraceReceived(session smtpMessageSession, protocol string, at time.Time) string {
+	helo := session.Helo
+	if helo == "" {
+		helo = "unknown"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Received: from %s", helo)
+	if session.RemoteIP != "" {
+		fmt.Fprintf(&b, " ([%s])", session.RemoteIP)
+	}
+
+	fmt.Fprintf(&b, "\r\n\tby %s with %s id %s", config.Server.Domain, protocol, session.UUID)
+	if session.TLSVersion != "" {
+		fmt.Fprintf(&b, "\r\n\t(version=%s cipher=%s)", session.TLSVersion, session.TLSCipherSuite)
+	}
+
+	if len(session.Recipients) == 1 {
+		fmt.Fprintf(&b, "\r\n\tfor <%s>", session.Recipients[0])
+	}
+
+	fmt.Fprintf(&b, "; %s\r\n", at.Format(time.RFC1123Z))
+	return b.String()
+}
+
+// smtpTraceReturnPath returns the return path header of the
+// envelope sender, the null sender of bounces is "<>".
+func smtpTraceReturnPath(from string) string {
+	return fmt.Sprintf("Return-Path: <%s>\r\n", from)
+}
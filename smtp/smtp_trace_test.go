@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+func TestSMTPTraceProtocol(t *testing.T) {
+	tests := []struct {
+		tls       bool
+		anonymous bool
+		lmtp      bool
+		protocol  string
+	}{
+		{false, true, false, "ESMTP"},
+		{true, true, false, "ESMTPS"},
+		{true, false, false, "ESMTPSA"},
+		{false, false, false, "ESMTPA"},
+		{false, true, true, "LMTP"},
+		{true, true, true, "LMTPS"},
+	}
+
+	for _, test := range tests {
+		s := testSession(nil)
+		s.Conn.TLS = tls.ConnectionState{HandshakeComplete: test.tls}
+		s.Auth.Anonymous = test.anonymous
+
+		if protocol := smtpTraceProtocol(s, test.lmtp); protocol != test.protocol {
+			t.Errorf("protocol %s with tls %t anonymous %t lmtp %t, want %s", protocol, test.tls, test.anonymous, test.lmtp, test.protocol)
+		}
+	}
+}
+
+func TestSMTPTraceReceived(t *testing.T) {
+	domain := config.Server.Domain
+	t.Cleanup(func() {
+		config.Server.Domain = domain
+	})
+	config.Server.Domain = "mx.example.com"
+
+	at := time.Date(2021, time.March, 4, 10, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		session  smtpMessageSession
+		received string
+	}{
+		{
+			name: "single recipient",
+			session: smtpMessageSession{
+				UUID:       "session",
+				Helo:       "mail.example.org",
+				RemoteIP:   "192.0.2.1",
+				Recipients: []string{"koray@example.com"},
+			},
+			received: "Received: from mail.example.org ([192.0.2.1])\r\n" +
+				"\tby mx.example.com with ESMTP id session\r\n" +
+				"\tfor <koray@example.com>; Thu, 04 Mar 2021 10:30:00 +0000\r\n",
+		},
+		{
+			name: "recipients are not disclosed",
+			session: smtpMessageSession{
+				UUID:       "session",
+				Helo:       "mail.example.org",
+				RemoteIP:   "192.0.2.1",
+				Recipients: []string{"koray@example.com", "other@example.com"},
+			},
+			received: "Received: from mail.example.org ([192.0.2.1])\r\n" +
+				"\tby mx.example.com with ESMTP id session; Thu, 04 Mar 2021 10:30:00 +0000\r\n",
+		},
+		{
+			name: "tls",
+			session: smtpMessageSession{
+				UUID:           "session",
+				Helo:           "mail.example.org",
+				RemoteIP:       "192.0.2.1",
+				TLSVersion:     "TLS1.3",
+				TLSCipherSuite: "TLS_AES_128_GCM_SHA256",
+			},
+			received: "Received: from mail.example.org ([192.0.2.1])\r\n" +
+				"\tby mx.example.com with ESMTP id session\r\n" +
+				"\t(version=TLS1.3 cipher=TLS_AES_128_GCM_SHA256); Thu, 04 Mar 2021 10:30:00 +0000\r\n",
+		},
+		{
+			name: "lmtp over a unix socket without helo",
+			session: smtpMessageSession{
+				UUID: "session",
+			},
+			received: "Received: from unknown\r\n" +
+				"\tby mx.example.com with ESMTP id session; Thu, 04 Mar 2021 10:30:00 +0000\r\n",
+		},
+	}
+
+	for _, test := range tests {
+		if received := smtpTraceReceived(test.session, "ESMTP", at); received != test.received {
+			t.Errorf("%s: received %q, want %q", test.name, received, test.received)
+		}
+	}
+}
+
+func TestSMTPTraceReturnPath(t *testing.T) {
+	tests := []struct {
+		from       string
+		returnPath string
+	}{
+		{"sender@example.org", "Return-Path: <sender@example.org>\r\n"},
+		{"", "Return-Path: <>\r\n"},
+	}
+
+	for _, test := range tests {
+		if returnPath := smtpTraceReturnPath(test.from); returnPath != test.returnPath {
+			t.Errorf("return path %q of %q, want %q", returnPath, test.from, test.returnPath)
+		}
+	}
+}
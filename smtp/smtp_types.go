@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/tls"
 	"net"
+	"time"
 
 	"github.com/emersion/go-smtp"
 )
@@ -15,20 +16,27 @@ const (
 	contentTypeMIME = "message/rfc822"
 	contentTypeText = "text/plain"
 	contentTypeHTML = "text/html"
+
+	// Only the first header fields of a message are sent
+	// to the API, the stored message keeps all of them.
+	messageHeadersMax = 500
 )
 
 // smtpConn is the conn type in smtp session.
 type smtpConn struct {
+	Helo       string
 	LocalAddr  net.Addr
 	RemoteAddr net.Addr
 	TLS        tls.ConnectionState
 }
 
-// smtpAuth is the auth type in smtp session.
+// smtpAuth is the auth type in smtp session. Authenticated
+// sessions send as the address of the inbox of the credential.
 type smtpAuth struct {
 	Anonymous bool
 	Username  string
-	Password  string
+	InboxID   uint
+	Address   string
 }
 
 // smtpSession is returned after successful login.
@@ -39,11 +47,54 @@ type smtpSession struct {
 	From       string
 	Recipients []smtpRecipient
 
+	SPF spfResult
+
+	// DNSBL is the result of the client, checked once when the
+	// session starts. Refused sessions reject every command.
+	DNSBL        dnsblResult
+	DNSBLRefused bool
+
+	// RatelimitMail is the MAIL command limit exceeded by the
+	// session, it's reported to the mail of the first recipient.
+	RatelimitMail *ratelimitKey
+
 	Conn smtpConn
 	Auth smtpAuth
+
+	// conn is the connection of the session, the HELO
+	// hostname is only known after the session is created.
+	conn *smtp.Conn
+}
+
+// smtpSessionData is the message data of a session, parsed
+// once and shared by the deliveries to each recipient.
+type smtpSessionData struct {
+	file    smtpData
+	dkim    []dkimResult
+	message smtpMessage
+
+	// Time the message data is received and the
+	// protocol of the session, for the trace headers.
+	received time.Time
+	protocol string
+}
+
+// smtpSessionInbox is the inbox recipients of a session which
+// are delivered the same copy of the message.
+type smtpSessionInbox struct {
+	message    smtpMessage
+	recipients []int
+	deliveries []typeMailMessageDelivery
+	seen       map[uint]int
+
+	// Message is tagged with the spf and dnsbl result
+	// headers if any of the mails has the tag policy.
+	tag      bool
+	dnsblTag bool
 }
 
 type smtpRecipient struct {
 	Address string
 	InboxID uint
+	Opts    smtp.RcptOptions
 }
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+// Messages are scored once when they are received. The score is the
+// sum of the scores of the rules which match the message: header
+// anomalies, HTML only bodies, links to url shorteners, the spf, dkim
+// and dmarc results and the dnsbl listings of the client. Scores of
+// the rules can be changed or disabled with 0 in "rules".
+//
+// The bayes classifier adds the bayes_spam or bayes_ham rule once it's
+// trained with "min_messages" of both classes. Token counts of the
+// trained messages are stored in redis, messages are trained with:
+//
+//	smtp --spam-train spam message1.eml message2.eml
+//	smtp --spam-train ham message3.eml
+//
+// The score and the matched rules are stored with the message, inboxes
+// hide the messages over their spam threshold in the API.
+
+const (
+	spamClassSpam = "spam"
+	spamClassHam  = "ham"
+
+	spamBayesMinMessagesDefault = 50
+
+	// spamBayesTokensMax is the max number of tokens
+	// of a message which are trained or classified.
+	spamBayesTokensMax = 1000
+
+	// spamBayesInteresting is the number of the tokens with the
+	// probabilities furthest from neutral which are combined.
+	spamBayesInteresting = 15
+
+	// spamBayesSpamProbability and spamBayesHamProbability are
+	// the probabilities of the bayes_spam and bayes_ham rules.
+	spamBayesSpamProbability = 0.9
+	spamBayesHamProbability  = 0.1
+
+	// spamFutureDate is how far in the future the date of
+	// a message can be before it's a header anomaly.
+	spamFutureDate = 24 * time.Hour
+)
+
+var (
+	// spamRuleScores are the default scores of the rules.
+	spamRuleScores = map[string]float64{
+		"missing_message_id": 1.0,
+		"missing_date":       1.0,
+		"missing_from":       1.5,
+		"missing_to":         0.5,
+		"missing_subject":    0.5,
+		"future_date":        1.0,
+		"reply_to_mismatch":  0.5,
+		"html_only":          1.0,
+		"url_shortener":      1.5,
+		"spf_fail":           2.0,
+		"spf_softfail":       1.0,
+		"dkim_fail":          1.5,
+		"dkim_none":          0.5,
+		"dmarc_fail":         2.0,
+		"dnsbl_listed":       3.0,
+		"bayes_spam":         3.0,
+		"bayes_ham":          -1.5,
+	}
+
+	// spamRules are the rules which are checked in order,
+	// the bayes rules are added by the classifier.
+	spamRules = []struct {
+		name  string
+		match func(s *smtpSession, message smtpMessage) bool
+	}{
+		{"missing_message_id", func(s *smtpSession, message smtpMessage) bool {
+			return message.MessageID == ""
+		}},
+		{"missing_date", func(s *smtpSession, message smtpMessage) bool {
+			return message.Date.IsZero()
+		}},
+		{"missing_from", func(s *smtpSession, message smtpMessage) bool {
+			return message.From.Address == ""
+		}},
+		{"missing_to", func(s *smtpSession, message smtpMessage) bool {
+			return len(message.To) == 0 && len(message.Cc) == 0
+		}},
+		{"missing_subject", func(s *smtpSession, message smtpMessage) bool {
+			return strings.TrimSpace(message.Subject) == ""
+		}},
+		{"future_date", func(s *smtpSession, message smtpMessage) bool {
+			return message.Date.After(time.Now().Add(spamFutureDate))
+		}},
+		{"reply_to_mismatch", func(s *smtpSession, message smtpMessage) bool {
+			return message.ReplyTo.Address != "" && message.From.Address != "" &&
+				!strings.EqualFold(spamDomain(message.ReplyTo.Address), spamDomain(message.From.Address))
+		}},
+		{"html_only", func(s *smtpSession, message smtpMessage) bool {
+			return message.HTMLOnly
+		}},
+		{"url_shortener", func(s *smtpSession, message smtpMessage) bool {
+			return spamShortened(message)
+		}},
+		{"spf_fail", func(s *smtpSession, message smtpMessage) bool {
+			return message.Session.SPF.Result == spfResultFail
+		}},
+		{"spf_softfail", func(s *smtpSession, message smtpMessage) bool {
+			return message.Session.SPF.Result == spfResultSoftFail
+		}},
+		{"dkim_fail", func(s *smtpSession, message smtpMessage) bool {
+			for _, result := range message.DKIM {
+				if result.Result == dkimResultFail {
+					return true
+				}
+			}
+			return false
+		}},
+		{"dkim_none", func(s *smtpSession, message smtpMessage) bool {
+			return config.DKIM.Status && len(message.DKIM) == 0
+		}},
+		{"dmarc_fail", func(s *smtpSession, message smtpMessage) bool {
+			return message.DMARC.Result == dmarcResultFail
+		}},
+		{"dnsbl_listed", func(s *smtpSession, message smtpMessage) bool {
+			return dnsblListed(s.DNSBL)
+		}},
+	}
+
+	// spamShorteners are the default url shortener domains.
+	spamShorteners = []string{
+		"bit.ly", "tinyurl.com", "t.co", "goo.gl", "ow.ly", "is.gd",
+		"buff.ly", "cutt.ly", "rebrand.ly", "shorturl.at", "tiny.cc", "rb.gy",
+	}
+
+	// spamURLPattern matches the hosts of the urls in the message.
+	spamURLPattern = regexp.MustCompile(`(?i)https?://([a-z0-9.-]+)`)
+)
+
+// spamResult is the spam score of a message with the matched rules.
+type spamResult struct {
+	Score float64    `json:"score"`
+	Rules []spamRule `json:"rules,omitempty"`
+}
+
+// spamRule is a rule which matched the message with its score.
+type spamRule struct {
+	Name  string  `json:"name"`
+	Score float64 `json:"score"`
+}
+
+// spamCheck scores the message with the rules and the classifier.
+func spamCheck(s *smtpSession, message smtpMessage) spamResult {
+	var result spamResult
+	for _, rule := range spamRules {
+		if rule.match(s, message) {
+			spamAdd(&result, rule.name)
+		}
+	}
+
+	if config.Spam.Bayes.Status {
+		probability, ok, err := spamBayesClassify(message)
+		if err != nil {
+			logger.Errorf("Failed to classify message for %s, %v", s.UUID, err)
+		}
+
+		if ok {
+			logger.Debugf("Session %s, bayes: %.4f", s.UUID, probability)
+
+			switch {
+			case probability >= spamBayesSpamProbability:
+				spamAdd(&result, "bayes_spam")
+			case probability <= spamBayesHamProbability:
+				spamAdd(&result, "bayes_ham")
+			}
+		}
+	}
+
+	// Scores are rounded so the sum of the
+	// rules is the score of the message.
+	result.Score = math.Round(result.Score*100) / 100
+	return result
+}
+
+// spamAdd adds the rule to the result with the score of the config,
+// rules with a score of 0 in the config are disabled.
+func spamAdd(result *spamResult, name string) {
+	score, ok := config.Spam.Rules[name]
+	if !ok {
+		score = spamRuleScores[name]
+	}
+
+	if score == 0 {
+		return
+	}
+
+	result.Rules = append(result.Rules, spamRule{Name: name, Score: score})
+	result.Score += score
+}
+
+// spamDomain returns the domain of the address.
+func spamDomain(address string) string {
+	return address[strings.LastIndex(address, "@")+1:]
+}
+
+// spamShortened returns true if the message links to a url shortener,
+// shortener domains match their subdomains as well.
+func spamShortened(message smtpMessage) bool {
+	shorteners := config.Spam.Shorteners
+	if len(shorteners) == 0 {
+		shorteners = spamShorteners
+	}
+
+	for _, match := range spamURLPattern.FindAllStringSubmatch(message.Text+" "+message.HTML, -1) {
+		host := dnsZoneName(match[1])
+		for _, shortener := range shorteners {
+			shortener = dnsZoneName(shortener)
+			if host == shortener || strings.HasSuffix(host, "."+shortener) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// spamBayesTokens returns the unique tokens of the subject, the text
+// or the text of the HTML and the url hosts of the message. Subject and url tokens are
+// prefixed so they are counted apart from the text tokens.
+func spamBayesTokens(message smtpMessage) []string {
+	var (
+		tokens []string
+		seen   = make(map[string]bool)
+	)
+
+	add := func(token string) {
+		if !seen[token] && len(tokens) < spamBayesTokensMax {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+
+	words := func(text string) []string {
+		var words []string
+		for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '$' && r != '\''
+		}) {
+			word = strings.Trim(word, "'")
+			if n := utf8.RuneCountInString(word); n < 3 || n > 32 {
+				continue
+			}
+			if _, err := strconv.Atoi(word); err == nil {
+				continue
+			}
+			words = append(words, word)
+		}
+		return words
+	}
+
+	for _, word := range words(message.Subject) {
+		add("subject:" + word)
+	}
+
+	for _, match := range spamURLPattern.FindAllStringSubmatch(message.Text+" "+message.HTML, -1) {
+		add("url:" + dnsZoneName(match[1]))
+	}
+
+	// HTML only messages are tokenized from the text of the HTML.
+	text := message.Text
+	if strings.TrimSpace(text) == "" {
+		text = spamHTMLText(message.HTML)
+	}
+
+	for _, word := range words(text) {
+		add(word)
+	}
+
+	return tokens
+}
+
+// spamHTMLText returns the text of the HTML without the tags, the
+// contents of the scripts and the styles are left out.
+func spamHTMLText(s string) string {
+	var (
+		b       strings.Builder
+		skipped int
+	)
+
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return b.String()
+
+		case html.StartTagToken:
+			if name, _ := z.TagName(); string(name) == "script" || string(name) == "style" {
+				skipped++
+			}
+
+		case html.EndTagToken:
+			if name, _ := z.TagName(); (string(name) == "script" || string(name) == "style") && skipped > 0 {
+				skipped--
+			}
+
+		case html.TextToken:
+			if skipped == 0 {
+				b.Write(z.Text())
+				b.WriteString(" ")
+			}
+		}
+	}
+}
+
+// spamBayesClassify returns the spam probability of the message, the
+// message is not classified until the classifier is trained with
+// enough messages of both classes.
+func spamBayesClassify(message smtpMessage) (float64, bool, error) {
+	trained, err := redisdb.HMGet(redisKeySpamBayesMessages(), spamClassSpam, spamClassHam).Result()
+	if err != nil {
+		return 0, false, err
+	}
+
+	spamMessages, hamMessages := spamBayesCount(trained[0]), spamBayesCount(trained[1])
+
+	minMessages := config.Spam.Bayes.MinMessages
+	if minMessages <= 0 {
+		minMessages = spamBayesMinMessagesDefault
+	}
+
+	if spamMessages < minMessages || hamMessages < minMessages {
+		return 0, false, nil
+	}
+
+	tokens := spamBayesTokens(message)
+	if len(tokens) == 0 {
+		return 0, false, nil
+	}
+
+	spamCounts, err := redisdb.HMGet(redisKeySpamBayesTokens(spamClassSpam), tokens...).Result()
+	if err != nil {
+		return 0, false, err
+	}
+
+	hamCounts, err := redisdb.HMGet(redisKeySpamBayesTokens(spamClassHam), tokens...).Result()
+	if err != nil {
+		return 0, false, err
+	}
+
+	// Probabilities of the tokens are adjusted for the number
+	// of messages they are seen in (Robinson), unseen tokens
+	// are neutral and don't change the probability.
+	var probabilities []float64
+	for i := range tokens {
+		spamCount, hamCount := spamBayesCount(spamCounts[i]), spamBayesCount(hamCounts[i])
+		if spamCount+hamCount == 0 {
+			continue
+		}
+
+		spamRatio := math.Min(float64(spamCount)/float64(spamMessages), 1)
+		hamRatio := math.Min(float64(hamCount)/float64(hamMessages), 1)
+		p := spamRatio / (spamRatio + hamRatio)
+
+		n := float64(spamCount + hamCount)
+		p = (0.5 + n*p) / (1 + n)
+
+		probabilities = append(probabilities, math.Max(0.01, math.Min(0.99, p)))
+	}
+
+	if len(probabilities) == 0 {
+		return 0, false, nil
+	}
+
+	sort.Slice(probabilities, func(n1, n2 int) bool {
+		return math.Abs(probabilities[n1]-0.5) > math.Abs(probabilities[n2]-0.5)
+	})
+
+	if len(probabilities) > spamBayesInteresting {
+		probabilities = probabilities[:spamBayesInteresting]
+	}
+
+	// Probabilities are combined in the log space so
+	// the products don't underflow.
+	var spamLog, hamLog float64
+	for _, p := range probabilities {
+		spamLog += math.Log(p)
+		hamLog += math.Log(1 - p)
+	}
+
+	return 1 / (1 + math.Exp(hamLog-spamLog)), true, nil
+}
+
+// spamBayesCount returns the count of an HMGET answer,
+// fields which are not counted yet are 0.
+func spamBayesCount(value interface{}) int64 {
+	s, ok := value.(string)
+	if !ok {
+		return 0
+	}
+
+	count, _ := strconv.ParseInt(s, 10, 64)
+	return count
+}
+
+// spamBayesTrain counts the tokens of the message in the class.
+func spamBayesTrain(class string, message smtpMessage) error {
+	pipe := redisdb.Pipeline()
+	for _, token := range spamBayesTokens(message) {
+		pipe.HIncrBy(redisKeySpamBayesTokens(class), token, 1)
+	}
+	pipe.HIncrBy(redisKeySpamBayesMessages(), class, 1)
+
+	_, err := pipe.Exec()
+	return err
+}
+
+// spamTrain trains the classifier with the message files as the class.
+func spamTrain(class string, paths []string) {
+	if class != spamClassSpam && class != spamClassHam {
+		fmt.Printf("Failed to train spam classifier, class must be %s or %s\n", spamClassSpam, spamClassHam)
+		os.Exit(1)
+	}
+
+	var trained int
+	for _, path := range paths {
+		message, err := smtpMessageRead(smtpMessageSession{}, smtpData{Path: path})
+		if err != nil {
+			fmt.Println("Failed to read message", path, err)
+			continue
+		}
+
+		if err := spamBayesTrain(class, message); err != nil {
+			fmt.Println("Failed to train spam classifier", path, err)
+			os.Exit(1)
+		}
+		trained++
+	}
+
+	fmt.Printf("%d messages trained as %s\n", trained, class)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSpamConfig sets the spam config of the test, the classifier
+// is disabled unless the test enables it.
+func testSpamConfig(t *testing.T) {
+	t.Helper()
+
+	previousSpam, previousDKIM := config.Spam, config.DKIM.Status
+	t.Cleanup(func() {
+		config.Spam, config.DKIM.Status = previousSpam, previousDKIM
+	})
+
+	config.Spam.Rules = nil
+	config.Spam.Shorteners = nil
+	config.Spam.Bayes.Status = false
+	config.DKIM.Status = false
+}
+
+// testSpamMessage returns a message which matches none of the rules.
+func testSpamMessage() smtpMessage {
+	return smtpMessage{
+		MessageID: "report@example.org",
+		From:      mail.Address{Name: "Sender", Address: "sender@example.org"},
+		To:        []mail.Address{{Address: "koray@example.com"}},
+		Date:      time.Now(),
+		Subject:   "Quarterly report",
+		Text:      "The report is attached.",
+		Session: smtpMessageSession{
+			SPF: spfResult{Result: spfResultPass},
+		},
+		DKIM:  []dkimResult{{Result: dkimResultPass}},
+		DMARC: dmarcResult{Result: dmarcResultPass},
+	}
+}
+
+func TestSpamCheck(t *testing.T) {
+	testSpamConfig(t)
+
+	tests := []struct {
+		name    string
+		message func(message *smtpMessage)
+		rules   []string
+		score   float64
+	}{
+		{"clean", func(message *smtpMessage) {}, nil, 0},
+		{"header anomalies", func(message *smtpMessage) {
+			message.MessageID = ""
+			message.Date = time.Time{}
+			message.Subject = " "
+		}, []string{"missing_message_id", "missing_date", "missing_subject"}, 2.5},
+		{"missing recipients and sender", func(message *smtpMessage) {
+			message.From = mail.Address{}
+			message.To = nil
+		}, []string{"missing_from", "missing_to"}, 2},
+		{"future date", func(message *smtpMessage) {
+			message.Date = time.Now().Add(48 * time.Hour)
+		}, []string{"future_date"}, 1},
+		{"reply to another domain", func(message *smtpMessage) {
+			message.ReplyTo = mail.Address{Address: "collect@example.net"}
+		}, []string{"reply_to_mismatch"}, 0.5},
+		{"reply to the sender domain", func(message *smtpMessage) {
+			message.ReplyTo = mail.Address{Address: "Billing@Example.org"}
+		}, nil, 0},
+		{"html only with a shortener", func(message *smtpMessage) {
+			message.HTMLOnly = true
+			message.HTML = `<a href="https://sub.bit.ly/x">claim</a>`
+		}, []string{"html_only", "url_shortener"}, 2.5},
+		{"authentication failures", func(message *smtpMessage) {
+			message.Session.SPF.Result = spfResultFail
+			message.DKIM = []dkimResult{{Result: dkimResultPass}, {Result: dkimResultFail}}
+			message.DMARC.Result = dmarcResultFail
+		}, []string{"spf_fail", "dkim_fail", "dmarc_fail"}, 5.5},
+		{"spf softfail", func(message *smtpMessage) {
+			message.Session.SPF.Result = spfResultSoftFail
+		}, []string{"spf_softfail"}, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := testSpamMessage()
+			test.message(&message)
+
+			result := spamCheck(testSession(nil), message)
+
+			var rules []string
+			for _, rule := range result.Rules {
+				rules = append(rules, rule.Name)
+			}
+
+			if strings.Join(rules, ",") != strings.Join(test.rules, ",") {
+				t.Fatalf("rules %v, want %v", rules, test.rules)
+			}
+
+			if result.Score != test.score {
+				t.Fatalf("score %.2f, want %.2f", result.Score, test.score)
+			}
+		})
+	}
+}
+
+// TestSpamCheckRules changes the scores of the rules with the config,
+// rules with a score of 0 are disabled.
+func TestSpamCheckRules(t *testing.T) {
+	testSpamConfig(t)
+	config.Spam.Rules = map[string]float64{
+		"missing_message_id": 0,
+		"missing_date":       2.25,
+	}
+	config.DKIM.Status = true
+
+	message := testSpamMessage()
+	message.MessageID = ""
+	message.Date = time.Time{}
+	message.DKIM = nil
+
+	result := spamCheck(testSession(nil), message)
+	if len(result.Rules) != 2 || result.Rules[0] != (spamRule{Name: "missing_date", Score: 2.25}) || result.Rules[1].Name != "dkim_none" {
+		t.Fatalf("rules %+v", result.Rules)
+	}
+
+	if result.Score != 2.75 {
+		t.Fatalf("score %.2f, want 2.75", result.Score)
+	}
+}
+
+func TestSpamShortened(t *testing.T) {
+	testSpamConfig(t)
+
+	tests := []struct {
+		text       string
+		shorteners []string
+		shortened  bool
+	}{
+		{"see https://bit.ly/abc", nil, true},
+		{"see HTTP://T.CO/abc", nil, true},
+		{"see https://go.bit.ly/abc", nil, true},
+		{"see https://notbit.ly/abc", nil, false},
+		{"see https://example.org/bit.ly", nil, false},
+		{"see https://s.example.net/abc", []string{"example.net"}, true},
+		{"see https://bit.ly/abc", []string{"example.net"}, false},
+	}
+
+	for _, test := range tests {
+		config.Spam.Shorteners = test.shorteners
+		if shortened := spamShortened(smtpMessage{Text: test.text}); shortened != test.shortened {
+			t.Errorf("shortened %t, want %t for %q with %v", shortened, test.shortened, test.text, test.shorteners)
+		}
+	}
+}
+
+func TestSpamBayesTokens(t *testing.T) {
+	tests := []struct {
+		name    string
+		message smtpMessage
+		tokens  []string
+	}{
+		{
+			name: "text",
+			message: smtpMessage{
+				Subject: "Cheap offer",
+				Text:    "Don't miss the CHEAP offer, only $99 at https://shop.example.net/deal 2024 ok",
+			},
+			tokens: []string{
+				"subject:cheap", "subject:offer",
+				"url:shop.example.net",
+				"don't", "miss", "the", "cheap", "offer", "only", "$99", "https", "shop", "example", "net", "deal",
+			},
+		},
+		{
+			name: "html only",
+			message: smtpMessage{
+				Subject: "Winner",
+				HTML: `<html><head><style>.prize { color: red }</style><script>track("visitor")</script></head>` +
+					`<body><p class="prize">You are a <b>winner</b>, claim the prize</p></body></html>`,
+			},
+			tokens: []string{"subject:winner", "you", "are", "winner", "claim", "the", "prize"},
+		},
+		{
+			name: "text is preferred",
+			message: smtpMessage{
+				Text: "plain words",
+				HTML: "<p>markup words</p>",
+			},
+			tokens: []string{"plain", "words"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tokens := spamBayesTokens(test.message)
+			if strings.Join(tokens, " ") != strings.Join(test.tokens, " ") {
+				t.Fatalf("tokens %v, want %v", tokens, test.tokens)
+			}
+		})
+	}
+}
+
+// TestSpamBayesClassify trains the classifier and classifies the
+// messages of both classes, HTML only spam is classified from the
+// text of its HTML.
+func TestSpamBayesClassify(t *testing.T) {
+	testRedis(t)
+	testSpamConfig(t)
+
+	keys := []string{redisKeySpamBayesTokens(spamClassSpam), redisKeySpamBayesTokens(spamClassHam), redisKeySpamBayesMessages()}
+	redisdb.Del(keys...)
+	t.Cleanup(func() {
+		redisdb.Del(keys...)
+	})
+
+	config.Spam.Bayes.Status = true
+	config.Spam.Bayes.MinMessages = 2
+
+	spam := []smtpMessage{
+		{Subject: "Winner", Text: "claim your free prize money now, winner"},
+		{Subject: "Prize", Text: "free money prize for the lucky winner"},
+	}
+	ham := []smtpMessage{
+		{Subject: "Report", Text: "the quarterly report is attached for review"},
+		{Subject: "Meeting", Text: "review the report before the meeting tomorrow"},
+	}
+
+	for _, message := range spam {
+		if err := spamBayesTrain(spamClassSpam, message); err != nil {
+			t.Fatalf("train spam: %v", err)
+		}
+	}
+	for _, message := range ham {
+		if err := spamBayesTrain(spamClassHam, message); err != nil {
+			t.Fatalf("train ham: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		message smtpMessage
+		rule    string
+	}{
+		{"spam", smtpMessage{Text: "free prize money for the winner"}, "bayes_spam"},
+		{"html only spam", smtpMessage{HTML: "<p>free <b>prize</b> money, winner</p>"}, "bayes_spam"},
+		{"ham", smtpMessage{Text: "quarterly report review meeting"}, "bayes_ham"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := spamCheck(testSession(nil), test.message)
+
+			for _, rule := range result.Rules {
+				if rule.Name == test.rule {
+					return
+				}
+			}
+			t.Fatalf("rules %+v, want %s", result.Rules, test.rule)
+		})
+	}
+}
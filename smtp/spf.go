@@ -0,0 +1,699 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SPF (RFC 7208) evaluation of the envelope sender.
+
+const (
+	spfResultNone      = "none"
+	spfResultNeutral   = "neutral"
+	spfResultPass      = "pass"
+	spfResultFail      = "fail"
+	spfResultSoftFail  = "softfail"
+	spfResultTempError = "temperror"
+	spfResultPermError = "permerror"
+
+	// Mail spf policies, decides what happens to the
+	// message when the spf check result is fail.
+	spfPolicyReject = "reject"
+	spfPolicyTag    = "tag"
+	spfPolicyIgnore = "ignore"
+
+	spfLookupLimit     = 10
+	spfVoidLookupLimit = 2
+	spfMXLimit         = 10
+	spfPTRLimit        = 10
+)
+
+var (
+	spfModifierRegexp = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9\-_.]*=`)
+	spfCIDRRegexp     = regexp.MustCompile(`^(.*?)(?:/(\d+))?(?://(\d+))?$`)
+	spfMacroRegexp    = regexp.MustCompile(`^([slodiphvcrtSLODIPHVCRT])(\d*)(r?)([.\-+,/_=]*)$`)
+)
+
+// spfResult is the result of an spf check.
+type spfResult struct {
+	Result string
+	Domain string
+	Reason string
+}
+
+// spfError is returned while evaluating a record when the
+// evaluation has to stop with a temperror or permerror.
+type spfError struct {
+	result string
+	reason string
+}
+
+func (e *spfError) Error() string {
+	return fmt.Sprintf("%s: %s", e.result, e.reason)
+}
+
+// spfChecker holds the state of a single check_host evaluation
+// including the nested include and redirect evaluations.
+type spfChecker struct {
+	ctx context.Context
+
+	ip     net.IP
+	sender string
+	local  string
+	domain string
+	helo   string
+
+	lookups     int
+	voidLookups int
+}
+
+// spfCheck evaluates the spf record of the sender domain for the
+// provided client ip. If the sender is empty (null reverse path),
+// the helo domain is checked instead.
+func spfCheck(ip net.IP, sender, helo string) spfResult {
+	if sender == "" {
+		sender = "postmaster@" + helo
+	}
+
+	local, domain := "postmaster", sender
+	if at := strings.LastIndex(sender, "@"); at >= 0 {
+		domain = sender[at+1:]
+		if at > 0 {
+			local = sender[:at]
+		}
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	if ip == nil {
+		return spfResult{
+			Result: spfResultNone,
+			Domain: domain,
+			Reason: "client ip is unknown",
+		}
+	}
+
+	ctx, cancel := dnsContext()
+	defer cancel()
+
+	c := &spfChecker{
+		ctx:    ctx,
+		ip:     ip,
+		sender: local + "@" + domain,
+		local:  local,
+		domain: domain,
+		helo:   helo,
+	}
+
+	result, err := c.checkHost(domain)
+	if err != nil {
+		return spfResult{
+			Result: err.result,
+			Domain: domain,
+			Reason: err.reason,
+		}
+	}
+
+	reason := fmt.Sprintf("domain of %s does not designate %s as permitted sender", c.sender, ip)
+	if result == spfResultPass {
+		reason = fmt.Sprintf("domain of %s designates %s as permitted sender", c.sender, ip)
+	} else if result == spfResultNone {
+		reason = fmt.Sprintf("domain of %s has no spf record", c.sender)
+	}
+
+	return spfResult{
+		Result: result,
+		Domain: domain,
+		Reason: reason,
+	}
+}
+
+// spfReceivedHeader returns the Received-SPF trace header
+// (RFC 7208 section 9.1) for the provided result.
+func spfReceivedHeader(r spfResult, ip net.IP, sender, helo string) string {
+	return fmt.Sprintf("Received-SPF: %s (%s) client-ip=%s; envelope-from=\"%s\"; helo=%s;\r\n",
+		r.Result, r.Reason, ip, sender, helo,
+	)
+}
+
+// spfTerm is a mechanism or a modifier of an spf record.
+type spfTerm struct {
+	qualifier string
+	name      string
+	value     string
+}
+
+// checkHost is the check_host() function of RFC 7208 section 4.
+func (c *spfChecker) checkHost(domain string) (string, *spfError) {
+	if !spfDomainValid(domain) {
+		return spfResultNone, nil
+	}
+
+	record, err := c.record(domain)
+	if err != nil || record == "" {
+		return spfResultNone, err
+	}
+
+	mechanisms, modifiers, err := spfParse(record)
+	if err != nil {
+		return "", err
+	}
+
+	for _, mechanism := range mechanisms {
+		match, err := c.match(domain, mechanism)
+		if err != nil {
+			return "", err
+		}
+
+		if match {
+			return spfQualifierResult(mechanism.qualifier), nil
+		}
+	}
+
+	if redirect, ok := modifiers["redirect"]; ok {
+		if err := c.lookup(); err != nil {
+			return "", err
+		}
+
+		target, err := c.expand(redirect, domain)
+		if err != nil {
+			return "", err
+		}
+
+		result, err := c.checkHost(target)
+		if err != nil {
+			return "", err
+		}
+
+		if result == spfResultNone {
+			return "", &spfError{spfResultPermError, fmt.Sprintf("redirect domain %s has no spf record", target)}
+		}
+
+		return result, nil
+	}
+
+	return spfResultNeutral, nil
+}
+
+// record returns the spf record of the domain, empty if
+// the domain has no spf records.
+func (c *spfChecker) record(domain string) (string, *spfError) {
+	txts, err := resolver.LookupTXT(c.ctx, domain)
+	if err != nil {
+		if err == dnsErrNotFound {
+			return "", nil
+		}
+		return "", &spfError{spfResultTempError, fmt.Sprintf("txt lookup for %s failed: %v", domain, err)}
+	}
+
+	var records []string
+	for _, txt := range txts {
+		lower := strings.ToLower(txt)
+		if lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			records = append(records, txt)
+		}
+	}
+
+	if len(records) > 1 {
+		return "", &spfError{spfResultPermError, fmt.Sprintf("%s has multiple spf records", domain)}
+	}
+
+	if len(records) == 0 {
+		return "", nil
+	}
+
+	return records[0], nil
+}
+
+// spfParse parses the terms of a record into mechanisms and modifiers.
+func spfParse(record string) ([]spfTerm, map[string]string, *spfError) {
+	var (
+		mechanisms []spfTerm
+		modifiers  = make(map[string]string)
+	)
+
+	for _, field := range strings.Fields(record)[1:] {
+		if spfModifierRegexp.MatchString(field) {
+			eq := strings.Index(field, "=")
+			name := strings.ToLower(field[:eq])
+
+			if _, ok := modifiers[name]; ok && (name == "redirect" || name == "exp") {
+				return nil, nil, &spfError{spfResultPermError, fmt.Sprintf("duplicate %s modifier", name)}
+			}
+
+			modifiers[name] = field[eq+1:]
+			continue
+		}
+
+		term := spfTerm{
+			qualifier: "+",
+		}
+
+		if strings.ContainsAny(field[:1], "+-~?") {
+			term.qualifier = field[:1]
+			field = field[1:]
+		}
+
+		name := field
+		if i := strings.IndexAny(field, ":/"); i >= 0 {
+			name = field[:i]
+			term.value = field[i:]
+		}
+		term.name = strings.ToLower(name)
+		term.value = strings.TrimPrefix(term.value, ":")
+
+		switch term.name {
+		case "all", "include", "a", "mx", "ptr", "ip4", "ip6", "exists":
+		default:
+			return nil, nil, &spfError{spfResultPermError, fmt.Sprintf("unknown mechanism %s", term.name)}
+		}
+
+		if term.value == "" && (term.name == "include" || term.name == "ip4" || term.name == "ip6" || term.name == "exists") {
+			return nil, nil, &spfError{spfResultPermError, fmt.Sprintf("mechanism %s requires a value", term.name)}
+		}
+
+		mechanisms = append(mechanisms, term)
+	}
+
+	return mechanisms, modifiers, nil
+}
+
+// match returns true if the client ip matches the mechanism.
+func (c *spfChecker) match(domain string, term spfTerm) (bool, *spfError) {
+	switch term.name {
+	case "all":
+		return true, nil
+
+	case "include":
+		if err := c.lookup(); err != nil {
+			return false, err
+		}
+
+		target, err := c.expand(term.value, domain)
+		if err != nil {
+			return false, err
+		}
+
+		result, err := c.checkHost(target)
+		if err != nil {
+			return false, err
+		}
+
+		if result == spfResultNone {
+			return false, &spfError{spfResultPermError, fmt.Sprintf("included domain %s has no spf record", target)}
+		}
+
+		return result == spfResultPass, nil
+
+	case "a":
+		if err := c.lookup(); err != nil {
+			return false, err
+		}
+
+		target, cidr4, cidr6, err := c.targetCIDR(term.value, domain)
+		if err != nil {
+			return false, err
+		}
+
+		ips, err := c.lookupIPs(target)
+		if err != nil {
+			return false, err
+		}
+
+		return spfIPsMatch(c.ip, ips, cidr4, cidr6), nil
+
+	case "mx":
+		if err := c.lookup(); err != nil {
+			return false, err
+		}
+
+		target, cidr4, cidr6, err := c.targetCIDR(term.value, domain)
+		if err != nil {
+			return false, err
+		}
+
+		mxs, lookupErr := resolver.LookupMX(c.ctx, target)
+		if lookupErr != nil {
+			if lookupErr == dnsErrNotFound {
+				return false, c.void()
+			}
+			return false, &spfError{spfResultTempError, fmt.Sprintf("mx lookup for %s failed: %v", target, lookupErr)}
+		}
+
+		if len(mxs) > spfMXLimit {
+			return false, &spfError{spfResultPermError, fmt.Sprintf("%s has more than %d mx records", target, spfMXLimit)}
+		}
+
+		for _, mx := range mxs {
+			ips, err := c.lookupIPs(mx.Host)
+			if err != nil {
+				return false, err
+			}
+
+			if spfIPsMatch(c.ip, ips, cidr4, cidr6) {
+				return true, nil
+			}
+		}
+
+		return false, nil
+
+	case "ptr":
+		if err := c.lookup(); err != nil {
+			return false, err
+		}
+
+		target := domain
+		if term.value != "" {
+			var err *spfError
+			if target, err = c.expand(term.value, domain); err != nil {
+				return false, err
+			}
+		}
+
+		for _, name := range c.validatedNames() {
+			if name == target || strings.HasSuffix(name, "."+target) {
+				return true, nil
+			}
+		}
+
+		return false, nil
+
+	case "ip4", "ip6":
+		value := term.value
+		if !strings.Contains(value, "/") {
+			if term.name == "ip4" {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return false, &spfError{spfResultPermError, fmt.Sprintf("%s network format error: %s", term.name, term.value)}
+		}
+
+		// ip4 only matches ipv4 clients and ip6 only matches ipv6 clients.
+		if (term.name == "ip4") != (c.ip.To4() != nil) {
+			return false, nil
+		}
+
+		return network.Contains(c.ip), nil
+
+	case "exists":
+		if err := c.lookup(); err != nil {
+			return false, err
+		}
+
+		target, err := c.expand(term.value, domain)
+		if err != nil {
+			return false, err
+		}
+
+		ips, err := c.lookupIPs(target)
+		if err != nil {
+			return false, err
+		}
+
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	}
+
+	return false, &spfError{spfResultPermError, fmt.Sprintf("unknown mechanism %s", term.name)}
+}
+
+// lookup counts a dns querying term against the lookup limit.
+func (c *spfChecker) lookup() *spfError {
+	c.lookups++
+	if c.lookups > spfLookupLimit {
+		return &spfError{spfResultPermError, fmt.Sprintf("more than %d dns lookups", spfLookupLimit)}
+	}
+	return nil
+}
+
+// void counts a lookup with no answers against the void lookup limit.
+func (c *spfChecker) void() *spfError {
+	c.voidLookups++
+	if c.voidLookups > spfVoidLookupLimit {
+		return &spfError{spfResultPermError, fmt.Sprintf("more than %d void dns lookups", spfVoidLookupLimit)}
+	}
+	return nil
+}
+
+// lookupIPs resolves the addresses of the host.
+func (c *spfChecker) lookupIPs(host string) ([]net.IP, *spfError) {
+	addrs, err := resolver.LookupIPAddr(c.ctx, host)
+	if err != nil {
+		if err == dnsErrNotFound {
+			return nil, c.void()
+		}
+		return nil, &spfError{spfResultTempError, fmt.Sprintf("address lookup for %s failed: %v", host, err)}
+	}
+
+	var ips []net.IP
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+
+	return ips, nil
+}
+
+// validatedNames returns the names of the client ip which
+// resolve back to the client ip, used by ptr and %{p}.
+func (c *spfChecker) validatedNames() []string {
+	return dnsValidatedNames(c.ctx, c.ip, spfPTRLimit)
+}
+
+// targetCIDR parses the "domain/cidr4//cidr6" value of the a and mx
+// mechanisms. Domain defaults to the current domain.
+func (c *spfChecker) targetCIDR(value, domain string) (string, int, int, *spfError) {
+	cidr4, cidr6 := 32, 128
+
+	matches := spfCIDRRegexp.FindStringSubmatch(value)
+	if matches[2] != "" {
+		cidr4, _ = strconv.Atoi(matches[2])
+	}
+	if matches[3] != "" {
+		cidr6, _ = strconv.Atoi(matches[3])
+	}
+
+	if cidr4 > 32 || cidr6 > 128 {
+		return "", 0, 0, &spfError{spfResultPermError, fmt.Sprintf("cidr length error: %s", value)}
+	}
+
+	if matches[1] == "" {
+		return domain, cidr4, cidr6, nil
+	}
+
+	target, err := c.expand(matches[1], domain)
+	return target, cidr4, cidr6, err
+}
+
+// expand expands the macros of a domain spec (RFC 7208 section 7).
+func (c *spfChecker) expand(spec, domain string) (string, *spfError) {
+	var b strings.Builder
+
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			b.WriteByte(spec[i])
+			continue
+		}
+
+		if i+1 >= len(spec) {
+			return "", &spfError{spfResultPermError, fmt.Sprintf("macro format error: %s", spec)}
+		}
+
+		i++
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+		case '_':
+			b.WriteByte(' ')
+		case '-':
+			b.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(spec[i:], '}')
+			if end < 0 {
+				return "", &spfError{spfResultPermError, fmt.Sprintf("macro is not closed: %s", spec)}
+			}
+
+			value, err := c.macro(spec[i+1:i+end], domain)
+			if err != nil {
+				return "", err
+			}
+
+			b.WriteString(value)
+			i += end
+		default:
+			return "", &spfError{spfResultPermError, fmt.Sprintf("macro format error: %s", spec)}
+		}
+	}
+
+	target := strings.TrimSuffix(b.String(), ".")
+
+	// Domain names longer than 253 chars are truncated
+	// from the left by removing labels.
+	for len(target) > 253 {
+		dot := strings.IndexByte(target, '.')
+		if dot < 0 {
+			break
+		}
+		target = target[dot+1:]
+	}
+
+	return strings.ToLower(target), nil
+}
+
+// macro expands a single macro, ie. "ir" of "%{ir}".
+func (c *spfChecker) macro(m, domain string) (string, *spfError) {
+	matches := spfMacroRegexp.FindStringSubmatch(m)
+	if matches == nil {
+		return "", &spfError{spfResultPermError, fmt.Sprintf("macro format error: %%{%s}", m)}
+	}
+
+	var value string
+	switch strings.ToLower(matches[1]) {
+	case "s":
+		value = c.sender
+	case "l":
+		value = c.local
+	case "o":
+		value = c.domain
+	case "d":
+		value = domain
+	case "i":
+		value = spfMacroIP(c.ip)
+	case "p":
+		value = "unknown"
+		if names := c.validatedNames(); len(names) > 0 {
+			value = names[0]
+		}
+	case "v":
+		value = "ip6"
+		if c.ip.To4() != nil {
+			value = "in-addr"
+		}
+	case "h":
+		value = c.helo
+	default:
+		// c, r and t are only allowed in exp.
+		return "", &spfError{spfResultPermError, fmt.Sprintf("macro not allowed: %%{%s}", m)}
+	}
+
+	delimiters := matches[4]
+	if delimiters == "" {
+		delimiters = "."
+	}
+
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delimiters, r)
+	})
+
+	if matches[3] == "r" {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+
+	if matches[2] != "" {
+		n, _ := strconv.Atoi(matches[2])
+		if n == 0 {
+			return "", &spfError{spfResultPermError, fmt.Sprintf("macro digit error: %%{%s}", m)}
+		}
+		if n < len(parts) {
+			parts = parts[len(parts)-n:]
+		}
+	}
+
+	value = strings.Join(parts, ".")
+
+	// Uppercase macros are url escaped.
+	if matches[1] == strings.ToUpper(matches[1]) {
+		value = url.QueryEscape(value)
+	}
+
+	return value, nil
+}
+
+// spfMacroIP returns the ip in the dotted format of the "i" macro.
+func spfMacroIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+
+	var nibbles []string
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, fmt.Sprintf("%x", b>>4), fmt.Sprintf("%x", b&0x0f))
+	}
+
+	return strings.Join(nibbles, ".")
+}
+
+// spfIPsMatch returns true if the ip is in any of the networks
+// created with the ips and the cidr lengths.
+func spfIPsMatch(ip net.IP, ips []net.IP, cidr4, cidr6 int) bool {
+	for _, candidate := range ips {
+		if candidate4 := candidate.To4(); candidate4 != nil {
+			ip4 := ip.To4()
+			if ip4 == nil {
+				continue
+			}
+
+			mask := net.CIDRMask(cidr4, 32)
+			if candidate4.Mask(mask).Equal(ip4.Mask(mask)) {
+				return true
+			}
+			continue
+		}
+
+		if ip.To4() != nil {
+			continue
+		}
+
+		mask := net.CIDRMask(cidr6, 128)
+		if candidate.To16().Mask(mask).Equal(ip.To16().Mask(mask)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// spfQualifierResult returns the result of a matching mechanism.
+func spfQualifierResult(qualifier string) string {
+	switch qualifier {
+	case "-":
+		return spfResultFail
+	case "~":
+		return spfResultSoftFail
+	case "?":
+		return spfResultNeutral
+	}
+
+	return spfResultPass
+}
+
+// spfDomainValid returns true if the domain is a valid
+// fully qualified domain for the spf check.
+func spfDomainValid(domain string) bool {
+	if domain == "" || len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+// testZone replaces the resolver with the zone file for the test.
+func testZone(t *testing.T, path string) {
+	t.Helper()
+
+	zone, err := dnsZoneLoad(path)
+	if err != nil {
+		t.Fatalf("load zone %s: %v", path, err)
+	}
+
+	previous := resolver
+	resolver = zone
+	t.Cleanup(func() {
+		resolver = previous
+	})
+}
+
+func TestSPFCheck(t *testing.T) {
+	testZone(t, "testdata/spf.zone")
+
+	tests := []struct {
+		name   string
+		ip     string
+		sender string
+		result string
+		reason string
+	}{
+		{"all", "192.0.2.1", "user@all.example.net", spfResultPass, ""},
+		{"neutral", "192.0.2.1", "user@neutral.example.net", spfResultNeutral, ""},
+		{"softfail", "192.0.2.1", "user@softfail.example.net", spfResultSoftFail, ""},
+		{"no record", "192.0.2.1", "user@none.example.net", spfResultNone, ""},
+		{"not an spf record", "192.0.2.1", "user@other.example.net", spfResultNone, ""},
+		{"no domain", "192.0.2.1", "user@localhost", spfResultNone, ""},
+
+		{"a", "192.0.2.11", "user@a.example.net", spfResultPass, ""},
+		{"a no match", "192.0.2.65", "user@a.example.net", spfResultFail, ""},
+		{"a cidr", "192.0.2.9", "user@a-cidr.example.net", spfResultPass, ""},
+		{"a cidr no match", "192.0.2.12", "user@a-cidr.example.net", spfResultFail, ""},
+		{"a current domain", "192.0.2.20", "user@a-current.example.net", spfResultPass, ""},
+		{"mx", "192.0.2.130", "user@mx.example.net", spfResultPass, ""},
+		{"mx no match", "192.0.2.140", "user@mx.example.net", spfResultFail, ""},
+		{"mx other domain", "192.0.2.140", "user@mx-org.example.net", spfResultPass, ""},
+		{"ptr", "192.0.2.65", "user@ptr.example.net", spfResultPass, ""},
+		{"ptr not validated", "10.0.0.10", "user@ptr.example.net", spfResultFail, ""},
+		{"ip4", "192.0.2.129", "user@ip4.example.net", spfResultPass, ""},
+		{"ip4 no match", "192.0.2.65", "user@ip4.example.net", spfResultFail, ""},
+		{"ip6", "2001:db8::cb01", "user@ip6.example.net", spfResultPass, ""},
+		{"ip6 ipv4 client", "192.0.2.1", "user@ip6.example.net", spfResultFail, ""},
+		{"include", "192.0.2.10", "user@include.example.net", spfResultPass, ""},
+		{"include no match", "192.0.2.65", "user@include.example.net", spfResultSoftFail, ""},
+		{"redirect", "192.0.2.10", "user@redirect.example.net", spfResultPass, ""},
+		{"redirect no match", "192.0.2.65", "user@redirect.example.net", spfResultFail, ""},
+		{"exists", "192.0.2.3", "strong-bad@exists.example.net", spfResultPass, ""},
+		{"exists no match", "192.0.2.4", "strong-bad@exists.example.net", spfResultFail, ""},
+
+		{"multiple records", "192.0.2.1", "user@multiple.example.net", spfResultPermError, "multiple spf records"},
+		{"unknown mechanism", "192.0.2.1", "user@unknown.example.net", spfResultPermError, "unknown mechanism"},
+		{"include without record", "192.0.2.1", "user@include-none.example.net", spfResultPermError, "has no spf record"},
+		{"redirect without record", "192.0.2.1", "user@redirect-none.example.net", spfResultPermError, "has no spf record"},
+		{"macro not allowed", "192.0.2.1", "user@macro.example.net", spfResultPermError, "macro format error"},
+
+		{"lookup limit", "192.0.2.200", "user@lookups.example.net", spfResultFail, ""},
+		{"lookup limit exceeded", "192.0.2.200", "user@lookups-over.example.net", spfResultPermError, "more than 10 dns lookups"},
+		{"lookup limit with include", "192.0.2.200", "user@lookups-include.example.net", spfResultPermError, "more than 10 dns lookups"},
+		{"void lookup limit", "192.0.2.200", "user@void.example.net", spfResultFail, ""},
+		{"void lookup limit exceeded", "192.0.2.200", "user@void-over.example.net", spfResultPermError, "more than 2 void dns lookups"},
+		{"void mx lookup limit exceeded", "192.0.2.200", "user@void-mx.example.net", spfResultPermError, "more than 2 void dns lookups"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := spfCheck(net.ParseIP(test.ip), test.sender, "mail.example.org")
+			if r.Result != test.result {
+				t.Fatalf("result %s (%s), want %s", r.Result, r.Reason, test.result)
+			}
+
+			if test.reason != "" && !strings.Contains(r.Reason, test.reason) {
+				t.Fatalf("reason %q, want %q", r.Reason, test.reason)
+			}
+		})
+	}
+}
+
+func TestSPFCheckNullSender(t *testing.T) {
+	testZone(t, "testdata/spf.zone")
+
+	r := spfCheck(net.ParseIP("192.0.2.10"), "", "a.example.net")
+	if r.Result != spfResultPass || r.Domain != "a.example.net" {
+		t.Fatalf("result %s of %s, want pass of the helo domain", r.Result, r.Domain)
+	}
+}
+
+// TestSPFMacros expands the macro examples of RFC 7208 section 7.4.
+func TestSPFMacros(t *testing.T) {
+	tests := []struct {
+		ip   string
+		spec string
+		want string
+	}{
+		{"192.0.2.3", "%{s}", "strong-bad@email.example.com"},
+		{"192.0.2.3", "%{o}", "email.example.com"},
+		{"192.0.2.3", "%{d}", "email.example.com"},
+		{"192.0.2.3", "%{d4}", "email.example.com"},
+		{"192.0.2.3", "%{d3}", "email.example.com"},
+		{"192.0.2.3", "%{d2}", "example.com"},
+		{"192.0.2.3", "%{d1}", "com"},
+		{"192.0.2.3", "%{dr}", "com.example.email"},
+		{"192.0.2.3", "%{d2r}", "example.email"},
+		{"192.0.2.3", "%{l}", "strong-bad"},
+		{"192.0.2.3", "%{l-}", "strong.bad"},
+		{"192.0.2.3", "%{lr}", "strong-bad"},
+		{"192.0.2.3", "%{lr-}", "bad.strong"},
+		{"192.0.2.3", "%{l1r-}", "strong"},
+		{"192.0.2.3", "%{ir}.%{v}._spf.%{d2}", "3.2.0.192.in-addr._spf.example.com"},
+		{"192.0.2.3", "%{lr-}.lp._spf.%{d2}", "bad.strong.lp._spf.example.com"},
+		{"192.0.2.3", "%{lr-}.lp.%{ir}.%{v}._spf.%{d2}", "bad.strong.lp.3.2.0.192.in-addr._spf.example.com"},
+		{"192.0.2.3", "%{ir}.%{v}.%{l1r-}.lp._spf.%{d2}", "3.2.0.192.in-addr.strong.lp._spf.example.com"},
+		{"192.0.2.3", "%{d2}.trusted-domains.example.net", "example.com.trusted-domains.example.net"},
+		{"192.0.2.3", "%{h}.%%.%_.%-", "mail.example.org.%. .%20"},
+		{"2001:db8::cb01", "%{ir}.%{v}._spf.%{d2}", "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"},
+	}
+
+	for _, test := range tests {
+		c := &spfChecker{
+			ip:     net.ParseIP(test.ip),
+			sender: "strong-bad@email.example.com",
+			local:  "strong-bad",
+			domain: "email.example.com",
+			helo:   "mail.example.org",
+		}
+
+		got, err := c.expand(test.spec, c.domain)
+		if err != nil {
+			t.Fatalf("expand %s: %v", test.spec, err)
+		}
+
+		if got != test.want {
+			t.Errorf("expand %s = %s, want %s", test.spec, got, test.want)
+		}
+	}
+}
+
+func TestSPFMacrosInvalid(t *testing.T) {
+	c := &spfChecker{
+		ip:     net.ParseIP("192.0.2.3"),
+		sender: "user@example.com",
+		local:  "user",
+		domain: "example.com",
+	}
+
+	for _, spec := range []string{"%", "%{d", "%x", "%{c}", "%{r}", "%{t}", "%{d0}", "%{z}"} {
+		if _, err := c.expand(spec, c.domain); err == nil || err.result != spfResultPermError {
+			t.Errorf("expand %s: error %v, want permerror", spec, err)
+		}
+	}
+}
+
+// TestSessionMailSPF rejects spf failures at MAIL FROM with the
+// reject policy of the server.
+func TestSessionMailSPF(t *testing.T) {
+	testZone(t, "testdata/spf.zone")
+
+	status, policy := config.SPF.Status, config.SPF.Policy
+	t.Cleanup(func() {
+		config.SPF.Status, config.SPF.Policy = status, policy
+	})
+	config.SPF.Status = true
+
+	tests := []struct {
+		policy string
+		sender string
+		reject bool
+	}{
+		{spfPolicyReject, "user@a.example.net", true},
+		{spfPolicyReject, "user@softfail.example.net", false},
+		{spfPolicyReject, "user@all.example.net", false},
+		{spfPolicyIgnore, "user@a.example.net", false},
+		{"", "user@a.example.net", false},
+	}
+
+	for _, test := range tests {
+		config.SPF.Policy = test.policy
+
+		s := testSession(nil)
+		err := s.Mail(test.sender, &smtp.MailOptions{})
+		if (err != nil) != test.reject {
+			t.Errorf("mail from %s with policy %q: error %v, want rejected %t", test.sender, test.policy, err, test.reject)
+		}
+
+		if s.SPF.Domain != strings.Split(test.sender, "@")[1] {
+			t.Errorf("mail from %s: spf domain %s", test.sender, s.SPF.Domain)
+		}
+	}
+}
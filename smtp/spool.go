@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Spool keeps the accepted inbound messages on disk until they
+// are uploaded to S3 and saved by the API, or until they are
+// relayed to the upstreams of a relay mail. Every message is stored
+// as two files under the spool path:
+// 	- `<id>.eml`: raw message, a hard link of the session data file
+// 	- `<id>.json`: spool entry with the session details and attempts
+// Files are written to a temp file, synced and renamed so a spool
+// entry is either fully written or not written at all. The raw
+// message is written first, a raw message without an entry is a
+// message which was never accepted and is removed on recovery.
+//
+// Messages which can't be saved for the inboxes for "inbox_days" are
+// moved with their entries to the dead letter directory of the spool,
+// where they are kept for the operators and never retried.
+
+const (
+	spoolExtRaw   = ".eml"
+	spoolExtEntry = ".json"
+	spoolExtTemp  = ".tmp"
+
+	spoolDirDead = "dead"
+
+	spoolInboxDaysDefault = 7
+)
+
+var (
+	// spoolInFlight keeps the ids of the entries that are being
+	// delivered, so an entry is not delivered twice at a time.
+	spoolInFlight      = make(map[string]bool)
+	spoolInFlightMutex = &sync.Mutex{}
+)
+
+// spoolEntry is the spooled message details.
+type spoolEntry struct {
+	ID         string                    `json:"id"`
+	Deliveries []typeMailMessageDelivery `json:"deliveries"`
+	Session    smtpMessageSession        `json:"session"`
+	Data       smtpData                  `json:"data"`
+	Trace      string                    `json:"trace,omitempty"`
+
+	// Relay is the envelope of a relayed message, entries
+	// without a relay are delivered to the inboxes.
+	Relay *spoolRelay `json:"relay,omitempty"`
+
+	DKIM       []dkimResult `json:"dkim,omitempty"`
+	DMARC      dmarcResult  `json:"dmarc"`
+	Quarantine string       `json:"quarantine,omitempty"`
+	Spam       spamResult   `json:"spam"`
+
+	Attempts    int       `json:"attempts"`
+	CreatedAt   time.Time `json:"created_at"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// initSpool recovers the spool and creates the retry timer
+// which delivers the spooled messages.
+func initSpool() {
+	if config.Spool.Path == "" {
+		logger.Fatalln("Failed to create spool, spool path is not configured")
+	}
+
+	pathEnsure(config.Spool.Path)
+	pathEnsure(filepath.Join(config.Spool.Path, spoolDirDead))
+
+	entries, err := spoolRecover()
+	if err != nil {
+		logger.Fatalln("Failed to recover spool", err)
+	}
+	logger.Printf("Spool recovered with %d messages", len(entries))
+
+	go func() {
+		logger.Println("Creating spool retry timer")
+
+		every := timeDuration(config.Spool.RetryEvery)
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				spoolRetry()
+			}
+		}
+	}()
+}
+
+// spoolAdd writes the message to the spool once for all of the
+// inboxes. The message is accepted only after spoolAdd returns
+// without an error.
+func spoolAdd(deliveries []typeMailMessageDelivery, message smtpMessage) (spoolEntry, error) {
+	entry := spoolEntryCreate(message)
+	entry.Deliveries = deliveries
+
+	return spoolEntryAdd(entry, message.Data)
+}
+
+// spoolEntryCreate creates the spool entry of a message.
+func spoolEntryCreate(message smtpMessage) spoolEntry {
+	// First attempt is made right after the message is added,
+	// retries start after the minimum backoff.
+	now := time.Now().UTC()
+	return spoolEntry{
+		ID:      uuid.New().String(),
+		Session: message.Session,
+		Data:    message.Data,
+		Trace:   message.Trace,
+
+		DKIM:       message.DKIM,
+		DMARC:      message.DMARC,
+		Quarantine: message.Quarantine,
+		Spam:       message.Spam,
+
+		CreatedAt:   now,
+		NextAttempt: now.Add(timeDuration(config.Spool.BackoffMin)),
+	}
+}
+
+// spoolEntryAdd writes the raw message and the entry to the spool.
+func spoolEntryAdd(entry spoolEntry, data smtpData) (spoolEntry, error) {
+	entry.Data.Path = spoolPath(entry.ID, spoolExtRaw)
+	if err := spoolLink(data.Path, entry.Data.Path); err != nil {
+		return entry, fmt.Errorf("write raw message error: %w", err)
+	}
+
+	if err := spoolEntrySave(entry); err != nil {
+		os.Remove(spoolPath(entry.ID, spoolExtRaw))
+		return entry, fmt.Errorf("write spool entry error: %w", err)
+	}
+
+	return entry, nil
+}
+
+// spoolDeliver uploads the message to S3, saves it to the API and
+// removes it from the spool. If the delivery fails, the entry is
+// rescheduled with an exponential backoff.
+func spoolDeliver(entry spoolEntry, message smtpMessage) error {
+	if !spoolLock(entry.ID) {
+		return fmt.Errorf("spool entry %s is being delivered", entry.ID)
+	}
+	defer spoolUnlock(entry.ID)
+
+	// Entry might be delivered and removed after it's listed.
+	if !pathExists(spoolPath(entry.ID, spoolExtEntry)) {
+		return nil
+	}
+
+	err := spoolSave(entry, message)
+	if err == nil {
+		if entry.Relay == nil {
+			spoolDelivered(entry)
+		}
+		spoolRemove(entry.ID)
+		return nil
+	}
+
+	// Relayed messages which can't be delivered are bounced
+	// to the envelope sender and removed from the spool.
+	if entry.Relay != nil && (smtpSendPermanent(err) || spoolRelayExpired(entry)) {
+		spoolRelayBounce(entry, err)
+		spoolRemove(entry.ID)
+		return err
+	}
+
+	entry.Attempts++
+	entry.LastError = err.Error()
+
+	if entry.Relay == nil && spoolInboxExpired(entry) {
+		spoolDeadLetter(entry)
+		return err
+	}
+
+	entry.NextAttempt = time.Now().UTC().Add(timeBackoff(
+		entry.Attempts,
+		timeDuration(config.Spool.BackoffMin),
+		timeDuration(config.Spool.BackoffMax),
+	))
+
+	if err := spoolEntrySave(entry); err != nil {
+		logger.Errorln("Failed to update spool entry", entry.ID, err)
+	}
+
+	return err
+}
+
+func spoolSave(entry spoolEntry, message smtpMessage) error {
+	if entry.Relay != nil {
+		return spoolRelaySend(entry)
+	}
+
+	msg, err := messageParse(message, entry.ID)
+	if err != nil {
+		return err
+	}
+	msg.Deliveries = entry.Deliveries
+
+	return messagesSave(msg)
+}
+
+// spoolDelivered notifies the envelope sender of the recipients
+// of the entry which are delivered to the inboxes.
+func spoolDelivered(entry spoolEntry) {
+	report := spoolReport(entry, entry.Session.From)
+	for _, address := range entry.Session.Recipients {
+		report.Recipients = append(report.Recipients, dsnRecipient{
+			Address: address,
+			Action:  dsnActionDelivered,
+			Status:  "2.0.0",
+			Reason:  "delivered to the inbox",
+		})
+	}
+
+	dsnNotify(report)
+}
+
+// spoolRetry delivers the spooled messages which are due.
+func spoolRetry() {
+	entries, err := spoolList()
+	if err != nil {
+		logger.Errorln("Failed to list spool", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	for _, entry := range entries {
+		if entry.NextAttempt.After(now) {
+			continue
+		}
+
+		if err := spoolRetryEntry(entry); err != nil {
+			logger.Errorf("Failed to deliver spooled message %s, attempt %d, %v", entry.ID, entry.Attempts+1, err)
+			continue
+		}
+
+		logger.Println("Delivered spooled message", entry.ID)
+	}
+}
+
+// spoolRetryEntry parses the spooled message and delivers it,
+// relayed messages are sent as is without parsing.
+func spoolRetryEntry(entry spoolEntry) error {
+	if entry.Relay != nil {
+		return spoolDeliver(entry, smtpMessage{Data: entry.Data})
+	}
+
+	release := smtpParseAcquire()
+	defer release()
+
+	message, err := smtpMessageRead(entry.Session, entry.Data)
+
+	if err != nil {
+		return fmt.Errorf("parse spooled message error: %w", err)
+	}
+	message.Trace = entry.Trace
+	message.DKIM = entry.DKIM
+	message.DMARC = entry.DMARC
+	message.Quarantine = entry.Quarantine
+	message.Spam = entry.Spam
+
+	return spoolDeliver(entry, message)
+}
+
+// spoolRecover removes the partially written files left
+// from a crash and returns the spooled entries.
+func spoolRecover() ([]spoolEntry, error) {
+	files, err := ioutil.ReadDir(config.Spool.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasSuffix(name, spoolExtTemp) {
+			logger.Println("Removing partial spool file", name)
+			os.Remove(filepath.Join(config.Spool.Path, name))
+			continue
+		}
+
+		if strings.HasSuffix(name, spoolExtRaw) {
+			id := strings.TrimSuffix(name, spoolExtRaw)
+			if !pathExists(spoolPath(id, spoolExtEntry)) {
+				logger.Println("Removing spooled message without entry", name)
+				os.Remove(filepath.Join(config.Spool.Path, name))
+			}
+		}
+	}
+
+	return spoolList()
+}
+
+// spoolList returns all spool entries sorted by creation time.
+func spoolList() ([]spoolEntry, error) {
+	paths, err := filepath.Glob(filepath.Join(config.Spool.Path, "*"+spoolExtEntry))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []spoolEntry
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			logger.Errorln("Failed to read spool entry", path, err)
+			continue
+		}
+
+		var entry spoolEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			logger.Errorln("Failed to unmarshal spool entry", path, err)
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+	})
+
+	return entries, nil
+}
+
+// spoolStatus prints the spooled messages.
+func spoolStatus() {
+	entries, err := spoolList()
+	if err != nil {
+		fmt.Println("Failed to list spool", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%d messages in spool %s\n\n", len(entries), config.Spool.Path)
+	if len(entries) == 0 {
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tINBOXES\tFROM\tAGE\tATTEMPTS\tNEXT ATTEMPT\tLAST ERROR")
+
+	now := time.Now().UTC()
+	for _, entry := range entries {
+		var inboxes []string
+		for _, delivery := range entry.Deliveries {
+			inboxes = append(inboxes, fmt.Sprint(delivery.InboxID))
+		}
+
+		from := entry.Session.From
+		if entry.Relay != nil {
+			from = entry.Relay.From
+			inboxes = []string{"relay " + entry.Relay.Host}
+			if entry.Relay.Host == "" {
+				inboxes = []string{"mx " + strings.Join(entry.Relay.To, ",")}
+			}
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			entry.ID,
+			strings.Join(inboxes, ","),
+			from,
+			now.Sub(entry.CreatedAt).Round(time.Second),
+			entry.Attempts,
+			entry.NextAttempt.Local().Format("2006-01-02 15:04:05"),
+			stringsFirstNChars(entry.LastError, 80),
+		)
+	}
+
+	w.Flush()
+}
+
+// spoolEntrySave writes the spool entry of a message.
+func spoolEntrySave(entry spoolEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return spoolWrite(spoolPath(entry.ID, spoolExtEntry), data)
+}
+
+// spoolInboxExpired returns true if the spooled message of the
+// inboxes is not retried anymore.
+func spoolInboxExpired(entry spoolEntry) bool {
+	days := config.Spool.InboxDays
+	if days <= 0 {
+		days = spoolInboxDaysDefault
+	}
+
+	return time.Since(entry.CreatedAt) > time.Duration(days)*24*time.Hour
+}
+
+// spoolDeadLetter moves the spooled message and its entry to the
+// dead letter directory. The message is linked and the entry is
+// written before they are removed from the spool, so the message is
+// retried again if moving it fails.
+func spoolDeadLetter(entry spoolEntry) {
+	dir := filepath.Join(config.Spool.Path, spoolDirDead)
+	pathEnsure(dir)
+
+	path := filepath.Join(dir, entry.ID+spoolExtRaw)
+	os.Remove(path)
+	if err := spoolLink(spoolPath(entry.ID, spoolExtRaw), path); err != nil {
+		logger.Errorln("Failed to move spooled message to dead letters", entry.ID, err)
+		return
+	}
+
+	entry.Data.Path = path
+	data, err := json.Marshal(entry)
+	if err == nil {
+		err = spoolWrite(filepath.Join(dir, entry.ID+spoolExtEntry), data)
+	}
+	if err != nil {
+		logger.Errorln("Failed to move spool entry to dead letters", entry.ID, err)
+		return
+	}
+
+	spoolRemove(entry.ID)
+	logger.Errorf("Moved spooled message %s to dead letters after %d attempts, last error: %s", entry.ID, entry.Attempts, entry.LastError)
+}
+
+// spoolRemove removes the spooled message, entry is removed
+// first so the raw message is cleaned up on recovery if
+// removing the raw message fails.
+func spoolRemove(id string) {
+	if err := os.Remove(spoolPath(id, spoolExtEntry)); err != nil {
+		logger.Errorln("Failed to remove spool entry", id, err)
+		return
+	}
+
+	if err := os.Remove(spoolPath(id, spoolExtRaw)); err != nil {
+		logger.Errorln("Failed to remove spooled message", id, err)
+	}
+}
+
+// spoolLink links the synced message data file to path, the data
+// is copied if the file can't be linked, then syncs the spool directory.
+func spoolLink(dataPath, path string) error {
+	if err := os.Link(dataPath, path); err != nil {
+		f, err := os.Open(dataPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return spoolWriteReader(path, f)
+	}
+
+	return spoolSyncDir(path)
+}
+
+// spoolWrite writes the data to path with a synced temp file
+// and a rename, then syncs the spool directory.
+func spoolWrite(path string, data []byte) error {
+	return spoolWriteReader(path, bytes.NewReader(data))
+}
+
+func spoolWriteReader(path string, r io.Reader) error {
+	tmp := path + spoolExtTemp
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return spoolSyncDir(path)
+}
+
+// spoolSyncDir syncs the directory of the path.
+func spoolSyncDir(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+func spoolPath(id, ext string) string {
+	return filepath.Join(config.Spool.Path, id+ext)
+}
+
+func spoolLock(id string) bool {
+	spoolInFlightMutex.Lock()
+	defer spoolInFlightMutex.Unlock()
+
+	if spoolInFlight[id] {
+		return false
+	}
+
+	spoolInFlight[id] = true
+	return true
+}
+
+func spoolUnlock(id string) {
+	spoolInFlightMutex.Lock()
+	defer spoolInFlightMutex.Unlock()
+
+	delete(spoolInFlight, id)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Relayed messages which can't be delivered to any of the upstreams
+// of the mail are accepted and kept in the spool, ie. as a backup MX.
+// Spooled messages are retried with backoff for "relay_days", then
+// or on a permanent failure, the envelope sender is sent a delivery
+// status notification, unless the sender asked not to be notified.
+// Notifications are spooled as relayed messages without a mail, which
+// are delivered to the mail hosts of the recipient domain. Recipients
+// rejected by the upstreams while the others are delivered are handled
+// on their own, permanent rejections are bounced and the message is
+// kept in the spool only for the temporarily rejected recipients.
+
+const (
+	spoolRelayDaysDefault = 5
+)
+
+// spoolRelay is the envelope of a spooled relay message.
+type spoolRelay struct {
+	Host string   `json:"host,omitempty"`
+	From string   `json:"from"`
+	To   []string `json:"to"`
+}
+
+// spoolAddRelay writes the relayed message to the spool. The
+// message is accepted only after spoolAddRelay returns without
+// an error.
+func spoolAddRelay(relay spoolRelay, message smtpMessage) (spoolEntry, error) {
+	entry := spoolEntryCreate(message)
+	entry.Relay = &relay
+
+	return spoolEntryAdd(entry, message.Data)
+}
+
+// spoolAddRejected spools the relayed message for the recipients which
+// are rejected temporarily and bounces the permanently rejected ones.
+func spoolAddRejected(relay spoolRelay, message smtpMessage, rejected []smtpRcptError) error {
+	entry := spoolEntryCreate(message)
+	entry.Relay = &relay
+
+	rcptErr := spoolRelayRejected(entry, rejected)
+	if rcptErr == nil {
+		return nil
+	}
+	entry.LastError = rcptErr.Error()
+
+	entry, err := spoolEntryAdd(entry, message.Data)
+	if err != nil {
+		return err
+	}
+
+	spoolRelayDelay(entry, rcptErr)
+	return nil
+}
+
+// spoolRelayRejected bounces the permanently rejected recipients of the
+// entry and leaves the envelope of the entry with the recipients which
+// are rejected temporarily, the error of the last temporary rejection
+// is returned if there are any.
+func spoolRelayRejected(entry spoolEntry, rejected []smtpRcptError) error {
+	var (
+		bounces []smtpRcptError
+		err     error
+	)
+
+	entry.Relay.To = nil
+	for _, rcptErr := range rejected {
+		if smtpSendPermanent(rcptErr.Err) {
+			bounces = append(bounces, rcptErr)
+			continue
+		}
+
+		entry.Relay.To = append(entry.Relay.To, rcptErr.Address)
+		err = rcptErr.Err
+	}
+
+	if len(bounces) > 0 {
+		spoolRelayBounceRecipients(entry, bounces)
+	}
+
+	return err
+}
+
+// spoolRelaySend sends the spooled message to the upstreams of
+// the mail, or to the mail hosts of the recipient domain.
+func spoolRelaySend(entry spoolEntry) error {
+	relay := entry.Relay
+	envelope := smtpEnvelope{
+		From:  relay.From,
+		To:    relay.To,
+		DSN:   entry.Session.DSN,
+		Trace: entry.Trace,
+		File:  &entry.Data,
+	}
+
+	if relay.Host == "" {
+		if len(relay.To) == 0 || strings.LastIndex(relay.To[0], "@") <= 0 {
+			return &smtpSendError{Permanent: true, Err: fmt.Errorf("recipient format error: %v", relay.To)}
+		}
+
+		domain := strings.ToLower(relay.To[0][strings.LastIndex(relay.To[0], "@")+1:])
+		upstreams, err := smtpUpstreamsMX(domain)
+		if err != nil {
+			return err
+		}
+
+		outcome, rejected, err := smtpSend(envelope, domain, upstreams)
+		if err != nil {
+			return err
+		}
+
+		spoolRelaySent(spoolReport(entry, relay.From), outcome, relay.To, rejected)
+		return spoolRelayRejected(entry, rejected)
+	}
+
+	mail, ok := mailsFind(relay.Host)
+	if !ok || !mail.Relay {
+		return fmt.Errorf("mail %s is not a relay mail", relay.Host)
+	}
+
+	outcome, rejected, err := smtpSend(envelope, "", mail.Upstreams)
+	if err != nil {
+		return err
+	}
+
+	spoolRelaySent(spoolReport(entry, relay.From), outcome, relay.To, rejected)
+	return spoolRelayRejected(entry, rejected)
+}
+
+// spoolRelayExpired returns true if the spooled message is
+// not retried anymore.
+func spoolRelayExpired(entry spoolEntry) bool {
+	days := config.Spool.RelayDays
+	if days <= 0 {
+		days = spoolRelayDaysDefault
+	}
+
+	return time.Since(entry.CreatedAt) > time.Duration(days)*24*time.Hour
+}
+
+// spoolRelayBounce spools a delivery status notification of the
+// failed message to the envelope sender.
+func spoolRelayBounce(entry spoolEntry, err error) {
+	var rejected []smtpRcptError
+	for _, to := range entry.Relay.To {
+		rejected = append(rejected, smtpRcptError{Address: to, Err: err})
+	}
+
+	spoolRelayBounceRecipients(entry, rejected)
+}
+
+// spoolRelayBounceRecipients spools a delivery status notification of
+// the failed recipients to the envelope sender. Messages of the null
+// sender are notifications themselves and are never bounced.
+func spoolRelayBounceRecipients(entry spoolEntry, rejected []smtpRcptError) {
+	if entry.Relay.From == "" {
+		logger.Errorln("Dropping undeliverable message of the null sender", entry.ID, rejected[0].Err)
+		return
+	}
+
+	report := spoolReport(entry, entry.Relay.From)
+	for _, rcptErr := range rejected {
+		expired := !smtpSendPermanent(rcptErr.Err)
+		status, diagnostic := dsnStatus(rcptErr.Err, expired)
+
+		reason := rcptErr.Err.Error()
+		if expired {
+			reason = fmt.Sprintf("delivery time expired, last error: %s", reason)
+		}
+
+		report.Recipients = append(report.Recipients, dsnRecipient{
+			Address:    rcptErr.Address,
+			Action:     dsnActionFailed,
+			Status:     status,
+			Reason:     reason,
+			Diagnostic: diagnostic,
+		})
+	}
+
+	logger.Printf("Bouncing message %s to %s", entry.ID, entry.Relay.From)
+	dsnNotify(report)
+}
+
+// spoolRelayDelay notifies the envelope sender of the recipients of
+// the entry which are spooled to be retried after the error.
+func spoolRelayDelay(entry spoolEntry, err error) {
+	status, diagnostic := dsnStatus(err, false)
+	if !strings.HasPrefix(status, "4.") {
+		status = "4.0.0"
+	}
+
+	report := spoolReport(entry, entry.Relay.From)
+	for _, to := range entry.Relay.To {
+		report.Recipients = append(report.Recipients, dsnRecipient{
+			Address:    to,
+			Action:     dsnActionDelayed,
+			Status:     status,
+			Reason:     fmt.Sprintf("delivery temporarily failed, %s", err.Error()),
+			Diagnostic: diagnostic,
+		})
+	}
+
+	dsnNotify(report)
+}
+
+// spoolRelaySent notifies the envelope sender of the recipients which
+// are accepted by an upstream without the DSN extension, upstreams
+// with the extension are passed the DSN parameters instead.
+func spoolRelaySent(report dsnReport, outcome smtpTLSOutcome, to []string, rejected []smtpRcptError) {
+	if outcome.DSN {
+		return
+	}
+
+	var addresses []string
+	for _, rcptErr := range rejected {
+		addresses = append(addresses, rcptErr.Address)
+	}
+
+	for _, address := range to {
+		if smtpAddressIn(address, addresses) {
+			continue
+		}
+
+		report.Recipients = append(report.Recipients, dsnRecipient{
+			Address: address,
+			Action:  dsnActionRelayed,
+			Status:  "2.0.0",
+			Reason:  fmt.Sprintf("relayed to %s", outcome.Host),
+		})
+	}
+
+	dsnNotify(report)
+}
+
+// spoolReport returns the notification report of the entry without
+// any recipients.
+func spoolReport(entry spoolEntry, to string) dsnReport {
+	return dsnReport{
+		To:      to,
+		Arrival: entry.CreatedAt,
+		Options: entry.Session.DSN,
+
+		Trace: entry.Trace,
+		Data:  entry.Data,
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSpoolInboxExpired(t *testing.T) {
+	days := config.Spool.InboxDays
+	t.Cleanup(func() {
+		config.Spool.InboxDays = days
+	})
+
+	tests := []struct {
+		days    int
+		age     time.Duration
+		expired bool
+	}{
+		{0, time.Hour, false},
+		{0, 8 * 24 * time.Hour, true},
+		{1, 23 * time.Hour, false},
+		{1, 25 * time.Hour, true},
+	}
+
+	for _, test := range tests {
+		config.Spool.InboxDays = test.days
+
+		entry := spoolEntry{CreatedAt: time.Now().UTC().Add(-test.age)}
+		if expired := spoolInboxExpired(entry); expired != test.expired {
+			t.Errorf("expired %t after %s with %d days, want %t", expired, test.age, test.days, test.expired)
+		}
+	}
+}
+
+// TestSpoolDeadLetter moves an expired inbox message out of the spool,
+// the message and its entry are kept in the dead letter directory.
+func TestSpoolDeadLetter(t *testing.T) {
+	raw := []byte("Subject: undeliverable\r\n\r\nundeliverable\r\n")
+
+	data, err := smtpDataWrite(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("write data: %v", err)
+	}
+	defer smtpDataRemove(data)
+
+	entry, err := spoolAdd([]typeMailMessageDelivery{{InboxID: 1}}, smtpMessage{Data: data})
+	if err != nil {
+		t.Fatalf("spool: %v", err)
+	}
+	entry.Attempts = 12
+	entry.LastError = "api is not available"
+
+	spoolDeadLetter(entry)
+
+	entries, err := spoolList()
+	if err != nil {
+		t.Fatalf("list spool: %v", err)
+	}
+	for _, listed := range entries {
+		if listed.ID == entry.ID {
+			t.Fatalf("entry %s is still spooled", entry.ID)
+		}
+	}
+
+	if pathExists(spoolPath(entry.ID, spoolExtRaw)) {
+		t.Fatalf("message %s is still spooled", entry.ID)
+	}
+
+	dir := filepath.Join(config.Spool.Path, spoolDirDead)
+	deadRaw, err := ioutil.ReadFile(filepath.Join(dir, entry.ID+spoolExtRaw))
+	if err != nil {
+		t.Fatalf("read dead letter: %v", err)
+	}
+	if !bytes.Equal(deadRaw, raw) {
+		t.Fatalf("dead letter %q, want %q", deadRaw, raw)
+	}
+
+	deadEntry, err := ioutil.ReadFile(filepath.Join(dir, entry.ID+spoolExtEntry))
+	if err != nil {
+		t.Fatalf("read dead letter entry: %v", err)
+	}
+
+	var dead spoolEntry
+	if err := json.Unmarshal(deadEntry, &dead); err != nil {
+		t.Fatalf("unmarshal dead letter entry: %v", err)
+	}
+	if dead.Attempts != entry.Attempts || dead.LastError != entry.LastError {
+		t.Fatalf("dead letter entry %d attempts %q, want %d attempts %q", dead.Attempts, dead.LastError, entry.Attempts, entry.LastError)
+	}
+}
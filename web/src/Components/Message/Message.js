@@ -67,13 +67,57 @@ function Message(props) {
     )
   }
 
+  function Authentication() {
+    const authentication = message.authentication
+    if (!authentication) return null
+
+    const badge = (name, result) => {
+      if (!result || !result.result) return null
+
+      return (
+        <span key={name + (result.domain || "")} className={result.pass ? "Badge-pass" : "Badge-fail"}>
+          {" "}{name}: {result.result}{result.domain ? ` (${result.domain})` : ""}{" "}
+        </span>
+      )
+    }
+
+    return (
+      <div>
+        {badge("spf", authentication.spf)}
+        {(authentication.dkim || []).map(d => badge("dkim", d))}
+        {badge("dmarc", authentication.dmarc)}
+      </div>
+    )
+  }
+
+  function Envelope() {
+    if (!message.envelope_from && !message.remote_ip) return null
+
+    const envelopeTo = (message.mail_message_deliveries || [])
+      .map(d => d.envelope_to)
+      .filter(to => to)
+
+    return (
+      <div>
+        envelope: &#60;{message.envelope_from}&#x3e;
+        {message.helo ? ` from ${message.helo}` : ""}
+        {message.remote_ip ? ` (${message.remote_ip})` : ""}
+        {envelopeTo.length > 0 ? ` for ${envelopeTo.join(", ")}` : ""}
+      </div>
+    )
+  }
+
   return (
     message ? 
       <div className="Message">
       <h2> { message.subject } </h2>
+      <Relations type={"from"} />
+      <Relations type={"reply_to"} />
       <Relations type={"to"} />
       <Relations type={"cc"} />
       <Relations type={"bcc"} />
+      <Envelope />
+      <Authentication />
       <p> { message.text || message.html } </p>
       <Files />
     </div> : 